@@ -0,0 +1,309 @@
+package main
+
+import (
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "os"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/jackc/pgx/v5"
+)
+
+// -------------------- Password Change --------------------
+
+func changePasswordHandler(hub *Hub, w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    var payload struct {
+        CurrentPassword string `json:"currentPassword"`
+        NewPassword     string `json:"newPassword"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+        http.Error(w, "Invalid JSON", http.StatusBadRequest)
+        return
+    }
+    claims := authClaims(r)
+    username := claims.Username
+
+    userKey, ipKey := loginThrottleKeys(username, r)
+    if wait := reserveAuthAttempt(userKey, ipKey); wait > 0 {
+        rejectThrottled(w, wait)
+        return
+    }
+    hash, err := getUserPasswordHash(username)
+    if err != nil {
+        http.Error(w, "User not found", http.StatusNotFound)
+        return
+    }
+    if ok, _ := verifyPassword(hash, payload.CurrentPassword); !ok {
+        log.Printf("⚠️ Failed password change for %q from %s", username, clientIP(r))
+        http.Error(w, "Current password is incorrect", http.StatusUnauthorized)
+        return
+    }
+    authAttemptSucceeded(userKey, ipKey)
+
+    if err := validateNewPassword(username, payload.NewPassword); err != nil {
+        http.Error(w, passwordPolicyMessage(err), http.StatusBadRequest)
+        return
+    }
+    if err := setPassword(hub, username, payload.NewPassword, claims.SessionID); err != nil {
+        log.Println("password change error:", err)
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+    w.WriteHeader(http.StatusOK)
+    w.Write([]byte("Password changed"))
+}
+
+// setPassword stores a new hash for username and revokes all of the user's
+// sessions except keepSession (empty revokes them all).
+func setPassword(hub *Hub, username, password, keepSession string) error {
+    hash, err := hashPassword(password)
+    if err != nil {
+        return err
+    }
+    if err := setUserPasswordHash(username, hash); err != nil {
+        return err
+    }
+    revoked, err := revokeUserSessions(username, keepSession)
+    if err != nil {
+        return err
+    }
+    for _, id := range revoked {
+        hub.revoke <- id
+    }
+    log.Printf("🔑 Password changed for %s, revoked %d session(s)", username, len(revoked))
+    return nil
+}
+
+// -------------------- Password Reset --------------------
+
+var passwordResetTTL = 30 * time.Minute
+
+type passwordReset struct {
+    Username  string
+    ExpiresAt time.Time
+    Used      bool
+}
+
+var (
+    resetsMu  sync.Mutex
+    resetsMap = map[string]*passwordReset{} // keyed by token hash
+
+    errResetInvalid = errors.New("invalid or expired reset token")
+)
+
+func hashResetToken(token string) string {
+    sum := sha256.Sum256([]byte(token))
+    return hex.EncodeToString(sum[:])
+}
+
+// requestPasswordResetHandler always answers 200 so it cannot be used to
+// discover which usernames exist.
+func requestPasswordResetHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    var payload struct {
+        Username string `json:"username"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+        http.Error(w, "Invalid JSON", http.StatusBadRequest)
+        return
+    }
+    const done = "If the account exists, a reset link has been sent"
+    if wait := reserveAuthAttempt("reset:ip:" + clientIP(r)); wait > 0 {
+        rejectThrottled(w, wait)
+        return
+    }
+    payload.Username = loginUsername(payload.Username)
+    email, err := getUserEmail(payload.Username)
+    if err != nil || isBotUser(payload.Username) {
+        w.WriteHeader(http.StatusOK)
+        w.Write([]byte(done))
+        return
+    }
+    // Limit mail per address too, without telling the caller: a 429 here
+    // would reveal that the account exists.
+    if wait := reserveAuthAttempt("reset:email:" + strings.ToLower(email)); wait > 0 {
+        log.Printf("🚫 Not sending another reset email for %q (retry in %s)", payload.Username, wait.Round(time.Second))
+        w.WriteHeader(http.StatusOK)
+        w.Write([]byte(done))
+        return
+    }
+
+    // Send in the background: answering only after the mail server has,
+    // and only for real accounts, would reveal which accounts exist
+    go sendPasswordReset(payload.Username, email)
+    w.WriteHeader(http.StatusOK)
+    w.Write([]byte(done))
+}
+
+// sendPasswordReset stores a new reset token for username and mails it.
+// Errors are only logged; the requester has already been answered.
+func sendPasswordReset(username, email string) {
+    token := randomToken(32)
+    if err := createPasswordReset(username, hashResetToken(token), time.Now().Add(passwordResetTTL)); err != nil {
+        log.Println("password reset create error:", err)
+        return
+    }
+    body := fmt.Sprintf("Someone requested a password reset for your ChatBox account %q.\n\n", username)
+    if base := os.Getenv("RESET_URL_BASE"); base != "" {
+        body += "Open this link to choose a new password:\n" + base + token + "\n\n"
+    } else {
+        body += "Your reset code is:\n" + token + "\n\n"
+    }
+    body += fmt.Sprintf("It expires in %s and can be used once. If this wasn't you, ignore this email.\n", passwordResetTTL)
+
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+    if err := notifier.Send(ctx, Notification{To: email, Username: username, Subject: "Reset your ChatBox password", Body: body}); err != nil {
+        log.Println("password reset notify error:", err)
+    }
+}
+
+func confirmPasswordResetHandler(hub *Hub, w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    var payload struct {
+        Token       string `json:"token"`
+        NewPassword string `json:"newPassword"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+        http.Error(w, "Invalid JSON", http.StatusBadRequest)
+        return
+    }
+    tokenHash := hashResetToken(payload.Token)
+    username, err := lookupPasswordReset(tokenHash)
+    if err != nil {
+        http.Error(w, "Invalid or expired reset token", http.StatusBadRequest)
+        return
+    }
+    if err := validateNewPassword(username, payload.NewPassword); err != nil {
+        http.Error(w, passwordPolicyMessage(err), http.StatusBadRequest)
+        return
+    }
+    // Consume the token atomically so a concurrent redeem loses.
+    if err := consumePasswordReset(tokenHash); err != nil {
+        http.Error(w, "Invalid or expired reset token", http.StatusBadRequest)
+        return
+    }
+    if err := setPassword(hub, username, payload.NewPassword, ""); err != nil {
+        log.Println("password reset error:", err)
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+    resetAuthFailures("login:user:" + username)
+    w.WriteHeader(http.StatusOK)
+    w.Write([]byte("Password reset"))
+}
+
+// -------------------- Account Store --------------------
+
+// getUserEmail returns the user's email; an error means the user does not exist.
+func getUserEmail(username string) (string, error) {
+    if useDB {
+        var email *string
+        err := dbPool.QueryRow(context.Background(), `SELECT email FROM users WHERE username=$1`, username).Scan(&email)
+        if err != nil {
+            return "", err
+        }
+        if email == nil {
+            return "", nil
+        }
+        return *email, nil
+    }
+    usersMu.RLock()
+    defer usersMu.RUnlock()
+    su, ok := usersMap[username]
+    if !ok {
+        return "", fmt.Errorf("not found")
+    }
+    return su.Email, nil
+}
+
+// createPasswordReset stores a new reset token and invalidates older ones
+// for the same user.
+func createPasswordReset(username, tokenHash string, expires time.Time) error {
+    if useDB {
+        ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        defer cancel()
+        if _, err := dbPool.Exec(ctx, `UPDATE password_resets SET used_at=NOW() WHERE username=$1 AND used_at IS NULL`, username); err != nil {
+            return err
+        }
+        _, err := dbPool.Exec(ctx, `
+            INSERT INTO password_resets (token_hash, username, expires_at) VALUES ($1, $2, $3)
+        `, tokenHash, username, expires)
+        return err
+    }
+    resetsMu.Lock()
+    defer resetsMu.Unlock()
+    for h, pr := range resetsMap {
+        if pr.Username == username || time.Now().After(pr.ExpiresAt) {
+            delete(resetsMap, h)
+        }
+    }
+    resetsMap[tokenHash] = &passwordReset{Username: username, ExpiresAt: expires}
+    return nil
+}
+
+func lookupPasswordReset(tokenHash string) (string, error) {
+    if useDB {
+        var username string
+        err := dbPool.QueryRow(context.Background(), `
+            SELECT username FROM password_resets
+            WHERE token_hash=$1 AND used_at IS NULL AND expires_at > NOW()
+        `, tokenHash).Scan(&username)
+        if err != nil {
+            if errors.Is(err, pgx.ErrNoRows) {
+                return "", errResetInvalid
+            }
+            return "", err
+        }
+        return username, nil
+    }
+    resetsMu.Lock()
+    defer resetsMu.Unlock()
+    pr, ok := resetsMap[tokenHash]
+    if !ok || pr.Used || time.Now().After(pr.ExpiresAt) {
+        return "", errResetInvalid
+    }
+    return pr.Username, nil
+}
+
+func consumePasswordReset(tokenHash string) error {
+    if useDB {
+        ct, err := dbPool.Exec(context.Background(), `
+            UPDATE password_resets SET used_at=NOW()
+            WHERE token_hash=$1 AND used_at IS NULL AND expires_at > NOW()
+        `, tokenHash)
+        if err != nil {
+            return err
+        }
+        if ct.RowsAffected() == 0 {
+            return errResetInvalid
+        }
+        return nil
+    }
+    resetsMu.Lock()
+    defer resetsMu.Unlock()
+    pr, ok := resetsMap[tokenHash]
+    if !ok || pr.Used || time.Now().After(pr.ExpiresAt) {
+        return errResetInvalid
+    }
+    pr.Used = true
+    return nil
+}
@@ -0,0 +1,548 @@
+package main
+
+import (
+    "context"
+    "crypto/sha256"
+    "crypto/subtle"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/jackc/pgx/v5"
+)
+
+// -------------------- API Keys --------------------
+
+// API keys look like cbx_<id>_<secret>. The id is stored in clear for lookup,
+// the secret only as a SHA-256 hash (it is random, so no slow hash is needed).
+const apiKeyPrefix = "cbx_"
+
+const (
+    scopeMessagesWrite = "messages:write"
+    scopeRoomsRead     = "rooms:read"
+    scopeRoomsManage   = "rooms:manage"
+)
+
+var validScopes = map[string]bool{
+    scopeMessagesWrite: true,
+    scopeRoomsRead:     true,
+    scopeRoomsManage:   true,
+}
+
+type apiKey struct {
+    ID         string     `json:"id"`
+    Username   string     `json:"bot"`
+    Name       string     `json:"name"`
+    Scopes     []string   `json:"scopes"`
+    Rooms      []string   `json:"rooms"`
+    CreatedBy  string     `json:"createdBy"`
+    CreatedAt  time.Time  `json:"createdAt"`
+    LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+    ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+    hash       string
+    revoked    bool
+}
+
+func (k *apiKey) hasScope(scope string) bool {
+    for _, s := range k.Scopes {
+        if s == scope {
+            return true
+        }
+    }
+    return false
+}
+
+// allowsRoom checks the key's room allowlist; an empty list allows every room.
+func (k *apiKey) allowsRoom(room string) bool {
+    if len(k.Rooms) == 0 {
+        return true
+    }
+    for _, r := range k.Rooms {
+        if r == room {
+            return true
+        }
+    }
+    return false
+}
+
+var (
+    apiKeysMu  sync.RWMutex
+    apiKeysMap = map[string]*apiKey{}
+
+    errAPIKeyInvalid = errors.New("invalid api key")
+)
+
+func hashAPIKeySecret(secret string) string {
+    sum := sha256.Sum256([]byte(secret))
+    return hex.EncodeToString(sum[:])
+}
+
+// apiKeyAllowedPath lists the endpoints a bot may call. Account, session and
+// admin endpoints stay human-only.
+func apiKeyAllowedPath(path string) bool {
+    switch path {
+    case "/ws", "/message", "/upload", "/rooms/list", "/rooms/create", "/rooms/join":
+        return true
+    }
+    // GET /rooms/{room}/messages
+    if rest, ok := strings.CutPrefix(path, "/rooms/"); ok {
+        room, sub, _ := strings.Cut(rest, "/")
+        return room != "" && sub == "messages"
+    }
+    return false
+}
+
+func authenticateAPIKey(token string) (*apiKey, error) {
+    rest := strings.TrimPrefix(token, apiKeyPrefix)
+    id, secret, ok := strings.Cut(rest, "_")
+    if !ok || id == "" || secret == "" {
+        return nil, errAPIKeyInvalid
+    }
+    var k *apiKey
+    if useDB {
+        ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        defer cancel()
+        var err error
+        if k, err = dbGetAPIKey(ctx, id); err != nil {
+            return nil, err
+        }
+    } else {
+        apiKeysMu.RLock()
+        stored, found := apiKeysMap[id]
+        if found {
+            cp := *stored
+            k = &cp
+        }
+        apiKeysMu.RUnlock()
+        if !found {
+            return nil, errAPIKeyInvalid
+        }
+    }
+    if subtle.ConstantTimeCompare([]byte(k.hash), []byte(hashAPIKeySecret(secret))) != 1 {
+        return nil, errAPIKeyInvalid
+    }
+    if k.revoked || (k.ExpiresAt != nil && time.Now().After(*k.ExpiresAt)) {
+        return nil, errAPIKeyInvalid
+    }
+    touchAPIKey(k)
+    return k, nil
+}
+
+func touchAPIKey(k *apiKey) {
+    now := time.Now()
+    if k.LastUsedAt != nil && now.Sub(*k.LastUsedAt) < sessionTouchInterval {
+        return
+    }
+    if useDB {
+        if _, err := dbPool.Exec(context.Background(), `UPDATE api_keys SET last_used_at=NOW() WHERE id=$1`, k.ID); err != nil {
+            log.Println("db touch api key error:", err)
+        }
+        return
+    }
+    apiKeysMu.Lock()
+    if stored, ok := apiKeysMap[k.ID]; ok {
+        stored.LastUsedAt = &now
+    }
+    apiKeysMu.Unlock()
+}
+
+// createAPIKey stores a new key and returns it with the full plaintext token,
+// which is shown to the caller exactly once.
+func createAPIKey(k *apiKey) (string, error) {
+    k.ID = randomToken(6)
+    secret := randomToken(24)
+    k.hash = hashAPIKeySecret(secret)
+    k.CreatedAt = time.Now()
+    if useDB {
+        ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        defer cancel()
+        if err := dbCreateAPIKey(ctx, k); err != nil {
+            return "", err
+        }
+    } else {
+        apiKeysMu.Lock()
+        cp := *k
+        apiKeysMap[k.ID] = &cp
+        apiKeysMu.Unlock()
+    }
+    return apiKeyPrefix + k.ID + "_" + secret, nil
+}
+
+func listAPIKeys(bot string) ([]apiKey, error) {
+    if useDB {
+        ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        defer cancel()
+        return dbListAPIKeys(ctx, bot)
+    }
+    apiKeysMu.RLock()
+    defer apiKeysMu.RUnlock()
+    out := make([]apiKey, 0)
+    for _, k := range apiKeysMap {
+        if k.Username == bot && !k.revoked {
+            out = append(out, *k)
+        }
+    }
+    sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+    return out, nil
+}
+
+func revokeAPIKey(bot, id string) error {
+    if useDB {
+        ct, err := dbPool.Exec(context.Background(), `
+            UPDATE api_keys SET revoked_at=NOW() WHERE id=$1 AND username=$2 AND revoked_at IS NULL
+        `, id, bot)
+        if err != nil {
+            return err
+        }
+        if ct.RowsAffected() == 0 {
+            return errAPIKeyInvalid
+        }
+        return nil
+    }
+    apiKeysMu.Lock()
+    defer apiKeysMu.Unlock()
+    k, ok := apiKeysMap[id]
+    if !ok || k.Username != bot || k.revoked {
+        return errAPIKeyInvalid
+    }
+    k.revoked = true
+    return nil
+}
+
+// -------------------- Request Scopes --------------------
+
+func withAPIKey(ctx context.Context, k *apiKey) context.Context {
+    return context.WithValue(ctx, ctxAPIKeyKey, k)
+}
+
+// authAPIKey returns the API key used for the request, or nil for a user session.
+func authAPIKey(r *http.Request) *apiKey {
+    k, _ := r.Context().Value(ctxAPIKeyKey).(*apiKey)
+    return k
+}
+
+// requireScope writes 403 and returns false when the request was made with
+// an API key lacking scope. Human sessions have every scope.
+func requireScope(w http.ResponseWriter, r *http.Request, scope string) bool {
+    if k := authAPIKey(r); k != nil && !k.hasScope(scope) {
+        http.Error(w, "API key lacks scope "+scope, http.StatusForbidden)
+        return false
+    }
+    return true
+}
+
+// roomAllowed reports whether the request may touch room under its API key allowlist.
+func roomAllowed(r *http.Request, room string) bool {
+    k := authAPIKey(r)
+    return k == nil || k.allowsRoom(room)
+}
+
+// -------------------- Bot Accounts --------------------
+
+type botInfo struct {
+    Username  string    `json:"username"`
+    Owner     string    `json:"owner"`
+    CreatedAt time.Time `json:"createdAt"`
+}
+
+// getBotOwner returns the owner of bot, or an error if it is not a bot.
+func getBotOwner(bot string) (string, error) {
+    if useDB {
+        var owner *string
+        var isBot bool
+        err := dbPool.QueryRow(context.Background(), `SELECT is_bot, bot_owner FROM users WHERE username=$1`, bot).Scan(&isBot, &owner)
+        if err != nil || !isBot || owner == nil {
+            return "", fmt.Errorf("bot not found")
+        }
+        return *owner, nil
+    }
+    usersMu.RLock()
+    defer usersMu.RUnlock()
+    su, ok := usersMap[bot]
+    if !ok || !su.IsBot {
+        return "", fmt.Errorf("bot not found")
+    }
+    return su.BotOwner, nil
+}
+
+func isBotUser(username string) bool {
+    _, err := getBotOwner(username)
+    return err == nil
+}
+
+func createBotUser(name, owner string) error {
+    // Bots never log in with a password; store an unusable one.
+    hash, err := hashPassword(randomToken(32))
+    if err != nil {
+        return err
+    }
+    if useDB {
+        ct, err := dbPool.Exec(context.Background(), `
+            INSERT INTO users (username, password_hash, is_bot, bot_owner)
+            SELECT $1, $2, TRUE, $3
+            WHERE NOT EXISTS (SELECT 1 FROM users WHERE lower(username) = lower($1))
+            ON CONFLICT DO NOTHING
+        `, name, hash, owner)
+        if err != nil {
+            return err
+        }
+        if ct.RowsAffected() == 0 {
+            return fmt.Errorf("username may already exist")
+        }
+        return nil
+    }
+    usersMu.Lock()
+    defer usersMu.Unlock()
+    if usernameTakenLocked(name) {
+        return fmt.Errorf("username may already exist")
+    }
+    usersMap[name] = &storedUser{Username: name, PasswordHash: hash, IsBot: true, BotOwner: owner, CreatedAt: time.Now()}
+    return nil
+}
+
+// listBots returns bots owned by owner, or every bot when owner is empty.
+func listBots(owner string) ([]botInfo, error) {
+    if useDB {
+        rows, err := dbPool.Query(context.Background(), `
+            SELECT username, bot_owner, created_at FROM users
+            WHERE is_bot AND ($1 = '' OR bot_owner = $1)
+            ORDER BY created_at ASC
+        `, owner)
+        if err != nil {
+            return nil, err
+        }
+        defer rows.Close()
+        out := make([]botInfo, 0)
+        for rows.Next() {
+            var b botInfo
+            if err := rows.Scan(&b.Username, &b.Owner, &b.CreatedAt); err != nil {
+                return nil, err
+            }
+            out = append(out, b)
+        }
+        return out, rows.Err()
+    }
+    usersMu.RLock()
+    defer usersMu.RUnlock()
+    out := make([]botInfo, 0)
+    for _, su := range usersMap {
+        if su.IsBot && (owner == "" || su.BotOwner == owner) {
+            out = append(out, botInfo{Username: su.Username, Owner: su.BotOwner, CreatedAt: su.CreatedAt})
+        }
+    }
+    sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+    return out, nil
+}
+
+// -------------------- Bot Handlers --------------------
+
+// botsHandler handles GET /bots (bots I own, all bots for admins) and POST /bots.
+func botsHandler(w http.ResponseWriter, r *http.Request) {
+    username := authUsername(r)
+    switch r.Method {
+    case http.MethodGet:
+        owner := username
+        if isAdmin(username) {
+            owner = ""
+        }
+        bots, err := listBots(owner)
+        if err != nil {
+            log.Println("list bots error:", err)
+            http.Error(w, "Server error", http.StatusInternalServerError)
+            return
+        }
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(bots)
+    case http.MethodPost:
+        if !requireRole(w, r, botCreateRole) {
+            return
+        }
+        var payload struct {
+            Username string `json:"username"`
+        }
+        if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+            http.Error(w, "Invalid JSON", http.StatusBadRequest)
+            return
+        }
+        if payload.Username == "" {
+            http.Error(w, "Bot username required", http.StatusBadRequest)
+            return
+        }
+        name, err := normalizeUsername(payload.Username)
+        if err != nil {
+            http.Error(w, "Invalid username: "+err.Error(), http.StatusBadRequest)
+            return
+        }
+        payload.Username = name
+        if err := createBotUser(payload.Username, username); err != nil {
+            http.Error(w, "Username may already exist", http.StatusConflict)
+            return
+        }
+        log.Printf("🤖 %s created bot %s", username, payload.Username)
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(botInfo{Username: payload.Username, Owner: username, CreatedAt: time.Now()})
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+// botKeysHandler handles /bots/{bot}/keys (GET, POST) and
+// /bots/{bot}/keys/{id} (DELETE). Only the bot's owner or an admin may call it.
+func botKeysHandler(hub *Hub, w http.ResponseWriter, r *http.Request) {
+    parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/bots/"), "/"), "/")
+    if len(parts) < 2 || len(parts) > 3 || parts[1] != "keys" {
+        http.Error(w, "Not found", http.StatusNotFound)
+        return
+    }
+    bot := parts[0]
+    username := authUsername(r)
+    owner, err := getBotOwner(bot)
+    if err != nil {
+        http.Error(w, "Bot not found", http.StatusNotFound)
+        return
+    }
+    if owner != username && !isAdmin(username) {
+        http.Error(w, "Forbidden", http.StatusForbidden)
+        return
+    }
+
+    if len(parts) == 3 {
+        if r.Method != http.MethodDelete {
+            http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+            return
+        }
+        if err := revokeAPIKey(bot, parts[2]); err != nil {
+            http.Error(w, "API key not found", http.StatusNotFound)
+            return
+        }
+        // Sockets don't remember which key opened them: close all of the
+        // bot's, and those holding another key reconnect
+        hub.kick <- bot
+        log.Printf("🤖 %s revoked API key %s of bot %s", username, parts[2], bot)
+        w.WriteHeader(http.StatusOK)
+        w.Write([]byte("API key revoked"))
+        return
+    }
+
+    switch r.Method {
+    case http.MethodGet:
+        keys, err := listAPIKeys(bot)
+        if err != nil {
+            log.Println("list api keys error:", err)
+            http.Error(w, "Server error", http.StatusInternalServerError)
+            return
+        }
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(keys)
+    case http.MethodPost:
+        if !requireRole(w, r, botCreateRole) {
+            return
+        }
+        var payload struct {
+            Name      string   `json:"name"`
+            Scopes    []string `json:"scopes"`
+            Rooms     []string `json:"rooms"`
+            ExpiresIn string   `json:"expiresIn,omitempty"` // Go duration, e.g. "720h"
+        }
+        if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+            http.Error(w, "Invalid JSON", http.StatusBadRequest)
+            return
+        }
+        if len(payload.Scopes) == 0 {
+            http.Error(w, "At least one scope required", http.StatusBadRequest)
+            return
+        }
+        for _, s := range payload.Scopes {
+            if !validScopes[s] {
+                http.Error(w, "Unknown scope "+s, http.StatusBadRequest)
+                return
+            }
+        }
+        k := &apiKey{Username: bot, Name: payload.Name, Scopes: payload.Scopes, Rooms: payload.Rooms, CreatedBy: username}
+        if k.Rooms == nil {
+            k.Rooms = []string{}
+        }
+        if payload.ExpiresIn != "" {
+            d, err := time.ParseDuration(payload.ExpiresIn)
+            if err != nil || d <= 0 {
+                http.Error(w, "Invalid expiresIn", http.StatusBadRequest)
+                return
+            }
+            exp := time.Now().Add(d)
+            k.ExpiresAt = &exp
+        }
+        token, err := createAPIKey(k)
+        if err != nil {
+            log.Println("create api key error:", err)
+            http.Error(w, "Server error", http.StatusInternalServerError)
+            return
+        }
+        log.Printf("🤖 %s created API key %s for bot %s (scopes: %v)", username, k.ID, bot, k.Scopes)
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(struct {
+            apiKey
+            Key string `json:"key"`
+        }{*k, token})
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+// -------------------- API Key DB Helpers --------------------
+
+func dbGetAPIKey(ctx context.Context, id string) (*apiKey, error) {
+    var k apiKey
+    var revokedAt *time.Time
+    var createdBy *string
+    err := dbPool.QueryRow(ctx, `
+        SELECT id, username, name, key_hash, scopes, rooms, created_by, created_at, last_used_at, expires_at, revoked_at
+        FROM api_keys WHERE id=$1
+    `, id).Scan(&k.ID, &k.Username, &k.Name, &k.hash, &k.Scopes, &k.Rooms, &createdBy, &k.CreatedAt, &k.LastUsedAt, &k.ExpiresAt, &revokedAt)
+    if err != nil {
+        if errors.Is(err, pgx.ErrNoRows) {
+            return nil, errAPIKeyInvalid
+        }
+        return nil, err
+    }
+    if createdBy != nil {
+        k.CreatedBy = *createdBy
+    }
+    k.revoked = revokedAt != nil
+    return &k, nil
+}
+
+func dbCreateAPIKey(ctx context.Context, k *apiKey) error {
+    _, err := dbPool.Exec(ctx, `
+        INSERT INTO api_keys (id, username, name, key_hash, scopes, rooms, created_by, created_at, expires_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+    `, k.ID, k.Username, k.Name, k.hash, k.Scopes, k.Rooms, k.CreatedBy, k.CreatedAt, k.ExpiresAt)
+    return err
+}
+
+func dbListAPIKeys(ctx context.Context, bot string) ([]apiKey, error) {
+    rows, err := dbPool.Query(ctx, `
+        SELECT id, username, name, scopes, rooms, COALESCE(created_by, ''), created_at, last_used_at, expires_at
+        FROM api_keys WHERE username=$1 AND revoked_at IS NULL
+        ORDER BY created_at ASC
+    `, bot)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    out := make([]apiKey, 0)
+    for rows.Next() {
+        var k apiKey
+        if err := rows.Scan(&k.ID, &k.Username, &k.Name, &k.Scopes, &k.Rooms, &k.CreatedBy, &k.CreatedAt, &k.LastUsedAt, &k.ExpiresAt); err != nil {
+            return nil, err
+        }
+        out = append(out, k)
+    }
+    return out, rows.Err()
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "testing"
+
+    "github.com/gorilla/websocket"
+)
+
+func TestBotKeysLifecycle(t *testing.T) {
+    srv := newTestServer(t)
+    testUser(t, "bot_owner")
+    testUser(t, "bot_stranger")
+    owner, stranger := sessionToken(t, "bot_owner"), sessionToken(t, "bot_stranger")
+    mux := http.NewServeMux()
+    mux.HandleFunc("/bots", botsHandler)
+    mux.HandleFunc("/bots/", func(w http.ResponseWriter, r *http.Request) { botKeysHandler(srv.hub, w, r) })
+    mux.HandleFunc("/message", func(w http.ResponseWriter, r *http.Request) {
+        if requireScope(w, r, scopeMessagesWrite) {
+            postMessageHandler(srv.hub, w, r)
+        }
+    })
+    mux.HandleFunc("/sessions", listSessionsHandler)
+    h := requireAuth(mux)
+
+    if w := serve(h, owner, http.MethodPost, "/bots", `{"username":"test_bot"}`); w.Code != http.StatusOK {
+        t.Fatalf("create bot: status %d: %s", w.Code, w.Body)
+    }
+    if w := serve(h, stranger, http.MethodPost, "/bots/test_bot/keys", `{"scopes":["messages:write"]}`); w.Code != http.StatusForbidden {
+        t.Fatalf("key for someone else's bot: status %d", w.Code)
+    }
+    if w := serve(h, owner, http.MethodPost, "/bots/test_bot/keys", `{"scopes":["everything"]}`); w.Code != http.StatusBadRequest {
+        t.Fatalf("unknown scope: status %d", w.Code)
+    }
+    newKey := func(scopes string) (id, token string) {
+        t.Helper()
+        w := serve(h, owner, http.MethodPost, "/bots/test_bot/keys", `{"scopes":`+scopes+`}`)
+        var resp struct {
+            ID  string `json:"id"`
+            Key string `json:"key"`
+        }
+        if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || resp.Key == "" {
+            t.Fatalf("create key: status %d: %v", w.Code, err)
+        }
+        return resp.ID, resp.Key
+    }
+    id, key := newKey(`["messages:write","rooms:read"]`)
+    _, readOnly := newKey(`["rooms:read"]`)
+
+    // Keys act as the bot, within their scopes and outside account endpoints
+    w := serve(h, key, http.MethodPost, "/message", `{"room":"general","text":"beep"}`)
+    var msg Message
+    if json.NewDecoder(w.Body).Decode(&msg); w.Code != http.StatusOK || msg.Username != "test_bot" || !msg.Bot {
+        t.Fatalf("post as bot: status %d %+v", w.Code, msg)
+    }
+    if w := serve(h, readOnly, http.MethodPost, "/message", `{"room":"general","text":"beep"}`); w.Code != http.StatusForbidden {
+        t.Fatalf("post without the scope: status %d", w.Code)
+    }
+    if w := serve(h, key, http.MethodGet, "/sessions", ""); w.Code != http.StatusForbidden && w.Code != http.StatusUnauthorized {
+        t.Fatalf("account endpoint with a key: status %d", w.Code)
+    }
+
+    // Revoking a key closes the bot's open sockets and the key stops working
+    conn, _, err := srv.dialToken(t, key, "room=general")
+    if err != nil {
+        t.Fatal(err)
+    }
+    readUntil(t, conn, "history")
+    if w := serve(h, stranger, http.MethodDelete, "/bots/test_bot/keys/"+id, ""); w.Code != http.StatusForbidden {
+        t.Fatalf("revoke by a stranger: status %d", w.Code)
+    }
+    if w := serve(h, owner, http.MethodDelete, "/bots/test_bot/keys/"+id, ""); w.Code != http.StatusOK {
+        t.Fatalf("revoke: status %d", w.Code)
+    }
+    expectClose(t, conn, websocket.ClosePolicyViolation)
+    if w := serve(h, key, http.MethodPost, "/message", `{"room":"general","text":"beep"}`); w.Code != http.StatusUnauthorized {
+        t.Fatalf("revoked key: status %d", w.Code)
+    }
+}
+
+func TestBotCreationNeedsRole(t *testing.T) {
+    testUser(t, "bot_member")
+    old := botCreateRole
+    botCreateRole = roleModerator
+    t.Cleanup(func() { botCreateRole = old })
+    h := requireAuth(http.HandlerFunc(botsHandler))
+    if w := serve(h, sessionToken(t, "bot_member"), http.MethodPost, "/bots", `{"username":"member_bot"}`); w.Code != http.StatusForbidden {
+        t.Fatalf("member creating a bot: status %d", w.Code)
+    }
+    if _, ok := resolveUsername("member_bot"); ok {
+        t.Fatal("refused request created the bot")
+    }
+    if err := setUserRole("bot_member", roleModerator); err != nil {
+        t.Fatal(err)
+    }
+    if w := serve(h, sessionToken(t, "bot_member"), http.MethodPost, "/bots", `{"username":"member_bot"}`); w.Code != http.StatusOK {
+        t.Fatalf("moderator creating a bot: status %d", w.Code)
+    }
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+    "context"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "log"
+    "net/http"
+    "os"
+    "strings"
+    "time"
+)
+
+// -------------------- Session Tokens --------------------
+
+const sessionCookieName = "chatbox_session"
+
+var (
+    sessionSecret []byte
+    sessionTTL    = 24 * time.Hour
+
+    errInvalidToken = errors.New("invalid token")
+    errExpiredToken = errors.New("token expired")
+
+    errAccountSuspended = errors.New("account suspended")
+)
+
+// sessionClaims is the signed payload carried by a session token.
+type sessionClaims struct {
+    Username  string `json:"sub"`
+    SessionID string `json:"sid"`
+    IssuedAt  int64  `json:"iat"`
+    ExpiresAt int64  `json:"exp"`
+}
+
+// initAuth loads the signing secret and token lifetime from the environment.
+// Without SESSION_SECRET a random key is generated, so tokens do not survive a restart.
+func initAuth() {
+    if secret := os.Getenv("SESSION_SECRET"); secret != "" {
+        sessionSecret = []byte(secret)
+    } else {
+        sessionSecret = make([]byte, 32)
+        if _, err := rand.Read(sessionSecret); err != nil {
+            log.Fatal("failed to generate session secret:", err)
+        }
+        log.Println("⚠️ SESSION_SECRET not set, using a random key (sessions reset on restart)")
+    }
+    sessionTTL = envDuration("SESSION_TTL", sessionTTL)
+}
+
+// blobMAC is the HMAC of a signBlob payload for domain. The NUL ends the
+// domain, so no domain/payload pair can be read as another split of the same
+// bytes (payloads are base64 and never contain NUL).
+func blobMAC(domain, payload string) []byte {
+    mac := hmac.New(sha256.New, sessionSecret)
+    mac.Write([]byte(domain))
+    mac.Write([]byte{0})
+    mac.Write([]byte(payload))
+    return mac.Sum(nil)
+}
+
+// signBlob serializes v and appends an HMAC over domain and the payload.
+// Different token kinds use different domains so one cannot stand in for another.
+func signBlob(domain string, v interface{}) (string, error) {
+    body, err := json.Marshal(v)
+    if err != nil {
+        return "", err
+    }
+    payload := base64.RawURLEncoding.EncodeToString(body)
+    sig := base64.RawURLEncoding.EncodeToString(blobMAC(domain, payload))
+    return payload + "." + sig, nil
+}
+
+// openBlob verifies a token produced by signBlob for domain and decodes it into v.
+func openBlob(domain, token string, v interface{}) error {
+    payload, sig, ok := strings.Cut(token, ".")
+    if !ok || payload == "" || sig == "" {
+        return errInvalidToken
+    }
+    got, err := base64.RawURLEncoding.DecodeString(sig)
+    if err != nil {
+        return errInvalidToken
+    }
+    if !hmac.Equal(got, blobMAC(domain, payload)) {
+        return errInvalidToken
+    }
+    body, err := base64.RawURLEncoding.DecodeString(payload)
+    if err != nil {
+        return errInvalidToken
+    }
+    if err := json.Unmarshal(body, v); err != nil {
+        return errInvalidToken
+    }
+    return nil
+}
+
+func signToken(c sessionClaims) (string, error) {
+    return signBlob("session", c)
+}
+
+func parseToken(token string) (*sessionClaims, error) {
+    var c sessionClaims
+    if err := openBlob("session", token, &c); err != nil {
+        return nil, err
+    }
+    if c.Username == "" || c.SessionID == "" {
+        return nil, errInvalidToken
+    }
+    if time.Now().Unix() >= c.ExpiresAt {
+        return nil, errExpiredToken
+    }
+    return &c, nil
+}
+
+// startSession records a new server-side session for username, signs a
+// token for it and sets it as a cookie. Suspended accounts are refused.
+func startSession(w http.ResponseWriter, r *http.Request, username string) (string, *sessionClaims, error) {
+    if !hasRole(username, roleMember) {
+        return "", nil, errAccountSuspended
+    }
+    now := time.Now()
+    sess, err := createSession(r, username, now.Add(sessionTTL))
+    if err != nil {
+        return "", nil, err
+    }
+    claims := &sessionClaims{
+        Username:  username,
+        SessionID: sess.ID,
+        IssuedAt:  now.Unix(),
+        ExpiresAt: now.Add(sessionTTL).Unix(),
+    }
+    token, err := signToken(*claims)
+    if err != nil {
+        return "", nil, err
+    }
+    http.SetCookie(w, &http.Cookie{
+        Name:     sessionCookieName,
+        Value:    token,
+        Path:     "/",
+        Expires:  now.Add(sessionTTL),
+        HttpOnly: true,
+        Secure:   r.TLS != nil || os.Getenv("COOKIE_SECURE") == "true",
+        SameSite: http.SameSiteLaxMode,
+    })
+    return token, claims, nil
+}
+
+// issueSession starts a session and writes the JSON login response.
+func issueSession(w http.ResponseWriter, r *http.Request, username string) {
+    token, claims, err := startSession(w, r, username)
+    if errors.Is(err, errAccountSuspended) {
+        http.Error(w, "Account suspended", http.StatusForbidden)
+        return
+    }
+    if err != nil {
+        log.Println("create session error:", err)
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+    resp := map[string]interface{}{
+        "username":  username,
+        "token":     token,
+        "expiresAt": claims.ExpiresAt,
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(resp)
+}
+
+// tokenFromRequest looks for a session token in the Authorization header,
+// the session cookie, and, on /ws only, the ?token= query parameter
+// (browsers cannot set headers on WebSocket upgrades). Elsewhere a token in
+// the URL would end up in access logs and Referer headers.
+func tokenFromRequest(r *http.Request) string {
+    if h := r.Header.Get("Authorization"); h != "" {
+        if scheme, tok, ok := strings.Cut(h, " "); ok && strings.EqualFold(scheme, "Bearer") {
+            return strings.TrimSpace(tok)
+        }
+    }
+    if c, err := r.Cookie(sessionCookieName); err == nil && c.Value != "" {
+        return c.Value
+    }
+    if r.URL.Path == "/ws" {
+        return r.URL.Query().Get("token")
+    }
+    return ""
+}
+
+// -------------------- Request Identity --------------------
+
+type ctxKey int
+
+const (
+    ctxAuthKey ctxKey = iota
+    ctxAPIKeyKey
+)
+
+func withAuth(ctx context.Context, c *sessionClaims) context.Context {
+    return context.WithValue(ctx, ctxAuthKey, c)
+}
+
+func authClaims(r *http.Request) *sessionClaims {
+    c, _ := r.Context().Value(ctxAuthKey).(*sessionClaims)
+    return c
+}
+
+// authUsername returns the authenticated user for a request that has passed requireAuth.
+func authUsername(r *http.Request) string {
+    if c := authClaims(r); c != nil {
+        return c.Username
+    }
+    return ""
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestSignedBlobsStayInTheirDomain(t *testing.T) {
+    session, err := signToken(sessionClaims{Username: "alice", SessionID: "s1", ExpiresAt: time.Now().Add(time.Hour).Unix()})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if c, err := parseToken(session); err != nil || c.Username != "alice" {
+        t.Fatalf("parseToken: %+v %v", c, err)
+    }
+    var ch mfaChallenge
+    if err := openBlob("mfa", session, &ch); err != errInvalidToken {
+        t.Fatalf("session token opened as an MFA challenge: %v", err)
+    }
+    challenge, _ := signBlob("mfa", mfaChallenge{Username: "alice"})
+    if _, err := parseToken(challenge); err != errInvalidToken {
+        t.Fatalf("MFA challenge accepted as a session: %v", err)
+    }
+
+    // Moving bytes between domain and payload must not keep the MAC valid
+    payload, _, _ := strings.Cut(challenge, ".")
+    if string(blobMAC("mfa", payload)) == string(blobMAC("mf", "a"+payload)) {
+        t.Fatal("domain and payload boundary is ambiguous")
+    }
+    tampered := session[:2] + "x" + session[3:] // base64 of `{"` is "eyJ"
+    if _, err := parseToken(tampered); err != errInvalidToken {
+        t.Fatalf("tampered token: %v", err)
+    }
+}
+
+func TestQueryTokenOnlyOnWebSocket(t *testing.T) {
+    testUser(t, "auth_query")
+    token := sessionToken(t, "auth_query")
+    h := requireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+    for path, want := range map[string]int{"/ws": http.StatusOK, "/rooms/list": http.StatusUnauthorized} {
+        w := httptest.NewRecorder()
+        h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path+"?token="+token, nil))
+        if w.Code != want {
+            t.Errorf("%s?token=: status %d, want %d", path, w.Code, want)
+        }
+    }
+}
+
+func TestOriginAllowed(t *testing.T) {
+    t.Setenv("ALLOWED_ORIGINS", "https://chat.example.com, https://app.example.com")
+    for origin, want := range map[string]bool{
+        "https://chat.example.com": true,
+        "https://app.example.com":  true,
+        "https://evil.example.com": false,
+        "http://chat.example.com":  false,
+    } {
+        if got := originAllowed(origin); got != want {
+            t.Errorf("originAllowed(%q) = %v, want %v", origin, got, want)
+        }
+    }
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "log"
+    "os"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/jackc/pgx/v5"
+    "github.com/jackc/pgx/v5/pgconn"
+)
+
+// -------------------- Backplane --------------------
+//
+// A hub only reaches the sockets of its own process. The backplane carries
+// what the other replicas need: broadcasts (room events, typing, settings
+// updates), profile changes, status changes, session revocations and each
+// node's share of every room's presence, which hubs merge into one roster.
+//
+// BACKPLANE picks the implementation: "memory" (default) for a single node,
+// or "postgres" to use LISTEN/NOTIFY on the existing database.
+
+// Message kinds on the backplane.
+const (
+    bpBroadcast = "broadcast" // a Broadcast from another node's hub
+    bpStatus    = "status"    // a user chose a new presence
+    bpRevoke    = "revoke"    // close the sockets of a session
+    bpKick      = "kick"      // close the sockets of a user
+    bpProfile   = "profile"   // a user's profile changed: drop cached copies, tell their peers
+    bpPresence  = "presence"  // one room entry of the sender's share of presence
+    bpSnapshot  = "snapshot"  // the sender's whole share, replacing what it sent before
+    bpHello     = "hello"     // a node (re)joined; everyone answers with a snapshot
+    bpHeartbeat = "heartbeat" // the sender is alive
+)
+
+// backplaneMessage is one message between nodes. Node is stamped by the
+// backplane; which other fields are set depends on Kind.
+type backplaneMessage struct {
+    Node     string          `json:"node"`
+    Kind     string          `json:"kind"`
+    Room     string          `json:"room,omitempty"`
+    User     string          `json:"user,omitempty"`
+    Key      string          `json:"key,omitempty"`
+    Seq      int64           `json:"seq,omitempty"`     // set for sequenced room events
+    Session  string          `json:"session,omitempty"` // bpRevoke
+    Payload  json.RawMessage `json:"payload,omitempty"` // bpBroadcast, bpProfile: the frame
+    State    *userPresence   `json:"state,omitempty"`   // bpStatus
+    Entry    *presenceEntry  `json:"entry,omitempty"`   // bpPresence; nil when the user left the room on that node
+    Snapshot []sharedEntry   `json:"snapshot,omitempty"`
+}
+
+// sharedEntry is one room entry of a node's share of presence.
+type sharedEntry struct {
+    Room  string        `json:"room"`
+    Entry presenceEntry `json:"entry"`
+}
+
+// Backplane connects the hubs of all nodes.
+type Backplane interface {
+    // Node identifies this process among the nodes.
+    Node() string
+    // Publish sends m to every other node. It must not block: the hub
+    // calls it from its run loop.
+    Publish(m backplaneMessage)
+    // Subscribe delivers other nodes' messages to handle, one at a time,
+    // and calls ready whenever the subscription is (re)established.
+    Subscribe(handle func(backplaneMessage), ready func())
+}
+
+// txPublisher is a backplane that can publish as part of a database
+// transaction. Room events go out that way so every node receives them in
+// commit order, which is sequence order.
+type txPublisher interface {
+    PublishTx(ctx context.Context, tx pgx.Tx, m backplaneMessage) error
+}
+
+var (
+    backplaneKind = "memory"
+    // nodeID names this process on the backplane (NODE_ID, default host-random).
+    nodeID string
+)
+
+// backplaneNodeTimeout is how long a silent node's presence is kept.
+func backplaneNodeTimeout() time.Duration {
+    return 3 * presenceSweepInterval
+}
+
+func initBackplane() Backplane {
+    nodeID = strings.TrimSpace(os.Getenv("NODE_ID"))
+    if nodeID == "" {
+        host, _ := os.Hostname()
+        nodeID = host + "-" + randomToken(4)
+    }
+    switch p := strings.ToLower(strings.TrimSpace(os.Getenv("BACKPLANE"))); p {
+    case "", "memory":
+    case "postgres":
+        if useDB {
+            backplaneKind = p
+        } else {
+            log.Println("⚠️ BACKPLANE=postgres needs DATABASE_URL, using memory")
+        }
+    default:
+        log.Printf("⚠️ Unknown BACKPLANE %q, using %s", p, backplaneKind)
+    }
+    log.Printf("🛰️ Backplane: %s (node %s)", backplaneKind, nodeID)
+    if backplaneKind == "postgres" {
+        return newPGBackplane(nodeID)
+    }
+    return newMemBus().join(nodeID)
+}
+
+// -------------------- Hub Side --------------------
+
+// receiveRemote hands a message from another node to the hub. Sequenced
+// room events are handed over under the room lock, like local ones, so a
+// client attaching to the room meanwhile gets each of them exactly once
+// (in its history/replay or live).
+func (h *Hub) receiveRemote(m backplaneMessage) {
+    if m.Kind == bpBroadcast && m.Seq > 0 && m.Room != "" {
+        l := roomLock(m.Room)
+        l.Lock()
+        defer l.Unlock()
+    }
+    h.remote <- m
+}
+
+// rejoinBackplane runs when the backplane (re)connects: messages may have
+// been missed, so ask every node for its share and send ours. The hello
+// without a Node is this hub's own, see handleRemote.
+func (h *Hub) rejoinBackplane() {
+    h.remote <- backplaneMessage{Kind: bpHello}
+}
+
+// handleRemote applies a message from another node. Only call from run().
+func (h *Hub) handleRemote(m backplaneMessage) {
+    if m.Node == "" {
+        h.backplane.Publish(backplaneMessage{Kind: bpHello})
+        h.publishSnapshot()
+        return
+    }
+    h.nodesSeen[m.Node] = time.Now()
+    switch m.Kind {
+    case bpBroadcast:
+        h.fanOut(Broadcast{room: m.Room, user: m.User, key: m.Key, message: m.Payload})
+    case bpStatus:
+        if _, online := h.userClients[m.User]; online && m.State != nil {
+            h.presence[m.User] = m.State
+            h.markPresence(m.User)
+        }
+    case bpRevoke:
+        h.dropClients(func(c *Client) bool { return c.sessionID == m.Session })
+    case bpKick:
+        h.dropClients(func(c *Client) bool { return c.username == m.User })
+    case bpProfile:
+        forgetTimezone(m.User)
+        h.fanOutToPeers(m.User, m.Payload)
+    case bpPresence:
+        h.setRemoteEntry(m.Node, m.Room, m.User, m.Entry)
+    case bpSnapshot:
+        h.replaceRemoteShare(m.Node, m.Snapshot)
+    case bpHello:
+        h.publishSnapshot()
+    }
+}
+
+// publishSnapshot sends this node's whole share of presence.
+func (h *Hub) publishSnapshot() {
+    snap := make([]sharedEntry, 0)
+    for room, users := range h.shared {
+        for _, e := range users {
+            snap = append(snap, sharedEntry{Room: room, Entry: e})
+        }
+    }
+    h.backplane.Publish(backplaneMessage{Kind: bpSnapshot, Snapshot: snap})
+}
+
+// expireNodes forgets the presence of nodes that went silent (crashed or
+// partitioned) and tells the others this one is alive.
+func (h *Hub) expireNodes(now time.Time) {
+    h.backplane.Publish(backplaneMessage{Kind: bpHeartbeat})
+    for node, seen := range h.nodesSeen {
+        if now.Sub(seen) < backplaneNodeTimeout() {
+            continue
+        }
+        log.Println("🛰️ Node went silent, dropping its presence:", node)
+        delete(h.nodesSeen, node)
+        h.replaceRemoteShare(node, nil)
+    }
+}
+
+// -------------------- In-Process Backplane --------------------
+
+// memBus links hubs in one process. With a single hub on it, publishing
+// reaches nobody, which is the single-node setup.
+type memBus struct {
+    mu    sync.Mutex
+    nodes []*memBackplane
+}
+
+type memBackplane struct {
+    bus  *memBus
+    node string
+    in   chan backplaneMessage
+}
+
+func newMemBus() *memBus {
+    return &memBus{}
+}
+
+func (b *memBus) join(node string) *memBackplane {
+    m := &memBackplane{bus: b, node: node, in: make(chan backplaneMessage, 1024)}
+    b.mu.Lock()
+    b.nodes = append(b.nodes, m)
+    b.mu.Unlock()
+    return m
+}
+
+func (m *memBackplane) Node() string { return m.node }
+
+func (m *memBackplane) Publish(msg backplaneMessage) {
+    msg.Node = m.node
+    m.bus.mu.Lock()
+    defer m.bus.mu.Unlock()
+    for _, other := range m.bus.nodes {
+        if other == m {
+            continue
+        }
+        select {
+        case other.in <- msg:
+        default:
+            log.Println("⚠️ Backplane queue full, dropping message for", other.node)
+        }
+    }
+}
+
+func (m *memBackplane) Subscribe(handle func(backplaneMessage), ready func()) {
+    go func() {
+        ready()
+        for msg := range m.in {
+            handle(msg)
+        }
+    }()
+}
+
+// -------------------- Postgres Backplane --------------------
+
+const (
+    pgBackplaneChannel = "chatbox_hub"
+    // NOTIFY payloads are capped at 8000 bytes; bigger messages are stored
+    // in backplane_payloads and the notification carries their ID.
+    maxNotifyPayload = 7900
+)
+
+type pgBackplane struct {
+    node string
+    out  chan backplaneMessage
+}
+
+func newPGBackplane(node string) *pgBackplane {
+    b := &pgBackplane{node: node, out: make(chan backplaneMessage, 4096)}
+    go b.publishLoop()
+    return b
+}
+
+func (b *pgBackplane) Node() string { return b.node }
+
+func (b *pgBackplane) Publish(m backplaneMessage) {
+    m.Node = b.node
+    select {
+    case b.out <- m:
+    default:
+        log.Println("⚠️ Backplane queue full, dropping", m.Kind, "message")
+    }
+}
+
+func (b *pgBackplane) publishLoop() {
+    for m := range b.out {
+        ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        if err := b.notify(ctx, dbPool, m); err != nil {
+            log.Println("backplane publish error:", err)
+        }
+        cancel()
+    }
+}
+
+func (b *pgBackplane) PublishTx(ctx context.Context, tx pgx.Tx, m backplaneMessage) error {
+    return b.notify(ctx, tx, m)
+}
+
+// pgQuerier is the part of pgxpool.Pool and pgx.Tx that notify uses.
+type pgQuerier interface {
+    Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+    QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// pgNotification is what goes over NOTIFY: the message itself, or a
+// reference to it in backplane_payloads when it is too big.
+type pgNotification struct {
+    Node string `json:"node"`
+    Ref  int64  `json:"ref"`
+}
+
+func (b *pgBackplane) notify(ctx context.Context, q pgQuerier, m backplaneMessage) error {
+    m.Node = b.node
+    payload, err := json.Marshal(m)
+    if err != nil {
+        return err
+    }
+    if len(payload) > maxNotifyPayload {
+        var ref int64
+        err := q.QueryRow(ctx, `INSERT INTO backplane_payloads (payload) VALUES ($1) RETURNING id`, string(payload)).Scan(&ref)
+        if err != nil {
+            return err
+        }
+        if _, err := q.Exec(ctx, `DELETE FROM backplane_payloads WHERE created_at < NOW() - INTERVAL '5 minutes'`); err != nil {
+            return err
+        }
+        if payload, err = json.Marshal(pgNotification{Node: b.node, Ref: ref}); err != nil {
+            return err
+        }
+    }
+    _, err = q.Exec(ctx, `SELECT pg_notify($1, $2)`, pgBackplaneChannel, string(payload))
+    return err
+}
+
+// Subscribe listens on a dedicated pool connection and reconnects with a
+// short backoff when it drops.
+func (b *pgBackplane) Subscribe(handle func(backplaneMessage), ready func()) {
+    go func() {
+        for {
+            if err := b.listen(handle, ready); err != nil {
+                log.Println("backplane listen error:", err)
+            }
+            time.Sleep(time.Second)
+        }
+    }()
+}
+
+func (b *pgBackplane) listen(handle func(backplaneMessage), ready func()) error {
+    ctx := context.Background()
+    conn, err := dbPool.Acquire(ctx)
+    if err != nil {
+        return err
+    }
+    defer conn.Release()
+    if _, err := conn.Exec(ctx, "LISTEN "+pgBackplaneChannel); err != nil {
+        return err
+    }
+    ready()
+    for {
+        n, err := conn.Conn().WaitForNotification(ctx)
+        if err != nil {
+            // Leave the connection out of the pool; its LISTEN state is gone with it
+            conn.Conn().Close(ctx)
+            return err
+        }
+        var ref pgNotification
+        if json.Unmarshal([]byte(n.Payload), &ref) != nil || ref.Node == b.node {
+            continue
+        }
+        payload := []byte(n.Payload)
+        if ref.Ref > 0 {
+            if payload, err = b.fetchPayload(ref.Ref); err != nil {
+                log.Println("backplane payload error:", err)
+                continue
+            }
+        }
+        var m backplaneMessage
+        if err := json.Unmarshal(payload, &m); err != nil {
+            log.Println("backplane decode error:", err)
+            continue
+        }
+        handle(m)
+    }
+}
+
+func (b *pgBackplane) fetchPayload(ref int64) ([]byte, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    var payload string
+    err := dbPool.QueryRow(ctx, `SELECT payload FROM backplane_payloads WHERE id=$1`, ref).Scan(&payload)
+    if errors.Is(err, pgx.ErrNoRows) {
+        return nil, errors.New("payload expired before it was read")
+    }
+    return []byte(payload), err
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+    "testing"
+
+    "github.com/gorilla/websocket"
+)
+
+func TestCrossNodeFanOut(t *testing.T) {
+    bus := newMemBus()
+    a, b := newTestNode(t, bus), newTestNode(t, bus)
+    testUser(t, "xnode_alice")
+    testUser(t, "xnode_bob")
+    bob, _, err := b.dial(t, "xnode_bob", "room=general")
+    if err != nil {
+        t.Fatal(err)
+    }
+    readUntil(t, bob, "users")
+
+    // Presence on one node reaches the other, aggregated per user
+    aliceA, _, err := a.dial(t, "xnode_alice", "room=general")
+    if err != nil {
+        t.Fatal(err)
+    }
+    waitPresence(t, bob, "presence_join", "xnode_alice")
+    aliceB, _, err := b.dial(t, "xnode_alice", "room=general")
+    if err != nil {
+        t.Fatal(err)
+    }
+    u := waitPresence(t, bob, "presence_update", "xnode_alice")["user"].(map[string]any)
+    if u["connections"] != 2.0 {
+        t.Fatalf("alice on both nodes: %v", u)
+    }
+
+    // Room events published on one node reach sockets on both, with their seq
+    seq := testRoomMessage(a.hub, "general", "xnode_alice", "hello from a")
+    for name, conn := range map[string]*websocket.Conn{"bob on b": bob, "alice on a": aliceA} {
+        f := readUntil(t, conn, "message")
+        if f["text"] != "hello from a" || f["seq"] != float64(seq) {
+            t.Fatalf("%s got %v", name, f)
+        }
+    }
+
+    // Kicking on one node closes the user's sockets on every node
+    a.hub.kick <- "xnode_alice"
+    expectClose(t, aliceA, websocket.ClosePolicyViolation)
+    expectClose(t, aliceB, websocket.ClosePolicyViolation)
+    waitPresence(t, bob, "presence_leave", "xnode_alice")
+}
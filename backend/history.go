@@ -0,0 +1,441 @@
+package main
+
+import (
+    "context"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/jackc/pgx/v5"
+)
+
+// -------------------- Message History --------------------
+//
+// History is paged with opaque cursors over (timestamp, id), oldest first
+// within a page. A page links to older and newer pages with prevCursor and
+// nextCursor, which are left out at either end of the room.
+
+const maxHistoryPage = 200
+
+// historyInitial is how many messages a client gets when it joins a room
+// (HISTORY_INITIAL_MESSAGES); it pages back from there.
+var historyInitial = 200
+
+func initHistory() {
+    historyInitial = envInt("HISTORY_INITIAL_MESSAGES", historyInitial)
+    if historyInitial < 0 || historyInitial > maxHistoryPage {
+        historyInitial = maxHistoryPage
+    }
+}
+
+var (
+    errBadCursor    = errors.New("invalid cursor")
+    errBadDate      = errors.New("at must be an RFC 3339 time or YYYY-MM-DD")
+    errHistoryQuery = errors.New("use only one of before, after, around and at")
+)
+
+// msgCursor is a position between messages: everything strictly before or
+// after (at, id).
+type msgCursor struct {
+    at time.Time
+    id int64
+}
+
+func cursorOf(m Message) *msgCursor {
+    return &msgCursor{at: m.at, id: m.ID}
+}
+
+func (c *msgCursor) String() string {
+    return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d_%d", c.at.UnixNano(), c.id)))
+}
+
+func parseCursor(s string) (*msgCursor, error) {
+    b, err := base64.RawURLEncoding.DecodeString(s)
+    if err != nil {
+        return nil, errBadCursor
+    }
+    ns, id, ok := strings.Cut(string(b), "_")
+    if !ok {
+        return nil, errBadCursor
+    }
+    n, err1 := strconv.ParseInt(ns, 10, 64)
+    i, err2 := strconv.ParseInt(id, 10, 64)
+    if err1 != nil || err2 != nil {
+        return nil, errBadCursor
+    }
+    return &msgCursor{at: time.Unix(0, n), id: i}, nil
+}
+
+// before reports whether m sorts before the cursor.
+func (c *msgCursor) before(m Message) bool {
+    return m.at.Before(c.at) || (m.at.Equal(c.at) && m.ID < c.id)
+}
+
+// after reports whether m sorts after the cursor.
+func (c *msgCursor) after(m Message) bool {
+    return m.at.After(c.at) || (m.at.Equal(c.at) && m.ID > c.id)
+}
+
+// HistoryQuery picks one page of a room's history. At most one of Before,
+// After, Around and At is set; none means the latest messages.
+type HistoryQuery struct {
+    Before string `json:"before,omitempty"` // cursor: messages older than it
+    After  string `json:"after,omitempty"`  // cursor: messages newer than it
+    Around int64  `json:"around,omitempty"` // message ID: it and its neighbours, for permalinks
+    At     string `json:"at,omitempty"`     // RFC 3339 time or YYYY-MM-DD: first messages from then on
+    Limit  int    `json:"limit,omitempty"`  // default 50, at most 200
+}
+
+// MessagePage is one page of history, oldest first.
+type MessagePage struct {
+    Room       string    `json:"room"`
+    Messages   []Message `json:"messages"`
+    PrevCursor string    `json:"prevCursor,omitempty"` // pass as before= for older messages
+    NextCursor string    `json:"nextCursor,omitempty"` // pass as after= for newer messages
+}
+
+// queryHistory resolves q against room. Errors are errHistoryQuery,
+// errBadCursor, errBadDate, errMessageNotFound (around a message outside the
+// room) or a store failure.
+func queryHistory(room string, q HistoryQuery) (*MessagePage, error) {
+    set := 0
+    for _, on := range []bool{q.Before != "", q.After != "", q.Around != 0, q.At != ""} {
+        if on {
+            set++
+        }
+    }
+    if set > 1 {
+        return nil, errHistoryQuery
+    }
+    limit := q.Limit
+    if limit <= 0 {
+        limit = 50
+    }
+    if limit > maxHistoryPage {
+        limit = maxHistoryPage
+    }
+
+    var older, newer []Message
+    var hasOlder, hasNewer bool
+    var err error
+    switch {
+    case q.Before != "":
+        c, err := parseCursor(q.Before)
+        if err != nil {
+            return nil, err
+        }
+        if older, hasOlder, err = loadMessagesBefore(room, c, limit); err != nil {
+            return nil, err
+        }
+        if len(older) > 0 {
+            if hasNewer, err = hasMessagesAfter(room, cursorOf(older[len(older)-1])); err != nil {
+                return nil, err
+            }
+        }
+    case q.After != "" || q.At != "":
+        var c *msgCursor
+        if q.After != "" {
+            c, err = parseCursor(q.After)
+        } else {
+            c, err = parseHistoryDate(q.At)
+        }
+        if err != nil {
+            return nil, err
+        }
+        if newer, hasNewer, err = loadMessagesAfter(room, c, limit); err != nil {
+            return nil, err
+        }
+        if len(newer) > 0 {
+            hasOlder, err = hasMessagesBefore(room, cursorOf(newer[0]))
+        } else if q.At != "" {
+            // Nothing since that date: show the last messages before it
+            older, hasOlder, err = loadMessagesBefore(room, c, limit)
+        }
+    case q.Around != 0:
+        m, err := getMessage(q.Around)
+        if err != nil {
+            return nil, err
+        }
+        if m.Room != room {
+            return nil, errMessageNotFound
+        }
+        half := (limit - 1) / 2
+        if older, hasOlder, err = loadMessagesBefore(room, cursorOf(*m), half); err != nil {
+            return nil, err
+        }
+        if newer, hasNewer, err = loadMessagesAfter(room, cursorOf(*m), limit-1-half); err != nil {
+            return nil, err
+        }
+        newer = append([]Message{*m}, newer...)
+    default:
+        older, hasOlder, err = loadMessagesBefore(room, nil, limit)
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    page := &MessagePage{Room: room, Messages: append(older, newer...)}
+    if page.Messages == nil {
+        page.Messages = []Message{}
+    }
+    if n := len(page.Messages); n > 0 {
+        if hasOlder {
+            page.PrevCursor = cursorOf(page.Messages[0]).String()
+        }
+        if hasNewer {
+            page.NextCursor = cursorOf(page.Messages[n-1]).String()
+        }
+    }
+    return page, nil
+}
+
+// parseHistoryDate turns an "at" value into the cursor just before that time.
+func parseHistoryDate(s string) (*msgCursor, error) {
+    t, err := time.Parse(time.RFC3339, s)
+    if err != nil {
+        if t, err = time.Parse("2006-01-02", s); err != nil {
+            return nil, errBadDate
+        }
+    }
+    return &msgCursor{at: t}, nil
+}
+
+// roomMessagesHandler serves GET /rooms/{room}/messages.
+func roomMessagesHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    room, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/rooms/"), "/")
+    if room == "" || rest != "messages" {
+        http.NotFound(w, r)
+        return
+    }
+    if !roomAllowed(r, room) {
+        http.Error(w, "Forbidden", http.StatusForbidden)
+        return
+    }
+    if err := checkRoomAccess(authUsername(r), room); err != nil {
+        writeRoomAccessError(w, err)
+        return
+    }
+    v := r.URL.Query()
+    q := HistoryQuery{Before: v.Get("before"), After: v.Get("after"), At: v.Get("at")}
+    if s := v.Get("around"); s != "" {
+        id, err := strconv.ParseInt(s, 10, 64)
+        if err != nil || id <= 0 {
+            http.Error(w, "Invalid message ID", http.StatusBadRequest)
+            return
+        }
+        q.Around = id
+    }
+    if s := v.Get("limit"); s != "" {
+        n, err := strconv.Atoi(s)
+        if err != nil || n <= 0 {
+            http.Error(w, "Invalid limit", http.StatusBadRequest)
+            return
+        }
+        q.Limit = n
+    }
+    page, err := queryHistory(room, q)
+    if err != nil {
+        switch {
+        case errors.Is(err, errMessageNotFound):
+            http.Error(w, "Message not found", http.StatusNotFound)
+        case errors.Is(err, errHistoryQuery), errors.Is(err, errBadCursor), errors.Is(err, errBadDate):
+            http.Error(w, err.Error(), http.StatusBadRequest)
+        default:
+            log.Println("history query error:", err)
+            http.Error(w, "Server error", http.StatusInternalServerError)
+        }
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(page)
+}
+
+// handleHistoryRequest answers an inbound history_request frame.
+func (c *Client) handleHistoryRequest(f HistoryRequestFrame) {
+    room, ok := c.targetRoom(f.ID, f.Room)
+    if !ok {
+        return
+    }
+    if f.Around < 0 || f.Limit < 0 {
+        c.sendError(f.ID, codeInvalidRequest, "around and limit must be positive")
+        return
+    }
+    page, err := queryHistory(room, f.HistoryQuery)
+    if err != nil {
+        switch {
+        case errors.Is(err, errMessageNotFound):
+            c.sendError(f.ID, codeNotFound, "Message not found")
+        case errors.Is(err, errHistoryQuery), errors.Is(err, errBadCursor), errors.Is(err, errBadDate):
+            c.sendError(f.ID, codeInvalidRequest, err.Error())
+        default:
+            log.Println("history query error:", err)
+            c.sendError(f.ID, codeServerError, "Could not load history")
+        }
+        return
+    }
+    if b, err := json.Marshal(HistoryPageEvent{Type: "history_page", RequestID: f.ID, MessagePage: *page}); err == nil {
+        c.queue(b)
+    }
+}
+
+// -------------------- History Store --------------------
+
+// loadMessagesBefore returns up to limit messages older than c (the newest
+// ones when c is nil), oldest first, and whether older ones remain.
+func loadMessagesBefore(room string, c *msgCursor, limit int) ([]Message, bool, error) {
+    if limit <= 0 {
+        more, err := hasMessagesBefore(room, c)
+        return nil, more, err
+    }
+    if useDB {
+        ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+        defer cancel()
+        return dbLoadMessagesBefore(ctx, room, c, limit)
+    }
+    messagesMu.RLock()
+    defer messagesMu.RUnlock()
+    var out []Message
+    more := false
+    for i := len(messagesList) - 1; i >= 0; i-- {
+        m := messagesList[i]
+        if m.Room != room || (c != nil && !c.before(m)) {
+            continue
+        }
+        if len(out) == limit {
+            more = true
+            break
+        }
+        out = append(out, m)
+    }
+    reverseMessages(out)
+    return out, more, nil
+}
+
+// loadMessagesAfter returns up to limit messages newer than c, oldest
+// first, and whether newer ones remain.
+func loadMessagesAfter(room string, c *msgCursor, limit int) ([]Message, bool, error) {
+    if limit <= 0 {
+        more, err := hasMessagesAfter(room, c)
+        return nil, more, err
+    }
+    if useDB {
+        ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+        defer cancel()
+        return dbLoadMessagesAfter(ctx, room, c, limit)
+    }
+    messagesMu.RLock()
+    defer messagesMu.RUnlock()
+    var out []Message
+    more := false
+    for _, m := range messagesList {
+        if m.Room != room || !c.after(m) {
+            continue
+        }
+        if len(out) == limit {
+            more = true
+            break
+        }
+        out = append(out, m)
+    }
+    return out, more, nil
+}
+
+func hasMessagesBefore(room string, c *msgCursor) (bool, error) {
+    msgs, more, err := loadMessagesBefore(room, c, 1)
+    return len(msgs) > 0 || more, err
+}
+
+func hasMessagesAfter(room string, c *msgCursor) (bool, error) {
+    msgs, more, err := loadMessagesAfter(room, c, 1)
+    return len(msgs) > 0 || more, err
+}
+
+func reverseMessages(ms []Message) {
+    for i, j := 0, len(ms)-1; i < j; i, j = i+1, j-1 {
+        ms[i], ms[j] = ms[j], ms[i]
+    }
+}
+
+// Both queries walk messages_room_timestamp_idx (the plain timestamp bound is
+// what the index can use; the id test breaks ties) and fetch one extra row to
+// learn whether another page exists.
+func dbLoadMessagesBefore(ctx context.Context, room string, c *msgCursor, limit int) ([]Message, bool, error) {
+    var rows pgx.Rows
+    var err error
+    if c == nil {
+        rows, err = dbPool.Query(ctx, `
+            SELECT id, username, text, timestamp, room, bot, COALESCE(reactions, '{}')
+            FROM messages
+            WHERE room = $1
+            ORDER BY timestamp DESC, id DESC
+            LIMIT $2
+        `, room, limit+1)
+    } else {
+        rows, err = dbPool.Query(ctx, `
+            SELECT id, username, text, timestamp, room, bot, COALESCE(reactions, '{}')
+            FROM messages
+            WHERE room = $1 AND timestamp <= $2 AND (timestamp < $2 OR id < $3)
+            ORDER BY timestamp DESC, id DESC
+            LIMIT $4
+        `, room, c.at, c.id, limit+1)
+    }
+    if err != nil {
+        return nil, false, err
+    }
+    out, err := scanMessages(rows)
+    if err != nil {
+        return nil, false, err
+    }
+    more := len(out) > limit
+    if more {
+        out = out[:limit]
+    }
+    reverseMessages(out)
+    return out, more, nil
+}
+
+func dbLoadMessagesAfter(ctx context.Context, room string, c *msgCursor, limit int) ([]Message, bool, error) {
+    rows, err := dbPool.Query(ctx, `
+        SELECT id, username, text, timestamp, room, bot, COALESCE(reactions, '{}')
+        FROM messages
+        WHERE room = $1 AND timestamp >= $2 AND (timestamp > $2 OR id > $3)
+        ORDER BY timestamp ASC, id ASC
+        LIMIT $4
+    `, room, c.at, c.id, limit+1)
+    if err != nil {
+        return nil, false, err
+    }
+    out, err := scanMessages(rows)
+    if err != nil {
+        return nil, false, err
+    }
+    more := len(out) > limit
+    if more {
+        out = out[:limit]
+    }
+    return out, more, nil
+}
+
+func scanMessages(rows pgx.Rows) ([]Message, error) {
+    defer rows.Close()
+    var out []Message
+    for rows.Next() {
+        var m Message
+        if err := rows.Scan(&m.ID, &m.Username, &m.Text, &m.at, &m.Room, &m.Bot, &m.Reactions); err != nil {
+            return nil, err
+        }
+        m.Timestamp = m.at.Format("2006-01-02 15:04:05 MST")
+        out = append(out, m)
+    }
+    return out, rows.Err()
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+    c := &msgCursor{at: time.Unix(1700000000, 123456789), id: 42}
+    got, err := parseCursor(c.String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !got.at.Equal(c.at) || got.id != c.id {
+        t.Fatalf("round trip: got %v/%d, want %v/%d", got.at, got.id, c.at, c.id)
+    }
+    for _, bad := range []string{"", "!!!", "bm9fdW5kZXJzY29yZQ", "YV9i"} {
+        if _, err := parseCursor(bad); err != errBadCursor {
+            t.Errorf("parseCursor(%q) = %v, want errBadCursor", bad, err)
+        }
+    }
+}
+
+// testMessages stores n messages in room and returns their IDs, oldest first.
+func testMessages(t *testing.T, room string, n int) []int64 {
+    t.Helper()
+    ids := make([]int64, n)
+    for i := range ids {
+        rc, err := saveMessage(Message{Username: "hist_user", Text: fmt.Sprint("message ", i), Room: room}, "")
+        if err != nil {
+            t.Fatal(err)
+        }
+        ids[i] = rc.ID
+    }
+    return ids
+}
+
+func pageIDs(p *MessagePage) []int64 {
+    ids := make([]int64, len(p.Messages))
+    for i, m := range p.Messages {
+        ids[i] = m.ID
+    }
+    return ids
+}
+
+func sameIDs(a, b []int64) bool {
+    if len(a) != len(b) {
+        return false
+    }
+    for i := range a {
+        if a[i] != b[i] {
+            return false
+        }
+    }
+    return true
+}
+
+func TestQueryHistoryPaging(t *testing.T) {
+    room := "hist-paging"
+    ids := testMessages(t, room, 25) // many share a timestamp; ties break on ID
+
+    latest, err := queryHistory(room, HistoryQuery{Limit: 10})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !sameIDs(pageIDs(latest), ids[15:]) || latest.PrevCursor == "" || latest.NextCursor != "" {
+        t.Fatalf("latest page: %v prev=%q next=%q", pageIDs(latest), latest.PrevCursor, latest.NextCursor)
+    }
+    older, err := queryHistory(room, HistoryQuery{Before: latest.PrevCursor, Limit: 10})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !sameIDs(pageIDs(older), ids[5:15]) || older.PrevCursor == "" || older.NextCursor == "" {
+        t.Fatalf("older page: %v prev=%q next=%q", pageIDs(older), older.PrevCursor, older.NextCursor)
+    }
+    oldest, err := queryHistory(room, HistoryQuery{Before: older.PrevCursor, Limit: 10})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !sameIDs(pageIDs(oldest), ids[:5]) || oldest.PrevCursor != "" {
+        t.Fatalf("oldest page: %v prev=%q", pageIDs(oldest), oldest.PrevCursor)
+    }
+    // And forward again from the middle page
+    newer, err := queryHistory(room, HistoryQuery{After: older.NextCursor, Limit: 10})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !sameIDs(pageIDs(newer), ids[15:]) || newer.NextCursor != "" {
+        t.Fatalf("newer page: %v next=%q", pageIDs(newer), newer.NextCursor)
+    }
+
+    around, err := queryHistory(room, HistoryQuery{Around: ids[12], Limit: 5})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !sameIDs(pageIDs(around), ids[10:15]) {
+        t.Fatalf("around %d: %v", ids[12], pageIDs(around))
+    }
+    at, err := queryHistory(room, HistoryQuery{At: "2000-01-01", Limit: 3})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !sameIDs(pageIDs(at), ids[:3]) || at.PrevCursor != "" {
+        t.Fatalf("at 2000-01-01: %v prev=%q", pageIDs(at), at.PrevCursor)
+    }
+}
+
+func TestQueryHistoryErrors(t *testing.T) {
+    other := testMessages(t, "hist-other", 1)
+    tests := []struct {
+        q    HistoryQuery
+        want error
+    }{
+        {HistoryQuery{Before: "x", After: "y"}, errHistoryQuery},
+        {HistoryQuery{Before: "not a cursor"}, errBadCursor},
+        {HistoryQuery{At: "yesterday"}, errBadDate},
+        {HistoryQuery{Around: other[0]}, errMessageNotFound}, // message of another room
+    }
+    for _, tt := range tests {
+        if _, err := queryHistory("hist-errors", tt.q); err != tt.want {
+            t.Errorf("queryHistory(%+v) = %v, want %v", tt.q, err, tt.want)
+        }
+    }
+}
+
+func TestRoomMessagesAccess(t *testing.T) {
+    testUser(t, "hist_owner")
+    testUser(t, "hist_outsider")
+    testPrivateRoom(t, "hist-secret", "hist_owner")
+    testMessages(t, "hist-secret", 3)
+    if err := createBotUser("hist_bot", "hist_owner"); err != nil {
+        t.Fatal(err)
+    }
+    readKey, err := createAPIKey(&apiKey{Username: "hist_bot", Scopes: []string{scopeRoomsRead}, CreatedBy: "hist_owner"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    writeKey, err := createAPIKey(&apiKey{Username: "hist_bot", Scopes: []string{scopeMessagesWrite}, CreatedBy: "hist_owner"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    // As wired in main
+    h := requireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if requireScope(w, r, scopeRoomsRead) {
+            roomMessagesHandler(w, r)
+        }
+    }))
+    get := func(token, path string) *httptest.ResponseRecorder {
+        r := httptest.NewRequest(http.MethodGet, path, nil)
+        r.Header.Set("Authorization", "Bearer "+token)
+        w := httptest.NewRecorder()
+        h.ServeHTTP(w, r)
+        return w
+    }
+
+    owner, outsider := sessionToken(t, "hist_owner"), sessionToken(t, "hist_outsider")
+    if w := get(outsider, "/rooms/hist-secret/messages?around=1"); w.Code != http.StatusForbidden {
+        t.Fatalf("outsider read private history: status %d", w.Code)
+    }
+    if w := get(outsider, "/rooms/hist-nowhere/messages"); w.Code != http.StatusNotFound {
+        t.Fatalf("missing room: status %d", w.Code)
+    }
+    w := get(owner, "/rooms/hist-secret/messages")
+    if w.Code != http.StatusOK {
+        t.Fatalf("owner: status %d: %s", w.Code, w.Body)
+    }
+    var page MessagePage
+    if err := json.NewDecoder(w.Body).Decode(&page); err != nil || len(page.Messages) != 3 {
+        t.Fatalf("owner page: %v %+v", err, page)
+    }
+
+    // Bots reach the endpoint with rooms:read, and the room check still applies
+    if w := get(readKey, "/rooms/general/messages"); w.Code != http.StatusOK {
+        t.Fatalf("bot with rooms:read: status %d: %s", w.Code, w.Body)
+    }
+    if w := get(readKey, "/rooms/hist-secret/messages"); w.Code != http.StatusForbidden {
+        t.Fatalf("bot read private history: status %d", w.Code)
+    }
+    if w := get(writeKey, "/rooms/general/messages"); w.Code != http.StatusForbidden {
+        t.Fatalf("bot without rooms:read: status %d", w.Code)
+    }
+}
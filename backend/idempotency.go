@@ -0,0 +1,146 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "log"
+    "time"
+
+    "github.com/jackc/pgx/v5"
+)
+
+// -------------------- Idempotent Sends --------------------
+//
+// Clients tag each message with an idempotency key (a UUID). A send that
+// repeats a key its user already used within the window is not stored
+// again; it gets the original message's ack instead, so retransmitting
+// after a lost ack is safe.
+
+const maxIdempotencyKeyLen = 64
+
+// idempotencyWindow is how long a key is remembered (IDEMPOTENCY_WINDOW).
+var idempotencyWindow = 24 * time.Hour
+
+func initIdempotency() {
+    idempotencyWindow = envDuration("IDEMPOTENCY_WINDOW", idempotencyWindow)
+}
+
+// sendReceipt is what a stored message is acked with. Duplicate is set when
+// the key was seen before and ID and Seq are the original message's.
+type sendReceipt struct {
+    ID        int64
+    Seq       int64
+    Duplicate bool
+}
+
+type sentKey struct {
+    username string
+    key      string
+}
+
+type sentEntry struct {
+    sendReceipt
+    at time.Time
+}
+
+// In-memory keys, guarded by messagesMu so a message and its key are
+// stored together. sentKeyOrder is oldest first, for expiry.
+var (
+    sentKeys     = map[sentKey]*sentEntry{}
+    sentKeyOrder []sentKey
+)
+
+// memExpireSentKeys drops keys older than the window. Callers hold messagesMu.
+func memExpireSentKeys(now time.Time) {
+    for len(sentKeyOrder) > 0 {
+        k := sentKeyOrder[0]
+        if e, ok := sentKeys[k]; ok {
+            if now.Sub(e.at) < idempotencyWindow {
+                break
+            }
+            delete(sentKeys, k)
+        }
+        sentKeyOrder = sentKeyOrder[1:]
+    }
+}
+
+// recordSendSeq notes the sequence number a keyed message was published
+// with, so repeats of it are acked with the same seq.
+func recordSendSeq(username, key string, seq int64) {
+    if key == "" || seq == 0 {
+        return
+    }
+    if useDB {
+        ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        defer cancel()
+        if _, err := dbPool.Exec(ctx, `UPDATE message_keys SET seq=$3 WHERE username=$1 AND idempotency_key=$2`, username, key, seq); err != nil {
+            log.Println("idempotency key update error:", err)
+        }
+        return
+    }
+    messagesMu.Lock()
+    defer messagesMu.Unlock()
+    if e, ok := sentKeys[sentKey{username, key}]; ok {
+        e.Seq = seq
+    }
+}
+
+// memForgetSentKeys drops the keys of deleted accounts.
+func memForgetSentKeys(gone map[string]bool) {
+    messagesMu.Lock()
+    defer messagesMu.Unlock()
+    for k := range sentKeys {
+        if gone[k.username] {
+            delete(sentKeys, k)
+        }
+    }
+}
+
+// dbSaveKeyedMessage stores m and claims key for its author in one
+// transaction. If the key is taken (a concurrent send with it waits for the
+// first to commit) the new row is rolled back and the original is returned.
+func dbSaveKeyedMessage(ctx context.Context, m Message, key string) (sendReceipt, error) {
+    tx, err := dbPool.Begin(ctx)
+    if err != nil {
+        return sendReceipt{}, err
+    }
+    defer tx.Rollback(ctx)
+    _, err = tx.Exec(ctx, `
+        DELETE FROM message_keys
+        WHERE username=$1 AND created_at <= NOW() - make_interval(secs => $2)
+    `, m.Username, idempotencyWindow.Seconds())
+    if err != nil {
+        return sendReceipt{}, err
+    }
+    var id int64
+    err = tx.QueryRow(ctx, `
+        INSERT INTO messages (username, text, room, bot) VALUES ($1, $2, $3, $4)
+        RETURNING id
+    `, m.Username, m.Text, m.Room, m.Bot).Scan(&id)
+    if err != nil {
+        return sendReceipt{}, err
+    }
+    ct, err := tx.Exec(ctx, `
+        INSERT INTO message_keys (username, idempotency_key, message_id) VALUES ($1, $2, $3)
+        ON CONFLICT (username, idempotency_key) DO NOTHING
+    `, m.Username, key, id)
+    if err != nil {
+        return sendReceipt{}, err
+    }
+    if ct.RowsAffected() == 0 {
+        tx.Rollback(ctx)
+        rc := sendReceipt{Duplicate: true}
+        err := dbPool.QueryRow(ctx, `
+            SELECT message_id, seq FROM message_keys WHERE username=$1 AND idempotency_key=$2
+        `, m.Username, key).Scan(&rc.ID, &rc.Seq)
+        if errors.Is(err, pgx.ErrNoRows) {
+            // Expired and pruned between our insert and this read
+            return sendReceipt{}, errors.New("idempotency key expired during send")
+        }
+        return rc, err
+    }
+    if err := tx.Commit(ctx); err != nil {
+        return sendReceipt{}, err
+    }
+    return sendReceipt{ID: id}, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+    "context"
+    "testing"
+    "time"
+)
+
+func TestSaveMessageDedupesByKey(t *testing.T) {
+    m := Message{Username: "idem_user", Text: "once", Room: "idem-room"}
+    first, err := saveMessage(m, "key-1")
+    if err != nil || first.Duplicate {
+        t.Fatalf("first send: %+v %v", first, err)
+    }
+    again, err := saveMessage(m, "key-1")
+    if err != nil || !again.Duplicate || again.ID != first.ID {
+        t.Fatalf("repeated key: %+v %v, want duplicate of %d", again, err, first.ID)
+    }
+
+    // Keys are per user, and sends without a key are never deduped
+    other, err := saveMessage(Message{Username: "idem_other", Text: "once", Room: "idem-room"}, "key-1")
+    if err != nil || other.Duplicate || other.ID == first.ID {
+        t.Fatalf("same key from another user: %+v %v", other, err)
+    }
+    a, _ := saveMessage(m, "")
+    b, _ := saveMessage(m, "")
+    if a.Duplicate || b.Duplicate || a.ID == b.ID {
+        t.Fatalf("unkeyed sends: %+v %+v", a, b)
+    }
+}
+
+func TestSaveMessageKeyExpires(t *testing.T) {
+    old := idempotencyWindow
+    idempotencyWindow = 20 * time.Millisecond
+    t.Cleanup(func() { idempotencyWindow = old })
+
+    m := Message{Username: "idem_expiry", Text: "hello", Room: "idem-room"}
+    first, err := saveMessage(m, "key-expiry")
+    if err != nil {
+        t.Fatal(err)
+    }
+    time.Sleep(2 * idempotencyWindow)
+    later, err := saveMessage(m, "key-expiry")
+    if err != nil || later.Duplicate || later.ID == first.ID {
+        t.Fatalf("send after the window: %+v %v", later, err)
+    }
+}
+
+func TestResentMessageGetsOriginalAck(t *testing.T) {
+    srv := newTestServer(t)
+    testUser(t, "idem_sender")
+    if _, err := dbCreateRoom(context.Background(), "idem-ws", "", "idem_sender", nil, false); err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { dbDeleteRoom(context.Background(), "idem-ws") })
+    conn, _, err := srv.dial(t, "idem_sender", "room=idem-ws")
+    if err != nil {
+        t.Fatal(err)
+    }
+    readUntil(t, conn, "history")
+    before := currentRoomSeq("idem-ws")
+
+    frame := map[string]any{"type": "message", "text": "hi", "clientId": 7, "idempotencyKey": "3f0c-resend"}
+    frame["id"] = "1"
+    sendFrame(t, conn, frame)
+    first := readUntil(t, conn, "ack")
+    frame["id"] = "2" // a resend after a lost ack
+    sendFrame(t, conn, frame)
+    again := readUntil(t, conn, "ack")
+
+    if first["duplicate"] != nil || again["duplicate"] != true {
+        t.Fatalf("duplicate flags: first %v, resend %v", first, again)
+    }
+    if again["id"] != first["id"] || again["seq"] != first["seq"] || again["clientId"] != first["clientId"] {
+        t.Fatalf("resend ack %v, want the original %v", again, first)
+    }
+    if seq := currentRoomSeq("idem-ws"); seq != before+1 {
+        t.Fatalf("room seq went from %d to %d, want one new event", before, seq)
+    }
+}
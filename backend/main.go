@@ -6,47 +6,54 @@ import (
     "errors"
     "fmt"
     "log"
+    "math"
     "net/http"
+    "net/mail"
     "os"
     "path/filepath"
     "sort"
     "strconv"
     "strings"
     "sync"
+    "sync/atomic"
     "time"
+    "unicode/utf8"
 
     "github.com/gorilla/websocket"
     "github.com/jackc/pgx/v5"
     "github.com/jackc/pgx/v5/pgxpool"
-    "golang.org/x/crypto/bcrypt"
 )
 
 // -------------------- CORS --------------------
 
+// originAllowed reports whether a browser page from origin may call the API
+// with credentials (ALLOWED_ORIGINS, comma-separated, or "*").
+func originAllowed(origin string) bool {
+    allowedOrigins := os.Getenv("ALLOWED_ORIGINS")
+    if allowedOrigins == "" {
+        allowedOrigins = "http://localhost:3000,https://localhost:3000"
+    }
+    if allowedOrigins == "*" {
+        return true
+    }
+    for _, allowed := range strings.Split(allowedOrigins, ",") {
+        if strings.TrimSpace(allowed) == origin {
+            return true
+        }
+    }
+    return false
+}
+
 func enableCors(next http.Handler) http.Handler {
     return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-        origin := r.Header.Get("Origin")
-        allowedOrigins := os.Getenv("ALLOWED_ORIGINS")
-        if allowedOrigins == "" {
-            allowedOrigins = "http://localhost:3000,https://localhost:3000"
-        }
-        
         // Check if origin is allowed
-        if origin != "" {
-            if allowedOrigins == "*" {
-                w.Header().Set("Access-Control-Allow-Origin", origin)
-            } else {
-                for _, allowed := range strings.Split(allowedOrigins, ",") {
-                    if strings.TrimSpace(allowed) == origin {
-                        w.Header().Set("Access-Control-Allow-Origin", origin)
-                        break
-                    }
-                }
-            }
+        if origin := r.Header.Get("Origin"); origin != "" && originAllowed(origin) {
+            w.Header().Set("Access-Control-Allow-Origin", origin)
         }
         
-        w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-        w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Requested-With, X-Username")
+        w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, PATCH, DELETE")
+        w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Requested-With, X-Username, Authorization, If-Match")
+        w.Header().Set("Access-Control-Expose-Headers", "ETag")
         w.Header().Set("Access-Control-Allow-Credentials", "true")
         
         // Security headers
@@ -63,12 +70,76 @@ func enableCors(next http.Handler) http.Handler {
     })
 }
 
+// -------------------- Auth Middleware --------------------
+
+// requireAuth resolves the session token on the request and rejects it
+// with 401 when missing or invalid. Handlers read the user via authUsername.
+func requireAuth(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        token := tokenFromRequest(r)
+        if token == "" {
+            http.Error(w, "Authentication required", http.StatusUnauthorized)
+            return
+        }
+        if strings.HasPrefix(token, apiKeyPrefix) {
+            key, err := authenticateAPIKey(token)
+            if err != nil {
+                if !errors.Is(err, errAPIKeyInvalid) {
+                    log.Println("api key lookup error:", err)
+                }
+                http.Error(w, "Invalid API key", http.StatusUnauthorized)
+                return
+            }
+            if !apiKeyAllowedPath(r.URL.Path) {
+                http.Error(w, "Not available to API keys", http.StatusForbidden)
+                return
+            }
+            if !hasRole(key.Username, roleMember) {
+                http.Error(w, "Account suspended", http.StatusForbidden)
+                return
+            }
+            ctx := withAuth(r.Context(), &sessionClaims{Username: key.Username})
+            next.ServeHTTP(w, r.WithContext(withAPIKey(ctx, key)))
+            return
+        }
+        claims, err := parseToken(token)
+        if err != nil {
+            http.Error(w, "Invalid or expired session", http.StatusUnauthorized)
+            return
+        }
+        if err := validateSession(claims.SessionID, claims.Username); err != nil {
+            if !errors.Is(err, errSessionNotFound) {
+                log.Println("session lookup error:", err)
+            }
+            http.Error(w, "Invalid or expired session", http.StatusUnauthorized)
+            return
+        }
+        // Suspension revokes sessions too; this covers any it missed
+        if !hasRole(claims.Username, roleMember) {
+            http.Error(w, "Account suspended", http.StatusForbidden)
+            return
+        }
+        if !mfaExemptPath(r.URL.Path) && mfaSetupPending(claims.Username) {
+            http.Error(w, "Two-factor authentication setup required", http.StatusForbidden)
+            return
+        }
+        next.ServeHTTP(w, r.WithContext(withAuth(r.Context(), claims)))
+    })
+}
+
 // -------------------- In-Memory Store --------------------
 
 type storedUser struct {
-    Username     string
-    PasswordHash []byte
-    DarkMode     bool
+    Username        string
+    PasswordHash    []byte
+    Email           string
+    Role            string
+    IsBot           bool
+    BotOwner        string
+    Profile         Profile
+    Settings        map[string]any
+    SettingsVersion int
+    CreatedAt       time.Time
 }
 
 var (
@@ -88,7 +159,8 @@ var (
 var dbPool *pgxpool.Pool
 var useDB bool
 
-// In-memory room storage for development
+// In-memory room storage for development, guarded by roomsMu
+var roomsMu sync.RWMutex
 var inMemoryRooms []Room
 var inMemoryRoomPasswords = make(map[string][]byte)
 
@@ -104,28 +176,123 @@ func init() {
 
 // -------------------- WebSocket / Hub --------------------
 
-var upgrader = websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
+// /ws accepts the session cookie, so a page from another site must not be
+// able to open it with the user's credentials. Clients that are not
+// browsers send no Origin.
+var upgrader = websocket.Upgrader{
+    CheckOrigin: func(r *http.Request) bool {
+        origin := r.Header.Get("Origin")
+        return origin == "" || originAllowed(origin)
+    },
+    Subprotocols: wsProtocols,
+}
 
+// WebSocket keepalive: the server pings every wsPingInterval and drops a
+// connection that has sent nothing (not even a pong) for wsPongWait, so
+// half-open sockets stop showing as online.
+var (
+    wsPongWait             = 60 * time.Second
+    wsPingInterval         = 50 * time.Second
+    wsWriteWait            = 10 * time.Second
+    wsMaxMessageSize int64 = 64 << 10
+)
+
+func initWebSocket() {
+    wsPongWait = envDuration("WS_PONG_TIMEOUT", wsPongWait)
+    wsPingInterval = envDuration("WS_PING_INTERVAL", wsPingInterval)
+    wsWriteWait = envDuration("WS_WRITE_TIMEOUT", wsWriteWait)
+    wsMaxMessageSize = int64(envInt("WS_MAX_MESSAGE_BYTES", int(wsMaxMessageSize)))
+    if wsPingInterval >= wsPongWait {
+        wsPingInterval = wsPongWait * 9 / 10
+        log.Printf("⚠️ WS_PING_INTERVAL must be below WS_PONG_TIMEOUT, using %s", wsPingInterval)
+    }
+}
+
+// Client is one WebSocket connection. writePump is its only writer: the hub
+// feeds it through send, and the connection's own goroutines (acks,
+// history, errors) through out. Only the hub closes send, via removeClient.
 type Client struct {
-    conn     *websocket.Conn
-    send     chan []byte
-    hub      *Hub
-    username string
-    room     string
-    status   string // online, away, busy
-    lastSeen time.Time
+    conn       *websocket.Conn
+    send       *sendQueue    // fan-out from the hub; closed by the hub
+    out        chan []byte   // frames for this client only; never closed
+    done       chan struct{} // closed when writePump exits
+    closeMsg   []byte        // close frame payload, set by the hub before closing send
+    hub        *Hub
+    username   string
+    room       string          // room named in the /ws URL, joined on register
+    rooms      map[string]bool // subscriptions as readPump sees them; readPump only
+    joined     map[string]bool // rooms the hub has added this client to; hub only
+    sessionID  string
+    apiKey     *apiKey       // set for bot connections
+    protocol   string        // negotiated subprotocol, "" for legacy clients
+    presence   *userPresence // stored presence at connect time, handed to the hub
+    lastSeen   atomic.Int64  // unix seconds of the last frame or pong
+    lastActive atomic.Int64  // unix seconds of the last frame; drives auto-away
+}
+
+// touch records activity; readPump calls it while the hub reads lastSeen.
+func (c *Client) touch() {
+    c.lastSeen.Store(time.Now().Unix())
+}
+
+// queue hands a frame for this client alone to the writer goroutine. It
+// reports false once the writer has exited.
+func (c *Client) queue(msg []byte) bool {
+    select {
+    case c.out <- msg:
+        return true
+    case <-c.done:
+        return false
+    }
+}
+
+// sendError reports a problem with the frame carrying requestID.
+func (c *Client) sendError(requestID, code, message string) {
+    c.sendErrorEvent(ErrorEvent{Code: code, Error: message, RequestID: requestID})
+}
+
+func (c *Client) sendErrorEvent(e ErrorEvent) {
+    e.Type = "error"
+    if b, err := json.Marshal(e); err == nil {
+        c.queue(b)
+    }
 }
 
 type Hub struct {
     clients    map[*Client]bool
-    rooms      map[string]map[*Client]bool
+    rooms      map[string]map[*Client]bool // subscribers per room
     register   chan *Client
     unregister chan *Client
     broadcast  chan Broadcast
+
+    subscriptions chan subscription
+    revoke     chan string // session ID whose connections must be closed
+    kick       chan string // username whose connections must be closed
+
+    profileUpdates chan profileUpdate // profile_updated frames, see fanOutToPeers
+
+    presenceUpdates chan presenceUpdate
+    presence        map[string]*userPresence            // chosen presence of connected users
+    userClients     map[string]map[*Client]bool         // open sockets per user
+    shown           map[string]map[string]presenceEntry // per room, what members were last told about each user
+    presenceDirty   map[roomUser]bool                   // entries to re-evaluate, see flushPresence
+
+    stats chan chan []queueStats // connectionStats requests
+
+    backplane    Backplane
+    remote       chan backplaneMessage                          // from other nodes, see receiveRemote
+    nodesSeen    map[string]time.Time                           // other nodes by when they were last heard
+    shared       map[string]map[string]presenceEntry            // per room, this node's part of each entry as last published
+    remoteShares map[string]map[string]map[string]presenceEntry // per room and user, the other nodes' parts by node
 }
 
 type Broadcast struct {
-    sender  *Client
+    sender  *Client // skipped when fanning out to room
+    room    string  // target room
+    user    string  // target every connection of this user instead of a room
+    key     string  // coalescing key for typing frames, see sendQueue
+    seq     int64   // room event sequence number, 0 for other frames
+    relayed bool    // already sent to the other nodes
     message []byte
 }
 
@@ -139,165 +306,278 @@ type Message struct {
     FileType  string             `json:"fileType,omitempty"`
     FileName  string             `json:"fileName,omitempty"`
     Room      string             `json:"room,omitempty"`
+    Bot       bool               `json:"bot,omitempty"`
+
+    at time.Time // stored timestamp, for history cursors
 }
 
-func newHub() *Hub {
+func newHub(bp Backplane) *Hub {
     return &Hub{
         clients:    make(map[*Client]bool),
         rooms:      make(map[string]map[*Client]bool),
         register:   make(chan *Client),
         unregister: make(chan *Client),
         broadcast:  make(chan Broadcast),
-    }
-}
+        revoke:     make(chan string),
+        kick:       make(chan string),
 
-func (h *Hub) broadcastUserList() {
-    // Broadcast user list per room
-    for room, roomClients := range h.rooms {
-        users := make([]map[string]interface{}, 0, len(roomClients))
-        for client := range roomClients {
-            users = append(users, map[string]interface{}{
-                "username": client.username,
-                "status":   client.status,
-                "lastSeen": client.lastSeen.Unix(),
-            })
-        }
-        
-        payload := struct {
-            Type  string                   `json:"type"`
-            Users []map[string]interface{} `json:"users"`
-            Room  string                   `json:"room"`
-        }{Type: "users", Users: users, Room: room}
-        
-        if b, err := json.Marshal(payload); err == nil {
-            for client := range roomClients {
-                select {
-                case client.send <- b:
-                default:
-                    close(client.send)
-                    delete(h.clients, client)
-                    delete(roomClients, client)
-                }
-            }
-        }
+        profileUpdates: make(chan profileUpdate),
+
+        subscriptions: make(chan subscription),
+
+        presenceUpdates: make(chan presenceUpdate),
+        presence:        make(map[string]*userPresence),
+        userClients:     make(map[string]map[*Client]bool),
+        shown:           make(map[string]map[string]presenceEntry),
+        presenceDirty:   make(map[roomUser]bool),
+
+        stats: make(chan chan []queueStats),
+
+        backplane:    bp,
+        remote:       make(chan backplaneMessage),
+        nodesSeen:    make(map[string]time.Time),
+        shared:       make(map[string]map[string]presenceEntry),
+        remoteShares: make(map[string]map[string]map[string]presenceEntry),
     }
 }
 
 func (h *Hub) run() {
+    sweep := time.NewTicker(presenceSweepInterval)
+    defer sweep.Stop()
+    h.backplane.Subscribe(h.receiveRemote, h.rejoinBackplane)
     for {
         select {
         case client := <-h.register:
             h.clients[client] = true
-            
-            // Add to room
-            if h.rooms[client.room] == nil {
-                h.rooms[client.room] = make(map[*Client]bool)
+            if h.userClients[client.username] == nil {
+                h.userClients[client.username] = make(map[*Client]bool)
+                h.presence[client.username] = client.presence
             }
-            h.rooms[client.room][client] = true
+            h.userClients[client.username][client] = true
             
             log.Println("✅ Client connected:", client.username, "in room:", client.room)
-            h.broadcastUserList()
         case client := <-h.unregister:
-            if _, ok := h.clients[client]; ok {
-                delete(h.clients, client)
-                
-                // Remove from room
-                if roomClients, exists := h.rooms[client.room]; exists {
-                    delete(roomClients, client)
-                    if len(roomClients) == 0 {
-                        delete(h.rooms, client.room)
-                    }
-                }
-                
-                close(client.send)
+            if h.removeClient(client, websocket.CloseNormalClosure, "") {
                 log.Println("❌ Client disconnected:", client.username, "from room:", client.room)
-                h.broadcastUserList()
             }
-        case b := <-h.broadcast:
-            // Broadcast only to clients in the same room
-            if b.sender != nil {
-                if roomClients, exists := h.rooms[b.sender.room]; exists {
-                    for client := range roomClients {
-                        if client == b.sender {
-                            continue
-                        }
-                        select {
-                        case client.send <- b.message:
-                        default:
-                            close(client.send)
-                            delete(h.clients, client)
-                            delete(roomClients, client)
-                        }
-                    }
-                }
+        case sessionID := <-h.revoke:
+            // Close every connection opened with a revoked session
+            h.dropClients(func(c *Client) bool { return c.sessionID == sessionID })
+            h.backplane.Publish(backplaneMessage{Kind: bpRevoke, Session: sessionID})
+        case username := <-h.kick:
+            // Close every connection of a deleted or suspended user, including bot API-key sockets
+            h.dropClients(func(c *Client) bool { return c.username == username })
+            h.backplane.Publish(backplaneMessage{Kind: bpKick, User: username})
+        case u := <-h.profileUpdates:
+            // Other nodes also drop their cached copy of the profile
+            h.fanOutToPeers(u.username, u.message)
+            h.backplane.Publish(backplaneMessage{Kind: bpProfile, User: u.username, Payload: u.message})
+        case m := <-h.remote:
+            h.handleRemote(m)
+        case s := <-h.subscriptions:
+            if s.join {
+                h.joinRoom(s.client, s.room)
             } else {
-                // Global broadcast (for system messages)
-                for client := range h.clients {
-                    select {
-                    case client.send <- b.message:
-                    default:
-                        close(client.send)
-                        delete(h.clients, client)
-                    }
-                }
+                h.leaveRoom(s.client, s.room)
+            }
+        case u := <-h.presenceUpdates:
+            if u.state != nil {
+                h.backplane.Publish(backplaneMessage{Kind: bpStatus, User: u.username, State: u.state})
             }
+            if _, online := h.userClients[u.username]; !online {
+                break
+            }
+            if u.state != nil {
+                h.presence[u.username] = u.state
+            }
+            h.markPresence(u.username)
+        case <-sweep.C:
+            h.sweepPresence()
+            h.expireNodes(time.Now())
+        case reply := <-h.stats:
+            stats := make([]queueStats, 0, len(h.clients))
+            for client := range h.clients {
+                s := client.send.stats()
+                s.Username, s.Rooms = client.username, len(client.joined)
+                stats = append(stats, s)
+            }
+            reply <- stats
+        case b := <-h.broadcast:
+            h.fanOut(b)
+            if !b.relayed {
+                h.backplane.Publish(backplaneMessage{Kind: bpBroadcast, Room: b.room, User: b.user, Key: b.key, Seq: b.seq, Payload: b.message})
+            }
+        }
+        // Disconnects above (slow consumers, revokes) leave entries to announce
+        h.flushPresence()
+    }
+}
+
+// fanOut delivers b to the clients on this node. Only call from run().
+func (h *Hub) fanOut(b Broadcast) {
+    // Broadcast only to clients subscribed to the room
+    if b.room != "" {
+        for client := range h.rooms[b.room] {
+            if client == b.sender {
+                continue
+            }
+            h.deliver(client, b.message, b.key)
+        }
+    } else if b.user != "" {
+        for client := range h.clients {
+            if client.username != b.user {
+                continue
+            }
+            h.deliver(client, b.message, b.key)
+        }
+    } else {
+        // Global broadcast (for system messages)
+        for client := range h.clients {
+            h.deliver(client, b.message, b.key)
         }
     }
 }
 
+// fanOutToPeers delivers msg to username's own connections and to everyone
+// in a room with them, as far as this node's roster knows. Only call from run().
+func (h *Hub) fanOutToPeers(username string, msg []byte) {
+    rooms := make(map[string]bool)
+    for client := range h.userClients[username] {
+        for room := range client.joined {
+            rooms[room] = true
+        }
+    }
+    for room, users := range h.remoteShares {
+        if len(users[username]) > 0 {
+            rooms[room] = true
+        }
+    }
+    sent := make(map[*Client]bool)
+    for client := range h.userClients[username] {
+        sent[client] = true
+        h.deliver(client, msg, "")
+    }
+    for room := range rooms {
+        for client := range h.rooms[room] {
+            if sent[client] {
+                continue
+            }
+            sent[client] = true
+            h.deliver(client, msg, "")
+        }
+    }
+}
+
+// dropClients disconnects every client matching match. Only call from run().
+func (h *Hub) dropClients(match func(*Client) bool) bool {
+    dropped := false
+    for client := range h.clients {
+        if !match(client) {
+            continue
+        }
+        h.removeClient(client, websocket.ClosePolicyViolation, "access revoked")
+        dropped = true
+        log.Println("🔒 Access revoked, disconnecting:", client.username, "from room:", client.room)
+    }
+    return dropped
+}
+
+// deliver queues msg for client under the slow-consumer policy and
+// disconnects the client if it does not fit. key is msg's coalescing key.
+func (h *Hub) deliver(client *Client, msg []byte, key string) {
+    if client.send.push(msg, key) {
+        return
+    }
+    slowDisconnects.Add(1)
+    log.Printf("🐢 Send queue full (%d frames), disconnecting: %s", sendQueueSize, client.username)
+    h.removeClient(client, websocket.CloseTryAgainLater, "send queue full")
+}
+
+// removeClient detaches client and closes its send queue, which makes
+// writePump send the close frame and shut the connection. This is the only
+// place send is closed; it must run on the hub goroutine and is a no-op for
+// clients that are already gone.
+func (h *Hub) removeClient(client *Client, code int, reason string) bool {
+    if _, ok := h.clients[client]; !ok {
+        return false
+    }
+    delete(h.clients, client)
+    for room := range client.joined {
+        if roomClients, exists := h.rooms[room]; exists {
+            delete(roomClients, client)
+            if len(roomClients) == 0 {
+                delete(h.rooms, room)
+            }
+        }
+        h.presenceDirty[roomUser{room, client.username}] = true
+    }
+    client.joined = nil
+    if userClients := h.userClients[client.username]; userClients != nil {
+        delete(userClients, client)
+        if len(userClients) == 0 {
+            delete(h.userClients, client.username)
+            delete(h.presence, client.username)
+        }
+    }
+    client.closeMsg = websocket.FormatCloseMessage(code, reason)
+    client.send.close()
+    return true
+}
+
 // -------------------- Message Store Helpers --------------------
 
-func saveMessage(m Message) int64 {
+// saveMessage stores m and returns its ID once the write has succeeded. With
+// a key it stores nothing if its author already sent that key within
+// idempotencyWindow, and returns the original's receipt instead.
+func saveMessage(m Message, key string) (sendReceipt, error) {
     if useDB {
         ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
         defer cancel()
-        id, err := dbSaveMessage(ctx, m)
-        if err != nil {
-            log.Println("db save error:", err)
+        if key != "" {
+            return dbSaveKeyedMessage(ctx, m, key)
         }
-        return id
+        id, err := dbSaveMessage(ctx, m)
+        return sendReceipt{ID: id}, err
     }
     messagesMu.Lock()
     defer messagesMu.Unlock()
+    m.at = time.Now()
+    if key != "" {
+        memExpireSentKeys(m.at)
+        if e, ok := sentKeys[sentKey{m.Username, key}]; ok {
+            rc := e.sendReceipt
+            rc.Duplicate = true
+            return rc, nil
+        }
+    }
     m.ID = nextMessageID
     nextMessageID++
     messagesList = append(messagesList, m)
-    return m.ID
+    if key != "" {
+        k := sentKey{m.Username, key}
+        sentKeys[k] = &sentEntry{sendReceipt: sendReceipt{ID: m.ID}, at: m.at}
+        sentKeyOrder = append(sentKeyOrder, k)
+    }
+    return sendReceipt{ID: m.ID}, nil
 }
 
-func loadRecentMessages(limit int, room string) []Message {
+var errMessageNotFound = errors.New("message not found")
+
+func getMessage(id int64) (*Message, error) {
     if useDB {
-        ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+        ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
         defer cancel()
-        msgs, err := dbLoadRecentMessages(ctx, limit, room)
-        if err != nil {
-            log.Println("db load history error:", err)
-            return nil
-        }
-        return msgs
+        return dbGetMessage(ctx, id)
     }
     messagesMu.RLock()
     defer messagesMu.RUnlock()
-    
-    // Filter messages by room
-    roomMessages := make([]Message, 0)
-    for _, msg := range messagesList {
-        if msg.Room == room {
-            roomMessages = append(roomMessages, msg)
+    for i := range messagesList {
+        if messagesList[i].ID == id {
+            m := messagesList[i]
+            return &m, nil
         }
     }
-    
-    if limit <= 0 || limit > len(roomMessages) {
-        limit = len(roomMessages)
-    }
-    start := len(roomMessages) - limit
-    if start < 0 {
-        start = 0
-    }
-    
-    out := make([]Message, limit)
-    copy(out, roomMessages[start:])
-    return out
+    return nil, errMessageNotFound
 }
 
 func editMessageText(id int64, text string) bool {
@@ -342,7 +622,18 @@ func deleteMessageByID(id int64) bool {
     return false
 }
 
+// toggleReaction adds username's emoji reaction to a message, or removes it
+// if already there. It reports false if the message does not exist.
 func toggleReaction(messageID int64, emoji, username string) bool {
+    if useDB {
+        ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        defer cancel()
+        if err := dbToggleReaction(ctx, messageID, emoji, username); err != nil {
+            log.Println("db reaction error:", err)
+            return false
+        }
+        return true
+    }
     messagesMu.Lock()
     defer messagesMu.Unlock()
     
@@ -385,11 +676,18 @@ func getTimestamp(tz string) string {
     return time.Now().In(loc).Format("2006-01-02 15:04:05 MST")
 }
 
+// readPump never writes to the connection and leaves closing it to
+// writePump once the hub has processed the unregister.
 func (c *Client) readPump() {
     defer func() {
         c.hub.unregister <- c
-        c.conn.Close()
     }()
+    c.conn.SetReadLimit(wsMaxMessageSize)
+    c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+    c.conn.SetPongHandler(func(string) error {
+        c.touch()
+        return c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+    })
     for {
         _, raw, err := c.conn.ReadMessage()
         if err != nil {
@@ -398,133 +696,293 @@ func (c *Client) readPump() {
         }
             break
         }
+        c.touch()
+        c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+        active := time.Now().Unix()
+        if prev := c.lastActive.Swap(active); presenceIdleTimeout > 0 && time.Duration(active-prev)*time.Second >= presenceIdleTimeout {
+            // Back from auto-away
+            c.hub.presenceUpdates <- presenceUpdate{username: c.username}
+        }
 
-        var inc struct {
-            Type      string `json:"type,omitempty"`
-            Text      string `json:"text"`
-            Timezone  string `json:"timezone,omitempty"`
-            ClientID  int64  `json:"clientId,omitempty"`
-            Username  string `json:"username,omitempty"`
-            IsTyping  bool   `json:"isTyping,omitempty"`
-            MessageID int64  `json:"messageId,omitempty"`
-            Emoji     string `json:"emoji,omitempty"`
-            FileURL   string `json:"fileUrl,omitempty"`
-            FileType  string `json:"fileType,omitempty"`
-            FileName  string `json:"fileName,omitempty"`
-        }
-        if err := json.Unmarshal(raw, &inc); err != nil {
-            log.Println("unmarshal error:", err)
-            continue
+        c.handleFrame(raw)
+    }
+}
+
+// handleFrame decodes one client frame and dispatches it by type. Anything
+// that cannot be acted on is answered with an error frame.
+func (c *Client) handleFrame(raw []byte) {
+    var env ClientEnvelope
+    if err := json.Unmarshal(raw, &env); err != nil {
+        log.Println("unmarshal error:", err)
+        c.sendError("", codeInvalidJSON, "Frame is not valid JSON")
+        return
+    }
+    if len(env.ID) > maxRequestIDLen {
+        c.sendError("", codeInvalidRequest, "Request id is too long")
+        return
+    }
+    if c.protocol != "" && env.ID == "" {
+        c.sendError("", codeInvalidRequest, "Frame needs an id")
+        return
+    }
+    if env.Type == "" && c.protocol == "" {
+        env.Type = "message" // legacy clients send chat messages untyped
+    }
+
+    switch env.Type {
+    case "status":
+        var f StatusFrame
+        if c.decodeFrame(raw, env.ID, &f) {
+            c.handleStatus(f)
         }
-        // Handle typing indicator
-        if inc.Type == "typing" {
-            typingPayload := struct {
-                Type     string `json:"type"`
-                Username string `json:"username"`
-                IsTyping bool   `json:"isTyping"`
-            }{Type: "typing", Username: c.username, IsTyping: inc.IsTyping}
-            
-            if b, err := json.Marshal(typingPayload); err == nil {
-                c.hub.broadcast <- Broadcast{sender: c, message: b}
-            }
-            continue
+    case "subscribe", "unsubscribe":
+        var f SubscriptionFrame
+        if !c.decodeFrame(raw, env.ID, &f) {
+            return
         }
-        
-        // Handle reaction
-        if inc.Type == "reaction" && inc.MessageID > 0 && inc.Emoji != "" {
-            if toggleReaction(inc.MessageID, inc.Emoji, c.username) {
-                reactionPayload := struct {
-                    Type      string `json:"type"`
-                    MessageID int64  `json:"messageId"`
-                    Emoji     string `json:"emoji"`
-                    Username  string `json:"username"`
-                }{Type: "reaction", MessageID: inc.MessageID, Emoji: inc.Emoji, Username: c.username}
-                
-                if b, err := json.Marshal(reactionPayload); err == nil {
-                    c.hub.broadcast <- Broadcast{sender: nil, message: b}
-                }
-            }
-            continue
+        if env.Type == "subscribe" {
+            c.subscribe(env.ID, f.Room, f.Since)
+        } else {
+            c.unsubscribe(env.ID, f.Room)
         }
-        
-        if inc.Text == "" && inc.FileURL == "" {
-            continue
+    case "history_request":
+        var f HistoryRequestFrame
+        if c.decodeFrame(raw, env.ID, &f) {
+            c.handleHistoryRequest(f)
         }
-
-        // Rate limiting: max 10 messages per minute
-        rateLimitMu.Lock()
-        now := time.Now()
-        userTimes := rateLimitMap[c.username]
-        // Remove times older than 1 minute
-        var recentTimes []time.Time
-        for _, t := range userTimes {
-            if now.Sub(t) < time.Minute {
-                recentTimes = append(recentTimes, t)
-            }
+    case "typing":
+        var f TypingFrame
+        if c.decodeFrame(raw, env.ID, &f) {
+            c.handleTyping(f)
         }
-        if len(recentTimes) >= 10 {
-            rateLimitMu.Unlock()
-            continue // Skip message if rate limited
+    case "reaction":
+        var f ReactionFrame
+        if c.decodeFrame(raw, env.ID, &f) {
+            c.handleReaction(f)
         }
-        recentTimes = append(recentTimes, now)
-        rateLimitMap[c.username] = recentTimes
-        rateLimitMu.Unlock()
+    case "message":
+        var f SendMessageFrame
+        if c.decodeFrame(raw, env.ID, &f) {
+            c.handleMessage(f)
+        }
+    default:
+        c.sendError(env.ID, codeUnknownType, "Unknown frame type")
+    }
+}
 
-        ts := getTimestamp(inc.Timezone)
-        out := Message{
-            Username:  c.username,
-            Text:      inc.Text,
-            Timestamp: ts,
-            Reactions: make(map[string][]string),
-            FileURL:   inc.FileURL,
-            FileType:  inc.FileType,
-            FileName:  inc.FileName,
-            Room:      c.room,
-        }
-
-        id := saveMessage(out)
-        out.ID = id
-
-        // send ack back to sender with mapping clientId -> id
-        if inc.ClientID > 0 {
-            ack := struct {
-                Type     string `json:"type"`
-                ClientID int64  `json:"clientId"`
-                ID       int64  `json:"id"`
-            }{Type: "ack", ClientID: inc.ClientID, ID: id}
-            if b, err := json.Marshal(ack); err == nil {
-                _ = c.conn.WriteMessage(websocket.TextMessage, b)
-            }
+// decodeFrame unmarshals raw into the frame type chosen by handleFrame.
+func (c *Client) decodeFrame(raw []byte, requestID string, v any) bool {
+    if err := json.Unmarshal(raw, v); err != nil {
+        c.sendError(requestID, codeInvalidRequest, "Frame fields have the wrong types")
+        return false
+    }
+    return true
+}
+
+func (c *Client) handleTyping(f TypingFrame) {
+    room, ok := c.targetRoom(f.ID, f.Room)
+    if !ok {
+        return
+    }
+    if b, err := json.Marshal(TypingEvent{Type: "typing", Username: c.username, IsTyping: f.IsTyping, Room: room}); err == nil {
+        c.hub.broadcast <- Broadcast{sender: c, room: room, key: "typing:" + room + ":" + c.username, message: b}
+    }
+}
+
+func (c *Client) handleReaction(f ReactionFrame) {
+    if f.MessageID <= 0 || f.Emoji == "" {
+        c.sendError(f.ID, codeInvalidRequest, "Reaction needs messageId and emoji")
+        return
+    }
+    room, ok := c.targetRoom(f.ID, f.Room)
+    if !ok {
+        return
+    }
+    // Bots need messages:write for anything that changes the room
+    if c.apiKey != nil && !c.apiKey.hasScope(scopeMessagesWrite) {
+        c.sendError(f.ID, codeForbidden, "API key lacks the messages:write scope")
+        return
+    }
+    if msg, err := getMessage(f.MessageID); err != nil || msg.Room != room {
+        c.sendError(f.ID, codeNotFound, "Message not found in this room")
+        return
+    }
+    if !toggleReaction(f.MessageID, f.Emoji, c.username) {
+        c.sendError(f.ID, codeNotFound, "Message not found in this room")
+        return
+    }
+    publishRoomEvent(c.hub, room, nil, ReactionEvent{Type: "reaction", MessageID: f.MessageID, Emoji: f.Emoji, Username: c.username, Room: room})
+}
+
+func (c *Client) handleMessage(f SendMessageFrame) {
+    if f.Text == "" && f.FileURL == "" {
+        c.sendError(f.ID, codeInvalidRequest, "Message needs text or a file")
+        return
+    }
+    if utf8.RuneCountInString(f.Text) > maxMessageTextLen {
+        c.sendError(f.ID, codeTooLarge, fmt.Sprintf("Message is longer than %d characters", maxMessageTextLen))
+        return
+    }
+    if len(f.IdempotencyKey) > maxIdempotencyKeyLen {
+        c.sendError(f.ID, codeInvalidRequest, "Idempotency key is too long")
+        return
+    }
+    room, ok := c.targetRoom(f.ID, f.Room)
+    if !ok {
+        return
+    }
+    if c.apiKey != nil && !c.apiKey.hasScope(scopeMessagesWrite) {
+        c.sendError(f.ID, codeForbidden, "API key lacks the messages:write scope")
+        return
+    }
+
+    // Rate limiting: max 10 messages per minute
+    rateLimitMu.Lock()
+    now := time.Now()
+    userTimes := rateLimitMap[c.username]
+    // Remove times older than 1 minute
+    var recentTimes []time.Time
+    for _, t := range userTimes {
+        if now.Sub(t) < time.Minute {
+            recentTimes = append(recentTimes, t)
         }
+    }
+    if len(recentTimes) >= 10 {
+        rateLimitMu.Unlock()
+        // The oldest message in the window is the next to age out
+        retry := int(math.Ceil(recentTimes[0].Add(time.Minute).Sub(now).Seconds()))
+        c.sendErrorEvent(ErrorEvent{Code: codeRateLimited, Error: "Too many messages, slow down", RequestID: f.ID, RetryAfter: max(retry, 1)})
+        return
+    }
+    recentTimes = append(recentTimes, now)
+    rateLimitMap[c.username] = recentTimes
+    rateLimitMu.Unlock()
+
+    ts := getTimestamp(userTimezone(c.username))
+    out := Message{
+        Username:  c.username,
+        Text:      f.Text,
+        Timestamp: ts,
+        Reactions: make(map[string][]string),
+        FileURL:   f.FileURL,
+        FileType:  f.FileType,
+        FileName:  f.FileName,
+        Room:      room,
+        Bot:       c.apiKey != nil,
+    }
+
+    rc, err := saveMessage(out, f.IdempotencyKey)
+    if err != nil {
+        log.Println("db save error:", err)
+        c.sendError(f.ID, codeServerError, "Message could not be saved")
+        return
+    }
+
+    if !rc.Duplicate {
+        out.ID = rc.ID
 
         // Stop typing indicator when message is sent
-        typingPayload := struct {
-            Type     string `json:"type"`
-            Username string `json:"username"`
-            IsTyping bool   `json:"isTyping"`
-        }{Type: "typing", Username: c.username, IsTyping: false}
-        
-        if b, err := json.Marshal(typingPayload); err == nil {
-            c.hub.broadcast <- Broadcast{sender: c, message: b}
+        if b, err := json.Marshal(TypingEvent{Type: "typing", Username: c.username, IsTyping: false, Room: room}); err == nil {
+            c.hub.broadcast <- Broadcast{sender: c, room: room, key: "typing:" + room + ":" + c.username, message: b}
+        }
+
+        rc.Seq = publishRoomEvent(c.hub, room, c, MessageEvent{Type: "message", Message: out})
+        recordSendSeq(c.username, f.IdempotencyKey, rc.Seq)
+    }
+
+    // send ack back to sender with mapping clientId/requestId -> id
+    if f.ClientID > 0 || f.ID != "" || f.IdempotencyKey != "" {
+        if b, err := json.Marshal(AckEvent{Type: "ack", RequestID: f.ID, ClientID: f.ClientID, ID: rc.ID, Seq: rc.Seq, Duplicate: rc.Duplicate}); err == nil {
+            c.queue(b)
         }
-        
-        outBytes, _ := json.Marshal(out)
-        c.hub.broadcast <- Broadcast{sender: c, message: outBytes}
     }
 }
 
+// writePump is the connection's single writer. It exits when the hub closes
+// send (after writing the close frame) or on the first write error.
 func (c *Client) writePump() {
-    defer c.conn.Close()
-    for msg := range c.send {
-        if err := c.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
-            if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-            log.Printf("websocket write error: %s", err.Error())
+    ticker := time.NewTicker(wsPingInterval)
+    defer func() {
+        ticker.Stop()
+        close(c.done)
+        c.conn.Close()
+    }()
+    for {
+        // Frames for this client alone go first so history precedes live traffic.
+        select {
+        case msg := <-c.out:
+            if !c.write(msg) {
+                return
+            }
+            continue
+        default:
         }
-            break
+        select {
+        case msg := <-c.out:
+            if !c.write(msg) {
+                return
+            }
+        case <-c.send.ready:
+            msg, ok, closed := c.send.pop()
+            if closed {
+                // Hub removed us; closeMsg was set before the queue closed
+                c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+                c.conn.WriteMessage(websocket.CloseMessage, c.closeMsg)
+                return
+            }
+            if ok && !c.write(msg) {
+                return
+            }
+        case <-ticker.C:
+            c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+            if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+                return
+            }
         }
     }
 }
 
+func (c *Client) write(msg []byte) bool {
+    c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+    if err := c.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+        if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+        log.Printf("websocket write error: %s", err.Error())
+    }
+        return false
+    }
+    return true
+}
+
+// wsHandler serves GET /ws: it checks the requested room and upgrades.
+func wsHandler(hub *Hub, w http.ResponseWriter, r *http.Request) {
+    username := authUsername(r)
+    room := r.URL.Query().Get("room")
+    if q := r.URL.Query().Get("username"); q != "" && !strings.EqualFold(q, username) {
+        http.Error(w, "Forbidden", http.StatusForbidden)
+        return
+    }
+    if room == "" {
+        room = "general" // Default room
+    }
+    if !requireScope(w, r, scopeRoomsRead) {
+        return
+    }
+    if !roomAllowed(r, room) {
+        http.Error(w, "Forbidden", http.StatusForbidden)
+        return
+    }
+    if err := checkRoomAccess(username, room); err != nil {
+        writeRoomAccessError(w, err)
+        return
+    }
+    if !offersSupportedProtocol(r) {
+        http.Error(w, "Unsupported WebSocket protocol, expected one of: "+strings.Join(wsProtocols, ", "), http.StatusBadRequest)
+        return
+    }
+    
+    serveWs(hub, username, room, w, r)
+}
+
 func serveWs(h *Hub, username, room string, w http.ResponseWriter, r *http.Request) {
     conn, err := upgrader.Upgrade(w, r, nil)
     if err != nil {
@@ -533,34 +991,53 @@ func serveWs(h *Hub, username, room string, w http.ResponseWriter, r *http.Reque
     }
     client := &Client{
         conn:     conn,
-        send:     make(chan []byte, 256),
+        send:     newSendQueue(),
+        out:      make(chan []byte, 16),
+        done:     make(chan struct{}),
         hub:      h,
         username: username,
         room:     room,
-        status:   "online",
-        lastSeen: time.Now(),
-    }
+        rooms:    make(map[string]bool),
+        joined:   make(map[string]bool),
+    }
+    client.touch()
+    client.lastActive.Store(client.lastSeen.Load())
+    if p, err := getPresence(username); err != nil {
+        log.Println("load presence error:", err)
+    } else {
+        client.presence = p
+    }
+    if claims := authClaims(r); claims != nil {
+        client.sessionID = claims.SessionID
+    }
+    client.apiKey = authAPIKey(r)
+    client.protocol = conn.Subprotocol()
+
+    // The writer starts first so a replay can drain while rooms attach.
+    // Each room's history or replay is queued before the hub adds the
+    // client to it, so it is written ahead of any broadcast; joining also
+    // sends the room's user list.
+    go client.writePump()
     h.register <- client
-
-    history := loadRecentMessages(200, room)
-    if len(history) > 0 {
-        payload := struct {
-            Type     string    `json:"type"`
-            Messages []Message `json:"messages"`
-        }{Type: "history", Messages: history}
-        if b, err := json.Marshal(payload); err == nil {
-            conn.WriteMessage(websocket.TextMessage, b)
+    for _, p := range resumePoints(r, room) {
+        if len(client.rooms) >= maxRoomSubscriptions {
+            client.sendError("", codeTooManySubscriptions, "Too many rooms to resume")
+            break
         }
+        if client.apiKey != nil && !client.apiKey.allowsRoom(p.room) {
+            client.sendError("", codeForbidden, "Not allowed in room "+p.room)
+            continue
+        }
+        // The /ws room was checked before the upgrade
+        if p.room != room && checkRoomAccess(username, p.room) != nil {
+            client.sendError("", codeForbidden, "Cannot resume room "+p.room)
+            continue
+        }
+        client.rooms[p.room] = true
+        client.attach(p.room, p.since)
     }
-    
-    // Send initial user list after registration
-    go func() {
-        time.Sleep(100 * time.Millisecond) // Small delay to ensure client is registered
-        h.broadcastUserList()
-    }()
 
     go client.readPump()
-    go client.writePump()
 }
 
 // -------------------- Authentication --------------------
@@ -568,6 +1045,7 @@ func serveWs(h *Hub, username, room string, w http.ResponseWriter, r *http.Reque
 type User struct {
     Username string `json:"username"`
     Password string `json:"password"`
+    Email    string `json:"email,omitempty"`
 }
 
 type Room struct {
@@ -605,29 +1083,58 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
         http.Error(w, "Username and password required", http.StatusBadRequest)
         return
     }
+    name, err := normalizeUsername(u.Username)
+    if err != nil {
+        http.Error(w, "Invalid username: "+err.Error(), http.StatusBadRequest)
+        return
+    }
+    u.Username = name
 
-    // create user with faster bcrypt cost
-    hash, _ := bcrypt.GenerateFromPassword([]byte(u.Password), bcrypt.MinCost)
-    if useDB {
-        if err := dbRegisterUser(context.Background(), u.Username, hash); err != nil {
-            http.Error(w, "Username may already exist", http.StatusBadRequest)
+    if err := validateNewPassword(u.Username, u.Password); err != nil {
+        http.Error(w, passwordPolicyMessage(err), http.StatusBadRequest)
+        return
+    }
+    if u.Email != "" {
+        addr, err := mail.ParseAddress(u.Email)
+        if err != nil || addr.Name != "" {
+            http.Error(w, "Invalid email address", http.StatusBadRequest)
             return
         }
-        w.WriteHeader(http.StatusOK)
-        w.Write([]byte("Registration successful"))
+        u.Email = addr.Address
+    }
+
+    hash, err := hashPassword(u.Password)
+    if err != nil {
+        log.Println("password hash error:", err)
+        http.Error(w, "Server error", http.StatusInternalServerError)
         return
     }
-    usersMu.Lock()
-    defer usersMu.Unlock()
-    if _, exists := usersMap[u.Username]; exists {
+    if err := createUser(u.Username, u.Email, hash); err != nil {
         http.Error(w, "Username may already exist", http.StatusBadRequest)
         return
     }
-    usersMap[u.Username] = &storedUser{Username: u.Username, PasswordHash: hash}
+    if strings.EqualFold(u.Username, strings.TrimSpace(os.Getenv("BOOTSTRAP_ADMIN"))) {
+        bootstrapAdmin(r.Context())
+    }
     w.WriteHeader(http.StatusOK)
     w.Write([]byte("Registration successful"))
 }
 
+// createUser stores a new account in either backend. It fails if the
+// username is taken in any letter case.
+func createUser(username, email string, hash []byte) error {
+    if useDB {
+        return dbRegisterUser(context.Background(), username, email, hash)
+    }
+    usersMu.Lock()
+    defer usersMu.Unlock()
+    if usernameTakenLocked(username) {
+        return fmt.Errorf("username may already exist")
+    }
+    usersMap[username] = &storedUser{Username: username, PasswordHash: hash, Email: email, Role: roleMember, CreatedAt: time.Now()}
+    return nil
+}
+
 func loginHandler(w http.ResponseWriter, r *http.Request) {
     if r.Method != http.MethodPost {
         http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -638,77 +1145,78 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
         http.Error(w, "Invalid JSON", http.StatusBadRequest)
         return
     }
-    if useDB {
-        hash, err := dbGetUserPasswordHash(context.Background(), u.Username)
-        if err != nil {
-            http.Error(w, "Invalid credentials", http.StatusUnauthorized)
-            return
-        }
-        if err := bcrypt.CompareHashAndPassword(hash, []byte(u.Password)); err != nil {
-            http.Error(w, "Invalid credentials", http.StatusUnauthorized)
-            return
-        }
-        resp := map[string]string{"username": u.Username}
-        w.Header().Set("Content-Type", "application/json")
-        json.NewEncoder(w).Encode(resp)
+    u.Username = loginUsername(u.Username)
+    userKey, ipKey := loginThrottleKeys(u.Username, r)
+    if wait := reserveAuthAttempt(userKey, ipKey); wait > 0 {
+        log.Printf("🚫 Blocked login attempt for %q from %s (retry in %s)", u.Username, clientIP(r), wait.Round(time.Second))
+        rejectThrottled(w, wait)
         return
     }
-    usersMu.RLock()
-    su, ok := usersMap[u.Username]
-    usersMu.RUnlock()
+    hash, err := getUserPasswordHash(u.Username)
+    if err != nil {
+        // Unknown users cost a verification too, so timing doesn't tell them apart
+        hash = dummyPasswordHash()
+    }
+    ok, needsRehash := verifyPassword(hash, u.Password)
+    if err != nil {
+        ok = false
+    }
     if !ok {
+        log.Printf("⚠️ Failed login for %q from %s", u.Username, clientIP(r))
         http.Error(w, "Invalid credentials", http.StatusUnauthorized)
         return
     }
-    if err := bcrypt.CompareHashAndPassword(su.PasswordHash, []byte(u.Password)); err != nil {
-        http.Error(w, "Invalid credentials", http.StatusUnauthorized)
-        return
+    authAttemptSucceeded(userKey, ipKey)
+    if needsRehash {
+        upgradePasswordHash(u.Username, u.Password)
     }
-    resp := map[string]string{"username": u.Username}
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(resp)
+    completeLogin(w, r, u.Username)
+}
+
+// getUserPasswordHash returns the stored hash for username from either backend.
+func getUserPasswordHash(username string) ([]byte, error) {
+    if useDB {
+        return dbGetUserPasswordHash(context.Background(), username)
+    }
+    usersMu.RLock()
+    defer usersMu.RUnlock()
+    su, ok := usersMap[username]
+    if !ok {
+        return nil, fmt.Errorf("not found")
+    }
+    return su.PasswordHash, nil
 }
 
 // -------------------- Dark Mode --------------------
 
+// getDarkModeHandler and setDarkModeHandler predate /account/settings and
+// now just read and patch its darkMode key.
 func getDarkModeHandler(w http.ResponseWriter, r *http.Request) {
     if r.Method != http.MethodGet {
         http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
         return
     }
-    username := r.URL.Query().Get("username")
-    if username == "" {
-        http.Error(w, "Username required", http.StatusBadRequest)
+    username := authUsername(r)
+    if q := r.URL.Query().Get("username"); q != "" && !strings.EqualFold(q, username) {
+        http.Error(w, "Forbidden", http.StatusForbidden)
         return
     }
-    if useDB {
-        dm, ok, err := dbGetDarkMode(context.Background(), username)
-        if err != nil {
-            http.Error(w, "Server error", http.StatusInternalServerError)
-            return
-        }
-        if !ok {
+    doc, _, err := getSettings(username)
+    if err != nil {
+        if errors.Is(err, errSettingsNotFound) {
             http.Error(w, "User not found", http.StatusNotFound)
             return
         }
-        resp := map[string]bool{"darkMode": dm}
-        w.Header().Set("Content-Type", "application/json")
-        json.NewEncoder(w).Encode(resp)
-        return
-    }
-    usersMu.RLock()
-    su, ok := usersMap[username]
-    usersMu.RUnlock()
-    if !ok {
-        http.Error(w, "User not found", http.StatusNotFound)
+        http.Error(w, "Server error", http.StatusInternalServerError)
         return
     }
-    resp := map[string]bool{"darkMode": su.DarkMode}
+    dm, _ := effectiveSettings(doc)["darkMode"].(bool)
+    resp := map[string]bool{"darkMode": dm}
     w.Header().Set("Content-Type", "application/json")
     json.NewEncoder(w).Encode(resp)
 }
 
-func setDarkModeHandler(w http.ResponseWriter, r *http.Request) {
+func setDarkModeHandler(hub *Hub, w http.ResponseWriter, r *http.Request) {
     if r.Method != http.MethodPost {
         http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
         return
@@ -721,35 +1229,130 @@ func setDarkModeHandler(w http.ResponseWriter, r *http.Request) {
         http.Error(w, "Invalid JSON", http.StatusBadRequest)
         return
     }
-    if useDB {
-        if err := dbSetDarkMode(context.Background(), payload.Username, payload.DarkMode); err != nil {
-            if strings.Contains(err.Error(), "not found") {
-                http.Error(w, "User not found", http.StatusNotFound)
-                return
-            }
-            http.Error(w, "Server error", http.StatusInternalServerError)
-            return
-        }
-        w.WriteHeader(http.StatusOK)
-        w.Write([]byte("Dark mode updated"))
+    username := authUsername(r)
+    if payload.Username != "" && !strings.EqualFold(payload.Username, username) {
+        http.Error(w, "Forbidden", http.StatusForbidden)
         return
     }
-    usersMu.Lock()
-    su, ok := usersMap[payload.Username]
-    if ok {
-        su.DarkMode = payload.DarkMode
-    }
-    usersMu.Unlock()
-    if !ok {
-        http.Error(w, "User not found", http.StatusNotFound)
+    doc, version, err := updateSettings(username, -1, func(cur map[string]any) (map[string]any, error) {
+        return mergePatch(cur, map[string]any{"darkMode": payload.DarkMode}), nil
+    })
+    if err != nil {
+        if errors.Is(err, errSettingsNotFound) {
+            http.Error(w, "User not found", http.StatusNotFound)
+            return
+        }
+        http.Error(w, "Server error", http.StatusInternalServerError)
         return
     }
+    publishSettings(hub, username, doc, version)
     w.WriteHeader(http.StatusOK)
     w.Write([]byte("Dark mode updated"))
 }
 
 // -------------------- Message Editing / Deletion --------------------
 
+// canModerateRoom reports whether username may act on other users' messages
+// in room: global moderators and admins, and the room's creator, can.
+func canModerateRoom(username, room string) bool {
+    if hasRole(username, roleModerator) {
+        return true
+    }
+    if room == "" {
+        room = "general"
+    }
+    rm, err := dbGetRoom(context.Background(), room)
+    if err != nil {
+        return false
+    }
+    return rm.Creator == username
+}
+
+// authorizeMessageChange loads message id and checks that username is its
+// author or a moderator of its room. moderated is true when the change is
+// made on someone else's message.
+func authorizeMessageChange(w http.ResponseWriter, r *http.Request, id int64, username string) (msg *Message, moderated bool, ok bool) {
+    msg, err := getMessage(id)
+    if err != nil {
+        if !errors.Is(err, errMessageNotFound) {
+            log.Println("load message error:", err)
+        }
+        http.Error(w, "Message not found", http.StatusNotFound)
+        return nil, false, false
+    }
+    if !roomAllowed(r, msg.Room) {
+        http.Error(w, "Forbidden", http.StatusForbidden)
+        return nil, false, false
+    }
+    if msg.Username == username {
+        return msg, false, true
+    }
+    if !canModerateRoom(username, msg.Room) {
+        http.Error(w, "Forbidden", http.StatusForbidden)
+        return nil, false, false
+    }
+    return msg, true, true
+}
+
+// postMessageHandler lets scripts and bots post to a room over REST.
+func postMessageHandler(hub *Hub, w http.ResponseWriter, r *http.Request) {
+    var payload struct {
+        Room string `json:"room"`
+        Text string `json:"text"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+        http.Error(w, "Invalid JSON", http.StatusBadRequest)
+        return
+    }
+    if payload.Room == "" {
+        payload.Room = "general"
+    }
+    if payload.Text == "" {
+        http.Error(w, "Text required", http.StatusBadRequest)
+        return
+    }
+    if utf8.RuneCountInString(payload.Text) > maxMessageTextLen {
+        http.Error(w, "Message too long", http.StatusRequestEntityTooLarge)
+        return
+    }
+    key := r.Header.Get("Idempotency-Key")
+    if len(key) > maxIdempotencyKeyLen {
+        http.Error(w, "Idempotency-Key too long", http.StatusBadRequest)
+        return
+    }
+    if !roomAllowed(r, payload.Room) {
+        http.Error(w, "Forbidden", http.StatusForbidden)
+        return
+    }
+    if err := checkRoomAccess(authUsername(r), payload.Room); err != nil {
+        writeRoomAccessError(w, err)
+        return
+    }
+    out := Message{
+        Username:  authUsername(r),
+        Text:      payload.Text,
+        Timestamp: getTimestamp(userTimezone(authUsername(r))),
+        Reactions: make(map[string][]string),
+        Room:      payload.Room,
+        Bot:       authAPIKey(r) != nil,
+    }
+    rc, err := saveMessage(out, key)
+    if err != nil {
+        log.Println("db save error:", err)
+        http.Error(w, "Message could not be saved", http.StatusInternalServerError)
+        return
+    }
+    out.ID = rc.ID
+    if rc.Duplicate {
+        w.Header().Set("Idempotent-Replayed", "true")
+    } else {
+        seq := publishRoomEvent(hub, out.Room, nil, MessageEvent{Type: "message", Message: out})
+        recordSendSeq(out.Username, key, seq)
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(out)
+}
+
 func editMessageHandler(hub *Hub, w http.ResponseWriter, r *http.Request) {
     if r.Method != http.MethodPut {
         http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -767,18 +1370,22 @@ func editMessageHandler(hub *Hub, w http.ResponseWriter, r *http.Request) {
         http.Error(w, "Invalid payload", http.StatusBadRequest)
         return
     }
+    username := authUsername(r)
+    msg, moderated, ok := authorizeMessageChange(w, r, payload.ID, username)
+    if !ok {
+        return
+    }
     if !editMessageText(payload.ID, payload.Text) {
         http.Error(w, "Message not found", http.StatusNotFound)
         return
     }
-    // broadcast edit to all clients
-    broadcastPayload := struct {
-        Type string `json:"type"`
-        ID   int64  `json:"id"`
-        Text string `json:"text"`
-    }{Type: "edit", ID: payload.ID, Text: payload.Text}
-    b, _ := json.Marshal(broadcastPayload)
-    hub.broadcast <- Broadcast{sender: nil, message: b}
+    // broadcast edit to the message's room
+    broadcastPayload := EditEvent{Type: "edit", ID: payload.ID, Text: payload.Text, Room: msg.Room}
+    if moderated {
+        broadcastPayload.EditedBy = username
+        log.Printf("🛡️ %s edited message %d by %s in room %s", username, msg.ID, msg.Username, msg.Room)
+    }
+    publishRoomEvent(hub, msg.Room, nil, broadcastPayload)
     w.WriteHeader(http.StatusOK)
     w.Write([]byte("Message edited"))
 }
@@ -798,17 +1405,23 @@ func deleteMessageHandler(hub *Hub, w http.ResponseWriter, r *http.Request) {
         http.Error(w, "Invalid message ID", http.StatusBadRequest)
         return
     }
+    username := authUsername(r)
+    msg, moderated, ok := authorizeMessageChange(w, r, id, username)
+    if !ok {
+        return
+    }
     if !deleteMessageByID(id) {
         http.Error(w, "Message not found", http.StatusNotFound)
         return
     }
-    // broadcast deletion to all clients
-    broadcastPayload := struct {
-        Type string `json:"type"`
-        ID   int64  `json:"id"`
-    }{Type: "delete", ID: id}
-    b, _ := json.Marshal(broadcastPayload)
-    hub.broadcast <- Broadcast{sender: nil, message: b}
+    // broadcast deletion to the message's room; moderator deletions say who and why
+    broadcastPayload := DeleteEvent{Type: "delete", ID: id, Room: msg.Room}
+    if moderated {
+        broadcastPayload.DeletedBy = username
+        broadcastPayload.Reason = strings.TrimSpace(r.URL.Query().Get("reason"))
+        log.Printf("🛡️ %s deleted message %d by %s in room %s (reason: %q)", username, msg.ID, msg.Username, msg.Room, broadcastPayload.Reason)
+    }
+    publishRoomEvent(hub, msg.Room, nil, broadcastPayload)
     w.WriteHeader(http.StatusOK)
     w.Write([]byte("Message deleted"))
 }
@@ -821,7 +1434,26 @@ func main() {
         log.Println("DB init error:", err)
     }
 
-    hub := newHub()
+    initAuth()
+    initWebSocket()
+    initPresence()
+    initRoomEvents()
+    initHistory()
+    initIdempotency()
+    initSendQueues()
+    initMFAPolicy(context.Background())
+    initPasswordPolicy()
+    initThrottle()
+    initTrustedProxies()
+    initNotifier()
+    initOIDC()
+    initRoles(context.Background())
+    initAccountDeletion()
+    initUsernamePolicy()
+    auditUsernames(context.Background())
+    passwordResetTTL = envDuration("PASSWORD_RESET_TTL", passwordResetTTL)
+
+    hub := newHub(initBackplane())
     go hub.run()
 
     // Auth endpoints with CORS
@@ -832,17 +1464,108 @@ func main() {
         loginHandler(w, r)
     })))
 
+    // Session endpoints
+    http.Handle("/logout", enableCors(requireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        logoutHandler(hub, w, r)
+    }))))
+    http.Handle("/sessions", enableCors(requireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        listSessionsHandler(w, r)
+    }))))
+    http.Handle("/sessions/", enableCors(requireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        revokeSessionHandler(hub, w, r)
+    }))))
+
+    // Account endpoints
+    http.Handle("/account/password", enableCors(requireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        changePasswordHandler(hub, w, r)
+    }))))
+    http.Handle("/account/password/reset", enableCors(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        requestPasswordResetHandler(w, r)
+    })))
+    http.Handle("/account/password/reset/confirm", enableCors(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        confirmPasswordResetHandler(hub, w, r)
+    })))
+
+    // Single sign-on (OpenID Connect)
+    http.HandleFunc("/auth/oidc/start", oidcStartHandler)
+    http.HandleFunc("/auth/oidc/callback", oidcCallbackHandler)
+
+    // Admin endpoints
+    http.Handle("/admin/users/role", enableCors(requireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        adminUserRoleHandler(hub, w, r)
+    }))))
+
+    // Bot accounts and API keys
+    http.Handle("/bots", enableCors(requireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        botsHandler(w, r)
+    }))))
+    http.Handle("/bots/", enableCors(requireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        botKeysHandler(hub, w, r)
+    }))))
+
+    // User profiles
+    http.Handle("/users/", enableCors(requireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        profileHandler(hub, w, r)
+    }))))
+
+    // Two-factor authentication endpoints
+    http.Handle("/login/mfa", enableCors(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        loginMFAHandler(w, r)
+    })))
+    http.Handle("/account/mfa", enableCors(requireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        mfaStatusHandler(w, r)
+    }))))
+    http.Handle("/account/mfa/enroll", enableCors(requireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        mfaEnrollHandler(w, r)
+    }))))
+    http.Handle("/account/mfa/activate", enableCors(requireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        mfaActivateHandler(w, r)
+    }))))
+    http.Handle("/account/mfa/disable", enableCors(requireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        mfaDisableHandler(w, r)
+    }))))
+    http.Handle("/admin/mfa-policy", enableCors(requireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        adminMFAPolicyHandler(w, r)
+    }))))
+    http.Handle("/admin/connections", enableCors(requireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        adminConnectionsHandler(hub, w, r)
+    }))))
+
     // Dark mode endpoints with CORS
-    http.Handle("/get_dark_mode", enableCors(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    http.Handle("/get_dark_mode", enableCors(requireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
         getDarkModeHandler(w, r)
-    })))
-    http.Handle("/set_dark_mode", enableCors(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-        setDarkModeHandler(w, r)
+    }))))
+    http.Handle("/set_dark_mode", enableCors(requireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        setDarkModeHandler(hub, w, r)
+    }))))
+
+    // Personal data export and account deletion
+    http.Handle("/account/export", enableCors(requireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        exportHandler(w, r)
+    }))))
+    http.Handle("/account", enableCors(requireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        deleteAccountHandler(hub, w, r)
+    }))))
+    http.Handle("/account/deletion", enableCors(requireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        requestAccountDeletionHandler(w, r)
+    }))))
+
+    // Per-user settings document
+    http.Handle("/account/settings", enableCors(requireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        settingsHandler(hub, w, r)
+    }))))
+    http.Handle("/account/settings/schema", enableCors(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        settingsSchemaHandler(w, r)
     })))
 
-    // Message edit/delete endpoints
-    http.Handle("/message", enableCors(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    // Message post/edit/delete endpoints
+    http.Handle("/message", enableCors(requireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if !requireScope(w, r, scopeMessagesWrite) {
+            return
+        }
         switch r.Method {
+        case http.MethodPost:
+            postMessageHandler(hub, w, r)
         case http.MethodPut:
             editMessageHandler(hub, w, r)
         case http.MethodDelete:
@@ -850,25 +1573,45 @@ func main() {
         default:
             http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
         }
-    })))
+    }))))
 
     // Room management endpoints
-    http.Handle("/rooms/list", enableCors(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-        listRoomsHandler(w, r)
-    })))
-    http.Handle("/rooms/create", enableCors(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-        createRoomHandler(w, r)
-    })))
-    http.Handle("/rooms/join", enableCors(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-        joinRoomHandler(w, r)
-    })))
+    http.Handle("/rooms/list", enableCors(requireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if requireScope(w, r, scopeRoomsRead) {
+            listRoomsHandler(w, r)
+        }
+    }))))
+    http.Handle("/rooms/create", enableCors(requireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if requireScope(w, r, scopeRoomsManage) {
+            createRoomHandler(w, r)
+        }
+    }))))
+    http.Handle("/rooms/join", enableCors(requireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if requireScope(w, r, scopeRoomsRead) {
+            joinRoomHandler(w, r)
+        }
+    }))))
+    http.Handle("/rooms/delete", enableCors(requireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if requireScope(w, r, scopeRoomsManage) {
+            deleteRoomHandler(hub, w, r)
+        }
+    }))))
+    // GET /rooms/{room}/messages pages through a room's history
+    http.Handle("/rooms/", enableCors(requireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if requireScope(w, r, scopeRoomsRead) {
+            roomMessagesHandler(w, r)
+        }
+    }))))
 
     // File upload endpoint
-    http.Handle("/upload", enableCors(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    http.Handle("/upload", enableCors(requireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
         if r.Method != http.MethodPost {
             http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
             return
         }
+        if !requireScope(w, r, scopeMessagesWrite) || !requireRole(w, r, uploadRole) {
+            return
+        }
         
         // Parse multipart form (10MB max)
         err := r.ParseMultipartForm(10 << 20)
@@ -893,15 +1636,16 @@ func main() {
             return
         }
         
-        // Generate unique filename
+        // Generate unique filename; the random part keeps two uploads of the
+        // same name in the same second from overwriting each other
         // Sanitize filename to prevent path traversal
         cleanName := filepath.Base(header.Filename)
-        filename := fmt.Sprintf("%d_%s", time.Now().Unix(), cleanName)
+        filename := fmt.Sprintf("%d_%s_%s", time.Now().Unix(), randomToken(4), cleanName)
         // Ensure file stays in uploads directory
         filePath := filepath.Join("uploads", filepath.Base(filename))
         
         // Save file
-        dst, err := os.Create(filePath)
+        dst, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
         if err != nil {
             log.Printf("Create file error: %s", err.Error())
             http.Error(w, "Failed to create file", http.StatusInternalServerError)
@@ -923,6 +1667,14 @@ func main() {
             return
         }
         
+        if err := recordUpload(filename, authUsername(r)); err != nil {
+            log.Printf("Record upload error: %s", err.Error())
+            dst.Close()
+            os.Remove(filePath)
+            http.Error(w, "Failed to save file", http.StatusInternalServerError)
+            return
+        }
+        
         log.Printf("File uploaded successfully: %s (%d bytes)", filename, written)
         
         // Detect content type if not provided
@@ -955,7 +1707,7 @@ func main() {
         
         w.Header().Set("Content-Type", "application/json")
         json.NewEncoder(w).Encode(response)
-    })))
+    }))))
     
     // Serve uploaded files with proper headers
     http.Handle("/files/", enableCors(http.StripPrefix("/files/", http.FileServer(http.Dir("uploads/")))))
@@ -984,23 +1736,13 @@ func main() {
         json.NewEncoder(w).Encode(status)
     })
 
-    // WebSocket endpoint expects ?username=XYZ&room=ABC from frontend after login
-    http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
-        username := r.URL.Query().Get("username")
-        room := r.URL.Query().Get("room")
-        if username == "" {
-            http.Error(w, "Username required", http.StatusBadRequest)
-            return
-        }
-        if room == "" {
-            room = "general" // Default room
-        }
-        
-        // Skip room validation for WebSocket - rooms are validated during creation/join
-        // WebSocket should allow connection to any room that was previously validated
-        
-        serveWs(hub, username, room, w, r)
-    })
+    // WebSocket endpoint expects ?room=ABC and a session token (cookie, bearer or ?token=)
+    http.Handle("/ws", requireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        wsHandler(hub, w, r)
+    })))
+    http.Handle("/ws/schema", enableCors(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        protocolSchemaHandler(w, r)
+    })))
 
     port := os.Getenv("PORT")
     if port == "" {
@@ -1010,6 +1752,36 @@ func main() {
     log.Fatal(http.ListenAndServe(":"+port, nil))
 }
 
+// -------------------- Config Helpers --------------------
+
+// envDuration parses a time.Duration from the environment, falling back to def.
+func envDuration(name string, def time.Duration) time.Duration {
+    v := strings.TrimSpace(os.Getenv(name))
+    if v == "" {
+        return def
+    }
+    d, err := time.ParseDuration(v)
+    if err != nil {
+        log.Printf("invalid %s=%q, using %s", name, v, def)
+        return def
+    }
+    return d
+}
+
+// envInt parses an int from the environment, falling back to def.
+func envInt(name string, def int) int {
+    v := strings.TrimSpace(os.Getenv(name))
+    if v == "" {
+        return def
+    }
+    n, err := strconv.Atoi(v)
+    if err != nil {
+        log.Printf("invalid %s=%q, using %d", name, v, def)
+        return def
+    }
+    return n
+}
+
 // -------------------- DB Helpers --------------------
 
 func initDB(ctx context.Context) error {
@@ -1090,53 +1862,26 @@ func dbSaveMessage(ctx context.Context, m Message) (int64, error) {
     var id int64
     // store server-side timestamp as now(); we still broadcast client-formatted timestamp in message
     err := dbPool.QueryRow(ctx, `
-        INSERT INTO messages (username, text, room) VALUES ($1, $2, $3)
+        INSERT INTO messages (username, text, room, bot) VALUES ($1, $2, $3, $4)
         RETURNING id
-    `, m.Username, m.Text, m.Room).Scan(&id)
+    `, m.Username, m.Text, m.Room, m.Bot).Scan(&id)
     return id, err
 }
 
-func dbLoadRecentMessages(ctx context.Context, limit int, room string) ([]Message, error) {
-    if limit <= 0 {
-        limit = 200
-    }
-    rows, err := dbPool.Query(ctx, `
-        SELECT id, username, text, timestamp, COALESCE(room, 'general') as room
-        FROM messages
-        WHERE COALESCE(room, 'general') = $2
-        ORDER BY timestamp DESC
-        LIMIT $1
-    `, limit, room)
+func dbGetMessage(ctx context.Context, id int64) (*Message, error) {
+    var m Message
+    err := dbPool.QueryRow(ctx, `
+        SELECT id, username, text, timestamp, COALESCE(room, 'general'), COALESCE(reactions, '{}')
+        FROM messages WHERE id=$1
+    `, id).Scan(&m.ID, &m.Username, &m.Text, &m.at, &m.Room, &m.Reactions)
     if err != nil {
-        return nil, err
-    }
-    defer rows.Close()
-    out := make([]Message, 0, limit)
-    for rows.Next() {
-        var (
-            id int64
-            username string
-            text string
-            ts time.Time
-        )
-        var room string
-        if err := rows.Scan(&id, &username, &text, &ts, &room); err != nil {
-            return nil, err
+        if errors.Is(err, pgx.ErrNoRows) {
+            return nil, errMessageNotFound
         }
-        out = append(out, Message{
-            ID: id,
-            Username: username,
-            Text: text,
-            Timestamp: ts.Format("2006-01-02 15:04:05 MST"),
-            Reactions: make(map[string][]string),
-            Room: room,
-        })
-    }
-    // reverse to chronological ascending like in-memory version
-    for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
-        out[i], out[j] = out[j], out[i]
+        return nil, err
     }
-    return out, rows.Err()
+    m.Timestamp = m.at.Format("2006-01-02 15:04:05 MST")
+    return &m, nil
 }
 
 func dbEditMessageText(ctx context.Context, id int64, text string) error {
@@ -1150,6 +1895,27 @@ func dbEditMessageText(ctx context.Context, id int64, text string) error {
     return nil
 }
 
+// dbToggleReaction flips username in the message's reactions[emoji] array
+// in one statement, so concurrent toggles on other nodes cannot lose updates.
+func dbToggleReaction(ctx context.Context, id int64, emoji, username string) error {
+    ct, err := dbPool.Exec(ctx, `
+        UPDATE messages SET reactions = CASE
+            WHEN COALESCE(reactions->$2::text, '[]') ? $3::text THEN
+                CASE WHEN jsonb_array_length((reactions->$2::text) - $3::text) = 0 THEN reactions - $2::text
+                     ELSE jsonb_set(reactions, ARRAY[$2::text], (reactions->$2::text) - $3::text) END
+            ELSE jsonb_set(COALESCE(reactions, '{}'), ARRAY[$2::text], COALESCE(reactions->$2::text, '[]') || to_jsonb($3::text))
+        END
+        WHERE id=$1
+    `, id, emoji, username)
+    if err != nil {
+        return err
+    }
+    if ct.RowsAffected() == 0 {
+        return fmt.Errorf("not found")
+    }
+    return nil
+}
+
 func dbDeleteMessageByID(ctx context.Context, id int64) error {
     ct, err := dbPool.Exec(ctx, `DELETE FROM messages WHERE id=$1`, id)
     if err != nil {
@@ -1161,18 +1927,22 @@ func dbDeleteMessageByID(ctx context.Context, id int64) error {
     return nil
 }
 
-func dbRegisterUser(ctx context.Context, username string, passwordHash []byte) error {
-    _, err := dbPool.Exec(ctx, `
-        INSERT INTO users (username, password_hash) VALUES ($1, $2)
-        ON CONFLICT (username) DO NOTHING
-    `, username, passwordHash)
+func dbRegisterUser(ctx context.Context, username, email string, passwordHash []byte) error {
+    var emailArg *string
+    if email != "" {
+        emailArg = &email
+    }
+    // No conflict target: also covers the case-insensitive username index
+    ct, err := dbPool.Exec(ctx, `
+        INSERT INTO users (username, password_hash, email)
+        SELECT $1, $2, $3
+        WHERE NOT EXISTS (SELECT 1 FROM users WHERE lower(username) = lower($1))
+        ON CONFLICT DO NOTHING
+    `, username, passwordHash, emailArg)
     if err != nil {
         return err
     }
-    // Verify created
-    var exists bool
-    _ = dbPool.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM users WHERE username=$1)`, username).Scan(&exists)
-    if !exists {
+    if ct.RowsAffected() == 0 {
         return fmt.Errorf("username may already exist")
     }
     return nil
@@ -1187,29 +1957,6 @@ func dbGetUserPasswordHash(ctx context.Context, username string) ([]byte, error)
     return hash, nil
 }
 
-func dbGetDarkMode(ctx context.Context, username string) (bool, bool, error) {
-    var dm bool
-    err := dbPool.QueryRow(ctx, `SELECT dark_mode FROM users WHERE username=$1`, username).Scan(&dm)
-    if err != nil {
-        if errors.Is(err, pgx.ErrNoRows) {
-            return false, false, nil
-        }
-        return false, false, err
-    }
-    return dm, true, nil
-}
-
-func dbSetDarkMode(ctx context.Context, username string, dark bool) error {
-    ct, err := dbPool.Exec(ctx, `UPDATE users SET dark_mode=$1 WHERE username=$2`, dark, username)
-    if err != nil {
-        return err
-    }
-    if ct.RowsAffected() == 0 {
-        return fmt.Errorf("not found")
-    }
-    return nil
-}
-
 // -------------------- Room Management --------------------
 
 func listRoomsHandler(w http.ResponseWriter, r *http.Request) {
@@ -1223,6 +1970,15 @@ func listRoomsHandler(w http.ResponseWriter, r *http.Request) {
         http.Error(w, "Failed to load rooms", http.StatusInternalServerError)
         return
     }
+    if k := authAPIKey(r); k != nil {
+        allowed := make([]Room, 0, len(rooms))
+        for _, room := range rooms {
+            if k.allowsRoom(room.Name) {
+                allowed = append(allowed, room)
+            }
+        }
+        rooms = allowed
+    }
     
     w.Header().Set("Content-Type", "application/json")
     json.NewEncoder(w).Encode(rooms)
@@ -1234,17 +1990,17 @@ func createRoomHandler(w http.ResponseWriter, r *http.Request) {
         return
     }
     
+    if !requireRole(w, r, roomCreateRole) {
+        return
+    }
+    
     var req CreateRoomRequest
     if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
         http.Error(w, "Invalid JSON", http.StatusBadRequest)
         return
     }
     
-    username := r.Header.Get("X-Username")
-    if username == "" {
-        http.Error(w, "Username required", http.StatusBadRequest)
-        return
-    }
+    username := authUsername(r)
     
     if req.Name == "" {
         http.Error(w, "Room name required", http.StatusBadRequest)
@@ -1253,7 +2009,7 @@ func createRoomHandler(w http.ResponseWriter, r *http.Request) {
     
     var passwordHash []byte
     if req.IsPrivate && req.Password != "" {
-        hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.MinCost)
+        hash, err := hashPassword(req.Password)
         if err != nil {
             http.Error(w, "Password hashing failed", http.StatusInternalServerError)
             return
@@ -1292,6 +2048,10 @@ func joinRoomHandler(w http.ResponseWriter, r *http.Request) {
         http.Error(w, "Room name required", http.StatusBadRequest)
         return
     }
+    if !roomAllowed(r, req.RoomName) {
+        http.Error(w, "Forbidden", http.StatusForbidden)
+        return
+    }
     
     room, err := dbGetRoom(context.Background(), req.RoomName)
     if err != nil {
@@ -1304,20 +2064,74 @@ func joinRoomHandler(w http.ResponseWriter, r *http.Request) {
             http.Error(w, "Password required for private room", http.StatusUnauthorized)
             return
         }
-        if err := bcrypt.CompareHashAndPassword(room.PasswordHash, []byte(req.Password)); err != nil {
+        username := authUsername(r)
+        userKey, ipKey := roomThrottleKeys(room.Name, username, r)
+        if wait := reserveAuthAttempt(userKey, ipKey); wait > 0 {
+            log.Printf("🚫 Blocked room password attempt for %s by %s from %s", room.Name, username, clientIP(r))
+            rejectThrottled(w, wait)
+            return
+        }
+        if ok, _ := verifyPassword(room.PasswordHash, req.Password); !ok {
+            log.Printf("⚠️ Failed room password for %s by %s from %s", room.Name, username, clientIP(r))
             http.Error(w, "Invalid password", http.StatusUnauthorized)
             return
         }
+        authAttemptSucceeded(userKey, ipKey)
+        if err := addRoomMember(r.Context(), room.Name, username); err != nil {
+            log.Println("room member add error:", err)
+            http.Error(w, "Server error", http.StatusInternalServerError)
+            return
+        }
     }
     
     w.Header().Set("Content-Type", "application/json")
     json.NewEncoder(w).Encode(map[string]string{"status": "success", "message": "Joined room successfully"})
 }
 
+// deleteRoomHandler handles DELETE /rooms/delete?name=. The room's creator,
+// moderators and admins may delete it; its messages go with it.
+func deleteRoomHandler(hub *Hub, w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodDelete {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    name := r.URL.Query().Get("name")
+    if name == "" {
+        http.Error(w, "Room name required", http.StatusBadRequest)
+        return
+    }
+    if !roomAllowed(r, name) {
+        http.Error(w, "Forbidden", http.StatusForbidden)
+        return
+    }
+    room, err := dbGetRoom(context.Background(), name)
+    if err != nil {
+        http.Error(w, "Room not found", http.StatusNotFound)
+        return
+    }
+    username := authUsername(r)
+    if room.Creator != username && !hasRole(username, roleModerator) {
+        http.Error(w, "Forbidden", http.StatusForbidden)
+        return
+    }
+    if err := dbDeleteRoom(context.Background(), name); err != nil {
+        log.Printf("Room deletion error: %s", err.Error())
+        http.Error(w, "Failed to delete room", http.StatusInternalServerError)
+        return
+    }
+    log.Printf("🗑️ %s deleted room %s", username, name)
+    b, _ := json.Marshal(RoomDeletedEvent{Type: "room_deleted", Room: name, DeletedBy: username})
+    hub.broadcast <- Broadcast{sender: nil, message: b}
+    w.WriteHeader(http.StatusOK)
+    w.Write([]byte("Room deleted"))
+}
+
 func dbListRooms(ctx context.Context) ([]Room, error) {
     if !useDB {
         // Return in-memory rooms
-        return inMemoryRooms, nil
+        roomsMu.RLock()
+        defer roomsMu.RUnlock()
+        return append([]Room(nil), inMemoryRooms...), nil
     }
     
     rows, err := dbPool.Query(ctx, `
@@ -1347,6 +2161,8 @@ func dbListRooms(ctx context.Context) ([]Room, error) {
 func dbCreateRoom(ctx context.Context, name, description, creator string, passwordHash []byte, isPrivate bool) (*Room, error) {
     if !useDB {
         // In-memory room creation for development
+        roomsMu.Lock()
+        defer roomsMu.Unlock()
         room := &Room{
             ID:          int64(len(inMemoryRooms) + 1),
             Name:        name,
@@ -1400,6 +2216,8 @@ type RoomWithPassword struct {
 func dbGetRoom(ctx context.Context, name string) (*RoomWithPassword, error) {
     if !useDB {
         // Check in-memory rooms
+        roomsMu.RLock()
+        defer roomsMu.RUnlock()
         for _, room := range inMemoryRooms {
             if room.Name == name {
                 roomWithPassword := &RoomWithPassword{
@@ -1429,3 +2247,52 @@ func dbGetRoom(ctx context.Context, name string) (*RoomWithPassword, error) {
     room.CreatedAt = createdAt.Format("2006-01-02 15:04:05")
     return &room, nil
 }
+
+func dbDeleteRoom(ctx context.Context, name string) error {
+    if !useDB {
+        roomsMu.Lock()
+        defer roomsMu.Unlock()
+        for i, room := range inMemoryRooms {
+            if room.Name == name {
+                inMemoryRooms = append(inMemoryRooms[:i], inMemoryRooms[i+1:]...)
+                delete(inMemoryRoomPasswords, name)
+                delete(roomMembers, name)
+                messagesMu.Lock()
+                kept := messagesList[:0]
+                for _, m := range messagesList {
+                    if m.Room != name {
+                        kept = append(kept, m)
+                    }
+                }
+                messagesList = kept
+                messagesMu.Unlock()
+                memForgetRoomEvents(name)
+                return nil
+            }
+        }
+        return fmt.Errorf("room not found")
+    }
+    
+    tx, err := dbPool.Begin(ctx)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback(ctx)
+    if _, err := tx.Exec(ctx, `DELETE FROM messages WHERE room = $1`, name); err != nil {
+        return err
+    }
+    if _, err := tx.Exec(ctx, `DELETE FROM room_events WHERE room = $1`, name); err != nil {
+        return err
+    }
+    if _, err := tx.Exec(ctx, `DELETE FROM room_sequences WHERE room = $1`, name); err != nil {
+        return err
+    }
+    ct, err := tx.Exec(ctx, `DELETE FROM rooms WHERE name = $1`, name)
+    if err != nil {
+        return err
+    }
+    if ct.RowsAffected() == 0 {
+        return fmt.Errorf("room not found")
+    }
+    return tx.Commit(ctx)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+    "encoding/json"
+    "io"
+    "log"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/gorilla/websocket"
+)
+
+// Tests run against the in-memory store with a fixed signing key.
+func TestMain(m *testing.M) {
+    sessionSecret = []byte("test-session-secret-0123456789abcdef")
+    if os.Getenv("CHATBOX_TEST_LOG") == "" {
+        log.SetOutput(io.Discard)
+    }
+    os.Exit(m.Run())
+}
+
+// testUser creates an in-memory member account.
+func testUser(t testing.TB, username string) {
+    t.Helper()
+    hash, err := hashPassword("correct horse battery staple")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := createUser(username, username+"@example.com", hash); err != nil {
+        t.Fatal(err)
+    }
+}
+
+// testServer serves /ws with a fresh hub on the in-process backplane.
+type testServer struct {
+    *httptest.Server
+    hub *Hub
+}
+
+func newTestServer(t testing.TB) *testServer {
+    t.Helper()
+    return newTestNode(t, newMemBus())
+}
+
+// newTestNode is newTestServer as one node among others on bus.
+func newTestNode(t testing.TB, bus *memBus) *testServer {
+    t.Helper()
+    hub := newHub(bus.join("test-" + randomToken(4)))
+    go hub.run()
+    mux := http.NewServeMux()
+    mux.Handle("/ws", requireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        wsHandler(hub, w, r)
+    })))
+    srv := httptest.NewServer(mux)
+    t.Cleanup(srv.Close)
+    // Runs after the test's sockets are closed: wait for the hub to let go
+    // of them, so it is idle before the next test changes package settings
+    t.Cleanup(func() {
+        deadline := time.Now().Add(5 * time.Second)
+        for time.Now().Before(deadline) {
+            reply := make(chan []queueStats)
+            hub.stats <- reply
+            if len(<-reply) == 0 {
+                return
+            }
+            time.Sleep(10 * time.Millisecond)
+        }
+    })
+    return &testServer{Server: srv, hub: hub}
+}
+
+// sessionToken signs username in and returns the session token.
+func sessionToken(t testing.TB, username string) string {
+    t.Helper()
+    token, _, err := startSession(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/login", nil), username)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return token
+}
+
+// dial opens /ws?query as username, speaking chatbox.v1.
+func (s *testServer) dial(t testing.TB, username, query string) (*websocket.Conn, *http.Response, error) {
+    t.Helper()
+    return s.dialToken(t, sessionToken(t, username), query)
+}
+
+// dialToken opens /ws?query with a session token or API key.
+func (s *testServer) dialToken(t testing.TB, token, query string) (*websocket.Conn, *http.Response, error) {
+    t.Helper()
+    d := websocket.Dialer{Subprotocols: []string{wsProtocolV1}}
+    h := http.Header{"Authorization": {"Bearer " + token}}
+    conn, resp, err := d.Dial("ws"+strings.TrimPrefix(s.URL, "http")+"/ws?"+query, h)
+    if err == nil {
+        t.Cleanup(func() { conn.Close() })
+    }
+    return conn, resp, err
+}
+
+// readUntil reads frames until one of type typ arrives and returns it.
+func readUntil(t testing.TB, conn *websocket.Conn, typ string) map[string]any {
+    t.Helper()
+    conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+    defer conn.SetReadDeadline(time.Time{})
+    for {
+        _, raw, err := conn.ReadMessage()
+        if err != nil {
+            t.Fatalf("waiting for %q: %v", typ, err)
+        }
+        var f map[string]any
+        if err := json.Unmarshal(raw, &f); err != nil {
+            t.Fatalf("bad frame %s: %v", raw, err)
+        }
+        if f["type"] == typ {
+            return f
+        }
+    }
+}
+
+func sendFrame(t testing.TB, conn *websocket.Conn, v any) {
+    t.Helper()
+    if err := conn.WriteJSON(v); err != nil {
+        t.Fatal(err)
+    }
+}
+
+// serve runs one request through h as token ("" for none).
+func serve(h http.Handler, token, method, path, body string) *httptest.ResponseRecorder {
+    r := httptest.NewRequest(method, path, strings.NewReader(body))
+    if token != "" {
+        r.Header.Set("Authorization", "Bearer "+token)
+    }
+    w := httptest.NewRecorder()
+    h.ServeHTTP(w, r)
+    return w
+}
+
+// expectClose reads until conn is closed and checks the close code.
+func expectClose(t testing.TB, conn *websocket.Conn, code int) {
+    t.Helper()
+    conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+    for {
+        _, _, err := conn.ReadMessage()
+        if err == nil {
+            continue
+        }
+        if !websocket.IsCloseError(err, code) {
+            t.Fatalf("got %v, want close %d", err, code)
+        }
+        return
+    }
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "testing"
+)
+
+func TestEditAndDeleteOwnership(t *testing.T) {
+    hub := newTestServer(t).hub
+    for _, u := range []string{"own_author", "own_other", "own_creator", "own_mod"} {
+        testUser(t, u)
+    }
+    if err := setUserRole("own_mod", roleModerator); err != nil {
+        t.Fatal(err)
+    }
+    room := "ownership-room"
+    if _, err := dbCreateRoom(context.Background(), room, "", "own_creator", nil, false); err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { dbDeleteRoom(context.Background(), room) })
+    h := requireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        switch r.Method {
+        case http.MethodPut:
+            editMessageHandler(hub, w, r)
+        case http.MethodDelete:
+            deleteMessageHandler(hub, w, r)
+        }
+    }))
+    post := func() int64 {
+        t.Helper()
+        rc, err := saveMessage(Message{Username: "own_author", Text: "original", Room: room}, "")
+        if err != nil {
+            t.Fatal(err)
+        }
+        return rc.ID
+    }
+    edit := func(user string, id int64) int {
+        return serve(h, sessionToken(t, user), http.MethodPut, "/message", fmt.Sprintf(`{"id":%d,"text":"changed"}`, id)).Code
+    }
+    del := func(user string, id int64) int {
+        return serve(h, sessionToken(t, user), http.MethodDelete, fmt.Sprintf("/message?id=%d&reason=spam", id), "").Code
+    }
+    // lastEvent returns the room's newest event, to check who it names
+    lastEvent := func() map[string]any {
+        t.Helper()
+        events, _, ok := roomEventsSince(room, currentRoomSeq(room)-1, resumeMaxEvents)
+        if !ok || len(events) != 1 {
+            t.Fatalf("no last event: ok=%v events=%d", ok, len(events))
+        }
+        var ev map[string]any
+        json.Unmarshal(events[0], &ev)
+        return ev
+    }
+
+    id := post()
+    if code := edit("own_other", id); code != http.StatusForbidden {
+        t.Fatalf("edit by another member: status %d", code)
+    }
+    if code := del("own_other", id); code != http.StatusForbidden {
+        t.Fatalf("delete by another member: status %d", code)
+    }
+    if code := edit("own_author", id); code != http.StatusOK {
+        t.Fatalf("edit by author: status %d", code)
+    }
+    if ev := lastEvent(); ev["type"] != "edit" || ev["editedBy"] != nil {
+        t.Fatalf("author's edit event: %v", ev)
+    }
+    if msg, err := getMessage(id); err != nil || msg.Text != "changed" {
+        t.Fatalf("after edit: %v %+v", err, msg)
+    }
+
+    // The room's creator and a global moderator act on others' messages, and
+    // the events say so
+    if code := edit("own_creator", id); code != http.StatusOK {
+        t.Fatalf("edit by room creator: status %d", code)
+    }
+    if ev := lastEvent(); ev["editedBy"] != "own_creator" {
+        t.Fatalf("creator's edit event: %v", ev)
+    }
+    if code := del("own_mod", id); code != http.StatusOK {
+        t.Fatalf("delete by moderator: status %d", code)
+    }
+    if ev := lastEvent(); ev["type"] != "delete" || ev["deletedBy"] != "own_mod" || ev["reason"] != "spam" {
+        t.Fatalf("moderator's delete event: %v", ev)
+    }
+    if code := del("own_author", id); code != http.StatusNotFound {
+        t.Fatalf("delete of a deleted message: status %d", code)
+    }
+
+    id = post()
+    if code := del("own_author", id); code != http.StatusOK {
+        t.Fatalf("delete by author: status %d", code)
+    }
+    if ev := lastEvent(); ev["deletedBy"] != nil {
+        t.Fatalf("author's delete event: %v", ev)
+    }
+}
+
+func TestReactionToggles(t *testing.T) {
+    srv := newTestServer(t)
+    testUser(t, "react_user")
+    testUser(t, "react_peer")
+    rc, err := saveMessage(Message{Username: "react_peer", Text: "react to me", Room: "general"}, "")
+    if err != nil {
+        t.Fatal(err)
+    }
+    elsewhere, err := saveMessage(Message{Username: "react_peer", Text: "not here", Room: "react-elsewhere"}, "")
+    if err != nil {
+        t.Fatal(err)
+    }
+    peer, _, err := srv.dial(t, "react_peer", "room=general")
+    if err != nil {
+        t.Fatal(err)
+    }
+    readUntil(t, peer, "history")
+    conn, _, err := srv.dial(t, "react_user", "room=general")
+    if err != nil {
+        t.Fatal(err)
+    }
+    readUntil(t, conn, "history")
+
+    react := func(id string, messageID int64) {
+        t.Helper()
+        sendFrame(t, conn, ReactionFrame{ClientEnvelope: ClientEnvelope{Type: "reaction", ID: id}, Room: "general", MessageID: messageID, Emoji: "🎉"})
+    }
+    reactors := func() string {
+        t.Helper()
+        m, err := getMessage(rc.ID)
+        if err != nil {
+            t.Fatal(err)
+        }
+        return fmt.Sprint(m.Reactions["🎉"])
+    }
+
+    react("on", rc.ID)
+    if f := readUntil(t, peer, "reaction"); f["username"] != "react_user" || f["messageId"] != float64(rc.ID) {
+        t.Fatalf("reaction event: %v", f)
+    }
+    if got := reactors(); got != "[react_user]" {
+        t.Fatalf("after reacting: %s", got)
+    }
+    react("off", rc.ID)
+    readUntil(t, peer, "reaction")
+    if got := reactors(); got != "[]" {
+        t.Fatalf("after toggling off: %s", got)
+    }
+    react("elsewhere", elsewhere.ID)
+    if f := readUntil(t, conn, "error"); f["requestId"] != "elsewhere" || f["code"] != codeNotFound {
+        t.Fatalf("reaction in another room: %v", f)
+    }
+}
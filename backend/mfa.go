@@ -0,0 +1,577 @@
+package main
+
+import (
+    "context"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha1"
+    "crypto/sha256"
+    "crypto/subtle"
+    "encoding/base32"
+    "encoding/binary"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "net/url"
+    "os"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/jackc/pgx/v5"
+)
+
+// -------------------- TOTP (RFC 6238) --------------------
+
+const (
+    totpPeriod        = 30
+    totpDigits        = 6
+    totpSkew          = 1 // accept one step either side for clock drift
+    recoveryCodeCount = 10
+    mfaChallengeTTL   = 5 * time.Minute
+)
+
+var b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func newTOTPSecret() string {
+    b := make([]byte, 20)
+    if _, err := rand.Read(b); err != nil {
+        panic(err)
+    }
+    return b32.EncodeToString(b)
+}
+
+// totpCode computes the HOTP value (RFC 4226) for a time step.
+func totpCode(secret []byte, step int64) string {
+    var msg [8]byte
+    binary.BigEndian.PutUint64(msg[:], uint64(step))
+    mac := hmac.New(sha1.New, secret)
+    mac.Write(msg[:])
+    sum := mac.Sum(nil)
+    off := sum[len(sum)-1] & 0x0f
+    v := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+    return fmt.Sprintf("%0*d", totpDigits, v%1000000)
+}
+
+// verifyTOTP checks code against the steps around now and returns the
+// matching step. Steps at or before lastStep are rejected to stop replay.
+func verifyTOTP(secret, code string, lastStep int64) (int64, bool) {
+    key, err := b32.DecodeString(strings.ToUpper(secret))
+    if err != nil || len(code) != totpDigits {
+        return 0, false
+    }
+    now := time.Now().Unix() / totpPeriod
+    for step := now - totpSkew; step <= now+totpSkew; step++ {
+        if step <= lastStep {
+            continue
+        }
+        if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+            return step, true
+        }
+    }
+    return 0, false
+}
+
+func otpauthURI(username, secret string) string {
+    issuer := os.Getenv("MFA_ISSUER")
+    if issuer == "" {
+        issuer = "ChatBox"
+    }
+    q := url.Values{}
+    q.Set("secret", secret)
+    q.Set("issuer", issuer)
+    q.Set("algorithm", "SHA1")
+    q.Set("digits", fmt.Sprint(totpDigits))
+    q.Set("period", fmt.Sprint(totpPeriod))
+    return "otpauth://totp/" + url.PathEscape(issuer+":"+username) + "?" + q.Encode()
+}
+
+func normalizeRecoveryCode(code string) string {
+    code = strings.ToLower(strings.TrimSpace(code))
+    return strings.ReplaceAll(code, "-", "")
+}
+
+func hashRecoveryCode(code string) string {
+    sum := sha256.Sum256([]byte(normalizeRecoveryCode(code)))
+    return hex.EncodeToString(sum[:])
+}
+
+// newRecoveryCodes returns plaintext codes for the user and their hashes for storage.
+func newRecoveryCodes() (plain []string, hashes []string) {
+    for i := 0; i < recoveryCodeCount; i++ {
+        c := randomToken(5)
+        c = c[:5] + "-" + c[5:]
+        plain = append(plain, c)
+        hashes = append(hashes, hashRecoveryCode(c))
+    }
+    return plain, hashes
+}
+
+// -------------------- MFA Store --------------------
+
+type userMFA struct {
+    Secret        string
+    Enabled       bool
+    RecoveryCodes []string
+    LastUsedStep  int64
+}
+
+var (
+    mfaMu  sync.Mutex
+    mfaMap = map[string]*userMFA{}
+
+    // mfaRequired is the admin "require 2FA for everyone" switch.
+    mfaRequired atomic.Bool
+
+    errMFAInvalidCode = errors.New("invalid code")
+)
+
+// getUserMFA returns the user's MFA record, or nil if they never enrolled.
+func getUserMFA(username string) (*userMFA, error) {
+    if useDB {
+        ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        defer cancel()
+        return dbGetUserMFA(ctx, username)
+    }
+    mfaMu.Lock()
+    defer mfaMu.Unlock()
+    m, ok := mfaMap[username]
+    if !ok {
+        return nil, nil
+    }
+    cp := *m
+    cp.RecoveryCodes = append([]string(nil), m.RecoveryCodes...)
+    return &cp, nil
+}
+
+func saveUserMFA(username string, m *userMFA) error {
+    if useDB {
+        ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        defer cancel()
+        return dbSaveUserMFA(ctx, username, m)
+    }
+    mfaMu.Lock()
+    defer mfaMu.Unlock()
+    cp := *m
+    mfaMap[username] = &cp
+    return nil
+}
+
+func deleteUserMFA(username string) error {
+    if useDB {
+        ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        defer cancel()
+        _, err := dbPool.Exec(ctx, `DELETE FROM user_mfa WHERE username=$1`, username)
+        return err
+    }
+    mfaMu.Lock()
+    defer mfaMu.Unlock()
+    delete(mfaMap, username)
+    return nil
+}
+
+// checkMFACode accepts a current TOTP code or an unused recovery code for an
+// enabled enrollment, and records its use.
+func checkMFACode(username, code string) error {
+    if useDB {
+        ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        defer cancel()
+        return dbCheckMFACode(ctx, username, code)
+    }
+    mfaMu.Lock()
+    defer mfaMu.Unlock()
+    m, ok := mfaMap[username]
+    if !ok || !m.Enabled {
+        return errMFAInvalidCode
+    }
+    if step, ok := verifyTOTP(m.Secret, strings.TrimSpace(code), m.LastUsedStep); ok {
+        m.LastUsedStep = step
+        return nil
+    }
+    h := hashRecoveryCode(code)
+    for i, rc := range m.RecoveryCodes {
+        if subtle.ConstantTimeCompare([]byte(rc), []byte(h)) == 1 {
+            m.RecoveryCodes = append(m.RecoveryCodes[:i], m.RecoveryCodes[i+1:]...)
+            return nil
+        }
+    }
+    return errMFAInvalidCode
+}
+
+// initMFAPolicy loads the require-2FA switch: MFA_REQUIRED sets the default,
+// a value saved by an admin in server_settings wins.
+func initMFAPolicy(ctx context.Context) {
+    mfaRequired.Store(os.Getenv("MFA_REQUIRED") == "true")
+    if !useDB {
+        return
+    }
+    var v bool
+    err := dbPool.QueryRow(ctx, `SELECT (value)::boolean FROM server_settings WHERE key='mfa_required'`).Scan(&v)
+    if err == nil {
+        mfaRequired.Store(v)
+    } else if !errors.Is(err, pgx.ErrNoRows) {
+        log.Println("load mfa policy error:", err)
+    }
+}
+
+func setMFARequired(required bool, by string) error {
+    if useDB {
+        ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        defer cancel()
+        _, err := dbPool.Exec(ctx, `
+            INSERT INTO server_settings (key, value, updated_by, updated_at)
+            VALUES ('mfa_required', to_jsonb($1::boolean), $2, NOW())
+            ON CONFLICT (key) DO UPDATE SET value=EXCLUDED.value, updated_by=EXCLUDED.updated_by, updated_at=NOW()
+        `, required, by)
+        if err != nil {
+            return err
+        }
+    }
+    mfaRequired.Store(required)
+    return nil
+}
+
+// mfaSetupPending reports whether 2FA is required but username has not
+// enabled it yet. Such sessions may only reach the enrollment endpoints.
+func mfaSetupPending(username string) bool {
+    if !mfaRequired.Load() {
+        return false
+    }
+    m, err := getUserMFA(username)
+    if err != nil {
+        log.Println("mfa lookup error:", err)
+        return false
+    }
+    return m == nil || !m.Enabled
+}
+
+func mfaExemptPath(path string) bool {
+    switch path {
+    case "/account/mfa", "/account/mfa/enroll", "/account/mfa/activate", "/logout":
+        return true
+    }
+    return false
+}
+
+// -------------------- MFA Login Step --------------------
+
+type mfaChallenge struct {
+    Username  string `json:"sub"`
+    ExpiresAt int64  `json:"exp"`
+}
+
+// completeLogin is called once the password has been verified. Users with
+// 2FA get a short-lived challenge token instead of a session.
+func completeLogin(w http.ResponseWriter, r *http.Request, username string) {
+    token, err := mfaChallengeFor(username)
+    if err != nil {
+        log.Println("mfa lookup error:", err)
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+    if token == "" {
+        issueSession(w, r, username)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{"mfaRequired": true, "mfaToken": token})
+}
+
+// mfaChallengeFor returns a login challenge token for POST /login/mfa when
+// username has two-factor authentication enabled, or "" when it does not.
+func mfaChallengeFor(username string) (string, error) {
+    m, err := getUserMFA(username)
+    if err != nil {
+        return "", err
+    }
+    if m == nil || !m.Enabled {
+        return "", nil
+    }
+    return signBlob("mfa", mfaChallenge{Username: username, ExpiresAt: time.Now().Add(mfaChallengeTTL).Unix()})
+}
+
+// loginMFAHandler handles POST /login/mfa, the second login step.
+func loginMFAHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    var payload struct {
+        MFAToken string `json:"mfaToken"`
+        Code     string `json:"code"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+        http.Error(w, "Invalid JSON", http.StatusBadRequest)
+        return
+    }
+    var ch mfaChallenge
+    if err := openBlob("mfa", payload.MFAToken, &ch); err != nil || time.Now().Unix() >= ch.ExpiresAt {
+        http.Error(w, "Invalid or expired login challenge", http.StatusUnauthorized)
+        return
+    }
+    userKey, ipKey := loginThrottleKeys(ch.Username, r)
+    if wait := reserveAuthAttempt(userKey, ipKey); wait > 0 {
+        log.Printf("🚫 Blocked 2FA attempt for %q from %s", ch.Username, clientIP(r))
+        rejectThrottled(w, wait)
+        return
+    }
+    if err := checkMFACode(ch.Username, payload.Code); err != nil {
+        if !errors.Is(err, errMFAInvalidCode) {
+            log.Println("mfa check error:", err)
+        }
+        log.Printf("⚠️ Failed 2FA code for %q from %s", ch.Username, clientIP(r))
+        http.Error(w, "Invalid code", http.StatusUnauthorized)
+        return
+    }
+    authAttemptSucceeded(userKey, ipKey)
+    issueSession(w, r, ch.Username)
+}
+
+// -------------------- MFA Enrollment --------------------
+
+func mfaStatusHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    m, err := getUserMFA(authUsername(r))
+    if err != nil {
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+    resp := map[string]interface{}{"enabled": false, "required": mfaRequired.Load()}
+    if m != nil && m.Enabled {
+        resp["enabled"] = true
+        resp["recoveryCodesLeft"] = len(m.RecoveryCodes)
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(resp)
+}
+
+// mfaEnrollHandler starts (or restarts) enrollment with a fresh secret. The
+// secret is not used for login until confirmed via /account/mfa/activate.
+func mfaEnrollHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    username := authUsername(r)
+    m, err := getUserMFA(username)
+    if err != nil {
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+    if m != nil && m.Enabled {
+        http.Error(w, "Two-factor authentication already enabled", http.StatusConflict)
+        return
+    }
+    secret := newTOTPSecret()
+    if err := saveUserMFA(username, &userMFA{Secret: secret}); err != nil {
+        log.Println("mfa enroll error:", err)
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]string{
+        "secret":     secret,
+        "otpauthUri": otpauthURI(username, secret),
+    })
+}
+
+func mfaActivateHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    var payload struct {
+        Code string `json:"code"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+        http.Error(w, "Invalid JSON", http.StatusBadRequest)
+        return
+    }
+    username := authUsername(r)
+    m, err := getUserMFA(username)
+    if err != nil {
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+    if m == nil {
+        http.Error(w, "Start enrollment first", http.StatusBadRequest)
+        return
+    }
+    if m.Enabled {
+        http.Error(w, "Two-factor authentication already enabled", http.StatusConflict)
+        return
+    }
+    step, ok := verifyTOTP(m.Secret, strings.TrimSpace(payload.Code), 0)
+    if !ok {
+        http.Error(w, "Invalid code", http.StatusBadRequest)
+        return
+    }
+    plain, hashes := newRecoveryCodes()
+    m.Enabled = true
+    m.LastUsedStep = step
+    m.RecoveryCodes = hashes
+    if err := saveUserMFA(username, m); err != nil {
+        log.Println("mfa activate error:", err)
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+    log.Printf("🔐 Two-factor authentication enabled for %s", username)
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{"enabled": true, "recoveryCodes": plain})
+}
+
+func mfaDisableHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    var payload struct {
+        Password string `json:"password"`
+        Code     string `json:"code"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+        http.Error(w, "Invalid JSON", http.StatusBadRequest)
+        return
+    }
+    if mfaRequired.Load() {
+        http.Error(w, "Two-factor authentication is required on this server", http.StatusForbidden)
+        return
+    }
+    username := authUsername(r)
+    userKey, ipKey := loginThrottleKeys(username, r)
+    if wait := reserveAuthAttempt(userKey, ipKey); wait > 0 {
+        rejectThrottled(w, wait)
+        return
+    }
+    hash, err := getUserPasswordHash(username)
+    if err != nil {
+        http.Error(w, "User not found", http.StatusNotFound)
+        return
+    }
+    if ok, _ := verifyPassword(hash, payload.Password); !ok {
+        http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+        return
+    }
+    if err := checkMFACode(username, payload.Code); err != nil {
+        http.Error(w, "Invalid code", http.StatusUnauthorized)
+        return
+    }
+    authAttemptSucceeded(userKey, ipKey)
+    if err := deleteUserMFA(username); err != nil {
+        log.Println("mfa disable error:", err)
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+    log.Printf("🔓 Two-factor authentication disabled for %s", username)
+    w.WriteHeader(http.StatusOK)
+    w.Write([]byte("Two-factor authentication disabled"))
+}
+
+// adminMFAPolicyHandler lets admins read or set the require-2FA switch.
+func adminMFAPolicyHandler(w http.ResponseWriter, r *http.Request) {
+    username := authUsername(r)
+    if !isAdmin(username) {
+        http.Error(w, "Forbidden", http.StatusForbidden)
+        return
+    }
+    switch r.Method {
+    case http.MethodGet:
+    case http.MethodPut:
+        var payload struct {
+            Required bool `json:"required"`
+        }
+        if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+            http.Error(w, "Invalid JSON", http.StatusBadRequest)
+            return
+        }
+        if err := setMFARequired(payload.Required, username); err != nil {
+            log.Println("set mfa policy error:", err)
+            http.Error(w, "Server error", http.StatusInternalServerError)
+            return
+        }
+        log.Printf("🛡️ %s set required 2FA to %v", username, payload.Required)
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]bool{"required": mfaRequired.Load()})
+}
+
+// -------------------- MFA DB Helpers --------------------
+
+func dbGetUserMFA(ctx context.Context, username string) (*userMFA, error) {
+    var m userMFA
+    err := dbPool.QueryRow(ctx, `
+        SELECT secret, enabled, recovery_codes, last_used_step FROM user_mfa WHERE username=$1
+    `, username).Scan(&m.Secret, &m.Enabled, &m.RecoveryCodes, &m.LastUsedStep)
+    if err != nil {
+        if errors.Is(err, pgx.ErrNoRows) {
+            return nil, nil
+        }
+        return nil, err
+    }
+    return &m, nil
+}
+
+func dbSaveUserMFA(ctx context.Context, username string, m *userMFA) error {
+    codes := m.RecoveryCodes
+    if codes == nil {
+        codes = []string{}
+    }
+    _, err := dbPool.Exec(ctx, `
+        INSERT INTO user_mfa (username, secret, enabled, recovery_codes, last_used_step, enabled_at)
+        VALUES ($1, $2, $3, $4, $5, CASE WHEN $3 THEN NOW() END)
+        ON CONFLICT (username) DO UPDATE
+        SET secret=EXCLUDED.secret, enabled=EXCLUDED.enabled, recovery_codes=EXCLUDED.recovery_codes,
+            last_used_step=EXCLUDED.last_used_step, enabled_at=EXCLUDED.enabled_at
+    `, username, m.Secret, m.Enabled, codes, m.LastUsedStep)
+    return err
+}
+
+// dbCheckMFACode verifies and consumes a code inside a row-locking
+// transaction so two concurrent logins cannot reuse the same code.
+func dbCheckMFACode(ctx context.Context, username, code string) error {
+    tx, err := dbPool.Begin(ctx)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback(ctx)
+    var m userMFA
+    err = tx.QueryRow(ctx, `
+        SELECT secret, enabled, recovery_codes, last_used_step FROM user_mfa
+        WHERE username=$1 FOR UPDATE
+    `, username).Scan(&m.Secret, &m.Enabled, &m.RecoveryCodes, &m.LastUsedStep)
+    if err != nil {
+        if errors.Is(err, pgx.ErrNoRows) {
+            return errMFAInvalidCode
+        }
+        return err
+    }
+    if !m.Enabled {
+        return errMFAInvalidCode
+    }
+    if step, ok := verifyTOTP(m.Secret, strings.TrimSpace(code), m.LastUsedStep); ok {
+        if _, err := tx.Exec(ctx, `UPDATE user_mfa SET last_used_step=$1 WHERE username=$2`, step, username); err != nil {
+            return err
+        }
+        return tx.Commit(ctx)
+    }
+    h := hashRecoveryCode(code)
+    for _, rc := range m.RecoveryCodes {
+        if subtle.ConstantTimeCompare([]byte(rc), []byte(h)) == 1 {
+            if _, err := tx.Exec(ctx, `UPDATE user_mfa SET recovery_codes=array_remove(recovery_codes, $1) WHERE username=$2`, rc, username); err != nil {
+                return err
+            }
+            return tx.Commit(ctx)
+        }
+    }
+    return errMFAInvalidCode
+}
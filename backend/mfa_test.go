@@ -0,0 +1,77 @@
+package main
+
+import (
+    "testing"
+    "time"
+)
+
+func TestTOTPCodeRFC6238(t *testing.T) {
+    // RFC 6238 appendix B (SHA-1), truncated to our six digits
+    secret := []byte("12345678901234567890")
+    tests := []struct {
+        unix int64
+        want string
+    }{
+        {59, "287082"},
+        {1111111109, "081804"},
+        {1234567890, "005924"},
+        {2000000000, "279037"},
+    }
+    for _, tt := range tests {
+        if got := totpCode(secret, tt.unix/totpPeriod); got != tt.want {
+            t.Errorf("totpCode at %d = %s, want %s", tt.unix, got, tt.want)
+        }
+    }
+}
+
+func TestVerifyTOTPSteps(t *testing.T) {
+    secret := newTOTPSecret()
+    key, _ := b32.DecodeString(secret)
+    now := time.Now().Unix() / totpPeriod
+
+    for _, d := range []int64{-totpSkew, 0, totpSkew} {
+        if step, ok := verifyTOTP(secret, totpCode(key, now+d), 0); !ok || step != now+d {
+            t.Errorf("step %+d: got %d/%v", d, step, ok)
+        }
+    }
+    if _, ok := verifyTOTP(secret, totpCode(key, now-totpSkew-1), 0); ok {
+        t.Error("code outside the skew window accepted")
+    }
+    // A code for a step at or before the last used one is a replay
+    if _, ok := verifyTOTP(secret, totpCode(key, now), now); ok {
+        t.Error("replayed code accepted")
+    }
+    if _, ok := verifyTOTP(secret, totpCode(key, now-1), now); ok {
+        t.Error("code older than the last used step accepted")
+    }
+    if _, ok := verifyTOTP(secret, "12345", 0); ok {
+        t.Error("short code accepted")
+    }
+}
+
+func TestCheckMFACodeRejectsReuse(t *testing.T) {
+    secret := newTOTPSecret()
+    key, _ := b32.DecodeString(secret)
+    plain, hashes := newRecoveryCodes()
+    if err := saveUserMFA("mfa_user", &userMFA{Secret: secret, Enabled: true, RecoveryCodes: hashes}); err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { deleteUserMFA("mfa_user") })
+
+    code := totpCode(key, time.Now().Unix()/totpPeriod)
+    if err := checkMFACode("mfa_user", code); err != nil {
+        t.Fatalf("fresh code: %v", err)
+    }
+    if err := checkMFACode("mfa_user", code); err != errMFAInvalidCode {
+        t.Fatalf("same code again: %v", err)
+    }
+    if err := checkMFACode("mfa_user", " "+plain[3]+" "); err != nil {
+        t.Fatalf("recovery code: %v", err)
+    }
+    if err := checkMFACode("mfa_user", plain[3]); err != errMFAInvalidCode {
+        t.Fatalf("recovery code reused: %v", err)
+    }
+    if m, _ := getUserMFA("mfa_user"); len(m.RecoveryCodes) != recoveryCodeCount-1 {
+        t.Fatalf("%d recovery codes left", len(m.RecoveryCodes))
+    }
+}
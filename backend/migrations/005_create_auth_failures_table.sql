@@ -0,0 +1,9 @@
+-- Failed password attempts per username / IP for login throttling and lockout
+CREATE TABLE IF NOT EXISTS auth_failures (
+    key VARCHAR(255) PRIMARY KEY,
+    failures INTEGER NOT NULL DEFAULT 0,
+    last_failure TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    locked_until TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS auth_failures_last_failure_idx ON auth_failures (last_failure);
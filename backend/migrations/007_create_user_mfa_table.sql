@@ -0,0 +1,18 @@
+-- TOTP two-factor authentication per user
+CREATE TABLE IF NOT EXISTS user_mfa (
+    username TEXT PRIMARY KEY REFERENCES users(username) ON DELETE CASCADE,
+    secret TEXT NOT NULL,
+    enabled BOOLEAN NOT NULL DEFAULT FALSE,
+    recovery_codes TEXT[] NOT NULL DEFAULT '{}', -- SHA-256 hashes, removed when used
+    last_used_step BIGINT NOT NULL DEFAULT 0,    -- rejects replay of an accepted code
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    enabled_at TIMESTAMPTZ
+);
+
+-- Server-wide settings changed at runtime by admins
+CREATE TABLE IF NOT EXISTS server_settings (
+    key VARCHAR(100) PRIMARY KEY,
+    value JSONB NOT NULL,
+    updated_by TEXT,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
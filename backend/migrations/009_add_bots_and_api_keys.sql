@@ -0,0 +1,23 @@
+-- Bot accounts: regular users flagged as bots, owned by a human user
+ALTER TABLE users ADD COLUMN IF NOT EXISTS is_bot BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS bot_owner TEXT REFERENCES users(username) ON DELETE CASCADE;
+
+-- Messages posted by bots are badged in clients
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS bot BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- Scoped API keys for bots; only a SHA-256 of the secret part is stored
+CREATE TABLE IF NOT EXISTS api_keys (
+    id VARCHAR(32) PRIMARY KEY,
+    username TEXT NOT NULL REFERENCES users(username) ON DELETE CASCADE,
+    name VARCHAR(100) NOT NULL DEFAULT '',
+    key_hash VARCHAR(64) NOT NULL,
+    scopes TEXT[] NOT NULL DEFAULT '{}',
+    rooms TEXT[] NOT NULL DEFAULT '{}', -- empty means every room
+    created_by TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    last_used_at TIMESTAMPTZ,
+    expires_at TIMESTAMPTZ,
+    revoked_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS api_keys_username_idx ON api_keys (username);
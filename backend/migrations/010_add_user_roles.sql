@@ -0,0 +1,11 @@
+-- Global roles: admin, moderator, member, suspended
+ALTER TABLE users ADD COLUMN IF NOT EXISTS role VARCHAR(20) NOT NULL DEFAULT 'member';
+
+DO $$
+BEGIN
+    ALTER TABLE users ADD CONSTRAINT users_role_check CHECK (role IN ('admin', 'moderator', 'member', 'suspended'));
+EXCEPTION
+    WHEN duplicate_object THEN NULL;
+END $$;
+
+CREATE INDEX IF NOT EXISTS users_role_idx ON users (role) WHERE role <> 'member';
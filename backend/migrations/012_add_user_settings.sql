@@ -0,0 +1,18 @@
+-- Versioned per-user settings document (replaces the dark_mode column)
+ALTER TABLE users ADD COLUMN IF NOT EXISTS settings JSONB NOT NULL DEFAULT '{}';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS settings_version INTEGER NOT NULL DEFAULT 0;
+
+-- Carry dark mode over into rows not yet migrated (settings_version > 0
+-- means settings is authoritative), then drop the column so nothing reads a
+-- stale copy. Guarded because migrations run again on every start.
+DO $$
+BEGIN
+    IF EXISTS (
+        SELECT 1 FROM information_schema.columns
+        WHERE table_schema = current_schema() AND table_name = 'users' AND column_name = 'dark_mode'
+    ) THEN
+        UPDATE users SET settings = settings || jsonb_build_object('darkMode', TRUE), settings_version = 1
+        WHERE dark_mode AND settings_version = 0;
+        ALTER TABLE users DROP COLUMN dark_mode;
+    END IF;
+END $$;
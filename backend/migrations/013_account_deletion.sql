@@ -0,0 +1,22 @@
+-- Placeholder account that keeps the messages of deleted users in shared rooms.
+-- It has an unusable password and is suspended, so it can never log in.
+INSERT INTO users (username, password_hash, role) VALUES ('[deleted]', '\x', 'suspended')
+ON CONFLICT (username) DO NOTHING;
+
+-- messages.username used to be ON DELETE CASCADE, which silently wiped a
+-- deleted user's history from every room. The server now reassigns or removes
+-- those messages itself (ACCOUNT_DELETION_POLICY), so the FK only guards
+-- against leftovers.
+DO $$
+BEGIN
+    IF EXISTS (
+        SELECT 1 FROM pg_constraint
+        WHERE conname = 'messages_username_fkey' AND confdeltype = 'c'
+    ) THEN
+        ALTER TABLE messages DROP CONSTRAINT messages_username_fkey;
+        ALTER TABLE messages ADD CONSTRAINT messages_username_fkey
+            FOREIGN KEY (username) REFERENCES users(username) ON UPDATE CASCADE;
+    END IF;
+END $$;
+
+CREATE INDEX IF NOT EXISTS messages_username_idx ON messages (username);
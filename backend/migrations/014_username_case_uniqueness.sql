@@ -0,0 +1,24 @@
+-- Usernames are unique case-insensitively. Accounts created before this rule
+-- may collide (e.g. "Alice" and "alice"); they are recorded here on every
+-- start and logged by the server until an admin renames or deletes one side.
+CREATE TABLE IF NOT EXISTS username_collisions (
+    folded TEXT PRIMARY KEY,
+    usernames TEXT[] NOT NULL,
+    detected_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+DELETE FROM username_collisions;
+
+INSERT INTO username_collisions (folded, usernames)
+SELECT lower(username), array_agg(username ORDER BY created_at)
+FROM users
+GROUP BY lower(username)
+HAVING COUNT(*) > 1;
+
+-- The index can only be built once no collisions remain.
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM username_collisions) THEN
+        CREATE UNIQUE INDEX IF NOT EXISTS users_username_lower_idx ON users (lower(username));
+    END IF;
+END $$;
@@ -0,0 +1,8 @@
+-- User-chosen presence, kept across reconnects
+CREATE TABLE IF NOT EXISTS user_presence (
+    username TEXT PRIMARY KEY REFERENCES users(username) ON DELETE CASCADE,
+    status VARCHAR(16) NOT NULL DEFAULT 'online',
+    status_text VARCHAR(100) NOT NULL DEFAULT '',
+    expires_at TIMESTAMPTZ, -- NULL keeps the status until changed
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
@@ -0,0 +1,13 @@
+-- Per-room sequence numbers and the recent events kept for resume/replay
+CREATE TABLE IF NOT EXISTS room_sequences (
+    room VARCHAR(50) PRIMARY KEY,
+    seq BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS room_events (
+    room VARCHAR(50) NOT NULL,
+    seq BIGINT NOT NULL,
+    payload JSONB NOT NULL, -- the frame as broadcast, including its seq
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (room, seq)
+);
@@ -0,0 +1,3 @@
+-- History pages filter on room = $1 so they can use messages_room_timestamp_idx;
+-- rows from before rooms existed are in 'general'
+UPDATE messages SET room = 'general' WHERE room IS NULL;
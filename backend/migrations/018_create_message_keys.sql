@@ -0,0 +1,10 @@
+-- Idempotency keys of recent sends, so a retransmitted message is acked with
+-- the original instead of being stored twice (IDEMPOTENCY_WINDOW)
+CREATE TABLE IF NOT EXISTS message_keys (
+    username TEXT NOT NULL REFERENCES users(username) ON DELETE CASCADE,
+    idempotency_key VARCHAR(64) NOT NULL,
+    message_id BIGINT NOT NULL,
+    seq BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (username, idempotency_key)
+);
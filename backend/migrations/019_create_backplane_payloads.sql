@@ -0,0 +1,9 @@
+-- Backplane messages too big for a NOTIFY payload (8000 bytes); the
+-- notification carries the row ID and rows are pruned after a few minutes
+CREATE TABLE IF NOT EXISTS backplane_payloads (
+    id BIGSERIAL PRIMARY KEY,
+    payload TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS backplane_payloads_created_at_idx ON backplane_payloads (created_at);
@@ -0,0 +1,8 @@
+-- Users who gave a password-protected room's password to /rooms/join; they
+-- may read it over WebSocket and history without giving it again
+CREATE TABLE IF NOT EXISTS room_members (
+    room VARCHAR(50) NOT NULL REFERENCES rooms(name) ON DELETE CASCADE,
+    username TEXT NOT NULL REFERENCES users(username) ON DELETE CASCADE ON UPDATE CASCADE,
+    joined_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (room, username)
+);
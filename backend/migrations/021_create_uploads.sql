@@ -0,0 +1,11 @@
+-- Who uploaded each file under uploads/, so deleting an account removes only
+-- that user's files. Files from before this table have no row and are kept.
+CREATE TABLE IF NOT EXISTS uploads (
+    name TEXT PRIMARY KEY,
+    username TEXT NOT NULL REFERENCES users(username) ON DELETE CASCADE ON UPDATE CASCADE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS uploads_username_idx ON uploads (username);
+-- Account deletion looks up whether a file is still attached to a message
+CREATE INDEX IF NOT EXISTS messages_file_url_idx ON messages (file_url) WHERE file_url IS NOT NULL;
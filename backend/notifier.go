@@ -0,0 +1,137 @@
+package main
+
+import (
+    "context"
+    "crypto/tls"
+    "fmt"
+    "log"
+    "net"
+    "net/smtp"
+    "os"
+    "strings"
+    "time"
+)
+
+// -------------------- Notifications --------------------
+
+// Notification is an out-of-band message to a user, e.g. a password reset link.
+type Notification struct {
+    To       string // email address, may be empty
+    Username string
+    Subject  string
+    Body     string
+}
+
+// Notifier delivers account notifications. Selected with NOTIFIER=smtp|log.
+type Notifier interface {
+    Send(ctx context.Context, n Notification) error
+}
+
+var notifier Notifier = logNotifier{}
+
+func initNotifier() {
+    switch strings.ToLower(os.Getenv("NOTIFIER")) {
+    case "smtp":
+        port := os.Getenv("SMTP_PORT")
+        if port == "" {
+            port = "25"
+        }
+        from := os.Getenv("SMTP_FROM")
+        if from == "" {
+            from = "chatbox@localhost"
+        }
+        notifier = smtpNotifier{
+            Addr:     net.JoinHostPort(os.Getenv("SMTP_HOST"), port),
+            Host:     os.Getenv("SMTP_HOST"),
+            Username: os.Getenv("SMTP_USER"),
+            Password: os.Getenv("SMTP_PASS"),
+            From:     from,
+        }
+        log.Println("📧 Notifications via SMTP:", os.Getenv("SMTP_HOST"))
+    default:
+        notifier = logNotifier{}
+    }
+}
+
+// logNotifier writes notifications to the server log. Development only:
+// reset tokens end up in the log.
+type logNotifier struct{}
+
+func (logNotifier) Send(ctx context.Context, n Notification) error {
+    log.Printf("📧 [notify] to=%s user=%s subject=%q\n%s", n.To, n.Username, n.Subject, n.Body)
+    return nil
+}
+
+// smtpNotifier sends plain-text email. Auth is skipped when no username is
+// configured, which is what local stand-ins like Mailpit expect.
+type smtpNotifier struct {
+    Addr     string
+    Host     string
+    Username string
+    Password string
+    From     string
+}
+
+// smtpTimeout bounds a send when the caller's context has no deadline.
+const smtpTimeout = 30 * time.Second
+
+// Send delivers n like smtp.SendMail, but gives up when ctx is done so a
+// hung mail server cannot hold the request that triggered it.
+func (s smtpNotifier) Send(ctx context.Context, n Notification) error {
+    if n.To == "" {
+        return fmt.Errorf("no email address for %s", n.Username)
+    }
+    if _, ok := ctx.Deadline(); !ok {
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithTimeout(ctx, smtpTimeout)
+        defer cancel()
+    }
+    var d net.Dialer
+    conn, err := d.DialContext(ctx, "tcp", s.Addr)
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+    deadline, _ := ctx.Deadline()
+    conn.SetDeadline(deadline)
+    stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+    defer stop()
+
+    c, err := smtp.NewClient(conn, s.Host)
+    if err != nil {
+        return err
+    }
+    defer c.Close()
+    if ok, _ := c.Extension("STARTTLS"); ok {
+        if err := c.StartTLS(&tls.Config{ServerName: s.Host}); err != nil {
+            return err
+        }
+    }
+    if s.Username != "" {
+        if err := c.Auth(smtp.PlainAuth("", s.Username, s.Password, s.Host)); err != nil {
+            return err
+        }
+    }
+    if err := c.Mail(s.From); err != nil {
+        return err
+    }
+    if err := c.Rcpt(n.To); err != nil {
+        return err
+    }
+    wc, err := c.Data()
+    if err != nil {
+        return err
+    }
+    msg := "From: " + s.From + "\r\n" +
+        "To: " + n.To + "\r\n" +
+        "Subject: " + n.Subject + "\r\n" +
+        "Content-Type: text/plain; charset=utf-8\r\n" +
+        "\r\n" + n.Body
+    if _, err := wc.Write([]byte(msg)); err != nil {
+        return err
+    }
+    if err := wc.Close(); err != nil {
+        return err
+    }
+    return c.Quit()
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+    "context"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestSMTPNotifierHonoursContext(t *testing.T) {
+    // A server that accepts and never greets
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer ln.Close()
+    go func() {
+        for {
+            c, err := ln.Accept()
+            if err != nil {
+                return
+            }
+            defer c.Close()
+        }
+    }()
+
+    n := smtpNotifier{Addr: ln.Addr().String(), Host: "127.0.0.1", From: "chatbox@localhost"}
+    ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+    defer cancel()
+    start := time.Now()
+    err = n.Send(ctx, Notification{To: "victim@example.com", Username: "victim", Subject: "x", Body: "y"})
+    if err == nil {
+        t.Fatal("send to a hung server succeeded")
+    }
+    if d := time.Since(start); d > 2*time.Second {
+        t.Fatalf("send took %s, want it bounded by the context", d)
+    }
+}
+
+func TestPasswordResetThrottledPerIP(t *testing.T) {
+    withTestThrottle(t)
+    status := func() int {
+        r := httptest.NewRequest(http.MethodPost, "/password/reset", strings.NewReader(`{"username":"nobody-here"}`))
+        r.RemoteAddr = "198.51.100.20:4000"
+        w := httptest.NewRecorder()
+        requestPasswordResetHandler(w, r)
+        return w.Code
+    }
+    for i := 0; i <= throttle.FreeAttempts; i++ {
+        if code := status(); code != http.StatusOK {
+            t.Fatalf("request %d: status %d, want 200", i+1, code)
+        }
+    }
+    if code := status(); code != http.StatusTooManyRequests {
+        t.Fatalf("status %d after %d requests, want 429", code, throttle.FreeAttempts+1)
+    }
+}
+
+// blockingNotifier holds every send until release is closed.
+type blockingNotifier struct {
+    release chan struct{}
+    sent    chan Notification
+}
+
+func (n blockingNotifier) Send(ctx context.Context, msg Notification) error {
+    select {
+    case <-n.release:
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+    n.sent <- msg
+    return nil
+}
+
+func TestPasswordResetAnswersBeforeSending(t *testing.T) {
+    withTestThrottle(t)
+    t.Setenv("RESET_URL_BASE", "")
+    testUser(t, "reset_async")
+    n := blockingNotifier{release: make(chan struct{}), sent: make(chan Notification, 1)}
+    old := notifier
+    notifier = n
+    t.Cleanup(func() { notifier = old })
+
+    r := httptest.NewRequest(http.MethodPost, "/password/reset", strings.NewReader(`{"username":"reset_async"}`))
+    w := httptest.NewRecorder()
+    requestPasswordResetHandler(w, r)
+    if w.Code != http.StatusOK {
+        t.Fatalf("status %d", w.Code)
+    }
+
+    // The handler returned with the mail still stuck; now let it through
+    close(n.release)
+    var msg Notification
+    select {
+    case msg = <-n.sent:
+    case <-time.After(5 * time.Second):
+        t.Fatal("reset email never sent")
+    }
+    _, token, _ := strings.Cut(msg.Body, "Your reset code is:\n")
+    token, _, _ = strings.Cut(token, "\n")
+    if msg.To != "reset_async@example.com" || token == "" {
+        t.Fatalf("notification %+v", msg)
+    }
+    if username, err := lookupPasswordReset(hashResetToken(token)); err != nil || username != "reset_async" {
+        t.Fatalf("token from the email: %q %v", username, err)
+    }
+}
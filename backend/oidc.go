@@ -0,0 +1,562 @@
+package main
+
+import (
+    "context"
+    "crypto"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rsa"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "math/big"
+    "net/http"
+    "net/url"
+    "os"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/jackc/pgx/v5"
+)
+
+// -------------------- OpenID Connect --------------------
+
+// oidcProvider implements the authorization-code flow with PKCE against a
+// single issuer. All endpoints come from discovery, so pointing Issuer at an
+// httptest server is enough to run the flow against a mock IdP (see
+// oidc_test.go).
+type oidcProvider struct {
+    Issuer         string
+    ClientID       string
+    ClientSecret   string
+    RedirectURL    string
+    Scopes         []string
+    UsernameClaim  string // claim mapped to the ChatBox username
+    PostLoginURL   string // frontend URL to land on after login
+    LinkByUsername bool   // link to an existing local member with the same name and verified email
+    HTTPClient     *http.Client
+
+    mu   sync.Mutex
+    meta *oidcMetadata
+    keys map[string]crypto.PublicKey // by kid
+}
+
+type oidcMetadata struct {
+    Issuer                string `json:"issuer"`
+    AuthorizationEndpoint string `json:"authorization_endpoint"`
+    TokenEndpoint         string `json:"token_endpoint"`
+    JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcFlowState travels in a signed cookie between /start and /callback.
+type oidcFlowState struct {
+    State     string `json:"st"`
+    Nonce     string `json:"n"`
+    Verifier  string `json:"v"`
+    ExpiresAt int64  `json:"exp"`
+}
+
+const (
+    oidcStateCookie = "chatbox_oidc"
+    oidcFlowTTL     = 10 * time.Minute
+)
+
+var (
+    oidc *oidcProvider // nil when OIDC_ISSUER is not set
+
+    identitiesMu  sync.RWMutex
+    identitiesMap = map[string]string{} // issuer + "|" + subject -> username
+
+    errIdentityNotFound = errors.New("identity not found")
+)
+
+func initOIDC() {
+    issuer := strings.TrimRight(os.Getenv("OIDC_ISSUER"), "/")
+    if issuer == "" {
+        return
+    }
+    scopes := strings.Fields(os.Getenv("OIDC_SCOPES"))
+    if len(scopes) == 0 {
+        scopes = []string{"openid", "profile", "email"}
+    }
+    claim := os.Getenv("OIDC_USERNAME_CLAIM")
+    if claim == "" {
+        claim = "preferred_username"
+    }
+    oidc = &oidcProvider{
+        Issuer:         issuer,
+        ClientID:       os.Getenv("OIDC_CLIENT_ID"),
+        ClientSecret:   os.Getenv("OIDC_CLIENT_SECRET"),
+        RedirectURL:    os.Getenv("OIDC_REDIRECT_URL"),
+        Scopes:         scopes,
+        UsernameClaim:  claim,
+        PostLoginURL:   os.Getenv("OIDC_POST_LOGIN_URL"),
+        LinkByUsername: os.Getenv("OIDC_LINK_BY_USERNAME") == "true",
+        HTTPClient:     &http.Client{Timeout: 10 * time.Second},
+    }
+    log.Println("🔗 OpenID Connect enabled for issuer:", issuer)
+}
+
+func (p *oidcProvider) getJSON(ctx context.Context, u string, v interface{}) error {
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+    if err != nil {
+        return err
+    }
+    resp, err := p.HTTPClient.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return fmt.Errorf("GET %s: %s", u, resp.Status)
+    }
+    return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+func (p *oidcProvider) discover(ctx context.Context) (*oidcMetadata, error) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    if p.meta != nil {
+        return p.meta, nil
+    }
+    var m oidcMetadata
+    if err := p.getJSON(ctx, p.Issuer+"/.well-known/openid-configuration", &m); err != nil {
+        return nil, fmt.Errorf("oidc discovery: %w", err)
+    }
+    if strings.TrimRight(m.Issuer, "/") != p.Issuer {
+        return nil, fmt.Errorf("oidc discovery: issuer mismatch %q", m.Issuer)
+    }
+    if m.AuthorizationEndpoint == "" || m.TokenEndpoint == "" || m.JWKSURI == "" {
+        return nil, fmt.Errorf("oidc discovery: incomplete metadata")
+    }
+    p.meta = &m
+    return p.meta, nil
+}
+
+// publicKey returns the signing key for kid, refetching the JWKS once when
+// the key is unknown (the IdP may have rotated).
+func (p *oidcProvider) publicKey(ctx context.Context, kid string) (crypto.PublicKey, error) {
+    p.mu.Lock()
+    key, ok := p.keys[kid]
+    p.mu.Unlock()
+    if ok {
+        return key, nil
+    }
+    meta, err := p.discover(ctx)
+    if err != nil {
+        return nil, err
+    }
+    var set struct {
+        Keys []struct {
+            Kid string `json:"kid"`
+            Kty string `json:"kty"`
+            Use string `json:"use"`
+            N   string `json:"n"`
+            E   string `json:"e"`
+            Crv string `json:"crv"`
+            X   string `json:"x"`
+            Y   string `json:"y"`
+        } `json:"keys"`
+    }
+    if err := p.getJSON(ctx, meta.JWKSURI, &set); err != nil {
+        return nil, fmt.Errorf("oidc jwks: %w", err)
+    }
+    keys := make(map[string]crypto.PublicKey)
+    for _, k := range set.Keys {
+        if k.Use != "" && k.Use != "sig" {
+            continue
+        }
+        switch k.Kty {
+        case "RSA":
+            n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+            e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+            if err1 != nil || err2 != nil {
+                continue
+            }
+            keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+        case "EC":
+            if k.Crv != "P-256" {
+                continue
+            }
+            x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+            y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+            if err1 != nil || err2 != nil {
+                continue
+            }
+            keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+        }
+    }
+    p.mu.Lock()
+    p.keys = keys
+    p.mu.Unlock()
+    if key, ok := keys[kid]; ok {
+        return key, nil
+    }
+    return nil, fmt.Errorf("oidc: unknown signing key %q", kid)
+}
+
+// exchangeCode redeems an authorization code and returns the raw ID token.
+func (p *oidcProvider) exchangeCode(ctx context.Context, code, verifier string) (string, error) {
+    meta, err := p.discover(ctx)
+    if err != nil {
+        return "", err
+    }
+    form := url.Values{}
+    form.Set("grant_type", "authorization_code")
+    form.Set("code", code)
+    form.Set("redirect_uri", p.RedirectURL)
+    form.Set("client_id", p.ClientID)
+    form.Set("code_verifier", verifier)
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, meta.TokenEndpoint, strings.NewReader(form.Encode()))
+    if err != nil {
+        return "", err
+    }
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    req.Header.Set("Accept", "application/json")
+    if p.ClientSecret != "" {
+        req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+    }
+    resp, err := p.HTTPClient.Do(req)
+    if err != nil {
+        return "", err
+    }
+    defer resp.Body.Close()
+    var tok struct {
+        IDToken string `json:"id_token"`
+        Error   string `json:"error"`
+    }
+    if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tok); err != nil {
+        return "", fmt.Errorf("oidc token response: %w", err)
+    }
+    if resp.StatusCode != http.StatusOK || tok.IDToken == "" {
+        return "", fmt.Errorf("oidc token exchange failed: %s %s", resp.Status, tok.Error)
+    }
+    return tok.IDToken, nil
+}
+
+// verifyIDToken checks the JWT signature (RS256 or ES256), issuer, audience,
+// expiry and nonce, and returns its claims.
+func (p *oidcProvider) verifyIDToken(ctx context.Context, raw, nonce string) (map[string]interface{}, error) {
+    parts := strings.Split(raw, ".")
+    if len(parts) != 3 {
+        return nil, errInvalidToken
+    }
+    var header struct {
+        Alg string `json:"alg"`
+        Kid string `json:"kid"`
+    }
+    hb, err := base64.RawURLEncoding.DecodeString(parts[0])
+    if err != nil || json.Unmarshal(hb, &header) != nil {
+        return nil, errInvalidToken
+    }
+    sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+    if err != nil {
+        return nil, errInvalidToken
+    }
+    key, err := p.publicKey(ctx, header.Kid)
+    if err != nil {
+        return nil, err
+    }
+    digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+    switch k := key.(type) {
+    case *rsa.PublicKey:
+        if header.Alg != "RS256" || rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) != nil {
+            return nil, errInvalidToken
+        }
+    case *ecdsa.PublicKey:
+        if header.Alg != "ES256" || len(sig) != 64 {
+            return nil, errInvalidToken
+        }
+        r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+        if !ecdsa.Verify(k, digest[:], r, s) {
+            return nil, errInvalidToken
+        }
+    default:
+        return nil, errInvalidToken
+    }
+
+    pb, err := base64.RawURLEncoding.DecodeString(parts[1])
+    if err != nil {
+        return nil, errInvalidToken
+    }
+    var claims map[string]interface{}
+    if err := json.Unmarshal(pb, &claims); err != nil {
+        return nil, errInvalidToken
+    }
+    if iss, _ := claims["iss"].(string); strings.TrimRight(iss, "/") != p.Issuer {
+        return nil, fmt.Errorf("oidc: wrong issuer %q", iss)
+    }
+    audOK := false
+    switch aud := claims["aud"].(type) {
+    case string:
+        audOK = aud == p.ClientID
+    case []interface{}:
+        for _, a := range aud {
+            if a == p.ClientID {
+                audOK = true
+            }
+        }
+    }
+    if !audOK {
+        return nil, fmt.Errorf("oidc: token not issued for this client")
+    }
+    exp, _ := claims["exp"].(float64)
+    if time.Now().Unix() >= int64(exp) {
+        return nil, errExpiredToken
+    }
+    if n, _ := claims["nonce"].(string); n != nonce {
+        return nil, fmt.Errorf("oidc: nonce mismatch")
+    }
+    return claims, nil
+}
+
+// -------------------- OIDC Handlers --------------------
+
+func oidcStartHandler(w http.ResponseWriter, r *http.Request) {
+    if oidc == nil {
+        http.Error(w, "Single sign-on is not configured", http.StatusNotFound)
+        return
+    }
+    meta, err := oidc.discover(r.Context())
+    if err != nil {
+        log.Println(err)
+        http.Error(w, "Identity provider unavailable", http.StatusBadGateway)
+        return
+    }
+    st := oidcFlowState{
+        State:     randomToken(16),
+        Nonce:     randomToken(16),
+        Verifier:  randomToken(32),
+        ExpiresAt: time.Now().Add(oidcFlowTTL).Unix(),
+    }
+    cookie, err := signBlob("oidc", st)
+    if err != nil {
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+    http.SetCookie(w, &http.Cookie{
+        Name:     oidcStateCookie,
+        Value:    cookie,
+        Path:     "/auth/oidc",
+        MaxAge:   int(oidcFlowTTL.Seconds()),
+        HttpOnly: true,
+        Secure:   r.TLS != nil || os.Getenv("COOKIE_SECURE") == "true",
+        SameSite: http.SameSiteLaxMode,
+    })
+    challenge := sha256.Sum256([]byte(st.Verifier))
+    q := url.Values{}
+    q.Set("response_type", "code")
+    q.Set("client_id", oidc.ClientID)
+    q.Set("redirect_uri", oidc.RedirectURL)
+    q.Set("scope", strings.Join(oidc.Scopes, " "))
+    q.Set("state", st.State)
+    q.Set("nonce", st.Nonce)
+    q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+    q.Set("code_challenge_method", "S256")
+    sep := "?"
+    if strings.Contains(meta.AuthorizationEndpoint, "?") {
+        sep = "&"
+    }
+    http.Redirect(w, r, meta.AuthorizationEndpoint+sep+q.Encode(), http.StatusFound)
+}
+
+func oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+    if oidc == nil {
+        http.Error(w, "Single sign-on is not configured", http.StatusNotFound)
+        return
+    }
+    q := r.URL.Query()
+    if e := q.Get("error"); e != "" {
+        http.Error(w, "Sign-in was cancelled or denied: "+e, http.StatusUnauthorized)
+        return
+    }
+    c, err := r.Cookie(oidcStateCookie)
+    if err != nil {
+        http.Error(w, "Sign-in session expired, please try again", http.StatusBadRequest)
+        return
+    }
+    var st oidcFlowState
+    if err := openBlob("oidc", c.Value, &st); err != nil || time.Now().Unix() >= st.ExpiresAt || q.Get("state") != st.State {
+        http.Error(w, "Invalid sign-in state, please try again", http.StatusBadRequest)
+        return
+    }
+    http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Value: "", Path: "/auth/oidc", MaxAge: -1, HttpOnly: true})
+
+    ctx, cancel := context.WithTimeout(r.Context(), 15*time.Second)
+    defer cancel()
+    rawIDToken, err := oidc.exchangeCode(ctx, q.Get("code"), st.Verifier)
+    if err != nil {
+        log.Println(err)
+        http.Error(w, "Sign-in failed", http.StatusBadGateway)
+        return
+    }
+    claims, err := oidc.verifyIDToken(ctx, rawIDToken, st.Nonce)
+    if err != nil {
+        log.Println("oidc id token rejected:", err)
+        http.Error(w, "Sign-in failed", http.StatusUnauthorized)
+        return
+    }
+    username, err := resolveOIDCUser(claims)
+    if err != nil {
+        log.Println("oidc user mapping error:", err)
+        http.Error(w, "Could not sign in: "+err.Error(), http.StatusConflict)
+        return
+    }
+
+    // Signing in through the IdP replaces the password, not the second
+    // factor: users with 2FA finish at POST /login/mfa like any other login.
+    mfaToken, err := mfaChallengeFor(username)
+    if err != nil {
+        log.Println("mfa lookup error:", err)
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+    if mfaToken != "" {
+        log.Printf("🔗 %s passed OpenID Connect, waiting for 2FA", username)
+        if oidc.PostLoginURL == "" {
+            w.Header().Set("Content-Type", "application/json")
+            json.NewEncoder(w).Encode(map[string]interface{}{"username": username, "mfaRequired": true, "mfaToken": mfaToken})
+            return
+        }
+        frag := url.Values{}
+        frag.Set("mfaToken", mfaToken)
+        frag.Set("username", username)
+        http.Redirect(w, r, oidc.PostLoginURL+"#"+frag.Encode(), http.StatusFound)
+        return
+    }
+
+    token, _, err := startSession(w, r, username)
+    if errors.Is(err, errAccountSuspended) {
+        http.Error(w, "Account suspended", http.StatusForbidden)
+        return
+    }
+    if err != nil {
+        log.Println("create session error:", err)
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+    log.Printf("🔗 %s signed in via OpenID Connect", username)
+    if oidc.PostLoginURL == "" {
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]string{"username": username, "token": token})
+        return
+    }
+    // The fragment never reaches servers or logs; the frontend picks it up
+    // for cross-site deployments where the cookie is not sent.
+    frag := url.Values{}
+    frag.Set("token", token)
+    frag.Set("username", username)
+    http.Redirect(w, r, oidc.PostLoginURL+"#"+frag.Encode(), http.StatusFound)
+}
+
+// resolveOIDCUser returns the ChatBox user linked to the token's subject,
+// linking or creating one on first login.
+func resolveOIDCUser(claims map[string]interface{}) (string, error) {
+    sub, _ := claims["sub"].(string)
+    if sub == "" {
+        return "", fmt.Errorf("token has no subject")
+    }
+    email, _ := claims["email"].(string)
+    if username, err := getIdentity(oidc.Issuer, sub); err == nil {
+        return username, nil
+    } else if !errors.Is(err, errIdentityNotFound) {
+        return "", err
+    }
+
+    raw, _ := claims[oidc.UsernameClaim].(string)
+    if strings.TrimSpace(raw) == "" {
+        return "", fmt.Errorf("claim %q missing from token", oidc.UsernameClaim)
+    }
+    username, err := normalizeUsername(raw)
+    if err != nil {
+        return "", fmt.Errorf("claim %q is not a valid username: %w", oidc.UsernameClaim, err)
+    }
+    if stored, ok := resolveUsername(username); ok {
+        username = stored
+        if !oidc.LinkByUsername {
+            return "", fmt.Errorf("username %q is already taken by a local account", username)
+        }
+        if err := checkOIDCLink(username, email, claims); err != nil {
+            return "", fmt.Errorf("username %q is already taken by a local account: %w", username, err)
+        }
+        log.Printf("🔗 Linking existing user %s to %s subject %s", username, oidc.Issuer, sub)
+    } else {
+        // SSO users get an unusable random password; they can set a real
+        // one later through the reset flow.
+        hash, err := hashPassword(randomToken(32))
+        if err != nil {
+            return "", err
+        }
+        if err := createUser(username, email, hash); err != nil {
+            return "", err
+        }
+        log.Printf("🔗 Created user %s from %s subject %s", username, oidc.Issuer, sub)
+    }
+    if err := linkIdentity(oidc.Issuer, sub, username, email); err != nil {
+        return "", err
+    }
+    return username, nil
+}
+
+// checkOIDCLink decides whether a first sign-in may take over the existing
+// local account username. The IdP must vouch for the email and it must be the
+// one on the account; admins, moderators and bots are never linked this way.
+func checkOIDCLink(username, email string, claims map[string]interface{}) error {
+    verified := claims["email_verified"] == true || claims["email_verified"] == "true"
+    if !verified || email == "" {
+        return fmt.Errorf("linking needs a verified email")
+    }
+    local, err := getUserEmail(username)
+    if err != nil {
+        return err
+    }
+    if !strings.EqualFold(strings.TrimSpace(local), strings.TrimSpace(email)) {
+        return fmt.Errorf("email does not match the account")
+    }
+    if hasRole(username, roleModerator) || isBotUser(username) {
+        return fmt.Errorf("privileged accounts are not linked automatically")
+    }
+    return nil
+}
+
+// -------------------- Identity Store --------------------
+
+func getIdentity(issuer, subject string) (string, error) {
+    if useDB {
+        var username string
+        err := dbPool.QueryRow(context.Background(), `
+            UPDATE user_identities SET last_login_at=NOW()
+            WHERE issuer=$1 AND subject=$2
+            RETURNING username
+        `, issuer, subject).Scan(&username)
+        if errors.Is(err, pgx.ErrNoRows) {
+            return "", errIdentityNotFound
+        }
+        return username, err
+    }
+    identitiesMu.RLock()
+    defer identitiesMu.RUnlock()
+    username, ok := identitiesMap[issuer+"|"+subject]
+    if !ok {
+        return "", errIdentityNotFound
+    }
+    return username, nil
+}
+
+func linkIdentity(issuer, subject, username, email string) error {
+    if useDB {
+        _, err := dbPool.Exec(context.Background(), `
+            INSERT INTO user_identities (issuer, subject, username, email) VALUES ($1, $2, $3, NULLIF($4, ''))
+        `, issuer, subject, username, email)
+        return err
+    }
+    identitiesMu.Lock()
+    defer identitiesMu.Unlock()
+    identitiesMap[issuer+"|"+subject] = username
+    return nil
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+    "crypto"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/json"
+    "fmt"
+    "math/big"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "strings"
+    "testing"
+    "time"
+)
+
+// mockIdP is an OpenID provider served from httptest. Its token endpoint
+// answers with whatever ID token the test sets in idToken.
+type mockIdP struct {
+    srv     *httptest.Server
+    key     *rsa.PrivateKey
+    idToken func(nonce string) string
+    nonce   string
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+    t.Helper()
+    key, err := rsa.GenerateKey(rand.Reader, 2048)
+    if err != nil {
+        t.Fatal(err)
+    }
+    idp := &mockIdP{key: key}
+    mux := http.NewServeMux()
+    idp.srv = httptest.NewServer(mux)
+    t.Cleanup(idp.srv.Close)
+    mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+        json.NewEncoder(w).Encode(map[string]string{
+            "issuer":                 idp.srv.URL,
+            "authorization_endpoint": idp.srv.URL + "/authorize",
+            "token_endpoint":         idp.srv.URL + "/token",
+            "jwks_uri":               idp.srv.URL + "/jwks",
+        })
+    })
+    mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+        json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+            "kid": "k1",
+            "kty": "RSA",
+            "use": "sig",
+            "n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+            "e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+        }}})
+    })
+    mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+        if r.FormValue("code") != "good-code" || r.FormValue("code_verifier") == "" {
+            w.WriteHeader(http.StatusBadRequest)
+            json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+            return
+        }
+        json.NewEncoder(w).Encode(map[string]string{"id_token": idp.idToken(idp.nonce)})
+    })
+    return idp
+}
+
+// sign makes an RS256 JWT over claims with key.
+func (idp *mockIdP) sign(key *rsa.PrivateKey, claims map[string]any) string {
+    h, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "k1", "typ": "JWT"})
+    p, _ := json.Marshal(claims)
+    input := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(p)
+    digest := sha256.Sum256([]byte(input))
+    sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+    if err != nil {
+        panic(err)
+    }
+    return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func (idp *mockIdP) claims(subject, username, nonce string) map[string]any {
+    return map[string]any{
+        "iss":                idp.srv.URL,
+        "aud":                "chatbox-test",
+        "sub":                subject,
+        "preferred_username": username,
+        "nonce":              nonce,
+        "iat":                time.Now().Unix(),
+        "exp":                time.Now().Add(time.Minute).Unix(),
+    }
+}
+
+func withMockOIDC(t *testing.T) *mockIdP {
+    idp := newMockIdP(t)
+    saved := oidc
+    oidc = &oidcProvider{
+        Issuer:        idp.srv.URL,
+        ClientID:      "chatbox-test",
+        RedirectURL:   "http://chatbox.test/auth/oidc/callback",
+        Scopes:        []string{"openid"},
+        UsernameClaim: "preferred_username",
+        HTTPClient:    idp.srv.Client(),
+    }
+    t.Cleanup(func() { oidc = saved })
+    return idp
+}
+
+// startOIDC runs /auth/oidc/start and returns the flow cookie and the state
+// sent to the IdP; the nonce is handed to the mock.
+func startOIDC(t *testing.T, idp *mockIdP) (*http.Cookie, string) {
+    t.Helper()
+    w := httptest.NewRecorder()
+    oidcStartHandler(w, httptest.NewRequest(http.MethodGet, "/auth/oidc/start", nil))
+    if w.Code != http.StatusFound {
+        t.Fatalf("start: status %d: %s", w.Code, w.Body)
+    }
+    loc, err := url.Parse(w.Header().Get("Location"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    q := loc.Query()
+    if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+        t.Fatalf("start: no PKCE challenge in %s", loc)
+    }
+    idp.nonce = q.Get("nonce")
+    cookies := w.Result().Cookies()
+    if len(cookies) != 1 || cookies[0].Name != oidcStateCookie {
+        t.Fatalf("start: unexpected cookies %v", cookies)
+    }
+    return cookies[0], q.Get("state")
+}
+
+func callbackOIDC(cookie *http.Cookie, state string) *httptest.ResponseRecorder {
+    r := httptest.NewRequest(http.MethodGet, "/auth/oidc/callback?code=good-code&state="+url.QueryEscape(state), nil)
+    r.AddCookie(cookie)
+    w := httptest.NewRecorder()
+    oidcCallbackHandler(w, r)
+    return w
+}
+
+func TestOIDCLogin(t *testing.T) {
+    idp := withMockOIDC(t)
+    idp.idToken = func(nonce string) string {
+        return idp.sign(idp.key, idp.claims("sub-ada", "ada_sso", nonce))
+    }
+    cookie, state := startOIDC(t, idp)
+    w := callbackOIDC(cookie, state)
+    if w.Code != http.StatusOK {
+        t.Fatalf("callback: status %d: %s", w.Code, w.Body)
+    }
+    var resp struct {
+        Username string `json:"username"`
+        Token    string `json:"token"`
+    }
+    json.NewDecoder(w.Body).Decode(&resp)
+    if resp.Username != "ada_sso" || resp.Token == "" {
+        t.Fatalf("callback: got %+v", resp)
+    }
+    if _, err := parseToken(resp.Token); err != nil {
+        t.Fatalf("callback token does not verify: %v", err)
+    }
+}
+
+func TestOIDCLoginRequiresSecondFactor(t *testing.T) {
+    idp := withMockOIDC(t)
+    testUser(t, "grace_mfa")
+    if err := saveUserMFA("grace_mfa", &userMFA{Secret: newTOTPSecret(), Enabled: true}); err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { deleteUserMFA("grace_mfa") })
+    if err := linkIdentity(idp.srv.URL, "sub-grace", "grace_mfa", ""); err != nil {
+        t.Fatal(err)
+    }
+    idp.idToken = func(nonce string) string {
+        return idp.sign(idp.key, idp.claims("sub-grace", "grace_mfa", nonce))
+    }
+    cookie, state := startOIDC(t, idp)
+    w := callbackOIDC(cookie, state)
+    if w.Code != http.StatusOK {
+        t.Fatalf("callback: status %d: %s", w.Code, w.Body)
+    }
+    var resp map[string]any
+    json.NewDecoder(w.Body).Decode(&resp)
+    if resp["mfaRequired"] != true || resp["mfaToken"] == nil {
+        t.Fatalf("callback skipped 2FA: %v", resp)
+    }
+    if _, ok := resp["token"]; ok {
+        t.Fatal("callback issued a session before the second factor")
+    }
+    for _, c := range w.Result().Cookies() {
+        if c.Name == sessionCookieName && c.Value != "" {
+            t.Fatal("callback set a session cookie before the second factor")
+        }
+    }
+}
+
+func TestOIDCRejects(t *testing.T) {
+    otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+    if err != nil {
+        t.Fatal(err)
+    }
+    tests := []struct {
+        name       string
+        token      func(idp *mockIdP, nonce string) string
+        badState   bool
+        wantStatus int
+    }{
+        {
+            name:       "state mismatch",
+            token:      func(idp *mockIdP, nonce string) string { return idp.sign(idp.key, idp.claims("s", "mallory", nonce)) },
+            badState:   true,
+            wantStatus: http.StatusBadRequest,
+        },
+        {
+            name:       "nonce mismatch",
+            token:      func(idp *mockIdP, nonce string) string { return idp.sign(idp.key, idp.claims("s", "mallory", "replayed")) },
+            wantStatus: http.StatusUnauthorized,
+        },
+        {
+            name:       "bad signature",
+            token:      func(idp *mockIdP, nonce string) string { return idp.sign(otherKey, idp.claims("s", "mallory", nonce)) },
+            wantStatus: http.StatusUnauthorized,
+        },
+        {
+            name: "expired",
+            token: func(idp *mockIdP, nonce string) string {
+                c := idp.claims("s", "mallory", nonce)
+                c["exp"] = time.Now().Add(-time.Minute).Unix()
+                return idp.sign(idp.key, c)
+            },
+            wantStatus: http.StatusUnauthorized,
+        },
+        {
+            name: "wrong audience",
+            token: func(idp *mockIdP, nonce string) string {
+                c := idp.claims("s", "mallory", nonce)
+                c["aud"] = "someone-else"
+                return idp.sign(idp.key, c)
+            },
+            wantStatus: http.StatusUnauthorized,
+        },
+        {
+            name: "alg none",
+            token: func(idp *mockIdP, nonce string) string {
+                parts := strings.Split(idp.sign(idp.key, idp.claims("s", "mallory", nonce)), ".")
+                h := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"k1"}`))
+                return h + "." + parts[1] + "."
+            },
+            wantStatus: http.StatusUnauthorized,
+        },
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            idp := withMockOIDC(t)
+            idp.idToken = func(nonce string) string { return tt.token(idp, nonce) }
+            cookie, state := startOIDC(t, idp)
+            if tt.badState {
+                state = "not-" + state
+            }
+            w := callbackOIDC(cookie, state)
+            if w.Code != tt.wantStatus {
+                t.Fatalf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+            }
+            if _, ok := resolveUsername("mallory"); ok {
+                t.Fatal("rejected sign-in created an account")
+            }
+        })
+    }
+}
+
+func TestOIDCLinkByUsername(t *testing.T) {
+    testUser(t, "link_member")
+    testUser(t, "link_mod")
+    if err := setUserRole("link_mod", roleModerator); err != nil {
+        t.Fatal(err)
+    }
+    tests := []struct {
+        name     string
+        username string
+        email    string
+        verified any
+        linked   bool
+    }{
+        {"unverified email", "link_member", "link_member@example.com", false, false},
+        {"no email_verified claim", "link_member", "link_member@example.com", nil, false},
+        {"other email", "link_member", "attacker@example.com", true, false},
+        {"moderator", "link_mod", "link_mod@example.com", true, false},
+        {"verified matching email", "link_member", "Link_Member@example.com", true, true},
+    }
+    for i, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            idp := withMockOIDC(t)
+            oidc.LinkByUsername = true
+            sub := fmt.Sprintf("sub-link-%d", i)
+            idp.idToken = func(nonce string) string {
+                c := idp.claims(sub, tt.username, nonce)
+                c["email"] = tt.email
+                if tt.verified != nil {
+                    c["email_verified"] = tt.verified
+                }
+                return idp.sign(idp.key, c)
+            }
+            cookie, state := startOIDC(t, idp)
+            w := callbackOIDC(cookie, state)
+            _, err := getIdentity(idp.srv.URL, sub)
+            if tt.linked && (w.Code != http.StatusOK || err != nil) {
+                t.Fatalf("not linked: status %d: %s (%v)", w.Code, w.Body, err)
+            }
+            if !tt.linked && (w.Code != http.StatusConflict || err == nil) {
+                t.Fatalf("linked anyway: status %d: %s", w.Code, w.Body)
+            }
+        })
+    }
+}
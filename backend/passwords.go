@@ -0,0 +1,266 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "context"
+    "crypto/rand"
+    "crypto/subtle"
+    _ "embed"
+    "encoding/base64"
+    "errors"
+    "fmt"
+    "log"
+    "os"
+    "strings"
+    "sync"
+    "time"
+
+    "golang.org/x/crypto/argon2"
+    "golang.org/x/crypto/bcrypt"
+)
+
+// -------------------- Password Policy --------------------
+
+//go:embed common_passwords.txt
+var builtinCommonPasswords string
+
+// passwordPolicy controls how new password hashes are produced. Hashes made
+// with a different algorithm or weaker parameters are upgraded on login.
+type passwordPolicy struct {
+    Algorithm    string // "bcrypt" or "argon2id"
+    BcryptCost   int
+    ArgonTime    uint32
+    ArgonMemory  uint32 // KiB
+    ArgonThreads uint8
+    MinLength    int
+}
+
+var (
+    pwPolicy = passwordPolicy{
+        Algorithm:    "bcrypt",
+        BcryptCost:   bcrypt.DefaultCost,
+        ArgonTime:    2,
+        ArgonMemory:  19 * 1024,
+        ArgonThreads: 1,
+        MinLength:    8,
+    }
+
+    commonPasswordsOnce sync.Once
+    commonPasswords     map[string]bool
+
+    dummyHashMu     sync.Mutex
+    dummyHash       []byte
+    dummyHashPolicy passwordPolicy
+
+    errPasswordTooShort = errors.New("password too short")
+    errPasswordCommon   = errors.New("password is too common")
+    errPasswordTooLong  = errors.New("password too long")
+)
+
+const (
+    argonKeyLen  = 32
+    argonSaltLen = 16
+    // bcrypt ignores input past 72 bytes; cap everything there so both
+    // algorithms accept the same passwords.
+    maxPasswordBytes = 72
+)
+
+// initPasswordPolicy reads PASSWORD_HASH_ALGO, BCRYPT_COST, ARGON2_TIME,
+// ARGON2_MEMORY_KB, ARGON2_THREADS and PASSWORD_MIN_LENGTH.
+func initPasswordPolicy() {
+    switch algo := strings.ToLower(strings.TrimSpace(os.Getenv("PASSWORD_HASH_ALGO"))); algo {
+    case "", "bcrypt":
+        pwPolicy.Algorithm = "bcrypt"
+    case "argon2id":
+        pwPolicy.Algorithm = "argon2id"
+    default:
+        log.Printf("unknown PASSWORD_HASH_ALGO=%q, using bcrypt", algo)
+    }
+    cost := envInt("BCRYPT_COST", pwPolicy.BcryptCost)
+    if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+        log.Printf("BCRYPT_COST=%d out of range, using %d", cost, bcrypt.DefaultCost)
+        cost = bcrypt.DefaultCost
+    }
+    pwPolicy.BcryptCost = cost
+    if t := envInt("ARGON2_TIME", int(pwPolicy.ArgonTime)); t > 0 {
+        pwPolicy.ArgonTime = uint32(t)
+    }
+    if m := envInt("ARGON2_MEMORY_KB", int(pwPolicy.ArgonMemory)); m >= 8 {
+        pwPolicy.ArgonMemory = uint32(m)
+    }
+    if p := envInt("ARGON2_THREADS", int(pwPolicy.ArgonThreads)); p > 0 && p < 256 {
+        pwPolicy.ArgonThreads = uint8(p)
+    }
+    pwPolicy.MinLength = envInt("PASSWORD_MIN_LENGTH", pwPolicy.MinLength)
+    log.Printf("🔑 Password hashing: %s", pwPolicy.Algorithm)
+}
+
+func loadCommonPasswords() {
+    commonPasswords = make(map[string]bool)
+    add := func(data string) {
+        sc := bufio.NewScanner(strings.NewReader(data))
+        for sc.Scan() {
+            line := strings.TrimSpace(sc.Text())
+            if line == "" || strings.HasPrefix(line, "#") {
+                continue
+            }
+            commonPasswords[strings.ToLower(line)] = true
+        }
+    }
+    add(builtinCommonPasswords)
+    if path := os.Getenv("PASSWORD_BLOCKLIST_FILE"); path != "" {
+        b, err := os.ReadFile(path)
+        if err != nil {
+            log.Println("password blocklist error:", err)
+            return
+        }
+        add(string(b))
+    }
+}
+
+// validateNewPassword enforces the policy for registration and password changes.
+func validateNewPassword(username, password string) error {
+    if len([]rune(password)) < pwPolicy.MinLength {
+        return errPasswordTooShort
+    }
+    if len(password) > maxPasswordBytes {
+        return errPasswordTooLong
+    }
+    commonPasswordsOnce.Do(loadCommonPasswords)
+    lower := strings.ToLower(password)
+    if commonPasswords[lower] || lower == strings.ToLower(username) {
+        return errPasswordCommon
+    }
+    return nil
+}
+
+// passwordPolicyMessage turns a validateNewPassword error into a client-facing message.
+func passwordPolicyMessage(err error) string {
+    switch {
+    case errors.Is(err, errPasswordTooShort):
+        return fmt.Sprintf("Password must be at least %d characters", pwPolicy.MinLength)
+    case errors.Is(err, errPasswordTooLong):
+        return fmt.Sprintf("Password must be at most %d bytes", maxPasswordBytes)
+    case errors.Is(err, errPasswordCommon):
+        return "Password is too common, please choose another"
+    }
+    return "Invalid password"
+}
+
+// -------------------- Password Hashing --------------------
+
+func hashPassword(password string) ([]byte, error) {
+    if pwPolicy.Algorithm == "argon2id" {
+        salt := make([]byte, argonSaltLen)
+        if _, err := rand.Read(salt); err != nil {
+            return nil, err
+        }
+        key := argon2.IDKey([]byte(password), salt, pwPolicy.ArgonTime, pwPolicy.ArgonMemory, pwPolicy.ArgonThreads, argonKeyLen)
+        enc := fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+            argon2.Version, pwPolicy.ArgonMemory, pwPolicy.ArgonTime, pwPolicy.ArgonThreads,
+            base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+        return []byte(enc), nil
+    }
+    return bcrypt.GenerateFromPassword([]byte(password), pwPolicy.BcryptCost)
+}
+
+// verifyPassword compares password with hash. needsRehash reports that the
+// hash was made with another algorithm or weaker parameters than the policy.
+func verifyPassword(hash []byte, password string) (ok bool, needsRehash bool) {
+    if bytes.HasPrefix(hash, []byte("$argon2id$")) {
+        var version int
+        var mem, t uint32
+        var p uint8
+        parts := strings.Split(string(hash), "$")
+        if len(parts) != 6 {
+            return false, false
+        }
+        if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+            return false, false
+        }
+        if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &mem, &t, &p); err != nil {
+            return false, false
+        }
+        salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+        if err != nil {
+            return false, false
+        }
+        want, err := base64.RawStdEncoding.DecodeString(parts[5])
+        if err != nil {
+            return false, false
+        }
+        got := argon2.IDKey([]byte(password), salt, t, mem, p, uint32(len(want)))
+        if subtle.ConstantTimeCompare(got, want) != 1 {
+            return false, false
+        }
+        needsRehash = pwPolicy.Algorithm != "argon2id" ||
+            mem < pwPolicy.ArgonMemory || t < pwPolicy.ArgonTime || p < pwPolicy.ArgonThreads
+        return true, needsRehash
+    }
+    if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil {
+        return false, false
+    }
+    cost, err := bcrypt.Cost(hash)
+    needsRehash = pwPolicy.Algorithm != "bcrypt" || err != nil || cost < pwPolicy.BcryptCost
+    return true, needsRehash
+}
+
+// dummyPasswordHash returns a hash of a random password made with the
+// current policy. Logins for unknown usernames verify against it so they take
+// as long as logins for real ones.
+func dummyPasswordHash() []byte {
+    dummyHashMu.Lock()
+    defer dummyHashMu.Unlock()
+    if dummyHash == nil || dummyHashPolicy != pwPolicy {
+        hash, err := hashPassword(rand.Text())
+        if err != nil {
+            log.Println("dummy hash error:", err)
+            return nil
+        }
+        dummyHash, dummyHashPolicy = hash, pwPolicy
+    }
+    return dummyHash
+}
+
+// upgradePasswordHash re-hashes password with the current policy after a
+// successful login. Failures are logged; the login still succeeds.
+func upgradePasswordHash(username, password string) {
+    hash, err := hashPassword(password)
+    if err != nil {
+        log.Println("rehash error:", err)
+        return
+    }
+    if err := setUserPasswordHash(username, hash); err != nil {
+        log.Println("rehash store error:", err)
+        return
+    }
+    log.Printf("🔑 Upgraded password hash for %s", username)
+}
+
+func setUserPasswordHash(username string, hash []byte) error {
+    if useDB {
+        ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        defer cancel()
+        return dbSetUserPasswordHash(ctx, username, hash)
+    }
+    usersMu.Lock()
+    defer usersMu.Unlock()
+    su, ok := usersMap[username]
+    if !ok {
+        return fmt.Errorf("not found")
+    }
+    su.PasswordHash = hash
+    return nil
+}
+
+func dbSetUserPasswordHash(ctx context.Context, username string, hash []byte) error {
+    ct, err := dbPool.Exec(ctx, `UPDATE users SET password_hash=$1 WHERE username=$2`, hash, username)
+    if err != nil {
+        return err
+    }
+    if ct.RowsAffected() == 0 {
+        return fmt.Errorf("not found")
+    }
+    return nil
+}
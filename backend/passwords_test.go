@@ -0,0 +1,126 @@
+package main
+
+import (
+    "bytes"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+
+    "golang.org/x/crypto/bcrypt"
+)
+
+// withPasswordPolicy swaps in p for one test.
+func withPasswordPolicy(t *testing.T, p passwordPolicy) {
+    t.Helper()
+    old := pwPolicy
+    pwPolicy = p
+    t.Cleanup(func() { pwPolicy = old })
+}
+
+var (
+    testBcryptPolicy = passwordPolicy{Algorithm: "bcrypt", BcryptCost: bcrypt.MinCost, MinLength: 8}
+    testArgonPolicy  = passwordPolicy{Algorithm: "argon2id", ArgonTime: 1, ArgonMemory: 64, ArgonThreads: 1, MinLength: 8}
+)
+
+func testHash(t *testing.T, p passwordPolicy, password string) []byte {
+    t.Helper()
+    withPasswordPolicy(t, p)
+    hash, err := hashPassword(password)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return hash
+}
+
+func TestVerifyPasswordRehash(t *testing.T) {
+    const pw = "correct horse battery staple"
+    bcryptHash := testHash(t, testBcryptPolicy, pw)
+    argonHash := testHash(t, testArgonPolicy, pw)
+    stronger := func(p passwordPolicy, f func(*passwordPolicy)) passwordPolicy {
+        f(&p)
+        return p
+    }
+    tests := []struct {
+        name       string
+        policy     passwordPolicy
+        hash       []byte
+        password   string
+        ok, rehash bool
+    }{
+        {"bcrypt at policy", testBcryptPolicy, bcryptHash, pw, true, false},
+        {"bcrypt below cost", stronger(testBcryptPolicy, func(p *passwordPolicy) { p.BcryptCost++ }), bcryptHash, pw, true, true},
+        {"bcrypt under argon2id policy", testArgonPolicy, bcryptHash, pw, true, true},
+        {"argon2id at policy", testArgonPolicy, argonHash, pw, true, false},
+        {"argon2id below memory", stronger(testArgonPolicy, func(p *passwordPolicy) { p.ArgonMemory *= 2 }), argonHash, pw, true, true},
+        {"argon2id below time", stronger(testArgonPolicy, func(p *passwordPolicy) { p.ArgonTime++ }), argonHash, pw, true, true},
+        {"argon2id under bcrypt policy", testBcryptPolicy, argonHash, pw, true, true},
+        {"wrong password bcrypt", testBcryptPolicy, bcryptHash, "wrong", false, false},
+        {"wrong password argon2id", testArgonPolicy, argonHash, "wrong", false, false},
+        {"malformed argon2id", testArgonPolicy, []byte("$argon2id$v=19$m=64$x$y"), pw, false, false},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            withPasswordPolicy(t, tt.policy)
+            ok, rehash := verifyPassword(tt.hash, tt.password)
+            if ok != tt.ok || rehash != tt.rehash {
+                t.Fatalf("verifyPassword = %v, %v; want %v, %v", ok, rehash, tt.ok, tt.rehash)
+            }
+        })
+    }
+}
+
+func TestLoginUpgradesHash(t *testing.T) {
+    withTestThrottle(t)
+    const pw = "correct horse battery staple"
+    if err := createUser("rehash_user", "rehash_user@example.com", testHash(t, testBcryptPolicy, pw)); err != nil {
+        t.Fatal(err)
+    }
+    withPasswordPolicy(t, testArgonPolicy)
+
+    login := func(password string) int {
+        r := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{"username":"rehash_user","password":"`+password+`"}`))
+        w := httptest.NewRecorder()
+        loginHandler(w, r)
+        return w.Code
+    }
+    if code := login("wrong password"); code != http.StatusUnauthorized {
+        t.Fatalf("wrong password: status %d", code)
+    }
+    if hash, _ := getUserPasswordHash("rehash_user"); !bytes.HasPrefix(hash, []byte("$2")) {
+        t.Fatalf("failed login changed the hash to %s", hash)
+    }
+    if code := login(pw); code != http.StatusOK {
+        t.Fatalf("login: status %d", code)
+    }
+    hash, _ := getUserPasswordHash("rehash_user")
+    if !bytes.HasPrefix(hash, []byte("$argon2id$")) {
+        t.Fatalf("hash not upgraded: %s", hash)
+    }
+    if ok, rehash := verifyPassword(hash, pw); !ok || rehash {
+        t.Fatalf("upgraded hash: ok=%v rehash=%v", ok, rehash)
+    }
+}
+
+func TestDummyHashFollowsPolicy(t *testing.T) {
+    withTestThrottle(t)
+    withPasswordPolicy(t, testArgonPolicy)
+    if hash := dummyPasswordHash(); !bytes.HasPrefix(hash, []byte("$argon2id$v=19$m=64,t=1,p=1$")) {
+        t.Fatalf("dummy hash under argon2id policy: %s", hash)
+    }
+    pwPolicy = testBcryptPolicy
+    hash := dummyPasswordHash()
+    if cost, err := bcrypt.Cost(hash); err != nil || cost != bcrypt.MinCost {
+        t.Fatalf("dummy hash under bcrypt policy: %s (cost %d, %v)", hash, cost, err)
+    }
+    if !bytes.Equal(dummyPasswordHash(), hash) {
+        t.Fatal("dummy hash rebuilt with the policy unchanged")
+    }
+
+    r := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{"username":"no_such_user","password":"whatever password"}`))
+    w := httptest.NewRecorder()
+    loginHandler(w, r)
+    if w.Code != http.StatusUnauthorized {
+        t.Fatalf("unknown user: status %d", w.Code)
+    }
+}
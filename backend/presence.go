@@ -0,0 +1,409 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "log"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+    "unicode/utf8"
+
+    "github.com/jackc/pgx/v5"
+)
+
+// -------------------- Presence --------------------
+
+const (
+    presenceOnline    = "online"
+    presenceAway      = "away"
+    presenceBusy      = "busy"
+    presenceInvisible = "invisible"
+
+    maxStatusTextLen = 100
+    maxStatusTTL     = 30 * 24 * time.Hour
+)
+
+var validPresence = map[string]bool{
+    presenceOnline:    true,
+    presenceAway:      true,
+    presenceBusy:      true,
+    presenceInvisible: true,
+}
+
+var (
+    // presenceIdleTimeout turns a user "away" once none of their sockets
+    // has sent a frame for this long (PRESENCE_IDLE_TIMEOUT, 0 disables).
+    presenceIdleTimeout = 10 * time.Minute
+    // presenceSweepInterval is how often the hub re-evaluates idle and expiry.
+    presenceSweepInterval = 30 * time.Second
+)
+
+func initPresence() {
+    presenceIdleTimeout = envDuration("PRESENCE_IDLE_TIMEOUT", presenceIdleTimeout)
+    presenceSweepInterval = envDuration("PRESENCE_SWEEP_INTERVAL", presenceSweepInterval)
+    if presenceSweepInterval <= 0 {
+        presenceSweepInterval = 30 * time.Second
+    }
+}
+
+// userPresence is what a user chose; the hub combines it with socket
+// activity to get what others see.
+type userPresence struct {
+    Status    string     `json:"status"`
+    Text      string     `json:"text,omitempty"`
+    ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// current drops a status whose expiry has passed.
+func (p *userPresence) current(now time.Time) userPresence {
+    if p == nil || (p.ExpiresAt != nil && !now.Before(*p.ExpiresAt)) {
+        return userPresence{Status: presenceOnline}
+    }
+    return *p
+}
+
+// presenceUpdate tells the hub a user's presence may have changed. A nil
+// state means "activity only" (e.g. a frame after being idle).
+type presenceUpdate struct {
+    username string
+    state    *userPresence
+}
+
+// presenceEntry is one user in a roster or presence delta, however many
+// sockets they have in the room.
+type presenceEntry struct {
+    Username    string     `json:"username"`
+    Status      string     `json:"status"`
+    StatusText  string     `json:"statusText,omitempty"`
+    ExpiresAt   *time.Time `json:"expiresAt,omitempty"`
+    LastSeen    int64      `json:"lastSeen"`
+    Connections int        `json:"connections"`
+}
+
+// aggregatePresence folds a user's sockets into one entry. ok is false for
+// invisible users, who are left out of user lists.
+func (h *Hub) aggregatePresence(username string, clients []*Client, now time.Time) (presenceEntry, bool) {
+    p := h.presence[username].current(now)
+    if p.Status == presenceInvisible {
+        return presenceEntry{}, false
+    }
+    e := presenceEntry{Username: username, Status: p.Status, StatusText: p.Text, ExpiresAt: p.ExpiresAt, Connections: len(clients)}
+    var lastActive int64
+    for _, c := range clients {
+        if s := c.lastSeen.Load(); s > e.LastSeen {
+            e.LastSeen = s
+        }
+        if a := c.lastActive.Load(); a > lastActive {
+            lastActive = a
+        }
+    }
+    if e.Status == presenceOnline && presenceIdleTimeout > 0 && now.Sub(time.Unix(lastActive, 0)) >= presenceIdleTimeout {
+        e.Status = presenceAway
+    }
+    return e, true
+}
+
+// localEntry aggregates the user's sockets on this node that joined the room.
+func (h *Hub) localEntry(ru roomUser, now time.Time) (presenceEntry, bool) {
+    var clients []*Client
+    for c := range h.userClients[ru.username] {
+        if c.joined[ru.room] {
+            clients = append(clients, c)
+        }
+    }
+    if len(clients) == 0 {
+        return presenceEntry{}, false
+    }
+    return h.aggregatePresence(ru.username, clients, now)
+}
+
+// presenceRank orders statuses for merging nodes: a user active on any
+// node is online even if idle (auto-away) on another.
+var presenceRank = map[string]int{presenceAway: 1, presenceBusy: 2, presenceOnline: 3}
+
+// mergeShares folds what other nodes share about ru into this node's entry.
+func (h *Hub) mergeShares(ru roomUser, e presenceEntry, visible bool) (presenceEntry, bool) {
+    for _, r := range h.remoteShares[ru.room][ru.username] {
+        if !visible {
+            e, visible = r, true
+            continue
+        }
+        e.Connections += r.Connections
+        e.LastSeen = max(e.LastSeen, r.LastSeen)
+        if presenceRank[r.Status] > presenceRank[e.Status] {
+            e.Status, e.StatusText, e.ExpiresAt = r.Status, r.StatusText, r.ExpiresAt
+        }
+    }
+    return e, visible
+}
+
+// presenceList builds room's aggregated, name-sorted user list across all nodes.
+func (h *Hub) presenceList(room string, now time.Time) []presenceEntry {
+    users := make(map[string]bool)
+    for c := range h.rooms[room] {
+        users[c.username] = true
+    }
+    for username := range h.remoteShares[room] {
+        users[username] = true
+    }
+    out := make([]presenceEntry, 0, len(users))
+    for username := range users {
+        ru := roomUser{room, username}
+        e, visible := h.localEntry(ru, now)
+        if e, visible = h.mergeShares(ru, e, visible); visible {
+            out = append(out, e)
+        }
+    }
+    sort.Slice(out, func(i, j int) bool { return out[i].Username < out[j].Username })
+    return out
+}
+
+// sameEntry reports whether a and b look the same to other members.
+// LastSeen moves with every frame and is left to the next snapshot.
+func sameEntry(a, b presenceEntry) bool {
+    sameExpiry := (a.ExpiresAt == nil) == (b.ExpiresAt == nil) &&
+        (a.ExpiresAt == nil || a.ExpiresAt.Equal(*b.ExpiresAt))
+    return a.Status == b.Status && a.StatusText == b.StatusText && sameExpiry && a.Connections == b.Connections
+}
+
+// roomUser is one user's entry in one room's roster.
+type roomUser struct {
+    room     string
+    username string
+}
+
+// sendRoster gives a client that just joined room its full user list.
+// Everything after that arrives as presence_join/presence_update/presence_leave.
+func (h *Hub) sendRoster(client *Client, room string) {
+    if b, err := json.Marshal(UsersEvent{Type: "users", Users: h.presenceList(room, time.Now()), Room: room}); err == nil {
+        h.deliver(client, b, "")
+    }
+}
+
+// markPresence queues every room username is subscribed to for re-evaluation.
+func (h *Hub) markPresence(username string) {
+    for c := range h.userClients[username] {
+        for room := range c.joined {
+            h.presenceDirty[roomUser{room, username}] = true
+        }
+    }
+}
+
+// sweepPresence re-evaluates every connected user so idle time and expired
+// statuses reach their rooms. Only entries that changed are sent.
+func (h *Hub) sweepPresence() {
+    for username := range h.userClients {
+        h.markPresence(username)
+    }
+}
+
+// flushPresence sends the deltas for every dirty entry. Delivering can drop
+// slow clients, which dirties more entries, so it loops until none are left.
+// Runs on the hub goroutine.
+func (h *Hub) flushPresence() {
+    if len(h.presenceDirty) == 0 {
+        return
+    }
+    now := time.Now()
+    for len(h.presenceDirty) > 0 {
+        dirty := h.presenceDirty
+        h.presenceDirty = make(map[roomUser]bool)
+        for ru := range dirty {
+            h.syncPresence(ru, now)
+        }
+    }
+}
+
+// syncPresence compares a user's entry in a room with what the room was last
+// told and sends the difference to that room only. This node's part of the
+// entry goes to the other nodes first.
+func (h *Hub) syncPresence(ru roomUser, now time.Time) {
+    e, visible := h.localEntry(ru, now)
+    h.share(ru, e, visible)
+    e, visible = h.mergeShares(ru, e, visible)
+    prev, shown := h.shown[ru.room][ru.username]
+
+    d := PresenceEvent{Room: ru.room}
+    switch {
+    case visible && !shown:
+        d.Type, d.User = "presence_join", &e
+    case visible && !sameEntry(prev, e):
+        d.Type, d.User = "presence_update", &e
+    case !visible && shown:
+        d.Type, d.Username = "presence_leave", ru.username
+    default:
+        return
+    }
+    if visible {
+        if h.shown[ru.room] == nil {
+            h.shown[ru.room] = make(map[string]presenceEntry)
+        }
+        h.shown[ru.room][ru.username] = e
+    } else {
+        delete(h.shown[ru.room], ru.username)
+        if len(h.shown[ru.room]) == 0 {
+            delete(h.shown, ru.room)
+        }
+    }
+    b, err := json.Marshal(d)
+    if err != nil {
+        return
+    }
+    key := "presence:" + ru.room + ":" + ru.username
+    for client := range h.rooms[ru.room] {
+        h.deliver(client, b, key)
+    }
+}
+
+// share publishes this node's part of ru's entry when it changed.
+func (h *Hub) share(ru roomUser, e presenceEntry, visible bool) {
+    prev, had := h.shared[ru.room][ru.username]
+    switch {
+    case visible && (!had || !sameEntry(prev, e)):
+        if h.shared[ru.room] == nil {
+            h.shared[ru.room] = make(map[string]presenceEntry)
+        }
+        h.shared[ru.room][ru.username] = e
+        h.backplane.Publish(backplaneMessage{Kind: bpPresence, Room: ru.room, User: ru.username, Entry: &e})
+    case !visible && had:
+        delete(h.shared[ru.room], ru.username)
+        if len(h.shared[ru.room]) == 0 {
+            delete(h.shared, ru.room)
+        }
+        h.backplane.Publish(backplaneMessage{Kind: bpPresence, Room: ru.room, User: ru.username})
+    }
+}
+
+// setRemoteEntry records node's part of a room entry; nil means it has none.
+func (h *Hub) setRemoteEntry(node, room, username string, e *presenceEntry) {
+    if e != nil {
+        if h.remoteShares[room] == nil {
+            h.remoteShares[room] = make(map[string]map[string]presenceEntry)
+        }
+        if h.remoteShares[room][username] == nil {
+            h.remoteShares[room][username] = make(map[string]presenceEntry)
+        }
+        h.remoteShares[room][username][node] = *e
+    } else if nodes := h.remoteShares[room][username]; nodes != nil {
+        delete(nodes, node)
+        if len(nodes) == 0 {
+            delete(h.remoteShares[room], username)
+        }
+        if len(h.remoteShares[room]) == 0 {
+            delete(h.remoteShares, room)
+        }
+    }
+    h.presenceDirty[roomUser{room, username}] = true
+}
+
+// replaceRemoteShare swaps everything node shared for snap.
+func (h *Hub) replaceRemoteShare(node string, snap []sharedEntry) {
+    for room, users := range h.remoteShares {
+        for username, nodes := range users {
+            if _, ok := nodes[node]; ok {
+                h.setRemoteEntry(node, room, username, nil)
+            }
+        }
+    }
+    for _, s := range snap {
+        e := s.Entry
+        h.setRemoteEntry(node, s.Room, e.Username, &e)
+    }
+}
+
+// handleStatus applies an inbound {"type":"status"} frame.
+func (c *Client) handleStatus(f StatusFrame) {
+    status := strings.ToLower(strings.TrimSpace(f.Status))
+    if !validPresence[status] {
+        c.sendError(f.ID, codeInvalidStatus, "Status must be online, away, busy or invisible")
+        return
+    }
+    text := strings.TrimSpace(f.Text)
+    if utf8.RuneCountInString(text) > maxStatusTextLen {
+        c.sendError(f.ID, codeInvalidStatus, "Status text is too long")
+        return
+    }
+    p := &userPresence{Status: status, Text: text}
+    if f.ExpiresAt != "" {
+        t, err := time.Parse(time.RFC3339, f.ExpiresAt)
+        if err != nil || !t.After(time.Now()) || t.Sub(time.Now()) > maxStatusTTL {
+            c.sendError(f.ID, codeInvalidStatus, "expiresAt must be a future RFC 3339 time within 30 days")
+            return
+        }
+        p.ExpiresAt = &t
+    }
+    if err := savePresence(c.username, p); err != nil {
+        log.Println("save presence error:", err)
+        c.sendError(f.ID, codeServerError, "Could not save status")
+        return
+    }
+    c.hub.presenceUpdates <- presenceUpdate{username: c.username, state: p}
+    if b, err := json.Marshal(StatusEvent{Type: "status", RequestID: f.ID, userPresence: *p}); err == nil {
+        c.queue(b)
+    }
+}
+
+// -------------------- Presence Store --------------------
+
+var (
+    presenceMu  sync.RWMutex
+    presenceMap = map[string]*userPresence{}
+)
+
+// getPresence returns the stored presence, or nil if the user never set one.
+func getPresence(username string) (*userPresence, error) {
+    if useDB {
+        ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        defer cancel()
+        return dbGetPresence(ctx, username)
+    }
+    presenceMu.RLock()
+    defer presenceMu.RUnlock()
+    p, ok := presenceMap[username]
+    if !ok {
+        return nil, nil
+    }
+    cp := *p
+    return &cp, nil
+}
+
+func savePresence(username string, p *userPresence) error {
+    if useDB {
+        ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        defer cancel()
+        return dbSavePresence(ctx, username, p)
+    }
+    presenceMu.Lock()
+    defer presenceMu.Unlock()
+    cp := *p
+    presenceMap[username] = &cp
+    return nil
+}
+
+func dbGetPresence(ctx context.Context, username string) (*userPresence, error) {
+    var p userPresence
+    err := dbPool.QueryRow(ctx, `
+        SELECT status, status_text, expires_at FROM user_presence WHERE username=$1
+    `, username).Scan(&p.Status, &p.Text, &p.ExpiresAt)
+    if err != nil {
+        if errors.Is(err, pgx.ErrNoRows) {
+            return nil, nil
+        }
+        return nil, err
+    }
+    return &p, nil
+}
+
+func dbSavePresence(ctx context.Context, username string, p *userPresence) error {
+    _, err := dbPool.Exec(ctx, `
+        INSERT INTO user_presence (username, status, status_text, expires_at, updated_at)
+        VALUES ($1, $2, $3, $4, NOW())
+        ON CONFLICT (username) DO UPDATE
+        SET status=EXCLUDED.status, status_text=EXCLUDED.status_text,
+            expires_at=EXCLUDED.expires_at, updated_at=NOW()
+    `, username, p.Status, p.Text, p.ExpiresAt)
+    return err
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+    "fmt"
+    "sync"
+    "testing"
+    "time"
+)
+
+// The presence benchmarks run against one hub holding benchConnections
+// clients in benchRoom. Clients have no socket: frames stay in their send
+// queues, which drop the oldest so memory stays bounded. frames/op counts
+// what the hub delivered per operation.
+const (
+    benchConnections = 10000
+    benchRoom        = "bench"
+)
+
+var (
+    benchHubOnce sync.Once
+    benchHub     *Hub
+)
+
+func newBenchClient(h *Hub, username string) *Client {
+    return &Client{
+        send:     newSendQueue(),
+        out:      make(chan []byte, 16),
+        done:     make(chan struct{}),
+        hub:      h,
+        username: username,
+        room:     benchRoom,
+        rooms:    map[string]bool{benchRoom: true},
+        joined:   make(map[string]bool),
+    }
+}
+
+// connectBench registers c with the hub and joins it to benchRoom.
+func connectBench(h *Hub, c *Client) {
+    h.register <- c
+    h.subscriptions <- subscription{client: c, room: benchRoom, join: true}
+}
+
+// framesDelivered totals the frames every connection has been handed.
+func framesDelivered(h *Hub) int64 {
+    var n int64
+    for _, s := range h.connectionStats() {
+        n += int64(s.Depth) + s.Dropped
+    }
+    return n
+}
+
+func presenceBenchHub(b *testing.B) *Hub {
+    b.Helper()
+    withSendQueue(b, policyDropOldest, 64)
+    benchHubOnce.Do(func() {
+        benchHub = newHub(newMemBus().join("bench"))
+        go benchHub.run()
+        for i := 0; i < benchConnections; i++ {
+            connectBench(benchHub, newBenchClient(benchHub, fmt.Sprint("bench_user_", i)))
+        }
+    })
+    return benchHub
+}
+
+// BenchmarkPresenceJoinLeave connects and disconnects one more user in a
+// room of 10k: the newcomer gets one roster, the room one delta each way.
+func BenchmarkPresenceJoinLeave(b *testing.B) {
+    h := presenceBenchHub(b)
+    before := framesDelivered(h)
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        c := newBenchClient(h, fmt.Sprint("bench_joiner_", i))
+        connectBench(h, c)
+        h.unregister <- c
+    }
+    after := framesDelivered(h)
+    b.StopTimer()
+    b.ReportMetric(float64(after-before)/float64(b.N), "frames/op")
+}
+
+// BenchmarkRoomBroadcast fans one chat message out to a room of 10k.
+func BenchmarkRoomBroadcast(b *testing.B) {
+    h := presenceBenchHub(b)
+    msg := []byte(`{"type":"message","seq":1,"id":1,"username":"bench_user_0","text":"hello, room","room":"bench"}`)
+    before := framesDelivered(h)
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        h.broadcast <- Broadcast{room: benchRoom, message: msg}
+    }
+    after := framesDelivered(h)
+    b.StopTimer()
+    b.ReportMetric(float64(after-before)/float64(b.N), "frames/op")
+}
+
+func TestStatusFrameIsSharedAndStored(t *testing.T) {
+    srv := newTestServer(t)
+    testUser(t, "status_watcher")
+    testUser(t, "status_setter")
+    watcher, _, err := srv.dial(t, "status_watcher", "room=general")
+    if err != nil {
+        t.Fatal(err)
+    }
+    readUntil(t, watcher, "users")
+    conn, _, err := srv.dial(t, "status_setter", "room=general")
+    if err != nil {
+        t.Fatal(err)
+    }
+    waitPresence(t, watcher, "presence_join", "status_setter")
+
+    sendFrame(t, conn, map[string]string{"type": "status", "id": "bad", "status": "asleep"})
+    if f := readUntil(t, conn, "error"); f["requestId"] != "bad" || f["code"] != codeInvalidStatus {
+        t.Fatalf("invalid status: %v", f)
+    }
+    sendFrame(t, conn, map[string]string{"type": "status", "id": "s1", "status": "Busy", "text": " lunch "})
+    if f := readUntil(t, conn, "status"); f["requestId"] != "s1" || f["status"] != presenceBusy || f["text"] != "lunch" {
+        t.Fatalf("status echo: %v", f)
+    }
+    u := waitPresence(t, watcher, "presence_update", "status_setter")["user"].(map[string]any)
+    if u["status"] != presenceBusy || u["statusText"] != "lunch" {
+        t.Fatalf("status seen by the room: %v", u)
+    }
+
+    // It survives reconnecting
+    conn.Close()
+    waitPresence(t, watcher, "presence_leave", "status_setter")
+    conn, _, err = srv.dial(t, "status_setter", "room=general")
+    if err != nil {
+        t.Fatal(err)
+    }
+    u = waitPresence(t, watcher, "presence_join", "status_setter")["user"].(map[string]any)
+    if u["status"] != presenceBusy || u["statusText"] != "lunch" {
+        t.Fatalf("status after reconnecting: %v", u)
+    }
+
+    // Invisible users leave the list without disconnecting
+    sendFrame(t, conn, map[string]string{"type": "status", "id": "s2", "status": "invisible"})
+    readUntil(t, conn, "status")
+    waitPresence(t, watcher, "presence_leave", "status_setter")
+}
+
+func TestPresenceAggregatesSockets(t *testing.T) {
+    srv := newTestServer(t)
+    testUser(t, "multi_socket")
+    testUser(t, "multi_watcher")
+    first, _, err := srv.dial(t, "multi_socket", "room=general")
+    if err != nil {
+        t.Fatal(err)
+    }
+    readUntil(t, first, "users")
+    second, _, err := srv.dial(t, "multi_socket", "room=general")
+    if err != nil {
+        t.Fatal(err)
+    }
+    readUntil(t, second, "users")
+    watcher, _, err := srv.dial(t, "multi_watcher", "room=general")
+    if err != nil {
+        t.Fatal(err)
+    }
+    roster := readUntil(t, watcher, "users")
+    if e := rosterEntry(roster, "multi_socket"); e == nil || e["connections"] != 2.0 {
+        t.Fatalf("roster entry for two sockets: %v", roster["users"])
+    }
+
+    first.Close()
+    u := waitPresence(t, watcher, "presence_update", "multi_socket")["user"].(map[string]any)
+    if u["connections"] != 1.0 || u["status"] != presenceOnline {
+        t.Fatalf("after closing one socket: %v", u)
+    }
+    second.Close()
+    waitPresence(t, watcher, "presence_leave", "multi_socket")
+}
+
+func TestIdleUsersGoAwayAndComeBack(t *testing.T) {
+    oldIdle, oldSweep := presenceIdleTimeout, presenceSweepInterval
+    presenceIdleTimeout, presenceSweepInterval = time.Second, 50*time.Millisecond
+    t.Cleanup(func() { presenceIdleTimeout, presenceSweepInterval = oldIdle, oldSweep })
+    srv := newTestServer(t)
+    testUser(t, "idle_user")
+    testUser(t, "idle_watcher")
+    conn, _, err := srv.dial(t, "idle_user", "room=general")
+    if err != nil {
+        t.Fatal(err)
+    }
+    readUntil(t, conn, "users")
+    watcher, _, err := srv.dial(t, "idle_watcher", "room=general")
+    if err != nil {
+        t.Fatal(err)
+    }
+    readUntil(t, watcher, "users")
+
+    u := waitPresence(t, watcher, "presence_update", "idle_user")["user"].(map[string]any)
+    if u["status"] != presenceAway {
+        t.Fatalf("idle user: %v", u)
+    }
+    // Any frame counts as activity
+    sendFrame(t, conn, map[string]any{"type": "typing", "id": "t1", "isTyping": false})
+    u = waitPresence(t, watcher, "presence_update", "idle_user")["user"].(map[string]any)
+    if u["status"] != presenceOnline {
+        t.Fatalf("active again: %v", u)
+    }
+}
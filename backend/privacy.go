@@ -0,0 +1,744 @@
+package main
+
+import (
+    "archive/zip"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+
+    "github.com/jackc/pgx/v5"
+)
+
+// -------------------- Account Deletion Policy --------------------
+
+const (
+    // deletedUsername owns the messages of anonymized accounts. The brackets
+    // keep it out of the registrable username space.
+    deletedUsername = "[deleted]"
+
+    deletionAnonymize  = "anonymize"
+    deletionHardDelete = "delete"
+)
+
+// accountDeletionPolicy decides what happens to a deleted user's messages:
+// "anonymize" reassigns them to deletedUsername, "delete" removes them.
+var accountDeletionPolicy = deletionAnonymize
+
+func initAccountDeletion() {
+    switch p := strings.ToLower(strings.TrimSpace(os.Getenv("ACCOUNT_DELETION_POLICY"))); p {
+    case "":
+    case deletionAnonymize, deletionHardDelete:
+        accountDeletionPolicy = p
+    default:
+        log.Printf("⚠️ Unknown ACCOUNT_DELETION_POLICY %q, using %s", p, accountDeletionPolicy)
+    }
+    log.Println("🗑️ Account deletion policy:", accountDeletionPolicy)
+}
+
+// -------------------- Personal Data Export --------------------
+
+type accountRecord struct {
+    Username  string    `json:"username"`
+    Email     string    `json:"email,omitempty"`
+    Role      string    `json:"role"`
+    IsBot     bool      `json:"isBot,omitempty"`
+    BotOwner  string    `json:"botOwner,omitempty"`
+    CreatedAt time.Time `json:"createdAt"`
+}
+
+type exportedReaction struct {
+    MessageID int64  `json:"messageId"`
+    Room      string `json:"room"`
+    Emoji     string `json:"emoji"`
+}
+
+// exportHandler streams GET /account/export as a ZIP with the caller's
+// account, profile, settings, messages, reactions and uploaded files.
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    username := authUsername(r)
+    account, err := getAccountRecord(username)
+    if err != nil {
+        http.Error(w, "User not found", http.StatusNotFound)
+        return
+    }
+    profile, err := getProfile(username)
+    if err != nil {
+        log.Println("export profile error:", err)
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+    settings, _, err := getSettings(username)
+    if err != nil {
+        log.Println("export settings error:", err)
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+    bots, err := listBots(username)
+    if err != nil {
+        log.Println("export bots error:", err)
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/zip")
+    w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="chatbox-%s-export.zip"`, safeFileName(username)))
+    zw := zip.NewWriter(w)
+    defer zw.Close()
+
+    // Headers are already sent, so failures below can only be logged.
+    if err := writeZipJSON(zw, "account.json", map[string]any{
+        "account":  account,
+        "profile":  profile,
+        "settings": effectiveSettings(settings),
+        "bots":     bots,
+    }); err != nil {
+        log.Println("export write error:", err)
+        return
+    }
+
+    files := map[string]bool{}
+    if name := uploadedFileName(profile.AvatarURL); name != "" {
+        files[name] = true
+    }
+    mw, err := zw.Create("messages.json")
+    if err != nil {
+        log.Println("export write error:", err)
+        return
+    }
+    enc := json.NewEncoder(mw)
+    io.WriteString(mw, "[\n")
+    first := true
+    err = eachUserMessage(r.Context(), username, func(m Message) error {
+        if !first {
+            io.WriteString(mw, ",\n")
+        }
+        first = false
+        if name := uploadedFileName(m.FileURL); name != "" {
+            files[name] = true
+        }
+        return enc.Encode(m)
+    })
+    io.WriteString(mw, "]\n")
+    if err != nil {
+        log.Println("export messages error:", err)
+        return
+    }
+
+    reactions, err := listUserReactions(r.Context(), username)
+    if err != nil {
+        log.Println("export reactions error:", err)
+        return
+    }
+    if err := writeZipJSON(zw, "reactions.json", reactions); err != nil {
+        log.Println("export write error:", err)
+        return
+    }
+
+    for name := range files {
+        if err := copyUploadToZip(zw, name); err != nil {
+            log.Printf("export file %s error: %v", name, err)
+        }
+    }
+    log.Printf("📦 Exported account data for %s", username)
+}
+
+func writeZipJSON(zw *zip.Writer, name string, v any) error {
+    f, err := zw.Create(name)
+    if err != nil {
+        return err
+    }
+    enc := json.NewEncoder(f)
+    enc.SetIndent("", "  ")
+    return enc.Encode(v)
+}
+
+func copyUploadToZip(zw *zip.Writer, name string) error {
+    src, err := os.Open(filepath.Join("uploads", name))
+    if err != nil {
+        return err
+    }
+    defer src.Close()
+    dst, err := zw.Create("files/" + name)
+    if err != nil {
+        return err
+    }
+    _, err = io.Copy(dst, src)
+    return err
+}
+
+// uploadedFileName returns the file name behind a /files/ URL, or "".
+func uploadedFileName(u string) string {
+    name := strings.TrimPrefix(u, "/files/")
+    if name == u || name == "" || name != filepath.Base(name) {
+        return ""
+    }
+    return name
+}
+
+func safeFileName(s string) string {
+    return strings.Map(func(r rune) rune {
+        if r == '"' || r == '\\' || r == '/' || r < 0x20 {
+            return '_'
+        }
+        return r
+    }, s)
+}
+
+// -------------------- Account Deletion --------------------
+
+var (
+    // accountDeletionFreshness is how recently a session must have signed
+    // in for DELETE /account to need no further proof.
+    accountDeletionFreshness = 10 * time.Minute
+    // accountDeletionTTL is how long an emailed deletion confirmation lasts.
+    accountDeletionTTL = 30 * time.Minute
+)
+
+// deletionTicket is the signed payload of an emailed deletion confirmation.
+// It only works from the session that asked for it.
+type deletionTicket struct {
+    Username  string `json:"sub"`
+    SessionID string `json:"sid"`
+    ExpiresAt int64  `json:"exp"`
+}
+
+// requestAccountDeletionHandler handles POST /account/deletion: it emails a
+// confirmation token for DELETE /account to users who cannot give a password
+// or 2FA code, such as accounts that sign in with OIDC.
+func requestAccountDeletionHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    claims := authClaims(r)
+    if claims == nil || authAPIKey(r) != nil {
+        http.Error(w, "Forbidden", http.StatusForbidden)
+        return
+    }
+    email, err := getUserEmail(claims.Username)
+    if err != nil || email == "" {
+        http.Error(w, "No email address on file", http.StatusConflict)
+        return
+    }
+    if wait := reserveAuthAttempt("deletion:email:" + strings.ToLower(email)); wait > 0 {
+        rejectThrottled(w, wait)
+        return
+    }
+    token, err := signBlob("account-delete", deletionTicket{
+        Username:  claims.Username,
+        SessionID: claims.SessionID,
+        ExpiresAt: time.Now().Add(accountDeletionTTL).Unix(),
+    })
+    if err != nil {
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+    go sendDeletionConfirmation(claims.Username, email, token)
+    w.WriteHeader(http.StatusAccepted)
+    w.Write([]byte("Confirmation sent"))
+}
+
+func sendDeletionConfirmation(username, email, token string) {
+    body := fmt.Sprintf("Someone asked to delete your ChatBox account %q.\n\n", username)
+    body += "To confirm, enter this code where you asked:\n" + token + "\n\n"
+    body += fmt.Sprintf("It expires in %s and only works in the browser that asked. If this wasn't you, change your password.\n", accountDeletionTTL)
+
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+    if err := notifier.Send(ctx, Notification{To: email, Username: username, Subject: "Confirm deleting your ChatBox account", Body: body}); err != nil {
+        log.Println("deletion confirmation notify error:", err)
+    }
+}
+
+// deleteAccountHandler handles DELETE /account. The caller proves it is the
+// user with one of {password}, {code} (TOTP or recovery code) or {token}
+// (from POST /account/deletion), or by having signed in within
+// accountDeletionFreshness. Messages are kept or removed according to
+// accountDeletionPolicy; bots the user owns go too.
+func deleteAccountHandler(hub *Hub, w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodDelete {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    claims := authClaims(r)
+    if claims == nil || authAPIKey(r) != nil {
+        http.Error(w, "Forbidden", http.StatusForbidden)
+        return
+    }
+    var payload struct {
+        Password string `json:"password"`
+        Code     string `json:"code"`
+        Token    string `json:"token"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&payload); err != nil && err != io.EOF {
+        http.Error(w, "Invalid JSON", http.StatusBadRequest)
+        return
+    }
+    username := claims.Username
+
+    fresh := time.Since(time.Unix(claims.IssuedAt, 0)) < accountDeletionFreshness
+    if !fresh && payload.Password == "" && payload.Code == "" && payload.Token == "" {
+        http.Error(w, "Confirm with your password, a 2FA code or the emailed code, or sign in again", http.StatusUnauthorized)
+        return
+    }
+    if !fresh {
+        userKey, ipKey := loginThrottleKeys(username, r)
+        if wait := reserveAuthAttempt(userKey, ipKey); wait > 0 {
+            rejectThrottled(w, wait)
+            return
+        }
+        var ok bool
+        switch {
+        case payload.Password != "":
+            if hash, err := getUserPasswordHash(username); err == nil {
+                ok, _ = verifyPassword(hash, payload.Password)
+            }
+        case payload.Code != "":
+            ok = checkMFACode(username, payload.Code) == nil
+        default:
+            var t deletionTicket
+            ok = openBlob("account-delete", payload.Token, &t) == nil && time.Now().Unix() < t.ExpiresAt &&
+                t.Username == username && t.SessionID == claims.SessionID
+        }
+        if !ok {
+            http.Error(w, "Confirmation is incorrect", http.StatusUnauthorized)
+            return
+        }
+        authAttemptSucceeded(userKey, ipKey)
+    }
+
+    if isAdmin(username) {
+        ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+        defer cancel()
+        if n, err := countAdmins(ctx); err != nil || n <= 1 {
+            http.Error(w, "Cannot delete the last admin", http.StatusConflict)
+            return
+        }
+    }
+    if err := deleteAccount(hub, username, accountDeletionPolicy); err != nil {
+        log.Println("delete account error:", err)
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+    http.SetCookie(w, &http.Cookie{Name: sessionCookieName, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+    w.WriteHeader(http.StatusOK)
+    w.Write([]byte("Account deleted"))
+}
+
+// deleteAccount removes username and its bots, disconnects their sockets and
+// tells clients how to re-render the affected history.
+func deleteAccount(hub *Hub, username, policy string) error {
+    bots, err := listBots(username)
+    if err != nil {
+        return err
+    }
+    users := []string{username}
+    for _, b := range bots {
+        users = append(users, b.Username)
+    }
+
+    // Capture session IDs before the rows disappear.
+    var sessionIDs []string
+    for _, u := range users {
+        ids, err := revokeUserSessions(u, "")
+        if err != nil {
+            return err
+        }
+        sessionIDs = append(sessionIDs, ids...)
+    }
+
+    var orphaned []string
+    if useDB {
+        ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+        defer cancel()
+        orphaned, err = dbDeleteAccounts(ctx, users, policy)
+    } else {
+        orphaned = memDeleteAccounts(users, policy)
+    }
+    if err != nil {
+        return err
+    }
+
+    for _, name := range orphaned {
+        if err := os.Remove(filepath.Join("uploads", name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+            log.Printf("remove upload %s error: %v", name, err)
+        }
+    }
+    for _, id := range sessionIDs {
+        hub.revoke <- id
+    }
+    for _, u := range users {
+        resetAuthFailures("login:user:" + u)
+        hub.kick <- u
+        timezoneMu.Lock()
+        delete(timezoneCache, u)
+        timezoneMu.Unlock()
+
+        event := UserDeletedEvent{Type: "user_deleted", Username: u, Policy: policy}
+        if policy == deletionAnonymize {
+            event.Replacement = deletedUsername
+        }
+        if b, err := json.Marshal(event); err == nil {
+            hub.broadcast <- Broadcast{sender: nil, message: b}
+        }
+    }
+    log.Printf("🗑️ Deleted account %s (%d bot(s), policy %s)", username, len(bots), policy)
+    return nil
+}
+
+// memDeleteAccounts applies the deletion policy to the in-memory stores and
+// returns the users' uploaded files that nothing left references.
+func memDeleteAccounts(users []string, policy string) []string {
+    gone := map[string]bool{}
+    for _, u := range users {
+        gone[u] = true
+    }
+
+    deletedIDs := map[int64]bool{}
+    messagesMu.Lock()
+    kept := messagesList[:0]
+    for _, m := range messagesList {
+        for emoji, reactors := range m.Reactions {
+            left := reactors[:0]
+            for _, who := range reactors {
+                if !gone[who] {
+                    left = append(left, who)
+                }
+            }
+            if len(left) == 0 {
+                delete(m.Reactions, emoji)
+            } else {
+                m.Reactions[emoji] = left
+            }
+        }
+        if gone[m.Username] {
+            if policy == deletionHardDelete {
+                deletedIDs[m.ID] = true
+                continue
+            }
+            m.Username = deletedUsername
+        }
+        kept = append(kept, m)
+    }
+    messagesList = kept
+    messagesMu.Unlock()
+
+    roomsMu.Lock()
+    for i := range inMemoryRooms {
+        if gone[inMemoryRooms[i].Creator] {
+            inMemoryRooms[i].Creator = deletedUsername
+        }
+    }
+    roomsMu.Unlock()
+
+    usersMu.Lock()
+    for _, u := range users {
+        delete(usersMap, u)
+    }
+    usersMu.Unlock()
+
+    sessionsMu.Lock()
+    for id, s := range sessionsMap {
+        if gone[s.Username] {
+            delete(sessionsMap, id)
+        }
+    }
+    sessionsMu.Unlock()
+    apiKeysMu.Lock()
+    for id, k := range apiKeysMap {
+        if gone[k.Username] {
+            delete(apiKeysMap, id)
+        }
+    }
+    apiKeysMu.Unlock()
+    mfaMu.Lock()
+    for _, u := range users {
+        delete(mfaMap, u)
+    }
+    mfaMu.Unlock()
+    identitiesMu.Lock()
+    for k, u := range identitiesMap {
+        if gone[u] {
+            delete(identitiesMap, k)
+        }
+    }
+    identitiesMu.Unlock()
+    presenceMu.Lock()
+    for _, u := range users {
+        delete(presenceMap, u)
+    }
+    presenceMu.Unlock()
+    memScrubRoomEvents(gone, policy, deletedIDs)
+    memForgetSentKeys(gone)
+    memForgetRoomMembers(gone)
+    resetsMu.Lock()
+    for h, pr := range resetsMap {
+        if gone[pr.Username] {
+            delete(resetsMap, h)
+        }
+    }
+    resetsMu.Unlock()
+    return memForgetUploads(gone)
+}
+
+// -------------------- Privacy Store --------------------
+
+func getAccountRecord(username string) (*accountRecord, error) {
+    if useDB {
+        ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        defer cancel()
+        var a accountRecord
+        var email, owner *string
+        err := dbPool.QueryRow(ctx, `
+            SELECT username, email, role, is_bot, bot_owner, created_at FROM users WHERE username=$1
+        `, username).Scan(&a.Username, &email, &a.Role, &a.IsBot, &owner, &a.CreatedAt)
+        if err != nil {
+            return nil, err
+        }
+        if email != nil {
+            a.Email = *email
+        }
+        if owner != nil {
+            a.BotOwner = *owner
+        }
+        return &a, nil
+    }
+    usersMu.RLock()
+    defer usersMu.RUnlock()
+    su, ok := usersMap[username]
+    if !ok {
+        return nil, fmt.Errorf("not found")
+    }
+    role := su.Role
+    if role == "" {
+        role = roleMember
+    }
+    return &accountRecord{Username: su.Username, Email: su.Email, Role: role, IsBot: su.IsBot, BotOwner: su.BotOwner, CreatedAt: su.CreatedAt}, nil
+}
+
+// eachUserMessage calls fn for every message username wrote, oldest first.
+func eachUserMessage(ctx context.Context, username string, fn func(Message) error) error {
+    if useDB {
+        rows, err := dbPool.Query(ctx, `
+            SELECT id, text, timestamp, COALESCE(room, 'general'), COALESCE(file_url, ''),
+                   COALESCE(file_type, ''), COALESCE(file_name, ''), COALESCE(reactions, '{}'), bot
+            FROM messages WHERE username=$1 ORDER BY id ASC
+        `, username)
+        if err != nil {
+            return err
+        }
+        defer rows.Close()
+        for rows.Next() {
+            m := Message{Username: username}
+            var ts time.Time
+            if err := rows.Scan(&m.ID, &m.Text, &ts, &m.Room, &m.FileURL, &m.FileType, &m.FileName, &m.Reactions, &m.Bot); err != nil {
+                return err
+            }
+            m.Timestamp = ts.Format("2006-01-02 15:04:05 MST")
+            if err := fn(m); err != nil {
+                return err
+            }
+        }
+        return rows.Err()
+    }
+    messagesMu.RLock()
+    var mine []Message
+    for _, m := range messagesList {
+        if m.Username == username {
+            mine = append(mine, m)
+        }
+    }
+    messagesMu.RUnlock()
+    for _, m := range mine {
+        if err := fn(m); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// dbScrubRoomEvents rewrites the logged events that name the users or, under
+// the delete policy, refer to their deleted messages (see scrubRoomEvent).
+func dbScrubRoomEvents(ctx context.Context, tx pgx.Tx, users []string, policy string, deletedIDs map[int64]bool) error {
+    ids := make([]int64, 0, len(deletedIDs))
+    for id := range deletedIDs {
+        ids = append(ids, id)
+    }
+    rows, err := tx.Query(ctx, `
+        SELECT room, seq, payload FROM room_events
+        WHERE payload->>'username' = ANY($1) OR payload->>'editedBy' = ANY($1) OR payload->>'deletedBy' = ANY($1)
+           OR (payload->>'type' = 'message'
+               AND jsonb_path_exists(payload, 'lax $.reactions.*[*] ? (@ == $users[*])', jsonb_build_object('users', $1::text[])))
+           OR (payload->>'type' = 'edit' AND (payload->>'id')::bigint = ANY($2))
+           OR (payload->>'type' = 'reaction' AND (payload->>'messageId')::bigint = ANY($2))
+    `, users, ids)
+    if err != nil {
+        return err
+    }
+    type scrubbed struct {
+        room    string
+        seq     int64
+        payload json.RawMessage
+    }
+    var changed []scrubbed
+    gone := map[string]bool{}
+    for _, u := range users {
+        gone[u] = true
+    }
+    for rows.Next() {
+        var e scrubbed
+        if err := rows.Scan(&e.room, &e.seq, &e.payload); err != nil {
+            rows.Close()
+            return err
+        }
+        if b, ok := scrubRoomEvent(e.payload, gone, policy, deletedIDs); ok {
+            e.payload = b
+            changed = append(changed, e)
+        }
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return err
+    }
+    for _, e := range changed {
+        if _, err := tx.Exec(ctx, `UPDATE room_events SET payload=$3 WHERE room=$1 AND seq=$2`, e.room, e.seq, e.payload); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// listUserReactions returns every reaction username left on any message.
+func listUserReactions(ctx context.Context, username string) ([]exportedReaction, error) {
+    out := make([]exportedReaction, 0)
+    if useDB {
+        rows, err := dbPool.Query(ctx, `
+            SELECT m.id, COALESCE(m.room, 'general'), e.key
+            FROM messages m, jsonb_each(COALESCE(m.reactions, '{}')) e
+            WHERE jsonb_typeof(e.value) = 'array' AND e.value ? $1
+            ORDER BY m.id ASC
+        `, username)
+        if err != nil {
+            return nil, err
+        }
+        defer rows.Close()
+        for rows.Next() {
+            var x exportedReaction
+            if err := rows.Scan(&x.MessageID, &x.Room, &x.Emoji); err != nil {
+                return nil, err
+            }
+            out = append(out, x)
+        }
+        return out, rows.Err()
+    }
+    messagesMu.RLock()
+    defer messagesMu.RUnlock()
+    for _, m := range messagesList {
+        for emoji, reactors := range m.Reactions {
+            if containsString(reactors, username) {
+                out = append(out, exportedReaction{MessageID: m.ID, Room: m.Room, Emoji: emoji})
+            }
+        }
+    }
+    return out, nil
+}
+
+// dbDeleteAccounts applies the deletion policy in one transaction and returns
+// the users' uploaded files that nothing left references.
+func dbDeleteAccounts(ctx context.Context, users []string, policy string) ([]string, error) {
+    tx, err := dbPool.Begin(ctx)
+    if err != nil {
+        return nil, err
+    }
+    defer tx.Rollback(ctx)
+
+    // Strip the users from reactions on any message.
+    _, err = tx.Exec(ctx, `
+        UPDATE messages m SET reactions = COALESCE((
+            SELECT jsonb_object_agg(e.key, e.value - $1::text[])
+            FROM jsonb_each(m.reactions) e
+            WHERE jsonb_typeof(e.value) <> 'array' OR jsonb_array_length(e.value - $1::text[]) > 0
+        ), '{}')
+        WHERE EXISTS (
+            SELECT 1 FROM jsonb_each(m.reactions) e
+            WHERE jsonb_typeof(e.value) = 'array' AND e.value ?| $1::text[]
+        )
+    `, users)
+    if err != nil {
+        return nil, err
+    }
+
+    deletedIDs := map[int64]bool{}
+    if policy == deletionHardDelete {
+        rows, err := tx.Query(ctx, `DELETE FROM messages WHERE username = ANY($1) RETURNING id`, users)
+        if err != nil {
+            return nil, err
+        }
+        for rows.Next() {
+            var id int64
+            if err := rows.Scan(&id); err != nil {
+                rows.Close()
+                return nil, err
+            }
+            deletedIDs[id] = true
+        }
+        rows.Close()
+        if err := rows.Err(); err != nil {
+            return nil, err
+        }
+    } else {
+        if _, err := tx.Exec(ctx, `UPDATE messages SET username=$1 WHERE username = ANY($2)`, deletedUsername, users); err != nil {
+            return nil, err
+        }
+    }
+    if _, err := tx.Exec(ctx, `UPDATE rooms SET creator=$1 WHERE creator = ANY($2)`, deletedUsername, users); err != nil {
+        return nil, err
+    }
+    if err := dbScrubRoomEvents(ctx, tx, users, policy, deletedIDs); err != nil {
+        return nil, err
+    }
+    // Files the users uploaded that no message or other user's avatar uses;
+    // their upload rows go with the users below.
+    var orphaned []string
+    rows, err := tx.Query(ctx, `
+        SELECT f.name FROM uploads f
+        WHERE f.username = ANY($1)
+          AND NOT EXISTS (SELECT 1 FROM messages WHERE file_url = '/files/' || f.name)
+          AND NOT EXISTS (SELECT 1 FROM users WHERE avatar_url = '/files/' || f.name AND NOT username = ANY($1))
+    `, users)
+    if err != nil {
+        return nil, err
+    }
+    for rows.Next() {
+        var name string
+        if err := rows.Scan(&name); err != nil {
+            rows.Close()
+            return nil, err
+        }
+        orphaned = append(orphaned, name)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return nil, err
+    }
+    // Sessions, resets, MFA, identities, API keys and uploads cascade from users.
+    if _, err := tx.Exec(ctx, `DELETE FROM users WHERE username = ANY($1)`, users); err != nil {
+        return nil, err
+    }
+    if err := tx.Commit(ctx); err != nil {
+        return nil, err
+    }
+    return orphaned, nil
+}
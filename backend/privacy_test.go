@@ -0,0 +1,257 @@
+package main
+
+import (
+    "archive/zip"
+    "bytes"
+    "context"
+    "encoding/json"
+    "io"
+    "net/http"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestDeleteAccountRemovesOnlyOwnUnusedUploads(t *testing.T) {
+    t.Chdir(t.TempDir())
+    hub := newTestServer(t).hub
+    testUser(t, "upload_victim")
+    testUser(t, "upload_leaver")
+    if err := os.Mkdir("uploads", 0750); err != nil {
+        t.Fatal(err)
+    }
+    upload := func(name, owner string) {
+        t.Helper()
+        if err := os.WriteFile(filepath.Join("uploads", name), []byte(name), 0640); err != nil {
+            t.Fatal(err)
+        }
+        if err := recordUpload(name, owner); err != nil {
+            t.Fatal(err)
+        }
+    }
+    post := func(user, name string) {
+        t.Helper()
+        if _, err := saveMessage(Message{Username: user, Text: "file", Room: "general", FileURL: "/files/" + name}, ""); err != nil {
+            t.Fatal(err)
+        }
+    }
+    upload("victim.png", "upload_victim")
+    upload("posted.png", "upload_leaver")
+    upload("shared.png", "upload_leaver")
+    upload("unused.png", "upload_leaver")
+    if err := os.WriteFile(filepath.Join("uploads", "legacy.png"), nil, 0640); err != nil {
+        t.Fatal(err)
+    }
+    // The leaver points their avatar at someone else's file...
+    if err := saveProfile(&Profile{Username: "upload_leaver", AvatarURL: "/files/victim.png"}); err != nil {
+        t.Fatal(err)
+    }
+    post("upload_leaver", "posted.png")
+    post("upload_leaver", "legacy.png")
+    // ...and someone else reposts one of theirs
+    post("upload_victim", "shared.png")
+
+    if err := deleteAccount(hub, "upload_leaver", deletionHardDelete); err != nil {
+        t.Fatal(err)
+    }
+    for name, kept := range map[string]bool{
+        "victim.png": true,  // someone else's upload
+        "shared.png": true,  // still on another user's message
+        "legacy.png": true,  // uploader unknown
+        "posted.png": false, // only on the deleted messages
+        "unused.png": false, // never referenced
+    } {
+        _, err := os.Stat(filepath.Join("uploads", name))
+        if exists := err == nil; exists != kept {
+            t.Errorf("%s: exists=%v, want %v", name, exists, kept)
+        }
+    }
+}
+
+func TestDeleteAccountNeedsConfirmation(t *testing.T) {
+    withTestThrottle(t)
+    hub := newTestServer(t).hub
+    n := blockingNotifier{release: make(chan struct{}), sent: make(chan Notification, 1)}
+    close(n.release)
+    old := notifier
+    notifier = n
+    t.Cleanup(func() { notifier = old })
+    del := requireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        deleteAccountHandler(hub, w, r)
+    }))
+    gone := func(user string) bool {
+        _, err := getUserEmail(user)
+        return err != nil
+    }
+
+    // A session that signed in moments ago needs nothing more
+    testUser(t, "del_fresh")
+    if w := serve(del, sessionToken(t, "del_fresh"), http.MethodDelete, "/account", ""); w.Code != http.StatusOK || !gone("del_fresh") {
+        t.Fatalf("fresh session: status %d %s", w.Code, w.Body)
+    }
+
+    oldFreshness := accountDeletionFreshness
+    accountDeletionFreshness = 0
+    t.Cleanup(func() { accountDeletionFreshness = oldFreshness })
+
+    testUser(t, "del_password")
+    token := sessionToken(t, "del_password")
+    for _, body := range []string{"", `{"password":"wrong password"}`} {
+        if w := serve(del, token, http.MethodDelete, "/account", body); w.Code != http.StatusUnauthorized || gone("del_password") {
+            t.Fatalf("%q: status %d", body, w.Code)
+        }
+    }
+    if w := serve(del, token, http.MethodDelete, "/account", `{"password":"correct horse battery staple"}`); w.Code != http.StatusOK || !gone("del_password") {
+        t.Fatalf("password: status %d %s", w.Code, w.Body)
+    }
+
+    testUser(t, "del_code")
+    secret := newTOTPSecret()
+    key, _ := b32.DecodeString(secret)
+    if err := saveUserMFA("del_code", &userMFA{Secret: secret, Enabled: true}); err != nil {
+        t.Fatal(err)
+    }
+    code := totpCode(key, time.Now().Unix()/totpPeriod)
+    if w := serve(del, sessionToken(t, "del_code"), http.MethodDelete, "/account", `{"code":"`+code+`"}`); w.Code != http.StatusOK || !gone("del_code") {
+        t.Fatalf("2FA code: status %d %s", w.Code, w.Body)
+    }
+
+    // The emailed code only works from the session that asked for it
+    testUser(t, "del_email")
+    asking, other := sessionToken(t, "del_email"), sessionToken(t, "del_email")
+    w := serve(requireAuth(http.HandlerFunc(requestAccountDeletionHandler)), asking, http.MethodPost, "/account/deletion", "")
+    if w.Code != http.StatusAccepted {
+        t.Fatalf("request confirmation: status %d", w.Code)
+    }
+    var msg Notification
+    select {
+    case msg = <-n.sent:
+    case <-time.After(5 * time.Second):
+        t.Fatal("confirmation email never sent")
+    }
+    _, emailed, _ := strings.Cut(msg.Body, "enter this code where you asked:\n")
+    emailed, _, _ = strings.Cut(emailed, "\n")
+    if msg.To != "del_email@example.com" || emailed == "" {
+        t.Fatalf("notification %+v", msg)
+    }
+    if w := serve(del, other, http.MethodDelete, "/account", `{"token":"`+emailed+`"}`); w.Code != http.StatusUnauthorized || gone("del_email") {
+        t.Fatalf("code from another session: status %d", w.Code)
+    }
+    if w := serve(del, asking, http.MethodDelete, "/account", `{"token":"`+emailed+`"}`); w.Code != http.StatusOK || !gone("del_email") {
+        t.Fatalf("emailed code: status %d %s", w.Code, w.Body)
+    }
+}
+
+func TestExportContents(t *testing.T) {
+    t.Chdir(t.TempDir())
+    testUser(t, "export_user")
+    testUser(t, "export_other")
+    if err := os.Mkdir("uploads", 0750); err != nil {
+        t.Fatal(err)
+    }
+    for _, name := range []string{"avatar.png", "attached.txt", "theirs.txt"} {
+        if err := os.WriteFile(filepath.Join("uploads", name), []byte("contents of "+name), 0640); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := saveProfile(&Profile{Username: "export_user", AvatarURL: "/files/avatar.png"}); err != nil {
+        t.Fatal(err)
+    }
+    save := func(m Message) int64 {
+        t.Helper()
+        rc, err := saveMessage(m, "")
+        if err != nil {
+            t.Fatal(err)
+        }
+        return rc.ID
+    }
+    mine := save(Message{Username: "export_user", Text: "mine", Room: "general", FileURL: "/files/attached.txt"})
+    theirs := save(Message{Username: "export_other", Text: "theirs", Room: "general", FileURL: "/files/theirs.txt"})
+    toggleReaction(theirs, "👍", "export_user")
+
+    w := serve(requireAuth(http.HandlerFunc(exportHandler)), sessionToken(t, "export_user"), http.MethodGet, "/account/export", "")
+    if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/zip" {
+        t.Fatalf("status %d, type %q", w.Code, w.Header().Get("Content-Type"))
+    }
+    zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+    if err != nil {
+        t.Fatal(err)
+    }
+    files := map[string][]byte{}
+    for _, f := range zr.File {
+        rc, err := f.Open()
+        if err != nil {
+            t.Fatal(err)
+        }
+        files[f.Name], _ = io.ReadAll(rc)
+        rc.Close()
+    }
+
+    var account struct {
+        Account accountRecord `json:"account"`
+        Profile Profile       `json:"profile"`
+    }
+    if err := json.Unmarshal(files["account.json"], &account); err != nil || account.Account.Email != "export_user@example.com" || account.Profile.AvatarURL != "/files/avatar.png" {
+        t.Fatalf("account.json: %s", files["account.json"])
+    }
+    var messages []Message
+    if err := json.Unmarshal(files["messages.json"], &messages); err != nil || len(messages) != 1 || messages[0].ID != mine {
+        t.Fatalf("messages.json: %s", files["messages.json"])
+    }
+    var reactions []exportedReaction
+    if err := json.Unmarshal(files["reactions.json"], &reactions); err != nil || len(reactions) != 1 || reactions[0] != (exportedReaction{MessageID: theirs, Room: "general", Emoji: "👍"}) {
+        t.Fatalf("reactions.json: %s", files["reactions.json"])
+    }
+    for name, want := range map[string]bool{"files/avatar.png": true, "files/attached.txt": true, "files/theirs.txt": false} {
+        if b, ok := files[name]; ok != want || ok && string(b) != "contents of "+strings.TrimPrefix(name, "files/") {
+            t.Errorf("%s: in export %v, want %v (%q)", name, ok, want, b)
+        }
+    }
+}
+
+func TestDeleteAccountPolicies(t *testing.T) {
+    hub := newTestServer(t).hub
+    for _, policy := range []string{deletionAnonymize, deletionHardDelete} {
+        t.Run(policy, func(t *testing.T) {
+            leaver, stayer, room := "policy_"+policy, "policy_stays_"+policy, "policy-room-"+policy
+            testUser(t, leaver)
+            testUser(t, stayer)
+            if _, err := dbCreateRoom(context.Background(), room, "", leaver, nil, false); err != nil {
+                t.Fatal(err)
+            }
+            t.Cleanup(func() { dbDeleteRoom(context.Background(), room) })
+            theirs, err := saveMessage(Message{Username: leaver, Text: "bye", Room: room}, "")
+            if err != nil {
+                t.Fatal(err)
+            }
+            kept, err := saveMessage(Message{Username: stayer, Text: "still here", Room: room}, "")
+            if err != nil {
+                t.Fatal(err)
+            }
+            toggleReaction(kept.ID, "👋", leaver)
+            toggleReaction(kept.ID, "👋", stayer)
+
+            if err := deleteAccount(hub, leaver, policy); err != nil {
+                t.Fatal(err)
+            }
+            m, err := getMessage(theirs.ID)
+            switch {
+            case policy == deletionHardDelete && err != errMessageNotFound:
+                t.Fatalf("their message after hard delete: %+v, %v", m, err)
+            case policy == deletionAnonymize && (err != nil || m.Username != deletedUsername || m.Text != "bye"):
+                t.Fatalf("their message after anonymizing: %+v, %v", m, err)
+            }
+            if m, err := getMessage(kept.ID); err != nil || m.Username != stayer || strings.Join(m.Reactions["👋"], ",") != stayer {
+                t.Fatalf("other message: %+v, %v", m, err)
+            }
+            if r, err := dbGetRoom(context.Background(), room); err != nil || r.Creator != deletedUsername {
+                t.Fatalf("room: %+v, %v", r, err)
+            }
+            if _, err := getUserEmail(leaver); err == nil {
+                t.Fatal("account still exists")
+            }
+        })
+    }
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "time"
+    "unicode/utf8"
+
+    "github.com/jackc/pgx/v5"
+)
+
+// -------------------- User Profiles --------------------
+
+type Profile struct {
+    Username    string `json:"username"`
+    DisplayName string `json:"displayName"`
+    AvatarURL   string `json:"avatarUrl"`
+    Bio         string `json:"bio"`
+    Pronouns    string `json:"pronouns"`
+    Timezone    string `json:"timezone"`
+    Bot         bool   `json:"bot,omitempty"`
+}
+
+const (
+    maxDisplayNameLen = 64
+    maxBioLen         = 500
+    maxPronounsLen    = 32
+)
+
+var (
+    // timezoneCache avoids a store lookup per chat message in readPump.
+    timezoneMu    sync.RWMutex
+    timezoneCache = map[string]string{}
+
+    errProfileNotFound = errors.New("profile not found")
+)
+
+// profileUpdate is a profile_updated frame for the hub to send to the
+// people who share a room with the user.
+type profileUpdate struct {
+    username string
+    message  []byte
+}
+
+func getProfile(username string) (*Profile, error) {
+    if useDB {
+        ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        defer cancel()
+        return dbGetProfile(ctx, username)
+    }
+    usersMu.RLock()
+    defer usersMu.RUnlock()
+    su, ok := usersMap[username]
+    if !ok {
+        return nil, errProfileNotFound
+    }
+    p := su.Profile
+    p.Username = su.Username
+    p.Bot = su.IsBot
+    return &p, nil
+}
+
+func saveProfile(p *Profile) error {
+    if useDB {
+        ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        defer cancel()
+        if err := dbSaveProfile(ctx, p); err != nil {
+            return err
+        }
+    } else {
+        usersMu.Lock()
+        su, ok := usersMap[p.Username]
+        if ok {
+            su.Profile = *p
+        }
+        usersMu.Unlock()
+        if !ok {
+            return errProfileNotFound
+        }
+    }
+    timezoneMu.Lock()
+    timezoneCache[p.Username] = p.Timezone
+    timezoneMu.Unlock()
+    return nil
+}
+
+// forgetTimezone drops username's cached timezone after another node
+// changed their profile.
+func forgetTimezone(username string) {
+    timezoneMu.Lock()
+    delete(timezoneCache, username)
+    timezoneMu.Unlock()
+}
+
+// userTimezone returns the user's preferred IANA timezone, or "" for server local time.
+func userTimezone(username string) string {
+    timezoneMu.RLock()
+    tz, ok := timezoneCache[username]
+    timezoneMu.RUnlock()
+    if ok {
+        return tz
+    }
+    p, err := getProfile(username)
+    if err != nil {
+        return ""
+    }
+    timezoneMu.Lock()
+    timezoneCache[username] = p.Timezone
+    timezoneMu.Unlock()
+    return p.Timezone
+}
+
+// validAvatarURL accepts only files served from our own /upload pipeline.
+func validAvatarURL(u string) bool {
+    if u == "" {
+        return true
+    }
+    name := strings.TrimPrefix(u, "/files/")
+    if name == u || name == "" || name != filepath.Base(name) {
+        return false
+    }
+    switch strings.ToLower(filepath.Ext(name)) {
+    case ".jpg", ".jpeg", ".png", ".gif", ".webp":
+    default:
+        return false
+    }
+    _, err := os.Stat(filepath.Join("uploads", name))
+    return err == nil
+}
+
+// -------------------- Profile Handlers --------------------
+
+// profileHandler handles GET and PUT /users/{username}.
+func profileHandler(hub *Hub, w http.ResponseWriter, r *http.Request) {
+    username := strings.TrimPrefix(r.URL.Path, "/users/")
+    if username == "" || strings.Contains(username, "/") {
+        http.Error(w, "Username required", http.StatusBadRequest)
+        return
+    }
+    switch r.Method {
+    case http.MethodGet:
+        p, err := getProfile(username)
+        if err != nil {
+            if !errors.Is(err, errProfileNotFound) {
+                log.Println("load profile error:", err)
+            }
+            http.Error(w, "User not found", http.StatusNotFound)
+            return
+        }
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(p)
+    case http.MethodPut:
+        updateProfileHandler(hub, username, w, r)
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+func updateProfileHandler(hub *Hub, username string, w http.ResponseWriter, r *http.Request) {
+    caller := authUsername(r)
+    if caller != username && !isAdmin(caller) {
+        http.Error(w, "Forbidden", http.StatusForbidden)
+        return
+    }
+    // Omitted fields are left unchanged
+    var payload struct {
+        DisplayName *string `json:"displayName"`
+        AvatarURL   *string `json:"avatarUrl"`
+        Bio         *string `json:"bio"`
+        Pronouns    *string `json:"pronouns"`
+        Timezone    *string `json:"timezone"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+        http.Error(w, "Invalid JSON", http.StatusBadRequest)
+        return
+    }
+    p, err := getProfile(username)
+    if err != nil {
+        http.Error(w, "User not found", http.StatusNotFound)
+        return
+    }
+    if payload.DisplayName != nil {
+        v := strings.TrimSpace(*payload.DisplayName)
+        if utf8.RuneCountInString(v) > maxDisplayNameLen {
+            http.Error(w, fmt.Sprintf("Display name must be at most %d characters", maxDisplayNameLen), http.StatusBadRequest)
+            return
+        }
+        p.DisplayName = v
+    }
+    if payload.AvatarURL != nil {
+        if !validAvatarURL(*payload.AvatarURL) {
+            http.Error(w, "Avatar must be an uploaded image", http.StatusBadRequest)
+            return
+        }
+        p.AvatarURL = *payload.AvatarURL
+    }
+    if payload.Bio != nil {
+        if utf8.RuneCountInString(*payload.Bio) > maxBioLen {
+            http.Error(w, fmt.Sprintf("Bio must be at most %d characters", maxBioLen), http.StatusBadRequest)
+            return
+        }
+        p.Bio = *payload.Bio
+    }
+    if payload.Pronouns != nil {
+        v := strings.TrimSpace(*payload.Pronouns)
+        if utf8.RuneCountInString(v) > maxPronounsLen {
+            http.Error(w, fmt.Sprintf("Pronouns must be at most %d characters", maxPronounsLen), http.StatusBadRequest)
+            return
+        }
+        p.Pronouns = v
+    }
+    if payload.Timezone != nil {
+        v := strings.TrimSpace(*payload.Timezone)
+        if v != "" {
+            if _, err := time.LoadLocation(v); err != nil || v == "Local" {
+                http.Error(w, "Unknown timezone", http.StatusBadRequest)
+                return
+            }
+        }
+        p.Timezone = v
+    }
+    if err := saveProfile(p); err != nil {
+        log.Println("save profile error:", err)
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+
+    if b, err := json.Marshal(ProfileUpdatedEvent{Type: "profile_updated", Profile: p}); err == nil {
+        hub.profileUpdates <- profileUpdate{username: p.Username, message: b}
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(p)
+}
+
+// -------------------- Profile DB Helpers --------------------
+
+func dbGetProfile(ctx context.Context, username string) (*Profile, error) {
+    p := Profile{Username: username}
+    err := dbPool.QueryRow(ctx, `
+        SELECT display_name, avatar_url, bio, pronouns, timezone, is_bot FROM users WHERE username=$1
+    `, username).Scan(&p.DisplayName, &p.AvatarURL, &p.Bio, &p.Pronouns, &p.Timezone, &p.Bot)
+    if err != nil {
+        if errors.Is(err, pgx.ErrNoRows) {
+            return nil, errProfileNotFound
+        }
+        return nil, err
+    }
+    return &p, nil
+}
+
+func dbSaveProfile(ctx context.Context, p *Profile) error {
+    ct, err := dbPool.Exec(ctx, `
+        UPDATE users SET display_name=$1, avatar_url=$2, bio=$3, pronouns=$4, timezone=$5
+        WHERE username=$6
+    `, p.DisplayName, p.AvatarURL, p.Bio, p.Pronouns, p.Timezone, p.Username)
+    if err != nil {
+        return err
+    }
+    if ct.RowsAffected() == 0 {
+        return errProfileNotFound
+    }
+    return nil
+}
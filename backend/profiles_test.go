@@ -0,0 +1,97 @@
+package main
+
+import (
+    "context"
+    "net/http"
+    "testing"
+    "time"
+
+    "github.com/gorilla/websocket"
+)
+
+// frameTypesUntil reads frames until one of type typ and returns the types
+// of those before it.
+func frameTypesUntil(t *testing.T, conn *websocket.Conn, typ string) []string {
+    t.Helper()
+    conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+    defer conn.SetReadDeadline(time.Time{})
+    var seen []string
+    for {
+        var f map[string]any
+        if err := conn.ReadJSON(&f); err != nil {
+            t.Fatalf("waiting for %q: %v", typ, err)
+        }
+        if f["type"] == typ {
+            return seen
+        }
+        seen = append(seen, f["type"].(string))
+    }
+}
+
+func TestProfileUpdateReachesRoomPeersOnly(t *testing.T) {
+    bus := newMemBus()
+    nodeA, nodeB := newTestNode(t, bus), newTestNode(t, bus)
+    for _, u := range []string{"prof_subject", "prof_peer", "prof_remote", "prof_stranger"} {
+        testUser(t, u)
+    }
+    for _, room := range []string{"prof-shared", "prof-elsewhere"} {
+        if _, err := dbCreateRoom(context.Background(), room, "", "prof_subject", nil, false); err != nil {
+            t.Fatal(err)
+        }
+        t.Cleanup(func() { dbDeleteRoom(context.Background(), room) })
+    }
+    dial := func(srv *testServer, user, room string) *websocket.Conn {
+        t.Helper()
+        conn, _, err := srv.dial(t, user, "room="+room)
+        if err != nil {
+            t.Fatal(err)
+        }
+        readUntil(t, conn, "history")
+        return conn
+    }
+    remote := dial(nodeB, "prof_remote", "prof-shared")
+    peer := dial(nodeA, "prof_peer", "prof-shared")
+    stranger := dial(nodeA, "prof_stranger", "prof-elsewhere")
+    dial(nodeA, "prof_subject", "prof-shared")
+    // nodeB learns of the subject through the roster
+    for {
+        f := readUntil(t, remote, "presence_join")
+        if user, _ := f["user"].(map[string]any); user["username"] == "prof_subject" {
+            break
+        }
+    }
+
+    timezoneMu.Lock()
+    timezoneCache["prof_subject"] = "Europe/Paris"
+    timezoneMu.Unlock()
+    h := requireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        profileHandler(nodeA.hub, w, r)
+    }))
+    if w := serve(h, sessionToken(t, "prof_subject"), http.MethodPut, "/users/prof_subject", `{"displayName":"Subject","timezone":"Asia/Tokyo"}`); w.Code != http.StatusOK {
+        t.Fatalf("update: status %d: %s", w.Code, w.Body)
+    }
+
+    if f := readUntil(t, peer, "profile_updated"); f["profile"].(map[string]any)["displayName"] != "Subject" {
+        t.Fatalf("peer got %v", f)
+    }
+    readUntil(t, remote, "profile_updated")
+    // The other node dropped its cached timezone before passing the frame on
+    timezoneMu.RLock()
+    tz, cached := timezoneCache["prof_subject"]
+    timezoneMu.RUnlock()
+    if cached {
+        t.Fatalf("timezone still cached as %q after a remote update", tz)
+    }
+    if tz := userTimezone("prof_subject"); tz != "Asia/Tokyo" {
+        t.Fatalf("timezone %q after reload", tz)
+    }
+
+    // Frames to one connection arrive in order: the stranger gets the
+    // marker without a profile_updated before it
+    nodeA.hub.broadcast <- Broadcast{user: "prof_stranger", message: []byte(`{"type":"marker"}`)}
+    for _, typ := range frameTypesUntil(t, stranger, "marker") {
+        if typ == "profile_updated" {
+            t.Fatal("profile update reached a user sharing no room")
+        }
+    }
+}
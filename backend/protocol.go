@@ -0,0 +1,450 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "reflect"
+    "strings"
+    "time"
+
+    "github.com/gorilla/websocket"
+)
+
+// -------------------- WebSocket Protocol --------------------
+//
+// Clients pick a protocol version with Sec-WebSocket-Protocol. Under
+// chatbox.v1 every client frame is a JSON object with a "type" and a
+// request "id"; replies and errors carry that id back as "requestId".
+// Connections that negotiate nothing get the legacy dialect: "id" is
+// optional and a frame without a "type" is a chat message.
+//
+// Every frame either way is described by the types below, and
+// GET /ws/schema serves them as JSON Schema.
+
+const wsProtocolV1 = "chatbox.v1"
+
+// wsProtocols lists the versions the server speaks, newest first.
+var wsProtocols = []string{wsProtocolV1}
+
+const (
+    maxRequestIDLen   = 64
+    maxMessageTextLen = 4000 // runes
+)
+
+// Error codes sent in ErrorEvent.Code.
+const (
+    codeInvalidJSON          = "invalid_json"
+    codeInvalidRequest       = "invalid_request"
+    codeUnknownType          = "unknown_type"
+    codeRateLimited          = "rate_limited"
+    codeForbidden            = "forbidden"
+    codeTooLarge             = "too_large"
+    codeNotFound             = "not_found"
+    codeInvalidRoom          = "invalid_room"
+    codeRoomRequired         = "room_required"
+    codeNotSubscribed        = "not_subscribed"
+    codeTooManySubscriptions = "too_many_subscriptions"
+    codeInvalidStatus        = "invalid_status"
+    codeServerError          = "server_error"
+)
+
+// offersSupportedProtocol reports whether the upgrade request either asks for
+// no subprotocol (legacy) or offers at least one version the server speaks.
+func offersSupportedProtocol(r *http.Request) bool {
+    offered := websocket.Subprotocols(r)
+    if len(offered) == 0 {
+        return true
+    }
+    for _, p := range offered {
+        if containsString(wsProtocols, p) {
+            return true
+        }
+    }
+    return false
+}
+
+// -------------------- Client Frames --------------------
+
+// ClientEnvelope is the part every client frame shares.
+type ClientEnvelope struct {
+    Type string `json:"type"`
+    ID   string `json:"id,omitempty" schema:"required"` // request ID, required under chatbox.v1
+}
+
+// SendMessageFrame posts a chat message ("message").
+type SendMessageFrame struct {
+    ClientEnvelope
+    Room           string `json:"room,omitempty"`
+    Text           string `json:"text,omitempty"`
+    ClientID       int64  `json:"clientId,omitempty"` // legacy optimistic-update ID, echoed in the ack
+    // IdempotencyKey (a UUID) makes resending safe: a repeat within the
+    // server's window is acked with the original message instead of stored.
+    IdempotencyKey string `json:"idempotencyKey,omitempty"`
+    FileURL        string `json:"fileUrl,omitempty"`
+    FileType       string `json:"fileType,omitempty"`
+    FileName       string `json:"fileName,omitempty"`
+}
+
+// TypingFrame starts or stops the typing indicator ("typing").
+type TypingFrame struct {
+    ClientEnvelope
+    Room     string `json:"room,omitempty"`
+    IsTyping bool   `json:"isTyping"`
+}
+
+// ReactionFrame toggles an emoji reaction ("reaction").
+type ReactionFrame struct {
+    ClientEnvelope
+    Room      string `json:"room,omitempty"`
+    MessageID int64  `json:"messageId"`
+    Emoji     string `json:"emoji"`
+}
+
+// SubscriptionFrame follows or stops following a room ("subscribe", "unsubscribe").
+// Since resumes from the last sequence number seen in the room instead of
+// sending its history; sent for a room already followed, it replays what the
+// client missed.
+type SubscriptionFrame struct {
+    ClientEnvelope
+    Room  string `json:"room"`
+    Since int64  `json:"since,omitempty"`
+}
+
+// HistoryRequestFrame asks for a page of a subscribed room's history
+// ("history_request"); the answer is a "history_page" event.
+type HistoryRequestFrame struct {
+    ClientEnvelope
+    Room string `json:"room,omitempty"`
+    HistoryQuery
+}
+
+// StatusFrame sets the sender's presence ("status").
+type StatusFrame struct {
+    ClientEnvelope
+    Status    string `json:"status"`
+    Text      string `json:"text,omitempty"`
+    ExpiresAt string `json:"expiresAt,omitempty"` // RFC 3339
+}
+
+// -------------------- Server Events --------------------
+
+// MessageEvent is a chat message ("message").
+type MessageEvent struct {
+    Type string `json:"type"`
+    Seq  int64  `json:"seq,omitempty"`
+    Message
+}
+
+// AckEvent confirms a stored message ("ack").
+type AckEvent struct {
+    Type      string `json:"type"`
+    RequestID string `json:"requestId,omitempty"`
+    ClientID  int64  `json:"clientId,omitempty"`
+    ID        int64  `json:"id"`
+    Seq       int64  `json:"seq,omitempty"` // the message's room sequence number
+    Duplicate bool   `json:"duplicate,omitempty"` // the idempotency key was already used; ID and Seq are the original's
+}
+
+// ErrorEvent reports why a client frame was rejected ("error").
+type ErrorEvent struct {
+    Type       string `json:"type"`
+    Code       string `json:"code"`
+    Error      string `json:"error"`
+    RequestID  string `json:"requestId,omitempty"`
+    RetryAfter int    `json:"retryAfter,omitempty"` // seconds, for rate_limited
+}
+
+// HistoryEvent carries a room's recent messages ("history"). Seq is the
+// room's sequence number at the time, to resume from later; PrevCursor pages
+// back with a history_request.
+type HistoryEvent struct {
+    Type       string    `json:"type"`
+    Room       string    `json:"room"`
+    Seq        int64     `json:"seq"`
+    Messages   []Message `json:"messages"`
+    PrevCursor string    `json:"prevCursor,omitempty"`
+}
+
+// HistoryPageEvent answers a history_request ("history_page").
+type HistoryPageEvent struct {
+    Type      string `json:"type"`
+    RequestID string `json:"requestId,omitempty"`
+    MessagePage
+}
+
+// ReplayEvent carries, in order, every room event a resuming client missed
+// ("replay"). Seq is the last of them.
+type ReplayEvent struct {
+    Type   string            `json:"type"`
+    Room   string            `json:"room"`
+    Seq    int64             `json:"seq"`
+    Events []json.RawMessage `json:"events"`
+}
+
+// ResyncEvent tells a resuming client its gap cannot be replayed; it should
+// drop what it has for the room and use the history that follows ("resync").
+type ResyncEvent struct {
+    Type string `json:"type"`
+    Room string `json:"room"`
+    Seq  int64  `json:"seq"`
+}
+
+// UsersEvent is a room's full roster, sent once per subscription ("users").
+type UsersEvent struct {
+    Type  string          `json:"type"`
+    Users []presenceEntry `json:"users"`
+    Room  string          `json:"room"`
+}
+
+// PresenceEvent is a roster change ("presence_join", "presence_update",
+// "presence_leave"). Leaves carry only the username.
+type PresenceEvent struct {
+    Type     string         `json:"type"`
+    Room     string         `json:"room"`
+    User     *presenceEntry `json:"user,omitempty"`
+    Username string         `json:"username,omitempty"`
+}
+
+// StatusEvent echoes the sender's new presence back to it ("status").
+type StatusEvent struct {
+    Type      string `json:"type"`
+    RequestID string `json:"requestId,omitempty"`
+    userPresence
+}
+
+// SubscriptionEvent confirms a subscribe or unsubscribe ("subscribed", "unsubscribed").
+type SubscriptionEvent struct {
+    Type      string `json:"type"`
+    Room      string `json:"room"`
+    RequestID string `json:"requestId,omitempty"`
+}
+
+// TypingEvent relays another member's typing indicator ("typing").
+type TypingEvent struct {
+    Type     string `json:"type"`
+    Username string `json:"username"`
+    IsTyping bool   `json:"isTyping"`
+    Room     string `json:"room"`
+}
+
+// ReactionEvent relays a reaction toggle ("reaction").
+type ReactionEvent struct {
+    Type      string `json:"type"`
+    MessageID int64  `json:"messageId"`
+    Emoji     string `json:"emoji"`
+    Username  string `json:"username"`
+    Room      string `json:"room"`
+    Seq       int64  `json:"seq,omitempty"`
+}
+
+// EditEvent announces an edited message ("edit").
+type EditEvent struct {
+    Type     string `json:"type"`
+    ID       int64  `json:"id"`
+    Text     string `json:"text"`
+    EditedBy string `json:"editedBy,omitempty"` // set for moderator edits
+    Room     string `json:"room,omitempty"`
+    Seq      int64  `json:"seq,omitempty"`
+}
+
+// DeleteEvent announces a deleted message ("delete").
+type DeleteEvent struct {
+    Type      string `json:"type"`
+    ID        int64  `json:"id"`
+    DeletedBy string `json:"deletedBy,omitempty"` // set for moderator deletions
+    Reason    string `json:"reason,omitempty"`
+    Room      string `json:"room,omitempty"`
+    Seq       int64  `json:"seq,omitempty"`
+}
+
+// TombstoneEvent stands in, in a replay, for a logged event removed with a
+// deleted account ("tombstone"). Clients skip it; it keeps the seqs contiguous.
+type TombstoneEvent struct {
+    Type string `json:"type"`
+    Room string `json:"room,omitempty"`
+    Seq  int64  `json:"seq,omitempty"`
+}
+
+// RoomDeletedEvent announces a deleted room to everyone ("room_deleted").
+type RoomDeletedEvent struct {
+    Type      string `json:"type"`
+    Room      string `json:"room"`
+    DeletedBy string `json:"deletedBy"`
+}
+
+// ProfileUpdatedEvent announces a changed profile to the user and everyone in a room with them ("profile_updated").
+type ProfileUpdatedEvent struct {
+    Type    string   `json:"type"`
+    Profile *Profile `json:"profile"`
+}
+
+// SettingsUpdatedEvent syncs settings across the owner's sockets ("settings_updated").
+type SettingsUpdatedEvent struct {
+    Type     string         `json:"type"`
+    Settings map[string]any `json:"settings"`
+    Version  int            `json:"version"`
+}
+
+// UserDeletedEvent announces a deleted account to everyone ("user_deleted").
+type UserDeletedEvent struct {
+    Type        string `json:"type"`
+    Username    string `json:"username"`
+    Policy      string `json:"policy"`
+    Replacement string `json:"replacement,omitempty"` // name shown instead under the anonymize policy
+}
+
+// -------------------- Schema Export --------------------
+
+type protocolFrame struct {
+    Types  []string
+    Sample any
+}
+
+var clientFrames = []protocolFrame{
+    {[]string{"message"}, SendMessageFrame{}},
+    {[]string{"typing"}, TypingFrame{}},
+    {[]string{"reaction"}, ReactionFrame{}},
+    {[]string{"subscribe", "unsubscribe"}, SubscriptionFrame{}},
+    {[]string{"status"}, StatusFrame{}},
+    {[]string{"history_request"}, HistoryRequestFrame{}},
+}
+
+var serverEvents = []protocolFrame{
+    {[]string{"message"}, MessageEvent{}},
+    {[]string{"ack"}, AckEvent{}},
+    {[]string{"error"}, ErrorEvent{}},
+    {[]string{"history"}, HistoryEvent{}},
+    {[]string{"history_page"}, HistoryPageEvent{}},
+    {[]string{"replay"}, ReplayEvent{}},
+    {[]string{"resync"}, ResyncEvent{}},
+    {[]string{"users"}, UsersEvent{}},
+    {[]string{"presence_join", "presence_update", "presence_leave"}, PresenceEvent{}},
+    {[]string{"status"}, StatusEvent{}},
+    {[]string{"subscribed", "unsubscribed"}, SubscriptionEvent{}},
+    {[]string{"typing"}, TypingEvent{}},
+    {[]string{"reaction"}, ReactionEvent{}},
+    {[]string{"edit"}, EditEvent{}},
+    {[]string{"delete"}, DeleteEvent{}},
+    {[]string{"tombstone"}, TombstoneEvent{}},
+    {[]string{"room_deleted"}, RoomDeletedEvent{}},
+    {[]string{"profile_updated"}, ProfileUpdatedEvent{}},
+    {[]string{"settings_updated"}, SettingsUpdatedEvent{}},
+    {[]string{"user_deleted"}, UserDeletedEvent{}},
+}
+
+// protocolSchema describes wsProtocolV1 as a JSON Schema (draft 2020-12).
+// Each frame type is a $def; ClientFrame and ServerEvent pick between them.
+func protocolSchema() map[string]any {
+    defs := map[string]any{}
+    refs := func(frames []protocolFrame) []any {
+        var out []any
+        for _, f := range frames {
+            t := reflect.TypeOf(f.Sample)
+            s := jsonSchema(t)
+            props := s["properties"].(map[string]any)
+            if len(f.Types) == 1 {
+                props["type"] = map[string]any{"const": f.Types[0]}
+            } else {
+                props["type"] = map[string]any{"enum": f.Types}
+            }
+            defs[t.Name()] = s
+            out = append(out, map[string]any{"$ref": "#/$defs/" + t.Name()})
+        }
+        return out
+    }
+    defs["ClientFrame"] = map[string]any{"oneOf": refs(clientFrames)}
+    defs["ServerEvent"] = map[string]any{"oneOf": refs(serverEvents)}
+    return map[string]any{
+        "$schema":     "https://json-schema.org/draft/2020-12/schema",
+        "$id":         wsProtocolV1,
+        "title":       "Chatbox WebSocket protocol " + wsProtocolV1,
+        "description": "Client frames need a request id; server replies echo it as requestId.",
+        "$defs":       defs,
+        "oneOf": []any{
+            map[string]any{"$ref": "#/$defs/ClientFrame"},
+            map[string]any{"$ref": "#/$defs/ServerEvent"},
+        },
+    }
+}
+
+var (
+    timeType       = reflect.TypeOf(time.Time{})
+    rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+// jsonSchema maps a Go type to JSON Schema following encoding/json's rules:
+// embedded structs are flattened and omitempty fields are optional, unless
+// tagged schema:"required" (the legacy dialect may omit them, v1 may not).
+func jsonSchema(t reflect.Type) map[string]any {
+    for t.Kind() == reflect.Pointer {
+        t = t.Elem()
+    }
+    if t == timeType {
+        return map[string]any{"type": "string", "format": "date-time"}
+    }
+    if t == rawMessageType {
+        return map[string]any{"$ref": "#/$defs/ServerEvent"}
+    }
+    switch t.Kind() {
+    case reflect.String:
+        return map[string]any{"type": "string"}
+    case reflect.Bool:
+        return map[string]any{"type": "boolean"}
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+        reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+        return map[string]any{"type": "integer"}
+    case reflect.Float32, reflect.Float64:
+        return map[string]any{"type": "number"}
+    case reflect.Slice, reflect.Array:
+        return map[string]any{"type": "array", "items": jsonSchema(t.Elem())}
+    case reflect.Map:
+        return map[string]any{"type": "object", "additionalProperties": jsonSchema(t.Elem())}
+    case reflect.Struct:
+        props := map[string]any{}
+        required := []string{}
+        addStructFields(t, props, &required)
+        s := map[string]any{"type": "object", "properties": props}
+        if len(required) > 0 {
+            s["required"] = required
+        }
+        return s
+    }
+    return map[string]any{}
+}
+
+func addStructFields(t reflect.Type, props map[string]any, required *[]string) {
+    for i := 0; i < t.NumField(); i++ {
+        f := t.Field(i)
+        tag := f.Tag.Get("json")
+        if tag == "-" {
+            continue
+        }
+        name, opts, _ := strings.Cut(tag, ",")
+        if f.Anonymous && name == "" {
+            addStructFields(f.Type, props, required)
+            continue
+        }
+        if !f.IsExported() {
+            continue
+        }
+        if name == "" {
+            name = f.Name
+        }
+        props[name] = jsonSchema(f.Type)
+        if !strings.Contains(opts, "omitempty") || f.Tag.Get("schema") == "required" {
+            *required = append(*required, name)
+        }
+    }
+}
+
+// protocolSchemaHandler serves GET /ws/schema so client teams can generate bindings.
+func protocolSchemaHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    w.Header().Set("Content-Type", "application/schema+json")
+    enc := json.NewEncoder(w)
+    enc.SetIndent("", "  ")
+    enc.Encode(protocolSchema())
+}
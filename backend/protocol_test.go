@@ -0,0 +1,56 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "reflect"
+    "slices"
+    "testing"
+)
+
+func TestProtocolSchemaRequiresRequestID(t *testing.T) {
+    w := httptest.NewRecorder()
+    protocolSchemaHandler(w, httptest.NewRequest(http.MethodGet, "/ws/schema", nil))
+    if w.Code != http.StatusOK {
+        t.Fatalf("status %d", w.Code)
+    }
+    var schema struct {
+        Defs map[string]struct {
+            Required []string `json:"required"`
+        } `json:"$defs"`
+    }
+    if err := json.NewDecoder(w.Body).Decode(&schema); err != nil {
+        t.Fatal(err)
+    }
+    for _, f := range clientFrames {
+        name := reflect.TypeOf(f.Sample).Name()
+        def, ok := schema.Defs[name]
+        if !ok {
+            t.Fatalf("no $def for %s", name)
+        }
+        for _, field := range []string{"type", "id"} {
+            if !slices.Contains(def.Required, field) {
+                t.Errorf("%s: %q not required (required: %v)", name, field, def.Required)
+            }
+        }
+    }
+    // Other omitempty fields stay optional
+    if req := schema.Defs["SendMessageFrame"].Required; slices.Contains(req, "room") || slices.Contains(req, "idempotencyKey") {
+        t.Errorf("SendMessageFrame required %v", req)
+    }
+}
+
+func TestV1FramesNeedAnID(t *testing.T) {
+    srv := newTestServer(t)
+    testUser(t, "proto_user")
+    conn, _, err := srv.dial(t, "proto_user", "room=general")
+    if err != nil {
+        t.Fatal(err)
+    }
+    readUntil(t, conn, "history")
+    sendFrame(t, conn, map[string]any{"type": "typing", "isTyping": true})
+    if f := readUntil(t, conn, "error"); f["code"] != codeInvalidRequest {
+        t.Fatalf("frame without id: %v", f)
+    }
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "os"
+    "strings"
+    "time"
+
+    "github.com/jackc/pgx/v5"
+)
+
+// -------------------- Roles --------------------
+
+const (
+    roleSuspended = "suspended"
+    roleMember    = "member"
+    roleModerator = "moderator"
+    roleAdmin     = "admin"
+)
+
+// roleRank orders roles so checks can ask for "at least" a role.
+var roleRank = map[string]int{
+    roleSuspended: 0,
+    roleMember:    1,
+    roleModerator: 2,
+    roleAdmin:     3,
+}
+
+var (
+    // Minimum roles for shared-state changes, overridable via
+    // ROOM_CREATE_ROLE, UPLOAD_ROLE and BOT_CREATE_ROLE.
+    roomCreateRole = roleMember
+    uploadRole     = roleMember
+    botCreateRole  = roleMember
+
+    errLastAdmin = errors.New("cannot demote the last admin")
+)
+
+func initRoles(ctx context.Context) {
+    if v := os.Getenv("ROOM_CREATE_ROLE"); roleRank[v] > 0 {
+        roomCreateRole = v
+    }
+    if v := os.Getenv("UPLOAD_ROLE"); roleRank[v] > 0 {
+        uploadRole = v
+    }
+    if v := os.Getenv("BOT_CREATE_ROLE"); roleRank[v] > 0 {
+        botCreateRole = v
+    }
+    bootstrapAdmin(ctx)
+}
+
+// bootstrapAdmin promotes BOOTSTRAP_ADMIN to admin while the server has no
+// admin at all. It runs at startup and again when that user registers.
+func bootstrapAdmin(ctx context.Context) {
+    name := strings.TrimSpace(os.Getenv("BOOTSTRAP_ADMIN"))
+    if name == "" {
+        return
+    }
+    if stored, ok := resolveUsername(name); ok {
+        name = stored
+    }
+    n, err := countAdmins(ctx)
+    if err != nil {
+        log.Println("bootstrap admin error:", err)
+        return
+    }
+    if n > 0 {
+        return
+    }
+    if err := setUserRole(name, roleAdmin); err != nil {
+        log.Printf("bootstrap admin: %s not registered yet", name)
+        return
+    }
+    log.Printf("👑 Bootstrapped %s as the first admin", name)
+}
+
+func getUserRole(username string) (string, error) {
+    if useDB {
+        var role string
+        err := dbPool.QueryRow(context.Background(), `SELECT role FROM users WHERE username=$1`, username).Scan(&role)
+        if err != nil {
+            return "", err
+        }
+        return role, nil
+    }
+    usersMu.RLock()
+    defer usersMu.RUnlock()
+    su, ok := usersMap[username]
+    if !ok {
+        return "", fmt.Errorf("not found")
+    }
+    if su.Role == "" {
+        return roleMember, nil
+    }
+    return su.Role, nil
+}
+
+func setUserRole(username, role string) error {
+    if useDB {
+        ct, err := dbPool.Exec(context.Background(), `UPDATE users SET role=$1 WHERE username=$2`, role, username)
+        if err != nil {
+            return err
+        }
+        if ct.RowsAffected() == 0 {
+            return fmt.Errorf("not found")
+        }
+        return nil
+    }
+    usersMu.Lock()
+    defer usersMu.Unlock()
+    su, ok := usersMap[username]
+    if !ok {
+        return fmt.Errorf("not found")
+    }
+    su.Role = role
+    return nil
+}
+
+func countAdmins(ctx context.Context) (int, error) {
+    if useDB {
+        var n int
+        err := dbPool.QueryRow(ctx, `SELECT COUNT(*) FROM users WHERE role='admin'`).Scan(&n)
+        return n, err
+    }
+    usersMu.RLock()
+    defer usersMu.RUnlock()
+    n := 0
+    for _, su := range usersMap {
+        if su.Role == roleAdmin {
+            n++
+        }
+    }
+    return n, nil
+}
+
+// hasRole reports whether username holds at least min. Unknown users have no role.
+func hasRole(username, min string) bool {
+    role, err := getUserRole(username)
+    if err != nil {
+        if !errors.Is(err, pgx.ErrNoRows) {
+            log.Println("role lookup error:", err)
+        }
+        return false
+    }
+    return roleRank[role] >= roleRank[min]
+}
+
+func isAdmin(username string) bool {
+    return hasRole(username, roleAdmin)
+}
+
+// requireRole writes 403 and returns false unless the caller holds at least min.
+func requireRole(w http.ResponseWriter, r *http.Request, min string) bool {
+    if !hasRole(authUsername(r), min) {
+        http.Error(w, "Forbidden", http.StatusForbidden)
+        return false
+    }
+    return true
+}
+
+// -------------------- Role Admin --------------------
+
+// adminUserRoleHandler handles PUT /admin/users/role {username, role}.
+// Suspending a user also ends all of their sessions.
+func adminUserRoleHandler(hub *Hub, w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPut {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    if !requireRole(w, r, roleAdmin) {
+        return
+    }
+    var payload struct {
+        Username string `json:"username"`
+        Role     string `json:"role"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+        http.Error(w, "Invalid JSON", http.StatusBadRequest)
+        return
+    }
+    if _, ok := roleRank[payload.Role]; !ok {
+        http.Error(w, "Unknown role", http.StatusBadRequest)
+        return
+    }
+    current, err := getUserRole(payload.Username)
+    if err != nil {
+        http.Error(w, "User not found", http.StatusNotFound)
+        return
+    }
+    if current == roleAdmin && payload.Role != roleAdmin {
+        ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+        defer cancel()
+        if n, err := countAdmins(ctx); err != nil || n <= 1 {
+            http.Error(w, errLastAdmin.Error(), http.StatusConflict)
+            return
+        }
+    }
+    if err := setUserRole(payload.Username, payload.Role); err != nil {
+        log.Println("set role error:", err)
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+    if payload.Role == roleSuspended {
+        revoked, err := revokeUserSessions(payload.Username, "")
+        if err != nil {
+            // A suspension that leaves sessions alive is no suspension: undo it
+            log.Println("revoke sessions error:", err)
+            if err := setUserRole(payload.Username, current); err != nil {
+                log.Println("restore role error:", err)
+            }
+            http.Error(w, "Server error", http.StatusInternalServerError)
+            return
+        }
+        for _, id := range revoked {
+            hub.revoke <- id
+        }
+        // API-key sockets have no session to revoke
+        hub.kick <- payload.Username
+    }
+    log.Printf("👑 %s changed role of %s: %s -> %s", authUsername(r), payload.Username, current, payload.Role)
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]string{"username": payload.Username, "role": payload.Role})
+}
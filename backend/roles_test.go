@@ -0,0 +1,106 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/gorilla/websocket"
+)
+
+func TestSuspensionClosesAPIKeySockets(t *testing.T) {
+    srv := newTestServer(t)
+    testUser(t, "role_admin")
+    if err := setUserRole("role_admin", roleAdmin); err != nil {
+        t.Fatal(err)
+    }
+    if err := createBotUser("role_bot", "role_admin"); err != nil {
+        t.Fatal(err)
+    }
+    key, err := createAPIKey(&apiKey{Username: "role_bot", Name: "test", Scopes: []string{scopeRoomsRead, scopeMessagesWrite}, CreatedBy: "role_admin"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    conn, _, err := srv.dialToken(t, key, "room=general")
+    if err != nil {
+        t.Fatal(err)
+    }
+    readUntil(t, conn, "history")
+
+    r := httptest.NewRequest(http.MethodPut, "/admin/users/role", strings.NewReader(`{"username":"role_bot","role":"suspended"}`))
+    r = r.WithContext(withAuth(r.Context(), &sessionClaims{Username: "role_admin"}))
+    w := httptest.NewRecorder()
+    adminUserRoleHandler(srv.hub, w, r)
+    if w.Code != http.StatusOK {
+        t.Fatalf("suspend: status %d: %s", w.Code, w.Body)
+    }
+
+    conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+    for {
+        _, _, err := conn.ReadMessage()
+        if err == nil {
+            continue
+        }
+        if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+            t.Fatalf("socket of suspended bot: %v, want close %d", err, websocket.ClosePolicyViolation)
+        }
+        break
+    }
+    if _, _, err := srv.dialToken(t, key, "room=general"); err == nil {
+        t.Fatal("suspended bot reconnected with its API key")
+    }
+}
+
+// Run with -race: the in-memory room list is shared by every handler.
+func TestInMemoryRoomsConcurrentAccess(t *testing.T) {
+    ctx := context.Background()
+    var wg sync.WaitGroup
+    for i := 0; i < 8; i++ {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            name := fmt.Sprintf("race-room-%d", i)
+            for j := 0; j < 20; j++ {
+                if _, err := dbCreateRoom(ctx, name, "", "system", nil, false); err != nil {
+                    t.Error(err)
+                    return
+                }
+                if _, err := dbListRooms(ctx); err != nil {
+                    t.Error(err)
+                }
+                if _, err := dbGetRoom(ctx, name); err != nil {
+                    t.Error(err)
+                }
+                if err := dbDeleteRoom(ctx, name); err != nil {
+                    t.Error(err)
+                }
+            }
+        }(i)
+    }
+    wg.Wait()
+}
+
+func TestSuspendedSessionRejected(t *testing.T) {
+    srv := newTestServer(t)
+    testUser(t, "role_suspended")
+    token := sessionToken(t, "role_suspended")
+    h := requireAuth(http.HandlerFunc(listSessionsHandler))
+    if w := serve(h, token, http.MethodGet, "/sessions", ""); w.Code != http.StatusOK {
+        t.Fatalf("before suspension: status %d", w.Code)
+    }
+    // Suspend without revoking, as if revocation had been missed
+    if err := setUserRole("role_suspended", roleSuspended); err != nil {
+        t.Fatal(err)
+    }
+    if w := serve(h, token, http.MethodGet, "/sessions", ""); w.Code != http.StatusForbidden {
+        t.Fatalf("suspended session: status %d", w.Code)
+    }
+    if _, resp, err := srv.dialToken(t, token, "room=general"); err == nil || resp.StatusCode != http.StatusForbidden {
+        t.Fatalf("suspended session opened a socket: %v", err)
+    }
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "log"
+    "net/http"
+    "time"
+
+    "github.com/jackc/pgx/v5"
+)
+
+// -------------------- Room Access --------------------
+//
+// A password-protected room is readable by its creator, admins and the users
+// who gave its password to /rooms/join, which records them as members. Every
+// way into a room (the /ws room, subscribe frames, history) goes through
+// checkRoomAccess.
+
+var (
+    errRoomNotFound = errors.New("room not found")
+    errRoomPrivate  = errors.New("room password required")
+)
+
+var roomMembers = map[string]map[string]bool{} // room -> usernames; guarded by roomsMu
+
+// checkRoomAccess returns nil when username may read room, errRoomNotFound
+// when it does not exist and errRoomPrivate when it is password-protected and
+// the user has not joined it.
+func checkRoomAccess(username, room string) error {
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    r, err := dbGetRoom(ctx, room)
+    if err != nil {
+        if !useDB || errors.Is(err, pgx.ErrNoRows) {
+            return errRoomNotFound
+        }
+        return err
+    }
+    if !r.IsPrivate || len(r.PasswordHash) == 0 || r.Creator == username {
+        return nil
+    }
+    member, err := isRoomMember(ctx, room, username)
+    if err != nil {
+        return err
+    }
+    if member || isAdmin(username) {
+        return nil
+    }
+    return errRoomPrivate
+}
+
+// writeRoomAccessError answers an HTTP request refused by checkRoomAccess.
+func writeRoomAccessError(w http.ResponseWriter, err error) {
+    switch {
+    case errors.Is(err, errRoomNotFound):
+        http.Error(w, "Room not found", http.StatusNotFound)
+    case errors.Is(err, errRoomPrivate):
+        http.Error(w, "Join this private room with its password first", http.StatusForbidden)
+    default:
+        log.Println("room access error:", err)
+        http.Error(w, "Server error", http.StatusInternalServerError)
+    }
+}
+
+func addRoomMember(ctx context.Context, room, username string) error {
+    if useDB {
+        _, err := dbPool.Exec(ctx, `
+            INSERT INTO room_members (room, username) VALUES ($1, $2)
+            ON CONFLICT (room, username) DO NOTHING
+        `, room, username)
+        return err
+    }
+    roomsMu.Lock()
+    defer roomsMu.Unlock()
+    if roomMembers[room] == nil {
+        roomMembers[room] = map[string]bool{}
+    }
+    roomMembers[room][username] = true
+    return nil
+}
+
+func isRoomMember(ctx context.Context, room, username string) (bool, error) {
+    if useDB {
+        var ok bool
+        err := dbPool.QueryRow(ctx, `
+            SELECT EXISTS (SELECT 1 FROM room_members WHERE room=$1 AND username=$2)
+        `, room, username).Scan(&ok)
+        return ok, err
+    }
+    roomsMu.RLock()
+    defer roomsMu.RUnlock()
+    return roomMembers[room][username], nil
+}
+
+// memForgetRoomMembers drops the memberships of deleted accounts.
+func memForgetRoomMembers(gone map[string]bool) {
+    roomsMu.Lock()
+    defer roomsMu.Unlock()
+    for _, members := range roomMembers {
+        for u := range members {
+            if gone[u] {
+                delete(members, u)
+            }
+        }
+    }
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "log"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/jackc/pgx/v5"
+)
+
+// -------------------- Room Event Log --------------------
+//
+// Messages, edits, deletes and reactions get a per-room sequence number and
+// are kept in a bounded log. A client reconnecting with the last sequence it
+// saw in each room gets exactly the events it missed, in order, or is told to
+// resync when they are no longer all available.
+//
+// A sender never receives its own message as an event, only the ack, so it
+// will see that message again in a replay; clients dedupe by message ID.
+
+var (
+    // roomEventRetention is how many events each room keeps for replay
+    // (ROOM_EVENT_RETENTION).
+    roomEventRetention = 1000
+    // resumeMaxEvents is the largest gap replayed; beyond it the client
+    // resyncs from history instead (RESUME_MAX_EVENTS).
+    resumeMaxEvents = 500
+)
+
+func initRoomEvents() {
+    roomEventRetention = envInt("ROOM_EVENT_RETENTION", roomEventRetention)
+    resumeMaxEvents = envInt("RESUME_MAX_EVENTS", resumeMaxEvents)
+    if roomEventRetention < 1 {
+        roomEventRetention = 1
+    }
+    if resumeMaxEvents > roomEventRetention {
+        resumeMaxEvents = roomEventRetention
+    }
+}
+
+// sequenced is a room event that can be stamped with its sequence number.
+type sequenced interface {
+    withSeq(seq int64) any
+}
+
+func (e MessageEvent) withSeq(seq int64) any  { e.Seq = seq; return e }
+func (e EditEvent) withSeq(seq int64) any     { e.Seq = seq; return e }
+func (e DeleteEvent) withSeq(seq int64) any   { e.Seq = seq; return e }
+func (e ReactionEvent) withSeq(seq int64) any { e.Seq = seq; return e }
+
+// roomLocks serialize numbering and fan-out per room, so events reach the
+// hub in sequence order and a client attaching to a room sees either the
+// whole of an event (in its history or replay) or its broadcast.
+var roomLocks sync.Map // room -> *sync.Mutex
+
+func roomLock(room string) *sync.Mutex {
+    l, _ := roomLocks.LoadOrStore(room, &sync.Mutex{})
+    return l.(*sync.Mutex)
+}
+
+// publishRoomEvent numbers ev, records it for replay and broadcasts it to
+// the room (skipping sender) on every node. It returns the sequence number,
+// or 0 if the event could not be recorded and went out unnumbered.
+func publishRoomEvent(hub *Hub, room string, sender *Client, ev sequenced) int64 {
+    l := roomLock(room)
+    l.Lock()
+    defer l.Unlock()
+    var relay func(ctx context.Context, tx pgx.Tx, seq int64, b []byte) error
+    if tp, ok := hub.backplane.(txPublisher); ok {
+        relay = func(ctx context.Context, tx pgx.Tx, seq int64, b []byte) error {
+            return tp.PublishTx(ctx, tx, backplaneMessage{Kind: bpBroadcast, Room: room, Seq: seq, Payload: b})
+        }
+    }
+    seq, b, err := appendRoomEvent(room, func(seq int64) ([]byte, error) {
+        return json.Marshal(ev.withSeq(seq))
+    }, relay)
+    if err != nil {
+        log.Println("room event log error:", err)
+        if b, err = json.Marshal(ev.withSeq(0)); err != nil {
+            return 0
+        }
+    }
+    hub.broadcast <- Broadcast{sender: sender, room: room, seq: seq, relayed: relay != nil && seq > 0, message: b}
+    return seq
+}
+
+// attach subscribes the client to room on the hub. With since > 0 the client
+// is resuming: it gets the events after since as one "replay" frame, or a
+// "resync" followed by fresh history when the gap cannot be replayed.
+// Without since it gets the usual history. Either way the frames are queued
+// under the room lock, so nothing published meanwhile is missed or repeated.
+func (c *Client) attach(room string, since int64) {
+    l := roomLock(room)
+    l.Lock()
+    defer l.Unlock()
+    c.catchUp(room, since)
+    c.hub.subscriptions <- subscription{client: c, room: room, join: true}
+}
+
+// resume catches a client already subscribed to room up from since, as
+// attach would, e.g. after drop_oldest lost some of its frames. Events still
+// in its send queue may repeat ones in the replay; clients skip seqs they
+// have seen.
+func (c *Client) resume(room string, since int64) {
+    l := roomLock(room)
+    l.Lock()
+    defer l.Unlock()
+    c.catchUp(room, since)
+}
+
+// catchUp queues the replay, resync and history frames for attach and
+// resume. Callers hold roomLock(room).
+func (c *Client) catchUp(room string, since int64) {
+    if since > 0 {
+        events, seq, ok := roomEventsSince(room, since, resumeMaxEvents)
+        if ok {
+            if len(events) > 0 {
+                if b, err := json.Marshal(ReplayEvent{Type: "replay", Room: room, Seq: seq, Events: events}); err == nil {
+                    c.queue(b)
+                }
+            }
+            return
+        }
+        if b, err := json.Marshal(ResyncEvent{Type: "resync", Room: room, Seq: seq}); err == nil {
+            c.queue(b)
+        }
+    }
+    if b := historyFrame(room); b != nil {
+        c.queue(b)
+    }
+}
+
+// -------------------- Room Event Store --------------------
+
+type loggedEvent struct {
+    seq     int64
+    payload json.RawMessage
+}
+
+var (
+    roomEventsMu sync.Mutex
+    roomSeqs     = map[string]int64{}
+    roomLogs     = map[string][]loggedEvent{}
+)
+
+// appendRoomEvent assigns the room's next sequence number, builds the event
+// with it and stores the result. Callers hold roomLock(room). With the
+// database, relay (if set) publishes the event in the same transaction.
+func appendRoomEvent(room string, build func(seq int64) ([]byte, error), relay func(ctx context.Context, tx pgx.Tx, seq int64, b []byte) error) (int64, []byte, error) {
+    if useDB {
+        ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        defer cancel()
+        return dbAppendRoomEvent(ctx, room, build, relay)
+    }
+    roomEventsMu.Lock()
+    defer roomEventsMu.Unlock()
+    seq := roomSeqs[room] + 1
+    b, err := build(seq)
+    if err != nil {
+        return 0, nil, err
+    }
+    roomSeqs[room] = seq
+    events := append(roomLogs[room], loggedEvent{seq: seq, payload: b})
+    if len(events) > roomEventRetention {
+        events = append([]loggedEvent(nil), events[len(events)-roomEventRetention:]...)
+    }
+    roomLogs[room] = events
+    return seq, b, nil
+}
+
+// currentRoomSeq returns the sequence number of the room's latest event.
+func currentRoomSeq(room string) int64 {
+    if useDB {
+        ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        defer cancel()
+        var seq int64
+        if err := dbPool.QueryRow(ctx, `SELECT seq FROM room_sequences WHERE room=$1`, room).Scan(&seq); err != nil {
+            return 0
+        }
+        return seq
+    }
+    roomEventsMu.Lock()
+    defer roomEventsMu.Unlock()
+    return roomSeqs[room]
+}
+
+// roomEventsSince returns the events after since and the room's current
+// sequence. ok is false when they cannot all be replayed: too many, pruned,
+// purged, or since is ahead of the server (e.g. the log was reset).
+func roomEventsSince(room string, since int64, limit int) ([]json.RawMessage, int64, bool) {
+    if useDB {
+        ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        defer cancel()
+        events, seq, err := dbRoomEventsSince(ctx, room, since, limit)
+        if err != nil {
+            log.Println("room event replay error:", err)
+            return nil, seq, false
+        }
+        return events, seq, int64(len(events)) == seq-since
+    }
+    roomEventsMu.Lock()
+    defer roomEventsMu.Unlock()
+    seq := roomSeqs[room]
+    if since > seq || seq-since > int64(limit) {
+        return nil, seq, false
+    }
+    var events []json.RawMessage
+    for _, e := range roomLogs[room] {
+        if e.seq > since {
+            events = append(events, e.payload)
+        }
+    }
+    return events, seq, int64(len(events)) == seq-since
+}
+
+// memForgetRoomEvents drops a deleted room's log and numbering.
+func memForgetRoomEvents(room string) {
+    roomEventsMu.Lock()
+    defer roomEventsMu.Unlock()
+    delete(roomSeqs, room)
+    delete(roomLogs, room)
+}
+
+// memScrubRoomEvents rewrites the logged events that name a deleted account
+// (see scrubRoomEvent) in place, so every sequence number still replays.
+func memScrubRoomEvents(gone map[string]bool, policy string, deletedIDs map[int64]bool) {
+    roomEventsMu.Lock()
+    defer roomEventsMu.Unlock()
+    for _, events := range roomLogs {
+        for i, e := range events {
+            if b, ok := scrubRoomEvent(e.payload, gone, policy, deletedIDs); ok {
+                events[i].payload = b
+            }
+        }
+    }
+}
+
+// scrubRoomEvent removes deleted accounts from a logged event. Only the
+// fields that name a person as author, reactor or moderator count, never
+// message text. Under the anonymize policy their messages are reassigned to
+// deletedUsername, as in the messages table; events that cannot be kept
+// (their reactions, and under the delete policy their messages and anything
+// about deletedIDs) become a tombstone with the same room and seq. ok is
+// false when the event is unchanged.
+func scrubRoomEvent(payload json.RawMessage, gone map[string]bool, policy string, deletedIDs map[int64]bool) (json.RawMessage, bool) {
+    dec := json.NewDecoder(bytes.NewReader(payload))
+    dec.UseNumber()
+    var ev map[string]any
+    if err := dec.Decode(&ev); err != nil {
+        return nil, false
+    }
+    name := func(key string) bool {
+        s, _ := ev[key].(string)
+        return gone[s]
+    }
+    about := func(key string) bool {
+        n, _ := ev[key].(json.Number)
+        id, err := n.Int64()
+        return err == nil && deletedIDs[id]
+    }
+    tombstone := func() (json.RawMessage, bool) {
+        t := TombstoneEvent{Type: "tombstone"}
+        t.Room, _ = ev["room"].(string)
+        if n, ok := ev["seq"].(json.Number); ok {
+            t.Seq, _ = n.Int64()
+        }
+        b, err := json.Marshal(t)
+        return b, err == nil
+    }
+    changed := false
+    switch ev["type"] {
+    case "message":
+        if name("username") {
+            if policy == deletionHardDelete {
+                return tombstone()
+            }
+            ev["username"] = deletedUsername
+            changed = true
+        }
+        reactions, _ := ev["reactions"].(map[string]any)
+        for emoji, v := range reactions {
+            reactors, _ := v.([]any)
+            left := reactors[:0:0]
+            for _, who := range reactors {
+                if s, _ := who.(string); !gone[s] {
+                    left = append(left, who)
+                }
+            }
+            if len(left) == len(reactors) {
+                continue
+            }
+            changed = true
+            if len(left) == 0 {
+                delete(reactions, emoji)
+            } else {
+                reactions[emoji] = left
+            }
+        }
+        if reactions != nil && len(reactions) == 0 {
+            delete(ev, "reactions")
+        }
+    case "reaction":
+        if name("username") || about("messageId") {
+            return tombstone()
+        }
+    case "edit":
+        if about("id") {
+            return tombstone()
+        }
+        if name("editedBy") {
+            ev["editedBy"] = deletedUsername
+            changed = true
+        }
+    case "delete":
+        if name("deletedBy") {
+            ev["deletedBy"] = deletedUsername
+            changed = true
+        }
+    }
+    if !changed {
+        return nil, false
+    }
+    b, err := json.Marshal(ev)
+    return b, err == nil
+}
+
+func dbAppendRoomEvent(ctx context.Context, room string, build func(seq int64) ([]byte, error), relay func(ctx context.Context, tx pgx.Tx, seq int64, b []byte) error) (int64, []byte, error) {
+    tx, err := dbPool.Begin(ctx)
+    if err != nil {
+        return 0, nil, err
+    }
+    defer tx.Rollback(ctx)
+    var seq int64
+    err = tx.QueryRow(ctx, `
+        INSERT INTO room_sequences (room, seq) VALUES ($1, 1)
+        ON CONFLICT (room) DO UPDATE SET seq = room_sequences.seq + 1
+        RETURNING seq
+    `, room).Scan(&seq)
+    if err != nil {
+        return 0, nil, err
+    }
+    b, err := build(seq)
+    if err != nil {
+        return 0, nil, err
+    }
+    if _, err := tx.Exec(ctx, `INSERT INTO room_events (room, seq, payload) VALUES ($1, $2, $3)`, room, seq, b); err != nil {
+        return 0, nil, err
+    }
+    if _, err := tx.Exec(ctx, `DELETE FROM room_events WHERE room=$1 AND seq <= $2`, room, seq-int64(roomEventRetention)); err != nil {
+        return 0, nil, err
+    }
+    if relay != nil {
+        if err := relay(ctx, tx, seq, b); err != nil {
+            return 0, nil, err
+        }
+    }
+    if err := tx.Commit(ctx); err != nil {
+        return 0, nil, err
+    }
+    return seq, b, nil
+}
+
+func dbRoomEventsSince(ctx context.Context, room string, since int64, limit int) ([]json.RawMessage, int64, error) {
+    var seq int64
+    err := dbPool.QueryRow(ctx, `SELECT COALESCE((SELECT seq FROM room_sequences WHERE room=$1), 0)`, room).Scan(&seq)
+    if err != nil {
+        return nil, 0, err
+    }
+    if since > seq || seq-since > int64(limit) {
+        return nil, seq, nil
+    }
+    rows, err := dbPool.Query(ctx, `
+        SELECT payload FROM room_events WHERE room=$1 AND seq > $2 ORDER BY seq LIMIT $3
+    `, room, since, limit)
+    if err != nil {
+        return nil, seq, err
+    }
+    defer rows.Close()
+    var events []json.RawMessage
+    for rows.Next() {
+        var b []byte
+        if err := rows.Scan(&b); err != nil {
+            return nil, seq, err
+        }
+        events = append(events, b)
+    }
+    return events, seq, rows.Err()
+}
+
+// resumePoint is a room to attach on connect and the sequence to resume from.
+type resumePoint struct {
+    room  string
+    since int64
+}
+
+// resumePoints lists the rooms a new connection attaches to: the ?room= room
+// plus any resume=<room>:<seq> parameters, which also say where each resumes.
+func resumePoints(r *http.Request, room string) []resumePoint {
+    points := []resumePoint{{room: room}}
+    for _, v := range r.URL.Query()["resume"] {
+        i := strings.LastIndex(v, ":")
+        if i <= 0 {
+            continue
+        }
+        since, err := strconv.ParseInt(v[i+1:], 10, 64)
+        if err != nil || since < 0 {
+            continue
+        }
+        name, found := v[:i], false
+        for j := range points {
+            if points[j].room == name {
+                points[j].since, found = since, true
+            }
+        }
+        if !found {
+            points = append(points, resumePoint{room: name, since: since})
+        }
+    }
+    return points
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "testing"
+    "time"
+)
+
+func testRoomMessage(hub *Hub, room, username, text string) int64 {
+    return publishRoomEvent(hub, room, nil, MessageEvent{Type: "message", Message: Message{Username: username, Text: text, Room: room}})
+}
+
+func replaySeqs(t *testing.T, events []json.RawMessage) []int64 {
+    t.Helper()
+    seqs := make([]int64, len(events))
+    for i, raw := range events {
+        var e struct {
+            Seq int64 `json:"seq"`
+        }
+        if err := json.Unmarshal(raw, &e); err != nil {
+            t.Fatal(err)
+        }
+        seqs[i] = e.Seq
+    }
+    return seqs
+}
+
+func TestRoomEventsSince(t *testing.T) {
+    hub := newTestServer(t).hub
+    room := "events-replay"
+    for i := 0; i < 5; i++ {
+        testRoomMessage(hub, room, "events_user", "hello")
+    }
+
+    events, seq, ok := roomEventsSince(room, 2, resumeMaxEvents)
+    if !ok || seq != 5 || !sameIDs(replaySeqs(t, events), []int64{3, 4, 5}) {
+        t.Fatalf("since 2: ok=%v seq=%d events=%v", ok, seq, replaySeqs(t, events))
+    }
+    if events, _, ok := roomEventsSince(room, 5, resumeMaxEvents); !ok || len(events) != 0 {
+        t.Fatalf("up to date: ok=%v events=%d", ok, len(events))
+    }
+    if _, _, ok := roomEventsSince(room, 9, resumeMaxEvents); ok {
+        t.Fatal("since ahead of the server replayed")
+    }
+    if _, _, ok := roomEventsSince(room, 1, 3); ok {
+        t.Fatal("gap larger than the limit replayed")
+    }
+}
+
+func TestDeleteAccountScrubsItsRoomEvents(t *testing.T) {
+    hub := newTestServer(t).hub
+    testUser(t, "events_gone")
+    testUser(t, "events_stay")
+    mixed, other := "events-mixed", "events-other"
+    testRoomMessage(hub, mixed, "events_stay", "before")
+    testRoomMessage(hub, mixed, "events_gone", "gone soon")
+    publishRoomEvent(hub, mixed, nil, ReactionEvent{Type: "reaction", MessageID: 1, Emoji: "👍", Username: "events_gone", Room: mixed})
+    publishRoomEvent(hub, mixed, nil, ReactionEvent{Type: "reaction", MessageID: 1, Emoji: "👍", Username: "events_stay", Room: mixed})
+    testRoomMessage(hub, other, "events_stay", "untouched")
+    testRoomMessage(hub, other, "events_stay", "events_gone is only named in text")
+
+    if err := deleteAccount(hub, "events_gone", deletionAnonymize); err != nil {
+        t.Fatal(err)
+    }
+
+    // Every seq still replays: the message is reassigned, the reaction
+    // becomes a tombstone and the rest is untouched
+    events, seq, ok := roomEventsSince(mixed, 0, resumeMaxEvents)
+    if !ok || seq != 4 || !sameIDs(replaySeqs(t, events), []int64{1, 2, 3, 4}) {
+        t.Fatalf("mixed room: ok=%v seq=%d events=%v", ok, seq, replaySeqs(t, events))
+    }
+    var msg MessageEvent
+    if err := json.Unmarshal(events[1], &msg); err != nil || msg.Username != deletedUsername || msg.Text != "gone soon" {
+        t.Fatalf("anonymized message: %s", events[1])
+    }
+    var tomb TombstoneEvent
+    if err := json.Unmarshal(events[2], &tomb); err != nil || tomb != (TombstoneEvent{Type: "tombstone", Room: mixed, Seq: 3}) {
+        t.Fatalf("their reaction: %s", events[2])
+    }
+    var kept ReactionEvent
+    if err := json.Unmarshal(events[3], &kept); err != nil || kept.Username != "events_stay" {
+        t.Fatalf("other reaction: %s", events[3])
+    }
+    events, _, ok = roomEventsSince(other, 0, resumeMaxEvents)
+    if !ok || !sameIDs(replaySeqs(t, events), []int64{1, 2}) {
+        t.Fatalf("other room: ok=%v events=%v", ok, replaySeqs(t, events))
+    }
+    if err := json.Unmarshal(events[1], &msg); err != nil || msg.Username != "events_stay" || msg.Text != "events_gone is only named in text" {
+        t.Fatalf("text mention changed: %s", events[1])
+    }
+}
+
+func TestScrubRoomEvent(t *testing.T) {
+    gone := map[string]bool{"alice": true}
+    deleted := map[int64]bool{7: true}
+    tests := []struct {
+        payload, policy, want string
+    }{
+        {`{"type":"message","seq":1,"room":"r","username":"alice","text":"hi"}`, deletionAnonymize,
+            `{"room":"r","seq":1,"text":"hi","type":"message","username":"[deleted]"}`},
+        {`{"type":"message","seq":1,"room":"r","username":"alice","text":"hi"}`, deletionHardDelete,
+            `{"type":"tombstone","room":"r","seq":1}`},
+        {`{"type":"message","seq":2,"username":"bob","reactions":{"👍":["bob","alice"],"🎉":["alice"]}}`, deletionAnonymize,
+            `{"reactions":{"👍":["bob"]},"seq":2,"type":"message","username":"bob"}`},
+        {`{"type":"reaction","seq":3,"room":"r","messageId":1,"emoji":"👍","username":"alice"}`, deletionAnonymize,
+            `{"type":"tombstone","room":"r","seq":3}`},
+        {`{"type":"reaction","seq":4,"room":"r","messageId":7,"emoji":"👍","username":"bob"}`, deletionHardDelete,
+            `{"type":"tombstone","room":"r","seq":4}`},
+        {`{"type":"edit","seq":5,"room":"r","id":7,"text":"x","editedBy":"bob"}`, deletionHardDelete,
+            `{"type":"tombstone","room":"r","seq":5}`},
+        {`{"type":"edit","seq":6,"id":1,"text":"x","editedBy":"alice"}`, deletionAnonymize,
+            `{"editedBy":"[deleted]","id":1,"seq":6,"text":"x","type":"edit"}`},
+        {`{"type":"delete","seq":7,"id":9007199254740993,"deletedBy":"alice"}`, deletionAnonymize,
+            `{"deletedBy":"[deleted]","id":9007199254740993,"seq":7,"type":"delete"}`},
+        {`{"type":"message","seq":8,"username":"bob","text":"hi alice"}`, deletionHardDelete, ""},
+        {`{"type":"edit","seq":9,"id":1,"text":"alice"}`, deletionHardDelete, ""},
+    }
+    for _, tt := range tests {
+        got, ok := scrubRoomEvent(json.RawMessage(tt.payload), gone, tt.policy, deleted)
+        if tt.want == "" {
+            if ok {
+                t.Errorf("scrubRoomEvent(%s) changed it to %s", tt.payload, got)
+            }
+            continue
+        }
+        if !ok || string(got) != tt.want {
+            t.Errorf("scrubRoomEvent(%s, %s) = %s, %v; want %s", tt.payload, tt.policy, got, ok, tt.want)
+        }
+    }
+}
+
+func TestResumeReplaysOrResyncs(t *testing.T) {
+    srv := newTestServer(t)
+    testUser(t, "resume_user")
+    testUser(t, "resume_gone")
+    room := "resume-room"
+    if _, err := dbCreateRoom(context.Background(), room, "", "resume_user", nil, false); err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { dbDeleteRoom(context.Background(), room) })
+    testRoomMessage(srv.hub, room, "resume_user", "one")
+    testRoomMessage(srv.hub, room, "resume_gone", "two")
+    testRoomMessage(srv.hub, room, "resume_user", "three")
+
+    resume := func(since string) map[string]any {
+        t.Helper()
+        conn, _, err := srv.dial(t, "resume_user", "room="+room+"&resume="+room+":"+since)
+        if err != nil {
+            t.Fatal(err)
+        }
+        conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+        var f map[string]any
+        if err := conn.ReadJSON(&f); err != nil {
+            t.Fatal(err)
+        }
+        if f["type"] == "resync" {
+            readUntil(t, conn, "history")
+        }
+        return f
+    }
+
+    if f := resume("1"); f["type"] != "replay" || f["seq"] != 3.0 || len(f["events"].([]any)) != 2 {
+        t.Fatalf("resume from 1: %v", f)
+    }
+    if f := resume("9"); f["type"] != "resync" || f["seq"] != 3.0 {
+        t.Fatalf("resume from ahead of the server: %v", f)
+    }
+    // A deleted account's message stays in the replay as a tombstone
+    if err := deleteAccount(srv.hub, "resume_gone", deletionHardDelete); err != nil {
+        t.Fatal(err)
+    }
+    f := resume("1")
+    if f["type"] != "replay" || len(f["events"].([]any)) != 2 {
+        t.Fatalf("resume across the deleted message: %v", f)
+    }
+    if e := f["events"].([]any)[0].(map[string]any); e["type"] != "tombstone" || e["seq"] != 2.0 {
+        t.Fatalf("deleted message replayed as %v", e)
+    }
+}
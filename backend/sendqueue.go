@@ -0,0 +1,196 @@
+package main
+
+import (
+    "encoding/json"
+    "log"
+    "net/http"
+    "os"
+    "strings"
+    "sync"
+    "sync/atomic"
+)
+
+// -------------------- Send Queues --------------------
+//
+// Each client has a bounded queue of frames fanned out by the hub. The hub
+// never blocks on it; what happens when a client falls behind is set by
+// SLOW_CONSUMER_POLICY:
+//
+//   - disconnect (default): a frame that does not fit closes the socket with
+//     1013 (try again later); the client reconnects and resumes.
+//   - drop_oldest: the oldest queued frame makes room. Sequenced room events
+//     can be lost this way; clients notice the gap in seq and resubscribe
+//     with since.
+//   - coalesce: typing and presence frames replace a queued frame about the
+//     same user in the same room, so a lagging client holds only the latest
+//     state; anything else that does not fit disconnects as above.
+
+const (
+    policyDisconnect = "disconnect"
+    policyDropOldest = "drop_oldest"
+    policyCoalesce   = "coalesce"
+)
+
+var (
+    slowConsumerPolicy = policyDisconnect
+    // sendQueueSize is how many frames a client may have waiting (SEND_QUEUE_SIZE).
+    sendQueueSize = 256
+)
+
+// Totals across all connections since start, for /admin/connections.
+var (
+    slowDisconnects atomic.Int64
+    framesDropped   atomic.Int64
+    framesCoalesced atomic.Int64
+)
+
+func initSendQueues() {
+    switch p := strings.ToLower(strings.TrimSpace(os.Getenv("SLOW_CONSUMER_POLICY"))); p {
+    case "":
+    case policyDisconnect, policyDropOldest, policyCoalesce:
+        slowConsumerPolicy = p
+    default:
+        log.Printf("⚠️ Unknown SLOW_CONSUMER_POLICY %q, using %s", p, slowConsumerPolicy)
+    }
+    sendQueueSize = envInt("SEND_QUEUE_SIZE", sendQueueSize)
+    if sendQueueSize < 1 {
+        sendQueueSize = 1
+    }
+    log.Printf("🐢 Slow consumer policy: %s (queue of %d frames)", slowConsumerPolicy, sendQueueSize)
+}
+
+type queuedFrame struct {
+    key string // coalescing key, "" for frames that must not be merged
+    msg []byte
+}
+
+// sendQueue is written by the hub and drained by writePump.
+type sendQueue struct {
+    mu        sync.Mutex
+    frames    []queuedFrame
+    closed    bool
+    ready     chan struct{} // holds a token while frames are waiting or the queue is closed
+    maxDepth  int
+    dropped   int64
+    coalesced int64
+}
+
+func newSendQueue() *sendQueue {
+    return &sendQueue{ready: make(chan struct{}, 1)}
+}
+
+func (q *sendQueue) signal() {
+    select {
+    case q.ready <- struct{}{}:
+    default:
+    }
+}
+
+// push queues msg under the slow-consumer policy. It reports false when the
+// frame does not fit and the client has to be disconnected.
+func (q *sendQueue) push(msg []byte, key string) bool {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    if q.closed {
+        return true
+    }
+    if key != "" && slowConsumerPolicy == policyCoalesce {
+        for i := len(q.frames) - 1; i >= 0; i-- {
+            if q.frames[i].key == key {
+                q.frames[i].msg = msg
+                q.coalesced++
+                framesCoalesced.Add(1)
+                return true
+            }
+        }
+    }
+    if len(q.frames) >= sendQueueSize {
+        if slowConsumerPolicy != policyDropOldest {
+            return false
+        }
+        q.frames[0] = queuedFrame{}
+        q.frames = q.frames[1:]
+        q.dropped++
+        framesDropped.Add(1)
+    }
+    q.frames = append(q.frames, queuedFrame{key: key, msg: msg})
+    q.maxDepth = max(q.maxDepth, len(q.frames))
+    q.signal()
+    return true
+}
+
+// pop takes the oldest frame. closed is true once the queue has been closed
+// and emptied by it.
+func (q *sendQueue) pop() (msg []byte, ok bool, closed bool) {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    if q.closed {
+        return nil, false, true
+    }
+    if len(q.frames) == 0 {
+        return nil, false, false
+    }
+    msg = q.frames[0].msg
+    q.frames[0] = queuedFrame{}
+    q.frames = q.frames[1:]
+    if len(q.frames) > 0 {
+        q.signal()
+    }
+    return msg, true, false
+}
+
+// close discards whatever is still queued and wakes the writer so it sends
+// the close frame. Only removeClient calls it.
+func (q *sendQueue) close() {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    q.closed = true
+    q.frames = nil
+    q.signal()
+}
+
+// queueStats is one connection's entry in /admin/connections.
+type queueStats struct {
+    Username  string `json:"username"`
+    Rooms     int    `json:"rooms"`
+    Depth     int    `json:"depth"`
+    MaxDepth  int    `json:"maxDepth"`
+    Dropped   int64  `json:"dropped"`
+    Coalesced int64  `json:"coalesced"`
+}
+
+func (q *sendQueue) stats() queueStats {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    return queueStats{Depth: len(q.frames), MaxDepth: q.maxDepth, Dropped: q.dropped, Coalesced: q.coalesced}
+}
+
+// connectionStats lists every connection's queue. It asks the hub, which
+// owns the client set.
+func (h *Hub) connectionStats() []queueStats {
+    reply := make(chan []queueStats, 1)
+    h.stats <- reply
+    return <-reply
+}
+
+// adminConnectionsHandler serves GET /admin/connections: send queue depth
+// per connection plus slow-consumer totals.
+func adminConnectionsHandler(hub *Hub, w http.ResponseWriter, r *http.Request) {
+    if !isAdmin(authUsername(r)) {
+        http.Error(w, "Forbidden", http.StatusForbidden)
+        return
+    }
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]any{
+        "policy":          slowConsumerPolicy,
+        "queueSize":       sendQueueSize,
+        "slowDisconnects": slowDisconnects.Load(),
+        "dropped":         framesDropped.Load(),
+        "coalesced":       framesCoalesced.Load(),
+        "connections":     hub.connectionStats(),
+    })
+}
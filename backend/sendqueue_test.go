@@ -0,0 +1,180 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "fmt"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/gorilla/websocket"
+)
+
+// withSendQueue sets the slow-consumer policy and queue size for one test.
+func withSendQueue(t testing.TB, policy string, size int) {
+    t.Helper()
+    oldPolicy, oldSize := slowConsumerPolicy, sendQueueSize
+    slowConsumerPolicy, sendQueueSize = policy, size
+    t.Cleanup(func() { slowConsumerPolicy, sendQueueSize = oldPolicy, oldSize })
+}
+
+func drain(q *sendQueue) []string {
+    var out []string
+    for {
+        msg, ok, _ := q.pop()
+        if !ok {
+            return out
+        }
+        out = append(out, string(msg))
+    }
+}
+
+func sameFrames(got []string, want ...string) bool {
+    return fmt.Sprint(got) == fmt.Sprint(want)
+}
+
+func TestSendQueueDisconnect(t *testing.T) {
+    withSendQueue(t, policyDisconnect, 2)
+    q := newSendQueue()
+    if !q.push([]byte("a"), "") || !q.push([]byte("b"), "typing:r:u") {
+        t.Fatal("push below capacity refused")
+    }
+    if q.push([]byte("c"), "") {
+        t.Fatal("push at capacity accepted")
+    }
+    if got := drain(q); !sameFrames(got, "a", "b") {
+        t.Fatalf("queue holds %v", got)
+    }
+}
+
+func TestSendQueueDropOldest(t *testing.T) {
+    withSendQueue(t, policyDropOldest, 2)
+    q := newSendQueue()
+    for _, m := range []string{"a", "b", "c", "d"} {
+        if !q.push([]byte(m), "") {
+            t.Fatalf("push %s refused", m)
+        }
+    }
+    if got := drain(q); !sameFrames(got, "c", "d") {
+        t.Fatalf("queue holds %v, want the newest two", got)
+    }
+    if s := q.stats(); s.Dropped != 2 || s.MaxDepth != 2 {
+        t.Fatalf("stats %+v", s)
+    }
+}
+
+func TestSendQueueCoalesce(t *testing.T) {
+    withSendQueue(t, policyCoalesce, 3)
+    q := newSendQueue()
+    q.push([]byte("msg"), "")
+    q.push([]byte("alice typing"), "typing:r:alice")
+    q.push([]byte("bob typing"), "typing:r:bob")
+    // Same key replaces in place, even with the queue full
+    if !q.push([]byte("alice stopped"), "typing:r:alice") {
+        t.Fatal("coalescing push refused")
+    }
+    if q.push([]byte("other"), "") {
+        t.Fatal("unkeyed push at capacity accepted")
+    }
+    if got := drain(q); !sameFrames(got, "msg", "alice stopped", "bob typing") {
+        t.Fatalf("queue holds %v", got)
+    }
+    if s := q.stats(); s.Coalesced != 1 {
+        t.Fatalf("stats %+v", s)
+    }
+}
+
+func TestSendQueueClose(t *testing.T) {
+    withSendQueue(t, policyDisconnect, 2)
+    q := newSendQueue()
+    q.push([]byte("a"), "")
+    q.close()
+    if _, ok, closed := q.pop(); ok || !closed {
+        t.Fatalf("pop after close: ok=%v closed=%v", ok, closed)
+    }
+    if !q.push([]byte("b"), "") {
+        t.Fatal("push after close should be a no-op, not a disconnect")
+    }
+}
+
+func TestSlowReaderClosedWithTryAgainLater(t *testing.T) {
+    withSendQueue(t, policyDisconnect, 4)
+    srv := newTestServer(t)
+    testUser(t, "slow_reader")
+    conn, _, err := srv.dial(t, "slow_reader", "room=general")
+    if err != nil {
+        t.Fatal(err)
+    }
+    readUntil(t, conn, "history")
+
+    // Stop reading and flood the user until the socket and queue are full
+    frame := append(append([]byte(`{"type":"filler","pad":"`), bytes.Repeat([]byte("x"), 256<<10)...), `"}`...)
+    before := slowDisconnects.Load()
+    deadline := time.Now().Add(10 * time.Second)
+    for slowDisconnects.Load() == before {
+        if time.Now().After(deadline) {
+            t.Fatal("slow reader was never disconnected")
+        }
+        srv.hub.broadcast <- Broadcast{user: "slow_reader", message: frame}
+    }
+
+    // Once it reads again it gets what was in flight, then the close
+    conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+    for {
+        _, _, err := conn.ReadMessage()
+        if err == nil {
+            continue
+        }
+        var ce *websocket.CloseError
+        if !errors.As(err, &ce) || ce.Code != websocket.CloseTryAgainLater {
+            t.Fatalf("got %v, want close 1013", err)
+        }
+        return
+    }
+}
+
+func TestResubscribeReplaysDroppedEvents(t *testing.T) {
+    withSendQueue(t, policyDropOldest, 4)
+    srv := newTestServer(t)
+    testUser(t, "drop_reader")
+    room := "drop-room"
+    if _, err := dbCreateRoom(context.Background(), room, "", "drop_reader", nil, false); err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { dbDeleteRoom(context.Background(), room) })
+    testRoomMessage(srv.hub, room, "drop_reader", "seen")
+    conn, _, err := srv.dial(t, "drop_reader", "room="+room)
+    if err != nil {
+        t.Fatal(err)
+    }
+    since := int64(readUntil(t, conn, "history")["seq"].(float64))
+
+    // Stop reading and publish until the queue has dropped some events
+    text := strings.Repeat("x", 16<<10)
+    dropped := func() int64 {
+        reply := make(chan []queueStats)
+        srv.hub.stats <- reply
+        var n int64
+        for _, s := range <-reply {
+            n += s.Dropped
+        }
+        return n
+    }
+    var last int64
+    for dropped() == 0 {
+        if last-since >= int64(resumeMaxEvents) {
+            t.Fatal("no frames dropped")
+        }
+        last = testRoomMessage(srv.hub, room, "drop_reader", text)
+    }
+
+    // Subscribing again with the last seq seen replays everything after it
+    sendFrame(t, conn, SubscriptionFrame{ClientEnvelope: ClientEnvelope{Type: "subscribe", ID: "again"}, Room: room, Since: since})
+    f := readUntil(t, conn, "replay")
+    events, _ := f["events"].([]any)
+    if f["room"] != room || f["seq"] != float64(last) || int64(len(events)) != last-since {
+        t.Fatalf("replay of %d events up to seq %v, want %d up to %d", len(events), f["seq"], last-since, last)
+    }
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net"
+    "net/http"
+    "os"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/jackc/pgx/v5"
+)
+
+// -------------------- Sessions --------------------
+
+// Session is a server-side record of an issued token, used for logout,
+// remote revocation and the "active devices" list.
+type Session struct {
+    ID         string    `json:"id"`
+    Username   string    `json:"-"`
+    UserAgent  string    `json:"userAgent"`
+    IP         string    `json:"ip"`
+    CreatedAt  time.Time `json:"createdAt"`
+    LastUsedAt time.Time `json:"lastUsedAt"`
+    ExpiresAt  time.Time `json:"expiresAt"`
+    Current    bool      `json:"current,omitempty"`
+    revoked    bool
+}
+
+var (
+    sessionsMu  sync.RWMutex
+    sessionsMap = map[string]*Session{}
+
+    errSessionNotFound = errors.New("session not found")
+)
+
+// sessionTouchInterval limits how often last-used timestamps are written.
+const sessionTouchInterval = time.Minute
+
+func randomToken(n int) string {
+    b := make([]byte, n)
+    if _, err := rand.Read(b); err != nil {
+        panic(err)
+    }
+    return hex.EncodeToString(b)
+}
+
+// trustedProxies are the proxies whose X-Forwarded-For is believed
+// (TRUSTED_PROXIES: comma-separated IPs or CIDRs, e.g. the load balancer's
+// range on Render/Fly). Without it the header is ignored, since anyone can
+// send one.
+var trustedProxies []*net.IPNet
+
+func initTrustedProxies() {
+    trustedProxies = nil
+    for _, p := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+        p = strings.TrimSpace(p)
+        if p == "" {
+            continue
+        }
+        if !strings.Contains(p, "/") {
+            if ip := net.ParseIP(p); ip != nil && ip.To4() != nil {
+                p += "/32"
+            } else {
+                p += "/128"
+            }
+        }
+        _, n, err := net.ParseCIDR(p)
+        if err != nil {
+            log.Printf("⚠️ Ignoring invalid TRUSTED_PROXIES entry %q", p)
+            continue
+        }
+        trustedProxies = append(trustedProxies, n)
+    }
+}
+
+func trustedProxy(addr string) bool {
+    ip := net.ParseIP(addr)
+    if ip == nil {
+        return false
+    }
+    for _, n := range trustedProxies {
+        if n.Contains(ip) {
+            return true
+        }
+    }
+    return false
+}
+
+// clientIP returns the remote address, or, when that is a trusted proxy,
+// the nearest X-Forwarded-For hop that is not one. Hops further left were
+// written by the client and are not believed.
+func clientIP(r *http.Request) string {
+    ip, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        ip = r.RemoteAddr
+    }
+    if !trustedProxy(ip) {
+        return ip
+    }
+    hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+    for i := len(hops) - 1; i >= 0; i-- {
+        hop := strings.TrimSpace(hops[i])
+        if hop == "" {
+            continue
+        }
+        ip = hop
+        if !trustedProxy(hop) {
+            break
+        }
+    }
+    return ip
+}
+
+func createSession(r *http.Request, username string, expires time.Time) (*Session, error) {
+    now := time.Now()
+    s := &Session{
+        ID:         randomToken(16),
+        Username:   username,
+        UserAgent:  r.UserAgent(),
+        IP:         clientIP(r),
+        CreatedAt:  now,
+        LastUsedAt: now,
+        ExpiresAt:  expires,
+    }
+    if useDB {
+        ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        defer cancel()
+        return s, dbCreateSession(ctx, s)
+    }
+    sessionsMu.Lock()
+    sessionsMap[s.ID] = s
+    sessionsMu.Unlock()
+    return s, nil
+}
+
+// validateSession checks that the session exists, belongs to username and
+// is neither revoked nor expired, and records its use.
+func validateSession(id, username string) error {
+    if id == "" {
+        return errSessionNotFound
+    }
+    if useDB {
+        ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        defer cancel()
+        return dbValidateSession(ctx, id, username)
+    }
+    sessionsMu.Lock()
+    defer sessionsMu.Unlock()
+    s, ok := sessionsMap[id]
+    if !ok || s.revoked || s.Username != username || time.Now().After(s.ExpiresAt) {
+        return errSessionNotFound
+    }
+    s.LastUsedAt = time.Now()
+    return nil
+}
+
+func listSessions(username string) ([]Session, error) {
+    if useDB {
+        ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        defer cancel()
+        return dbListSessions(ctx, username)
+    }
+    sessionsMu.RLock()
+    defer sessionsMu.RUnlock()
+    now := time.Now()
+    out := make([]Session, 0)
+    for _, s := range sessionsMap {
+        if s.Username == username && !s.revoked && now.Before(s.ExpiresAt) {
+            out = append(out, *s)
+        }
+    }
+    return out, nil
+}
+
+// revokeSession marks a session of username as revoked. It returns
+// errSessionNotFound if no active session with that ID belongs to the user.
+func revokeSession(username, id string) error {
+    if useDB {
+        ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        defer cancel()
+        return dbRevokeSession(ctx, username, id)
+    }
+    sessionsMu.Lock()
+    defer sessionsMu.Unlock()
+    s, ok := sessionsMap[id]
+    if !ok || s.revoked || s.Username != username {
+        return errSessionNotFound
+    }
+    s.revoked = true
+    return nil
+}
+
+// revokeUserSessions revokes every active session of username except keepID
+// and returns the revoked IDs so their connections can be closed.
+func revokeUserSessions(username, keepID string) ([]string, error) {
+    if useDB {
+        ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        defer cancel()
+        return dbRevokeUserSessions(ctx, username, keepID)
+    }
+    sessionsMu.Lock()
+    defer sessionsMu.Unlock()
+    var ids []string
+    for id, s := range sessionsMap {
+        if s.Username == username && id != keepID && !s.revoked {
+            s.revoked = true
+            ids = append(ids, id)
+        }
+    }
+    return ids, nil
+}
+
+// -------------------- Session Handlers --------------------
+
+func logoutHandler(hub *Hub, w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    claims := authClaims(r)
+    if err := revokeSession(claims.Username, claims.SessionID); err != nil && !errors.Is(err, errSessionNotFound) {
+        log.Println("logout error:", err)
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+    hub.revoke <- claims.SessionID
+    http.SetCookie(w, &http.Cookie{
+        Name:     sessionCookieName,
+        Value:    "",
+        Path:     "/",
+        MaxAge:   -1,
+        HttpOnly: true,
+    })
+    w.WriteHeader(http.StatusOK)
+    w.Write([]byte("Logged out"))
+}
+
+func listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    claims := authClaims(r)
+    sessions, err := listSessions(claims.Username)
+    if err != nil {
+        log.Println("list sessions error:", err)
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+    for i := range sessions {
+        sessions[i].Current = sessions[i].ID == claims.SessionID
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(sessions)
+}
+
+// revokeSessionHandler handles DELETE /sessions/{id}.
+func revokeSessionHandler(hub *Hub, w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodDelete {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    id := strings.TrimPrefix(r.URL.Path, "/sessions/")
+    if id == "" || strings.Contains(id, "/") {
+        http.Error(w, "Session ID required", http.StatusBadRequest)
+        return
+    }
+    if err := revokeSession(authUsername(r), id); err != nil {
+        if errors.Is(err, errSessionNotFound) {
+            http.Error(w, "Session not found", http.StatusNotFound)
+            return
+        }
+        log.Println("revoke session error:", err)
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+    hub.revoke <- id
+    w.WriteHeader(http.StatusOK)
+    w.Write([]byte("Session revoked"))
+}
+
+// -------------------- Session DB Helpers --------------------
+
+func dbCreateSession(ctx context.Context, s *Session) error {
+    _, err := dbPool.Exec(ctx, `
+        INSERT INTO sessions (id, username, user_agent, ip, created_at, last_used_at, expires_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7)
+    `, s.ID, s.Username, s.UserAgent, s.IP, s.CreatedAt, s.LastUsedAt, s.ExpiresAt)
+    return err
+}
+
+func dbValidateSession(ctx context.Context, id, username string) error {
+    var lastUsed time.Time
+    err := dbPool.QueryRow(ctx, `
+        SELECT last_used_at FROM sessions
+        WHERE id=$1 AND username=$2 AND revoked_at IS NULL AND expires_at > NOW()
+    `, id, username).Scan(&lastUsed)
+    if err != nil {
+        if errors.Is(err, pgx.ErrNoRows) {
+            return errSessionNotFound
+        }
+        return err
+    }
+    if time.Since(lastUsed) > sessionTouchInterval {
+        if _, err := dbPool.Exec(ctx, `UPDATE sessions SET last_used_at=NOW() WHERE id=$1`, id); err != nil {
+            log.Println("db touch session error:", err)
+        }
+    }
+    return nil
+}
+
+func dbListSessions(ctx context.Context, username string) ([]Session, error) {
+    rows, err := dbPool.Query(ctx, `
+        SELECT id, COALESCE(user_agent, ''), COALESCE(ip, ''), created_at, last_used_at, expires_at
+        FROM sessions
+        WHERE username=$1 AND revoked_at IS NULL AND expires_at > NOW()
+        ORDER BY last_used_at DESC
+    `, username)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    out := make([]Session, 0)
+    for rows.Next() {
+        s := Session{Username: username}
+        if err := rows.Scan(&s.ID, &s.UserAgent, &s.IP, &s.CreatedAt, &s.LastUsedAt, &s.ExpiresAt); err != nil {
+            return nil, err
+        }
+        out = append(out, s)
+    }
+    return out, rows.Err()
+}
+
+func dbRevokeSession(ctx context.Context, username, id string) error {
+    ct, err := dbPool.Exec(ctx, `
+        UPDATE sessions SET revoked_at=NOW()
+        WHERE id=$1 AND username=$2 AND revoked_at IS NULL
+    `, id, username)
+    if err != nil {
+        return fmt.Errorf("revoke session: %w", err)
+    }
+    if ct.RowsAffected() == 0 {
+        return errSessionNotFound
+    }
+    return nil
+}
+
+func dbRevokeUserSessions(ctx context.Context, username, keepID string) ([]string, error) {
+    rows, err := dbPool.Query(ctx, `
+        UPDATE sessions SET revoked_at=NOW()
+        WHERE username=$1 AND id<>$2 AND revoked_at IS NULL
+        RETURNING id
+    `, username, keepID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    var ids []string
+    for rows.Next() {
+        var id string
+        if err := rows.Scan(&id); err != nil {
+            return nil, err
+        }
+        ids = append(ids, id)
+    }
+    return ids, rows.Err()
+}
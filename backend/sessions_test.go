@@ -0,0 +1,64 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "testing"
+
+    "github.com/gorilla/websocket"
+)
+
+func TestSessionsListRevokeAndLogout(t *testing.T) {
+    srv := newTestServer(t)
+    testUser(t, "sess_user")
+    testUser(t, "sess_other")
+    laptop, phone := sessionToken(t, "sess_user"), sessionToken(t, "sess_user")
+    other := sessionToken(t, "sess_other")
+    mux := http.NewServeMux()
+    mux.HandleFunc("/sessions", listSessionsHandler)
+    mux.HandleFunc("/sessions/", func(w http.ResponseWriter, r *http.Request) { revokeSessionHandler(srv.hub, w, r) })
+    mux.HandleFunc("/logout", func(w http.ResponseWriter, r *http.Request) { logoutHandler(srv.hub, w, r) })
+    h := requireAuth(mux)
+
+    w := serve(h, laptop, http.MethodGet, "/sessions", "")
+    var sessions []Session
+    if err := json.NewDecoder(w.Body).Decode(&sessions); err != nil || len(sessions) != 2 {
+        t.Fatalf("list: %v %+v", err, sessions)
+    }
+    var phoneID string
+    for _, s := range sessions {
+        if !s.Current {
+            phoneID = s.ID
+        }
+    }
+    if phoneID == "" {
+        t.Fatalf("no other session in %+v", sessions)
+    }
+
+    // Another user cannot revoke it; its owner can, and its socket closes
+    if w := serve(h, other, http.MethodDelete, "/sessions/"+phoneID, ""); w.Code != http.StatusNotFound {
+        t.Fatalf("revoke someone else's session: status %d", w.Code)
+    }
+    conn, _, err := srv.dialToken(t, phone, "room=general")
+    if err != nil {
+        t.Fatal(err)
+    }
+    readUntil(t, conn, "history")
+    if w := serve(h, laptop, http.MethodDelete, "/sessions/"+phoneID, ""); w.Code != http.StatusOK {
+        t.Fatalf("revoke: status %d", w.Code)
+    }
+    expectClose(t, conn, websocket.ClosePolicyViolation)
+    if w := serve(h, phone, http.MethodGet, "/sessions", ""); w.Code != http.StatusUnauthorized {
+        t.Fatalf("revoked token: status %d", w.Code)
+    }
+
+    if w := serve(h, laptop, http.MethodPost, "/logout", ""); w.Code != http.StatusOK {
+        t.Fatalf("logout: status %d", w.Code)
+    }
+    if w := serve(h, laptop, http.MethodGet, "/sessions", ""); w.Code != http.StatusUnauthorized {
+        t.Fatalf("token after logout: status %d", w.Code)
+    }
+    if w := serve(h, other, http.MethodGet, "/sessions", ""); w.Code != http.StatusOK {
+        t.Fatalf("other user's session: status %d", w.Code)
+    }
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/jackc/pgx/v5"
+)
+
+// -------------------- User Settings --------------------
+
+// settingSpec describes one key of the settings document. Only keys listed
+// in settingsSchema may be stored; unset keys read back as their default.
+type settingSpec struct {
+    Kind    string // "bool", "string" or "number"
+    Default any
+    Enum    []string
+    MaxLen  int
+    Min     float64
+    Max     float64
+}
+
+var settingsSchema = map[string]settingSpec{
+    "darkMode":             {Kind: "bool", Default: false},
+    "notificationsEnabled": {Kind: "bool", Default: false},
+    "soundEnabled":         {Kind: "bool", Default: true},
+    "compactMode":          {Kind: "bool", Default: false},
+    "enterToSend":          {Kind: "bool", Default: true},
+    "fontScale":            {Kind: "number", Default: 1.0, Min: 0.75, Max: 2},
+    "language":             {Kind: "string", Default: "", MaxLen: 16},
+    "timeFormat":           {Kind: "string", Default: "24h", Enum: []string{"12h", "24h"}},
+}
+
+const maxSettingsBody = 16 << 10
+
+var (
+    errSettingsVersion  = errors.New("settings were modified concurrently")
+    errSettingsNotFound = errors.New("user not found")
+    errSettingsInvalid  = errors.New("invalid settings")
+)
+
+// validateSettings checks a stored (non-defaulted) settings document against the schema.
+func validateSettings(doc map[string]any) error {
+    for key, v := range doc {
+        spec, ok := settingsSchema[key]
+        if !ok {
+            return fmt.Errorf("unknown setting %q", key)
+        }
+        switch spec.Kind {
+        case "bool":
+            if _, ok := v.(bool); !ok {
+                return fmt.Errorf("%s must be a boolean", key)
+            }
+        case "number":
+            n, ok := v.(float64)
+            if !ok {
+                return fmt.Errorf("%s must be a number", key)
+            }
+            if n < spec.Min || n > spec.Max {
+                return fmt.Errorf("%s must be between %g and %g", key, spec.Min, spec.Max)
+            }
+        case "string":
+            s, ok := v.(string)
+            if !ok {
+                return fmt.Errorf("%s must be a string", key)
+            }
+            if spec.MaxLen > 0 && len(s) > spec.MaxLen {
+                return fmt.Errorf("%s must be at most %d characters", key, spec.MaxLen)
+            }
+            if len(spec.Enum) > 0 && !containsString(spec.Enum, s) {
+                return fmt.Errorf("%s must be one of %s", key, strings.Join(spec.Enum, ", "))
+            }
+        }
+    }
+    return nil
+}
+
+func containsString(list []string, s string) bool {
+    for _, v := range list {
+        if v == s {
+            return true
+        }
+    }
+    return false
+}
+
+// effectiveSettings fills in schema defaults for keys the user has not set.
+func effectiveSettings(doc map[string]any) map[string]any {
+    out := make(map[string]any, len(settingsSchema))
+    for key, spec := range settingsSchema {
+        out[key] = spec.Default
+    }
+    for key, v := range doc {
+        out[key] = v
+    }
+    return out
+}
+
+// mergePatch applies an RFC 7396 JSON merge patch to target.
+func mergePatch(target map[string]any, patch map[string]any) map[string]any {
+    if target == nil {
+        target = map[string]any{}
+    }
+    for key, v := range patch {
+        if v == nil {
+            delete(target, key)
+            continue
+        }
+        if sub, ok := v.(map[string]any); ok {
+            cur, _ := target[key].(map[string]any)
+            target[key] = mergePatch(cur, sub)
+            continue
+        }
+        target[key] = v
+    }
+    return target
+}
+
+func settingsETag(version int) string {
+    return `"` + strconv.Itoa(version) + `"`
+}
+
+// ifMatchVersion parses If-Match into the version it requires, or -1 when
+// the request is unconditional.
+func ifMatchVersion(r *http.Request) (int, error) {
+    h := strings.TrimSpace(r.Header.Get("If-Match"))
+    if h == "" || h == "*" {
+        return -1, nil
+    }
+    v, err := strconv.Atoi(strings.Trim(strings.TrimPrefix(h, "W/"), `"`))
+    if err != nil {
+        return 0, errSettingsVersion
+    }
+    return v, nil
+}
+
+func copySettings(doc map[string]any) map[string]any {
+    out := make(map[string]any, len(doc))
+    for k, v := range doc {
+        out[k] = v
+    }
+    return out
+}
+
+// -------------------- Settings Store --------------------
+
+func getSettings(username string) (map[string]any, int, error) {
+    if useDB {
+        ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        defer cancel()
+        return dbGetSettings(ctx, username)
+    }
+    usersMu.RLock()
+    defer usersMu.RUnlock()
+    su, ok := usersMap[username]
+    if !ok {
+        return nil, 0, errSettingsNotFound
+    }
+    return copySettings(su.Settings), su.SettingsVersion, nil
+}
+
+// updateSettings replaces the user's settings with apply(current) if the
+// stored version still equals expect (-1 skips the check), and bumps the version.
+func updateSettings(username string, expect int, apply func(map[string]any) (map[string]any, error)) (map[string]any, int, error) {
+    if useDB {
+        ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        defer cancel()
+        return dbUpdateSettings(ctx, username, expect, apply)
+    }
+    usersMu.Lock()
+    defer usersMu.Unlock()
+    su, ok := usersMap[username]
+    if !ok {
+        return nil, 0, errSettingsNotFound
+    }
+    if expect >= 0 && expect != su.SettingsVersion {
+        return nil, 0, errSettingsVersion
+    }
+    doc, err := apply(copySettings(su.Settings))
+    if err != nil {
+        return nil, 0, err
+    }
+    su.Settings = doc
+    su.SettingsVersion++
+    return copySettings(doc), su.SettingsVersion, nil
+}
+
+// -------------------- Settings Handlers --------------------
+
+// settingsHandler serves /account/settings: GET returns the document with an
+// ETag, PATCH applies a JSON merge patch and PUT replaces it. Both writes honour If-Match.
+func settingsHandler(hub *Hub, w http.ResponseWriter, r *http.Request) {
+    username := authUsername(r)
+    switch r.Method {
+    case http.MethodGet:
+        doc, version, err := getSettings(username)
+        if err != nil {
+            if !errors.Is(err, errSettingsNotFound) {
+                log.Println("load settings error:", err)
+            }
+            http.Error(w, "User not found", http.StatusNotFound)
+            return
+        }
+        writeSettings(w, doc, version)
+    case http.MethodPatch, http.MethodPut:
+        var body map[string]any
+        if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSettingsBody)).Decode(&body); err != nil || body == nil {
+            http.Error(w, "Body must be a JSON object", http.StatusBadRequest)
+            return
+        }
+        expect, err := ifMatchVersion(r)
+        if err != nil {
+            http.Error(w, "Settings have changed", http.StatusPreconditionFailed)
+            return
+        }
+        replace := r.Method == http.MethodPut
+        apply := func(cur map[string]any) (map[string]any, error) {
+            if replace {
+                cur = map[string]any{}
+            }
+            next := mergePatch(cur, body)
+            if err := validateSettings(next); err != nil {
+                return nil, fmt.Errorf("%w: %v", errSettingsInvalid, err)
+            }
+            return next, nil
+        }
+        doc, version, err := updateSettings(username, expect, apply)
+        if err != nil {
+            switch {
+            case errors.Is(err, errSettingsVersion):
+                http.Error(w, "Settings have changed", http.StatusPreconditionFailed)
+            case errors.Is(err, errSettingsNotFound):
+                http.Error(w, "User not found", http.StatusNotFound)
+            case errors.Is(err, errSettingsInvalid):
+                http.Error(w, err.Error(), http.StatusBadRequest)
+            default:
+                log.Println("update settings error:", err)
+                http.Error(w, "Server error", http.StatusInternalServerError)
+            }
+            return
+        }
+        publishSettings(hub, username, doc, version)
+        writeSettings(w, doc, version)
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+// settingsSchemaHandler describes the accepted keys so clients can render forms.
+func settingsSchemaHandler(w http.ResponseWriter, r *http.Request) {
+    type field struct {
+        Key     string   `json:"key"`
+        Type    string   `json:"type"`
+        Default any      `json:"default"`
+        Enum    []string `json:"enum,omitempty"`
+        MaxLen  int      `json:"maxLength,omitempty"`
+        Min     *float64 `json:"minimum,omitempty"`
+        Max     *float64 `json:"maximum,omitempty"`
+    }
+    fields := make([]field, 0, len(settingsSchema))
+    for key, spec := range settingsSchema {
+        f := field{Key: key, Type: spec.Kind, Default: spec.Default, Enum: spec.Enum, MaxLen: spec.MaxLen}
+        if spec.Kind == "number" {
+            min, max := spec.Min, spec.Max
+            f.Min, f.Max = &min, &max
+        }
+        fields = append(fields, f)
+    }
+    sort.Slice(fields, func(i, j int) bool { return fields[i].Key < fields[j].Key })
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(fields)
+}
+
+func writeSettings(w http.ResponseWriter, doc map[string]any, version int) {
+    w.Header().Set("ETag", settingsETag(version))
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]any{
+        "settings": effectiveSettings(doc),
+        "version":  version,
+    })
+}
+
+// publishSettings pushes the new document to every socket the user has open.
+func publishSettings(hub *Hub, username string, doc map[string]any, version int) {
+    b, err := json.Marshal(SettingsUpdatedEvent{Type: "settings_updated", Settings: effectiveSettings(doc), Version: version})
+    if err != nil {
+        return
+    }
+    hub.broadcast <- Broadcast{user: username, message: b}
+}
+
+// -------------------- Settings DB Helpers --------------------
+
+func dbGetSettings(ctx context.Context, username string) (map[string]any, int, error) {
+    var doc map[string]any
+    var version int
+    err := dbPool.QueryRow(ctx, `SELECT settings, settings_version FROM users WHERE username=$1`, username).Scan(&doc, &version)
+    if err != nil {
+        if errors.Is(err, pgx.ErrNoRows) {
+            return nil, 0, errSettingsNotFound
+        }
+        return nil, 0, err
+    }
+    return doc, version, nil
+}
+
+func dbUpdateSettings(ctx context.Context, username string, expect int, apply func(map[string]any) (map[string]any, error)) (map[string]any, int, error) {
+    tx, err := dbPool.Begin(ctx)
+    if err != nil {
+        return nil, 0, err
+    }
+    defer tx.Rollback(ctx)
+    var doc map[string]any
+    var version int
+    err = tx.QueryRow(ctx, `
+        SELECT settings, settings_version FROM users WHERE username=$1 FOR UPDATE
+    `, username).Scan(&doc, &version)
+    if err != nil {
+        if errors.Is(err, pgx.ErrNoRows) {
+            return nil, 0, errSettingsNotFound
+        }
+        return nil, 0, err
+    }
+    if expect >= 0 && expect != version {
+        return nil, 0, errSettingsVersion
+    }
+    doc, err = apply(doc)
+    if err != nil {
+        return nil, 0, err
+    }
+    err = tx.QueryRow(ctx, `
+        UPDATE users SET settings=$1, settings_version=settings_version+1 WHERE username=$2
+        RETURNING settings_version
+    `, doc, username).Scan(&version)
+    if err != nil {
+        return nil, 0, err
+    }
+    if err := tx.Commit(ctx); err != nil {
+        return nil, 0, err
+    }
+    return doc, version, nil
+}
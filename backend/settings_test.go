@@ -0,0 +1,88 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+func TestMergePatch(t *testing.T) {
+    tests := []struct {
+        target, patch, want string
+    }{
+        {`{"a":1}`, `{"a":2}`, `{"a":2}`},
+        {`{"a":1}`, `{"b":true}`, `{"a":1,"b":true}`},
+        {`{"a":1,"b":2}`, `{"a":null}`, `{"b":2}`},
+        {`{"a":{"x":1,"y":2}}`, `{"a":{"y":null,"z":3}}`, `{"a":{"x":1,"z":3}}`},
+        {`{"a":[1,2]}`, `{"a":[3]}`, `{"a":[3]}`},
+        {`{"a":1}`, `{"a":{"x":1}}`, `{"a":{"x":1}}`},
+        {`null`, `{"a":1,"b":null}`, `{"a":1}`},
+    }
+    for _, tt := range tests {
+        var target, patch, want map[string]any
+        json.Unmarshal([]byte(tt.target), &target)
+        json.Unmarshal([]byte(tt.patch), &patch)
+        json.Unmarshal([]byte(tt.want), &want)
+        if got := mergePatch(target, patch); !reflect.DeepEqual(got, want) {
+            t.Errorf("mergePatch(%s, %s) = %v, want %s", tt.target, tt.patch, got, tt.want)
+        }
+    }
+}
+
+func TestSettingsIfMatch(t *testing.T) {
+    hub := newTestServer(t).hub
+    testUser(t, "settings_user")
+    token := sessionToken(t, "settings_user")
+    h := requireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        settingsHandler(hub, w, r)
+    }))
+    do := func(method, ifMatch, body string) (*httptest.ResponseRecorder, map[string]any) {
+        t.Helper()
+        r := httptest.NewRequest(method, "/account/settings", strings.NewReader(body))
+        r.Header.Set("Authorization", "Bearer "+token)
+        if ifMatch != "" {
+            r.Header.Set("If-Match", ifMatch)
+        }
+        w := httptest.NewRecorder()
+        h.ServeHTTP(w, r)
+        var resp struct {
+            Settings map[string]any `json:"settings"`
+        }
+        json.Unmarshal(w.Body.Bytes(), &resp)
+        return w, resp.Settings
+    }
+
+    w, doc := do(http.MethodGet, "", "")
+    if w.Code != http.StatusOK || w.Header().Get("ETag") != `"0"` || doc["timeFormat"] != "24h" {
+        t.Fatalf("initial GET: %d etag=%s %v", w.Code, w.Header().Get("ETag"), doc)
+    }
+    w, doc = do(http.MethodPatch, `"0"`, `{"darkMode":true,"fontScale":1.5}`)
+    if w.Code != http.StatusOK || w.Header().Get("ETag") != `"1"` || doc["darkMode"] != true || doc["fontScale"] != 1.5 {
+        t.Fatalf("PATCH at version 0: %d etag=%s %v", w.Code, w.Header().Get("ETag"), doc)
+    }
+
+    // A writer still holding version 0 loses, and nothing changes
+    if w, _ := do(http.MethodPatch, `"0"`, `{"darkMode":false}`); w.Code != http.StatusPreconditionFailed {
+        t.Fatalf("stale If-Match: status %d", w.Code)
+    }
+    if w, _ := do(http.MethodPatch, `"not a version"`, `{"darkMode":false}`); w.Code != http.StatusPreconditionFailed {
+        t.Fatalf("malformed If-Match: status %d", w.Code)
+    }
+    if w, _ := do(http.MethodPatch, `W/"1"`, `{"timeFormat":"36h"}`); w.Code != http.StatusBadRequest {
+        t.Fatalf("invalid value: status %d", w.Code)
+    }
+
+    // null resets a key to its default; the other key is kept
+    w, doc = do(http.MethodPatch, `W/"1"`, `{"fontScale":null}`)
+    if w.Code != http.StatusOK || doc["fontScale"] != 1.0 || doc["darkMode"] != true {
+        t.Fatalf("PATCH null: %d %v", w.Code, doc)
+    }
+    // Unconditional PUT replaces the whole document
+    w, doc = do(http.MethodPut, "", `{"compactMode":true}`)
+    if w.Code != http.StatusOK || w.Header().Get("ETag") != `"3"` || doc["darkMode"] != false || doc["compactMode"] != true {
+        t.Fatalf("PUT: %d etag=%s %v", w.Code, w.Header().Get("ETag"), doc)
+    }
+}
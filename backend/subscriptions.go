@@ -0,0 +1,155 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "log"
+    "strings"
+)
+
+// -------------------- Room Subscriptions --------------------
+
+// maxRoomSubscriptions caps how many rooms one socket can follow.
+const maxRoomSubscriptions = 50
+
+// subscription asks the hub to add a client to a room or take it out.
+type subscription struct {
+    client *Client
+    room   string
+    join   bool
+}
+
+// historyFrame returns the recent history of room as a "history" frame.
+// Callers hold roomLock(room) so Seq matches the messages.
+func historyFrame(room string) []byte {
+    ev := HistoryEvent{Type: "history", Room: room, Seq: currentRoomSeq(room), Messages: []Message{}}
+    history, more, err := loadMessagesBefore(room, nil, historyInitial)
+    if err != nil {
+        log.Println("db load history error:", err)
+    }
+    if len(history) > 0 {
+        ev.Messages = history
+        if more {
+            ev.PrevCursor = cursorOf(history[0]).String()
+        }
+    }
+    b, err := json.Marshal(ev)
+    if err != nil {
+        return nil
+    }
+    return b
+}
+
+func subscriptionAck(kind, room, requestID string) []byte {
+    b, _ := json.Marshal(SubscriptionEvent{Type: kind, Room: room, RequestID: requestID})
+    return b
+}
+
+// subscribe handles an inbound {"type":"subscribe","room":...} frame. The
+// room's history (or replay, see attach) is queued before the hub adds the
+// client, so it arrives ahead of the roster and any live traffic. Subscribing
+// again with since catches up on what the client missed (see resume).
+func (c *Client) subscribe(requestID, room string, since int64) {
+    room = strings.TrimSpace(room)
+    if room == "" {
+        c.sendError(requestID, codeInvalidRoom, "Room required")
+        return
+    }
+    if c.rooms[room] {
+        c.queue(subscriptionAck("subscribed", room, requestID))
+        if since > 0 {
+            c.resume(room, since)
+        }
+        return
+    }
+    if len(c.rooms) >= maxRoomSubscriptions {
+        c.sendError(requestID, codeTooManySubscriptions, "Unsubscribe from a room first")
+        return
+    }
+    if c.apiKey != nil && !c.apiKey.allowsRoom(room) {
+        c.sendError(requestID, codeForbidden, "Not allowed in this room")
+        return
+    }
+    if err := checkRoomAccess(c.username, room); err != nil {
+        switch {
+        case errors.Is(err, errRoomNotFound):
+            c.sendError(requestID, codeNotFound, "Room not found")
+        case errors.Is(err, errRoomPrivate):
+            c.sendError(requestID, codeForbidden, "Join this private room with its password first")
+        default:
+            log.Println("room access error:", err)
+            c.sendError(requestID, codeServerError, "Could not subscribe, try again")
+        }
+        return
+    }
+    c.rooms[room] = true
+    c.queue(subscriptionAck("subscribed", room, requestID))
+    c.attach(room, since)
+}
+
+// unsubscribe handles an inbound {"type":"unsubscribe","room":...} frame.
+func (c *Client) unsubscribe(requestID, room string) {
+    room = strings.TrimSpace(room)
+    if !c.rooms[room] {
+        c.sendError(requestID, codeNotSubscribed, "Not subscribed to this room")
+        return
+    }
+    delete(c.rooms, room)
+    c.hub.subscriptions <- subscription{client: c, room: room}
+    c.queue(subscriptionAck("unsubscribed", room, requestID))
+}
+
+// targetRoom resolves the room an inbound frame is meant for. Frames without
+// a room are accepted from sockets following exactly one room, as older
+// clients send them.
+func (c *Client) targetRoom(requestID, room string) (string, bool) {
+    if room == "" && len(c.rooms) == 1 {
+        for r := range c.rooms {
+            return r, true
+        }
+    }
+    if room == "" {
+        c.sendError(requestID, codeRoomRequired, "Frame must name a room")
+        return "", false
+    }
+    if !c.rooms[room] {
+        c.sendError(requestID, codeNotSubscribed, "Not subscribed to this room")
+        return "", false
+    }
+    return room, true
+}
+
+// joinRoom adds client to room and sends it the room's roster. Only call
+// from run().
+func (h *Hub) joinRoom(client *Client, room string) {
+    if _, ok := h.clients[client]; !ok || client.joined[room] {
+        return
+    }
+    // Tell the room first so the newcomer does not get a delta for itself
+    // on top of its snapshot
+    client.joined[room] = true
+    h.presenceDirty[roomUser{room, client.username}] = true
+    h.flushPresence()
+
+    if h.rooms[room] == nil {
+        h.rooms[room] = make(map[*Client]bool)
+    }
+    h.rooms[room][client] = true
+    h.sendRoster(client, room)
+}
+
+// leaveRoom takes client out of room. Only call from run().
+func (h *Hub) leaveRoom(client *Client, room string) {
+    if !client.joined[room] {
+        return
+    }
+    delete(client.joined, room)
+    if roomClients, exists := h.rooms[room]; exists {
+        delete(roomClients, client)
+        if len(roomClients) == 0 {
+            delete(h.rooms, room)
+        }
+    }
+    h.presenceDirty[roomUser{room, client.username}] = true
+    log.Println("👋 Client left room:", client.username, "room:", room)
+}
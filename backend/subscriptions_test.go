@@ -0,0 +1,77 @@
+package main
+
+import (
+    "context"
+    "net/http"
+    "testing"
+)
+
+func testPrivateRoom(t *testing.T, name, creator string) {
+    t.Helper()
+    hash, err := hashPassword("room password 123")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := dbCreateRoom(context.Background(), name, "", creator, hash, true); err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { dbDeleteRoom(context.Background(), name) })
+}
+
+func TestSubscribeChecksRoomAccess(t *testing.T) {
+    srv := newTestServer(t)
+    testUser(t, "sub_owner")
+    testUser(t, "sub_outsider")
+    testPrivateRoom(t, "sub-secret", "sub_owner")
+
+    conn, _, err := srv.dial(t, "sub_outsider", "room=general")
+    if err != nil {
+        t.Fatal(err)
+    }
+    readUntil(t, conn, "history")
+
+    sendFrame(t, conn, map[string]any{"type": "subscribe", "id": "1", "room": "sub-secret"})
+    if f := readUntil(t, conn, "error"); f["code"] != codeForbidden || f["requestId"] != "1" {
+        t.Fatalf("subscribe to private room: %v", f)
+    }
+    sendFrame(t, conn, map[string]any{"type": "subscribe", "id": "2", "room": "no-such-room"})
+    if f := readUntil(t, conn, "error"); f["code"] != codeNotFound || f["requestId"] != "2" {
+        t.Fatalf("subscribe to missing room: %v", f)
+    }
+
+    if err := addRoomMember(context.Background(), "sub-secret", "sub_outsider"); err != nil {
+        t.Fatal(err)
+    }
+    sendFrame(t, conn, map[string]any{"type": "subscribe", "id": "3", "room": "sub-secret"})
+    if f := readUntil(t, conn, "subscribed"); f["room"] != "sub-secret" {
+        t.Fatalf("subscribe after joining: %v", f)
+    }
+}
+
+func TestWebSocketRoomChecksAccess(t *testing.T) {
+    srv := newTestServer(t)
+    testUser(t, "ws_owner")
+    testUser(t, "ws_outsider")
+    testPrivateRoom(t, "ws-secret", "ws_owner")
+
+    if _, resp, err := srv.dial(t, "ws_outsider", "room=ws-secret"); err == nil || resp.StatusCode != http.StatusForbidden {
+        t.Fatalf("outsider connected to private room: %v", err)
+    }
+    if _, resp, err := srv.dial(t, "ws_outsider", "room=ws-missing"); err == nil || resp.StatusCode != http.StatusNotFound {
+        t.Fatalf("connected to missing room: %v", err)
+    }
+    conn, _, err := srv.dial(t, "ws_owner", "room=ws-secret")
+    if err != nil {
+        t.Fatalf("creator could not connect: %v", err)
+    }
+    readUntil(t, conn, "history")
+
+    // Resuming a private room by name is refused too
+    conn, _, err = srv.dial(t, "ws_outsider", "room=general&resume=ws-secret:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if f := readUntil(t, conn, "error"); f["code"] != codeForbidden {
+        t.Fatalf("resume into private room: %v", f)
+    }
+}
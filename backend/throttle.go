@@ -0,0 +1,284 @@
+package main
+
+import (
+    "context"
+    "log"
+    "math"
+    "net/http"
+    "sort"
+    "strconv"
+    "sync"
+    "time"
+)
+
+// -------------------- Brute-force Protection --------------------
+
+// authThrottle tracks failed password attempts per key (username, IP, room)
+// and blocks further attempts with exponential backoff and a temporary lockout.
+type authThrottle struct {
+    FreeAttempts     int           // failures allowed before backoff starts
+    BaseDelay        time.Duration // first backoff delay, doubled per failure
+    MaxDelay         time.Duration
+    LockoutThreshold int           // failures that trigger a full lockout
+    LockoutDuration  time.Duration
+    Window           time.Duration // failures older than this are forgotten
+}
+
+type failureState struct {
+    Failures    int
+    LastFailure time.Time
+    LockedUntil time.Time
+}
+
+var (
+    throttle = authThrottle{
+        FreeAttempts:     3,
+        BaseDelay:        time.Second,
+        MaxDelay:         5 * time.Minute,
+        LockoutThreshold: 10,
+        LockoutDuration:  15 * time.Minute,
+        Window:           time.Hour,
+    }
+
+    failuresMu  sync.Mutex
+    failuresMap = map[string]*failureState{}
+)
+
+func initThrottle() {
+    throttle.FreeAttempts = envInt("AUTH_FREE_ATTEMPTS", throttle.FreeAttempts)
+    throttle.BaseDelay = envDuration("AUTH_BACKOFF_BASE", throttle.BaseDelay)
+    throttle.MaxDelay = envDuration("AUTH_BACKOFF_MAX", throttle.MaxDelay)
+    throttle.LockoutThreshold = envInt("AUTH_LOCKOUT_THRESHOLD", throttle.LockoutThreshold)
+    throttle.LockoutDuration = envDuration("AUTH_LOCKOUT_DURATION", throttle.LockoutDuration)
+    throttle.Window = envDuration("AUTH_FAILURE_WINDOW", throttle.Window)
+}
+
+// blockedUntil returns the earliest time another attempt is allowed.
+func (t authThrottle) blockedUntil(s failureState) time.Time {
+    if time.Since(s.LastFailure) > t.Window {
+        return time.Time{}
+    }
+    until := s.LockedUntil
+    if over := s.Failures - t.FreeAttempts; over > 0 {
+        delay := time.Duration(float64(t.BaseDelay) * math.Pow(2, float64(over-1)))
+        if delay > t.MaxDelay || delay <= 0 {
+            delay = t.MaxDelay
+        }
+        if next := s.LastFailure.Add(delay); next.After(until) {
+            until = next
+        }
+    }
+    return until
+}
+
+// reserveAuthAttempt returns how long the caller must wait before trying any
+// of keys again. When no wait is needed it counts the attempt as a failure
+// against every key in the same step, so a concurrent burst cannot all pass
+// the check; on success the caller takes it back with authAttemptSucceeded.
+func reserveAuthAttempt(keys ...string) time.Duration {
+    var wait time.Duration
+    err := updateFailureStates(keys, func(states []failureState) bool {
+        now := time.Now()
+        for _, s := range states {
+            if d := throttle.blockedUntil(s).Sub(now); d > wait {
+                wait = d
+            }
+        }
+        if wait > 0 {
+            return false
+        }
+        for i, s := range states {
+            if now.Sub(s.LastFailure) > throttle.Window {
+                s = failureState{}
+            }
+            s.Failures++
+            s.LastFailure = now
+            if s.Failures >= throttle.LockoutThreshold && !now.Before(s.LockedUntil) {
+                s.LockedUntil = now.Add(throttle.LockoutDuration)
+                log.Printf("🚫 Locked out %s for %s after %d failed attempts", keys[i], throttle.LockoutDuration, s.Failures)
+            }
+            states[i] = s
+        }
+        return true
+    })
+    if err != nil {
+        log.Println("throttle update error:", err)
+        return 0
+    }
+    return wait
+}
+
+// authAttemptSucceeded clears the user's failures and takes back the
+// attempt reserved against the IP, whose earlier failures still count.
+func authAttemptSucceeded(userKey, ipKey string) {
+    resetAuthFailures(userKey)
+    err := updateFailureStates([]string{ipKey}, func(states []failureState) bool {
+        if states[0].Failures == 0 {
+            return false
+        }
+        states[0].Failures--
+        return true
+    })
+    if err != nil {
+        log.Println("throttle update error:", err)
+    }
+}
+
+func resetAuthFailures(keys ...string) {
+    for _, key := range keys {
+        if err := clearFailureState(key); err != nil {
+            log.Println("throttle reset error:", err)
+        }
+    }
+}
+
+// rejectThrottled writes a 429 with Retry-After when wait is positive.
+func rejectThrottled(w http.ResponseWriter, wait time.Duration) {
+    secs := int(math.Ceil(wait.Seconds()))
+    w.Header().Set("Retry-After", strconv.Itoa(secs))
+    http.Error(w, "Too many failed attempts, try again later", http.StatusTooManyRequests)
+}
+
+func loginThrottleKeys(username string, r *http.Request) (userKey, ipKey string) {
+    return "login:user:" + username, "login:ip:" + clientIP(r)
+}
+
+func roomThrottleKeys(room, username string, r *http.Request) (userKey, ipKey string) {
+    return "room:" + room + ":user:" + username, "room:" + room + ":ip:" + clientIP(r)
+}
+
+// -------------------- Failure Store --------------------
+
+// failurePruneInterval is how often expired failure records are deleted.
+const failurePruneInterval = time.Minute
+
+var lastFailurePrune time.Time // guarded by failuresMu
+
+// updateFailureStates loads the state of each key, lets fn change them and
+// stores them if fn returns true, all while holding the keys: the failures
+// mutex in memory, row locks in the database.
+func updateFailureStates(keys []string, fn func(states []failureState) bool) error {
+    pruneFailureStates()
+    if useDB {
+        ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        defer cancel()
+        return dbUpdateFailureStates(ctx, keys, fn)
+    }
+    failuresMu.Lock()
+    defer failuresMu.Unlock()
+    states := make([]failureState, len(keys))
+    for i, key := range keys {
+        if s, ok := failuresMap[key]; ok {
+            states[i] = *s
+        }
+    }
+    if !fn(states) {
+        return nil
+    }
+    for i, key := range keys {
+        s := states[i]
+        failuresMap[key] = &s
+    }
+    return nil
+}
+
+// failureExpired reports whether a record no longer affects anything.
+func failureExpired(s failureState, now time.Time) bool {
+    return now.Sub(s.LastFailure) > throttle.Window && !now.Before(s.LockedUntil)
+}
+
+// pruneFailureStates forgets expired records, at most once per interval, so
+// keys for one-off usernames and IPs do not pile up.
+func pruneFailureStates() {
+    now := time.Now()
+    failuresMu.Lock()
+    if now.Sub(lastFailurePrune) < failurePruneInterval {
+        failuresMu.Unlock()
+        return
+    }
+    lastFailurePrune = now
+    if !useDB {
+        for key, s := range failuresMap {
+            if failureExpired(*s, now) {
+                delete(failuresMap, key)
+            }
+        }
+        failuresMu.Unlock()
+        return
+    }
+    failuresMu.Unlock()
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    _, err := dbPool.Exec(ctx, `
+        DELETE FROM auth_failures
+        WHERE last_failure < $1 AND (locked_until IS NULL OR locked_until <= $2)
+    `, now.Add(-throttle.Window), now)
+    if err != nil {
+        log.Println("throttle prune error:", err)
+    }
+}
+
+func clearFailureState(key string) error {
+    if useDB {
+        ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        defer cancel()
+        _, err := dbPool.Exec(ctx, `DELETE FROM auth_failures WHERE key=$1`, key)
+        return err
+    }
+    failuresMu.Lock()
+    defer failuresMu.Unlock()
+    delete(failuresMap, key)
+    return nil
+}
+
+// dbUpdateFailureStates is updateFailureStates in one transaction. Rows are
+// created if missing and locked in key order, so concurrent attempts on the
+// same keys queue up instead of reading the same counts.
+func dbUpdateFailureStates(ctx context.Context, keys []string, fn func(states []failureState) bool) error {
+    tx, err := dbPool.Begin(ctx)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback(ctx)
+    order := make([]int, len(keys))
+    for i := range order {
+        order[i] = i
+    }
+    sort.Slice(order, func(a, b int) bool { return keys[order[a]] < keys[order[b]] })
+    states := make([]failureState, len(keys))
+    for _, i := range order {
+        _, err := tx.Exec(ctx, `
+            INSERT INTO auth_failures (key, failures, last_failure) VALUES ($1, 0, 'epoch')
+            ON CONFLICT (key) DO NOTHING
+        `, keys[i])
+        if err != nil {
+            return err
+        }
+        var locked *time.Time
+        err = tx.QueryRow(ctx, `
+            SELECT failures, last_failure, locked_until FROM auth_failures WHERE key=$1 FOR UPDATE
+        `, keys[i]).Scan(&states[i].Failures, &states[i].LastFailure, &locked)
+        if err != nil {
+            return err
+        }
+        if locked != nil {
+            states[i].LockedUntil = *locked
+        }
+    }
+    if !fn(states) {
+        return nil
+    }
+    for i, key := range keys {
+        var locked *time.Time
+        if !states[i].LockedUntil.IsZero() {
+            locked = &states[i].LockedUntil
+        }
+        _, err := tx.Exec(ctx, `
+            UPDATE auth_failures SET failures=$2, last_failure=$3, locked_until=$4 WHERE key=$1
+        `, key, states[i].Failures, states[i].LastFailure, locked)
+        if err != nil {
+            return err
+        }
+    }
+    return tx.Commit(ctx)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+    "net/http/httptest"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+func withTestThrottle(t *testing.T) {
+    t.Helper()
+    saved := throttle
+    throttle = authThrottle{
+        FreeAttempts:     3,
+        BaseDelay:        time.Minute,
+        MaxDelay:         time.Hour,
+        LockoutThreshold: 10,
+        LockoutDuration:  time.Hour,
+        Window:           time.Hour,
+    }
+    failuresMu.Lock()
+    failuresMap = map[string]*failureState{}
+    lastFailurePrune = time.Time{}
+    failuresMu.Unlock()
+    t.Cleanup(func() { throttle = saved })
+}
+
+func TestReserveAuthAttemptConcurrentBurst(t *testing.T) {
+    withTestThrottle(t)
+    var allowed atomic.Int32
+    var wg sync.WaitGroup
+    for i := 0; i < 50; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            if reserveAuthAttempt("login:user:burst", "login:ip:192.0.2.1") == 0 {
+                allowed.Add(1)
+            }
+        }()
+    }
+    wg.Wait()
+    // The free attempts plus the one that starts the backoff
+    if got, want := allowed.Load(), int32(throttle.FreeAttempts+1); got != want {
+        t.Fatalf("%d attempts got through, want %d", got, want)
+    }
+    if s := failuresMap["login:user:burst"]; s.Failures != throttle.FreeAttempts+1 {
+        t.Fatalf("recorded %d failures, want %d", s.Failures, throttle.FreeAttempts+1)
+    }
+}
+
+func TestAuthAttemptSucceeded(t *testing.T) {
+    withTestThrottle(t)
+    reserveAuthAttempt("login:user:a", "login:ip:192.0.2.1")
+    reserveAuthAttempt("login:user:a", "login:ip:192.0.2.1")
+    authAttemptSucceeded("login:user:a", "login:ip:192.0.2.1")
+    if _, ok := failuresMap["login:user:a"]; ok {
+        t.Fatal("user failures not cleared on success")
+    }
+    if got := failuresMap["login:ip:192.0.2.1"].Failures; got != 1 {
+        t.Fatalf("ip failures = %d, want 1 (the earlier failure)", got)
+    }
+}
+
+func TestPruneFailureStates(t *testing.T) {
+    withTestThrottle(t)
+    now := time.Now()
+    failuresMap["old"] = &failureState{Failures: 5, LastFailure: now.Add(-2 * time.Hour)}
+    failuresMap["locked"] = &failureState{Failures: 10, LastFailure: now.Add(-2 * time.Hour), LockedUntil: now.Add(time.Minute)}
+    failuresMap["recent"] = &failureState{Failures: 1, LastFailure: now}
+    pruneFailureStates()
+    if _, ok := failuresMap["old"]; ok {
+        t.Error("expired record kept")
+    }
+    if _, ok := failuresMap["locked"]; !ok {
+        t.Error("record still locked was pruned")
+    }
+    if _, ok := failuresMap["recent"]; !ok {
+        t.Error("recent record was pruned")
+    }
+}
+
+func TestClientIP(t *testing.T) {
+    t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8, 192.0.2.9")
+    initTrustedProxies()
+    t.Cleanup(func() { trustedProxies = nil })
+
+    tests := []struct {
+        remote, fwd, want string
+    }{
+        {"198.51.100.7:1234", "", "198.51.100.7"},
+        {"198.51.100.7:1234", "203.0.113.5", "198.51.100.7"}, // not from a proxy: header ignored
+        {"10.1.2.3:1234", "203.0.113.5", "203.0.113.5"},
+        {"10.1.2.3:1234", "1.1.1.1, 203.0.113.5", "203.0.113.5"}, // spoofed leftmost hop
+        {"10.1.2.3:1234", "203.0.113.5, 192.0.2.9", "203.0.113.5"},
+        {"10.1.2.3:1234", "", "10.1.2.3"},
+    }
+    for _, tt := range tests {
+        r := httptest.NewRequest("GET", "/", nil)
+        r.RemoteAddr = tt.remote
+        if tt.fwd != "" {
+            r.Header.Set("X-Forwarded-For", tt.fwd)
+        }
+        if got := clientIP(r); got != tt.want {
+            t.Errorf("clientIP(%s, %q) = %s, want %s", tt.remote, tt.fwd, got, tt.want)
+        }
+    }
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+    "context"
+    "sync"
+    "time"
+)
+
+// -------------------- Upload Ownership --------------------
+//
+// Every file saved by /upload is recorded with its uploader. Anyone may
+// attach a file URL to a message or avatar, so deleting an account removes
+// only the files that user uploaded and nothing else still references.
+
+var (
+    uploadsMu    sync.Mutex
+    uploadOwners = map[string]string{} // file name -> uploader
+)
+
+// recordUpload notes that username uploaded the file name under uploads/.
+func recordUpload(name, username string) error {
+    if useDB {
+        ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        defer cancel()
+        _, err := dbPool.Exec(ctx, `INSERT INTO uploads (name, username) VALUES ($1, $2)`, name, username)
+        return err
+    }
+    uploadsMu.Lock()
+    defer uploadsMu.Unlock()
+    uploadOwners[name] = username
+    return nil
+}
+
+// memForgetUploads drops the records of files uploaded by deleted accounts
+// and returns those no longer referenced by what is left: any message's
+// file, or the avatar of a remaining user. Call it after the deletion policy
+// has been applied to messages and users.
+func memForgetUploads(gone map[string]bool) []string {
+    referenced := map[string]bool{}
+    messagesMu.RLock()
+    for _, m := range messagesList {
+        if name := uploadedFileName(m.FileURL); name != "" {
+            referenced[name] = true
+        }
+    }
+    messagesMu.RUnlock()
+    usersMu.RLock()
+    for _, su := range usersMap {
+        if name := uploadedFileName(su.Profile.AvatarURL); name != "" {
+            referenced[name] = true
+        }
+    }
+    usersMu.RUnlock()
+
+    var orphaned []string
+    uploadsMu.Lock()
+    defer uploadsMu.Unlock()
+    for name, owner := range uploadOwners {
+        if !gone[owner] {
+            continue
+        }
+        delete(uploadOwners, name)
+        if !referenced[name] {
+            orphaned = append(orphaned, name)
+        }
+    }
+    return orphaned
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "log"
+    "os"
+    "strings"
+    "time"
+
+    "golang.org/x/text/secure/precis"
+    "golang.org/x/text/unicode/norm"
+)
+
+// -------------------- Username Policy --------------------
+
+const (
+    minUsernameLen = 3
+    maxUsernameLen = 32
+)
+
+// reservedUsernames can never be registered, compared case-insensitively.
+// "system" owns the default rooms; RESERVED_USERNAMES adds more.
+var reservedUsernames = map[string]bool{
+    "system":    true,
+    "deleted":   true,
+    "everyone":  true,
+    "here":      true,
+    "root":      true,
+    "chatbox":   true,
+    "anonymous": true,
+    "null":      true,
+    "undefined": true,
+}
+
+var (
+    errUsernameLength   = fmt.Errorf("username must be %d-%d characters", minUsernameLen, maxUsernameLen)
+    errUsernameChars    = errors.New("username may only contain letters, digits, '.', '_' and '-', and must start with a letter or digit")
+    errUsernameReserved = errors.New("username is reserved")
+)
+
+func initUsernamePolicy() {
+    for _, name := range strings.Split(os.Getenv("RESERVED_USERNAMES"), ",") {
+        if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+            reservedUsernames[name] = true
+        }
+    }
+}
+
+// normalizeUsername returns the canonical form of a new username or explains
+// why it is not acceptable. Compatibility forms (full-width letters,
+// ligatures) are folded with NFKC and PRECIS before the ASCII-only character
+// check, so lookalike Unicode cannot produce a second "alice". Case is
+// preserved for display; uniqueness is case-insensitive (see usernameKey).
+func normalizeUsername(raw string) (string, error) {
+    // Cheap bound before doing any Unicode work on huge inputs.
+    if len(raw) > 4*maxUsernameLen {
+        return "", errUsernameLength
+    }
+    s := norm.NFKC.String(strings.TrimSpace(raw))
+    s, err := precis.UsernameCasePreserved.String(s)
+    if err != nil {
+        return "", errUsernameChars
+    }
+    if len(s) < minUsernameLen || len(s) > maxUsernameLen {
+        return "", errUsernameLength
+    }
+    for i, r := range s {
+        switch {
+        case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+        case (r == '.' || r == '_' || r == '-') && i > 0:
+        default:
+            return "", errUsernameChars
+        }
+    }
+    if reservedUsernames[usernameKey(s)] {
+        return "", errUsernameReserved
+    }
+    return s, nil
+}
+
+// usernameKey is the identity two usernames share when they differ only in case.
+func usernameKey(name string) string {
+    return strings.ToLower(name)
+}
+
+// resolveUsername finds the stored account matching name case-insensitively,
+// preferring an exact match for legacy accounts that still collide.
+func resolveUsername(name string) (string, bool) {
+    if name == "" {
+        return "", false
+    }
+    if useDB {
+        ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        defer cancel()
+        var stored string
+        err := dbPool.QueryRow(ctx, `
+            SELECT username FROM users WHERE lower(username) = lower($1)
+            ORDER BY username = $1 DESC LIMIT 1
+        `, name).Scan(&stored)
+        if err != nil {
+            return "", false
+        }
+        return stored, true
+    }
+    usersMu.RLock()
+    defer usersMu.RUnlock()
+    if _, ok := usersMap[name]; ok {
+        return name, true
+    }
+    for stored := range usersMap {
+        if usernameKey(stored) == usernameKey(name) {
+            return stored, true
+        }
+    }
+    return "", false
+}
+
+// loginUsername maps what a user typed at login to their stored username.
+// Input that fails the policy is tried verbatim so accounts created before
+// it still work.
+func loginUsername(raw string) string {
+    name := strings.TrimSpace(raw)
+    if n, err := normalizeUsername(raw); err == nil {
+        name = n
+    }
+    if stored, ok := resolveUsername(name); ok {
+        return stored
+    }
+    return raw
+}
+
+// usernameTakenLocked reports whether name collides with an in-memory
+// account. The caller must hold usersMu.
+func usernameTakenLocked(name string) bool {
+    for stored := range usersMap {
+        if usernameKey(stored) == usernameKey(name) {
+            return true
+        }
+    }
+    return false
+}
+
+// auditUsernames logs the case collisions that migration 014 found among
+// accounts created before the policy existed.
+func auditUsernames(ctx context.Context) {
+    if !useDB {
+        return
+    }
+    rows, err := dbPool.Query(ctx, `SELECT usernames FROM username_collisions ORDER BY folded`)
+    if err != nil {
+        log.Println("username audit error:", err)
+        return
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var names []string
+        if err := rows.Scan(&names); err != nil {
+            log.Println("username audit error:", err)
+            return
+        }
+        log.Printf("⚠️ Usernames differ only by case: %s (case-insensitive index disabled until resolved)", strings.Join(names, ", "))
+    }
+}
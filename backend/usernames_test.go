@@ -0,0 +1,94 @@
+package main
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+)
+
+func TestNormalizeUsername(t *testing.T) {
+    tests := []struct {
+        raw, want string
+        err       error
+    }{
+        {"  alice ", "alice", nil},
+        {"Alice.B-c_1", "Alice.B-c_1", nil},
+        {"Ａｌｉｃｅ", "Alice", nil}, // full-width
+        {"ﬁona", "fiona", nil},     // ligature
+        {"ab", "", errUsernameLength},
+        {strings.Repeat("a", maxUsernameLen+1), "", errUsernameLength},
+        {strings.Repeat("a", 10*1024), "", errUsernameLength},
+        {"al ice", "", errUsernameChars},
+        {"_alice", "", errUsernameChars},
+        {"alicé", "", errUsernameChars},
+        {"ali\x00ce", "", errUsernameChars},
+        {"[deleted]", "", errUsernameChars},
+        {"System", "", errUsernameReserved},
+        {"ＳＹＳＴＥＭ", "", errUsernameReserved},
+    }
+    for _, tt := range tests {
+        got, err := normalizeUsername(tt.raw)
+        if got != tt.want || err != tt.err {
+            t.Errorf("normalizeUsername(%q) = %q, %v; want %q, %v", tt.raw, got, err, tt.want, tt.err)
+        }
+    }
+}
+
+func TestUsernamesCollideAcrossCase(t *testing.T) {
+    withTestThrottle(t)
+    withPasswordPolicy(t, testBcryptPolicy)
+    register := func(name string) *httptest.ResponseRecorder {
+        r := httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(`{"username":"`+name+`","password":"correct horse battery staple"}`))
+        w := httptest.NewRecorder()
+        registerHandler(w, r)
+        return w
+    }
+    if w := register("Collide_Case"); w.Code != http.StatusOK {
+        t.Fatalf("first registration: status %d %s", w.Code, w.Body)
+    }
+    for _, name := range []string{"collide_case", "COLLIDE_CASE", "ｃｏｌｌｉｄｅ_case"} {
+        if w := register(name); w.Code != http.StatusBadRequest {
+            t.Errorf("registering %q: status %d", name, w.Code)
+        }
+    }
+    if err := createBotUser("collide_CASE", "Collide_Case"); err == nil {
+        t.Error("bot took a colliding name")
+    }
+
+    // Signing in under any casing reaches the one account
+    if got := loginUsername(" COLLIDE_case "); got != "Collide_Case" {
+        t.Fatalf("loginUsername = %q", got)
+    }
+    r := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{"username":"collide_CASE","password":"correct horse battery staple"}`))
+    w := httptest.NewRecorder()
+    loginHandler(w, r)
+    if w.Code != http.StatusOK {
+        t.Fatalf("login with other casing: status %d %s", w.Code, w.Body)
+    }
+}
+
+func TestResolveUsernamePrefersExactLegacyMatch(t *testing.T) {
+    // Accounts from before the policy may still differ only by case
+    usersMu.Lock()
+    usersMap["legacy_pair"] = &storedUser{Username: "legacy_pair", Role: roleMember}
+    usersMap["Legacy_Pair"] = &storedUser{Username: "Legacy_Pair", Role: roleMember}
+    usersMu.Unlock()
+    t.Cleanup(func() {
+        usersMu.Lock()
+        delete(usersMap, "legacy_pair")
+        delete(usersMap, "Legacy_Pair")
+        usersMu.Unlock()
+    })
+    for _, name := range []string{"legacy_pair", "Legacy_Pair"} {
+        if got, ok := resolveUsername(name); !ok || got != name {
+            t.Errorf("resolveUsername(%q) = %q, %v", name, got, ok)
+        }
+    }
+    if got, ok := resolveUsername("LEGACY_PAIR"); !ok || usernameKey(got) != "legacy_pair" {
+        t.Errorf("resolveUsername(LEGACY_PAIR) = %q, %v", got, ok)
+    }
+    if _, ok := resolveUsername("legacy_pair_none"); ok {
+        t.Error("resolved a missing account")
+    }
+}
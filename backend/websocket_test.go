@@ -0,0 +1,169 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/gorilla/websocket"
+)
+
+// withKeepalive shortens the WebSocket keepalive for one test. Call it before
+// starting the test server so the hub is drained before it is restored.
+func withKeepalive(t testing.TB, pongWait, pingInterval time.Duration) {
+    t.Helper()
+    oldWait, oldInterval := wsPongWait, wsPingInterval
+    wsPongWait, wsPingInterval = pongWait, pingInterval
+    t.Cleanup(func() { wsPongWait, wsPingInterval = oldWait, oldInterval })
+}
+
+// waitPresence reads until a presence frame of type typ about username arrives.
+func waitPresence(t testing.TB, conn *websocket.Conn, typ, username string) map[string]any {
+    t.Helper()
+    for {
+        f := readUntil(t, conn, typ)
+        if u, _ := f["user"].(map[string]any); u["username"] == username || f["username"] == username {
+            return f
+        }
+    }
+}
+
+// rosterEntry returns username's entry in a "users" frame, or nil.
+func rosterEntry(f map[string]any, username string) map[string]any {
+    users, _ := f["users"].([]any)
+    for _, u := range users {
+        if e, _ := u.(map[string]any); e["username"] == username {
+            return e
+        }
+    }
+    return nil
+}
+
+func TestSilentConnectionIsReaped(t *testing.T) {
+    withKeepalive(t, 300*time.Millisecond, 100*time.Millisecond)
+    srv := newTestServer(t)
+    testUser(t, "reap_watcher")
+    testUser(t, "reap_silent")
+    watcher, _, err := srv.dial(t, "reap_watcher", "room=general")
+    if err != nil {
+        t.Fatal(err)
+    }
+    readUntil(t, watcher, "users")
+    // The silent socket is never read, so it never answers a ping; the
+    // watcher keeps reading (and ponging) and sees it leave
+    if _, _, err := srv.dial(t, "reap_silent", "room=general"); err != nil {
+        t.Fatal(err)
+    }
+    waitPresence(t, watcher, "presence_join", "reap_silent")
+    start := time.Now()
+    waitPresence(t, watcher, "presence_leave", "reap_silent")
+    if d := time.Since(start); d > 3*time.Second {
+        t.Fatalf("reaped after %s", d)
+    }
+}
+
+func TestPongsKeepConnectionAndLastSeen(t *testing.T) {
+    withKeepalive(t, 300*time.Millisecond, 100*time.Millisecond)
+    srv := newTestServer(t)
+    testUser(t, "pong_user")
+    testUser(t, "pong_watcher")
+    start := time.Now().Unix()
+    conn, _, err := srv.dial(t, "pong_user", "room=general")
+    if err != nil {
+        t.Fatal(err)
+    }
+    // Reading answers pings; the client sends nothing else
+    go func() {
+        for {
+            if _, _, err := conn.ReadMessage(); err != nil {
+                return
+            }
+        }
+    }()
+    time.Sleep(2100 * time.Millisecond)
+
+    watcher, _, err := srv.dial(t, "pong_watcher", "room=general")
+    if err != nil {
+        t.Fatal(err)
+    }
+    e := rosterEntry(readUntil(t, watcher, "users"), "pong_user")
+    if e == nil {
+        t.Fatal("connection answering pings was dropped")
+    }
+    if seen, _ := e["lastSeen"].(float64); int64(seen) < start+2 {
+        t.Fatalf("lastSeen %v, want at least %d", e["lastSeen"], start+2)
+    }
+}
+
+func TestOversizedFrameClosesConnection(t *testing.T) {
+    old := wsMaxMessageSize
+    wsMaxMessageSize = 1024
+    t.Cleanup(func() { wsMaxMessageSize = old })
+    srv := newTestServer(t)
+    testUser(t, "big_frame")
+    conn, _, err := srv.dial(t, "big_frame", "room=general")
+    if err != nil {
+        t.Fatal(err)
+    }
+    readUntil(t, conn, "history")
+    sendFrame(t, conn, map[string]string{"type": "message", "id": "big", "text": strings.Repeat("x", 2048)})
+    expectClose(t, conn, websocket.CloseMessageTooBig)
+}
+
+func TestOneWriterPerConnection(t *testing.T) {
+    withKeepalive(t, 5*time.Second, 5*time.Millisecond)
+    withSendQueue(t, policyDropOldest, 64)
+    srv := newTestServer(t)
+    testUser(t, "one_writer")
+    conn, _, err := srv.dial(t, "one_writer", "room=general")
+    if err != nil {
+        t.Fatal(err)
+    }
+    readUntil(t, conn, "history")
+    // Pings arrive every few milliseconds; a pong that loses the race with
+    // the server closing the socket is not what this test is about
+    conn.SetPingHandler(func(data string) error {
+        conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+        return nil
+    })
+
+    // Replies from readPump, hub fan-out and pings all race for the socket
+    stop := make(chan struct{})
+    flooded := make(chan struct{})
+    go func() {
+        defer close(flooded)
+        for {
+            select {
+            case <-stop:
+                return
+            case srv.hub.broadcast <- Broadcast{user: "one_writer", message: []byte(`{"type":"filler"}`)}:
+            }
+        }
+    }()
+    defer func() {
+        close(stop)
+        <-flooded
+    }()
+    const n = 200
+    go func() {
+        for i := 0; i < n; i++ {
+            if conn.WriteJSON(map[string]string{"type": "bogus", "id": fmt.Sprint("w-", i)}) != nil {
+                return
+            }
+        }
+    }()
+    got := map[string]bool{}
+    for len(got) < n {
+        f := readUntil(t, conn, "error")
+        id, _ := f["requestId"].(string)
+        if !strings.HasPrefix(id, "w-") || got[id] {
+            t.Fatalf("unexpected error frame %v", f)
+        }
+        got[id] = true
+    }
+
+    // Shutting down mid-flood still ends with the close frame
+    srv.hub.kick <- "one_writer"
+    expectClose(t, conn, websocket.ClosePolicyViolation)
+}
@@ -36,16 +36,50 @@ export const connect = (username) => {
 
 
 
+// The session token from /login. It is sent as a Bearer header because the
+// session cookie (SameSite=Lax) does not reach a backend on another site.
+const TOKEN_KEY = 'chatbox-token';
+
+export const getSessionToken = () => localStorage.getItem(TOKEN_KEY) || '';
+
+export const setSessionToken = (token) => {
+  if (token) {
+    localStorage.setItem(TOKEN_KEY, token);
+  } else {
+    localStorage.removeItem(TOKEN_KEY);
+  }
+};
+
+const authHeaders = () => {
+  const token = getSessionToken();
+  return token ? { Authorization: `Bearer ${token}` } : {};
+};
+
+// apiFetch is fetch with the session attached, for absolute backend URLs.
+export const apiFetch = (url, options = {}) => fetch(url, {
+  credentials: 'include',
+  ...options,
+  headers: { ...authHeaders(), ...options.headers },
+});
+
+// wsAuthQuery is the ?token= parameter for /ws; browsers cannot set headers
+// on WebSocket upgrades.
+export const wsAuthQuery = () => {
+  const token = getSessionToken();
+  return token ? `&token=${encodeURIComponent(token)}` : '';
+};
+
 export const apiRequest = async (endpoint, options = {}) => {
   const url = `${getApiBase()}${endpoint}`;
   const config = {
+    credentials: 'include',
+    ...options,
     headers: {
       'Content-Type': 'application/json',
       'X-Requested-With': 'XMLHttpRequest',
+      ...authHeaders(),
       ...options.headers
     },
-    credentials: 'include',
-    ...options
   };
   
   const response = await fetch(url, config);
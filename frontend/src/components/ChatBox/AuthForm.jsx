@@ -1,5 +1,5 @@
 import React, { useState, useEffect, useRef } from "react";
-import { apiRequest } from "../../api";
+import { apiRequest, setSessionToken } from "../../api";
 
 export default function AuthForm({ setUsername }) {
   const [usernameInput, setUsernameInput] = useState("");
@@ -58,14 +58,13 @@ export default function AuthForm({ setUsername }) {
       const controller = new AbortController();
       const timeoutId = setTimeout(() => controller.abort(), 10000); // 10s timeout
       
-      const res = await apiRequest(endpoint, {
+      const credentials = JSON.stringify({ username: usernameInput.trim(), password });
+      let res = await apiRequest(endpoint, {
         method: "POST",
-        body: JSON.stringify({ username: usernameInput.trim(), password }),
+        body: credentials,
         signal: controller.signal,
       });
       
-      clearTimeout(timeoutId);
-      
       if (!res.ok) {
         const text = await res.text();
         if (res.status === 401) {
@@ -77,7 +76,24 @@ export default function AuthForm({ setUsername }) {
         }
         throw new Error(text || 'Authentication failed');
       }
-      setUsername(usernameInput.trim()); // successful login/register
+      // Registering does not sign in, so follow it with a login
+      if (!isLogin) {
+        res = await apiRequest("/login", { method: "POST", body: credentials, signal: controller.signal });
+      }
+      let session = await res.json();
+      if (session.mfaRequired) {
+        const code = window.prompt("Enter the code from your authenticator app");
+        if (!code) throw new Error('Two-factor code required');
+        res = await apiRequest("/login/mfa", {
+          method: "POST",
+          body: JSON.stringify({ mfaToken: session.mfaToken, code: code.trim() }),
+          signal: controller.signal,
+        });
+        session = await res.json();
+      }
+      clearTimeout(timeoutId);
+      setSessionToken(session.token);
+      setUsername(session.username || usernameInput.trim()); // successful login/register
     } catch (err) {
       if (err.name === 'AbortError') {
         setError('Connection timeout. Please check your internet and try again.');
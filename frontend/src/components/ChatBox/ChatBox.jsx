@@ -1,14 +1,16 @@
 import React, { useState, useEffect } from "react";
 import AuthForm from "./AuthForm";
 import ChatBoxContent from "./ChatBoxContent";
+import { apiRequest, getSessionToken, setSessionToken } from "../../api";
 
 export default function ChatBox() {
   const [username, setUsername] = useState("");
 
-  // Load username from localStorage on component mount
+  // Load username from localStorage on component mount; without a session
+  // token the user has to sign in again
   useEffect(() => {
     const savedUsername = localStorage.getItem("chatbox-username");
-    if (savedUsername) {
+    if (savedUsername && getSessionToken()) {
       setUsername(savedUsername);
     }
   }, []);
@@ -21,6 +23,8 @@ export default function ChatBox() {
 
   // Logout function
   const handleLogout = () => {
+    apiRequest("/logout", { method: "POST" }).catch((err) => console.error("Logout failed:", err));
+    setSessionToken("");
     setUsername("");
     localStorage.removeItem("chatbox-username");
   };
@@ -3,6 +3,7 @@ import './ChatBox.css';
 import LoadingSpinner from './LoadingSpinner';
 import WelcomeTour from './WelcomeTour';
 import KeyboardShortcuts from './KeyboardShortcuts';
+import { apiFetch, wsAuthQuery } from '../../api';
 
 // Helper function to format timestamps
 const formatTimeAgo = (timestamp) => {
@@ -149,6 +150,7 @@ const formatMessage = (text, currentUsername, searchTerm = '') => {
 export default function ChatBoxContent({ username, onLogout }) {
   const [ws, setWs] = useState(null);
   const [messages, setMessages] = useState([]);
+  const messagesRef = useRef(messages);
   const [input, setInput] = useState("");
   const [darkMode, setDarkMode] = useState(false);
   const [editingId, setEditingId] = useState(null);
@@ -205,6 +207,10 @@ export default function ChatBoxContent({ username, onLogout }) {
   const fileInputRef = useRef(null);
   const recordingRef = useRef(null);
 
+  useEffect(() => {
+    messagesRef.current = messages;
+  }, [messages]);
+
   // Resolve backend base URL with env overrides for production
   const isSecure = window.location.protocol === "https:";
   const httpProto = isSecure ? "https" : "http";
@@ -219,7 +225,7 @@ export default function ChatBoxContent({ username, onLogout }) {
   useEffect(() => {
     const fetchDarkMode = async () => {
       try {
-        const res = await fetch(`${backendHttp}/get_dark_mode?username=${username}`);
+        const res = await apiFetch(`${backendHttp}/get_dark_mode?username=${username}`);
         if (res.ok) {
           const data = await res.json();
           setDarkMode(data.darkMode);
@@ -231,7 +237,7 @@ export default function ChatBoxContent({ username, onLogout }) {
     
     const fetchRooms = async () => {
       try {
-        const res = await fetch(`${backendHttp}/rooms/list`);
+        const res = await apiFetch(`${backendHttp}/rooms/list`);
         if (res.ok) {
           const rooms = await res.json();
           setAvailableRooms(rooms);
@@ -277,7 +283,7 @@ export default function ChatBoxContent({ username, onLogout }) {
 
   // Open WebSocket once
   useEffect(() => {
-    const socket = new WebSocket(`${backendWs}/ws?username=${username}&room=${currentRoom}`);
+    const socket = new WebSocket(`${backendWs}/ws?username=${username}&room=${currentRoom}${wsAuthQuery()}`);
 
     socket.onopen = () => {
       console.log("✅ WebSocket connected to room:", currentRoom);
@@ -285,6 +291,11 @@ export default function ChatBoxContent({ username, onLogout }) {
       setReconnectAttempts(0);
       setShowConnectionError(false);
       setRoomJoinTime(new Date());
+
+      // Resend messages whose ack never arrived, with their original keys
+      messagesRef.current
+        .filter((m) => m.status === "sending" && m.room === currentRoom)
+        .forEach((m) => socket.send(JSON.stringify(messageFrame(m))));
     };
 
     socket.onmessage = (event) => {
@@ -360,6 +371,21 @@ export default function ChatBoxContent({ username, onLogout }) {
           }
         }
 
+        // online users changes after the initial list
+        if ((payload.type === "presence_join" || payload.type === "presence_update") && payload.user) {
+          if (payload.room === currentRoom) {
+            setOnlineUsers((prev) => {
+              const others = prev.filter((u) => (typeof u === 'string' ? u : u.username) !== payload.user.username);
+              return [...others, payload.user].sort((a, b) => a.username.localeCompare(b.username));
+            });
+          }
+        }
+        if (payload.type === "presence_leave" && payload.username) {
+          if (payload.room === currentRoom) {
+            setOnlineUsers((prev) => prev.filter((u) => (typeof u === 'string' ? u : u.username) !== payload.username));
+          }
+        }
+
         // typing indicator
         if (payload.type === "typing") {
           setTypingUsers((prev) => {
@@ -388,7 +414,7 @@ export default function ChatBoxContent({ username, onLogout }) {
         if (!ws || ws.readyState === WebSocket.CLOSED) {
           if (reconnectAttempts < 5) {
             console.log(`🔄 Reconnecting WebSocket... (attempt ${reconnectAttempts + 1})`);
-            const newSocket = new WebSocket(`${backendWs}/ws?username=${username}&room=${currentRoom}`);
+            const newSocket = new WebSocket(`${backendWs}/ws?username=${username}&room=${currentRoom}${wsAuthQuery()}`);
             setWs(newSocket);
           } else {
             setConnectionStatus('failed');
@@ -413,7 +439,7 @@ export default function ChatBoxContent({ username, onLogout }) {
     setIsLoadingHistory(true);
     try {
       const oldestMessage = filteredMessages[0];
-      const response = await fetch(`${backendHttp}/messages/history?room=${currentRoom}&before=${oldestMessage.id}&limit=20`);
+      const response = await apiFetch(`${backendHttp}/messages/history?room=${currentRoom}&before=${oldestMessage.id}&limit=20`);
       if (response.ok) {
         const olderMessages = await response.json();
         if (olderMessages.length > 0) {
@@ -494,11 +520,11 @@ export default function ChatBoxContent({ username, onLogout }) {
     if (!ws || ws.readyState !== WebSocket.OPEN) return;
     
     const timeoutId = setTimeout(() => {
-      ws.send(JSON.stringify({ type: "typing", username, isTyping: false }));
+      ws.send(JSON.stringify({ type: "typing", username, isTyping: false, room: currentRoom }));
     }, 1000);
 
     if (input.trim()) {
-      ws.send(JSON.stringify({ type: "typing", username, isTyping: true }));
+      ws.send(JSON.stringify({ type: "typing", username, isTyping: true, room: currentRoom }));
     }
 
     return () => clearTimeout(timeoutId);
@@ -506,7 +532,7 @@ export default function ChatBoxContent({ username, onLogout }) {
 
   const createRoomHandler = async (roomData) => {
     try {
-      const res = await fetch(`${backendHttp}/rooms/create`, {
+      const res = await apiFetch(`${backendHttp}/rooms/create`, {
         method: 'POST',
         headers: {
           'Content-Type': 'application/json',
@@ -529,7 +555,7 @@ export default function ChatBoxContent({ username, onLogout }) {
   
   const joinRoomHandler = async (roomName, password = '') => {
     try {
-      const res = await fetch(`${backendHttp}/rooms/join`, {
+      const res = await apiFetch(`${backendHttp}/rooms/join`, {
         method: 'POST',
         headers: { 'Content-Type': 'application/json' },
         body: JSON.stringify({ roomName, password })
@@ -545,6 +571,21 @@ export default function ChatBoxContent({ username, onLogout }) {
     }
   };
   
+  // messageFrame builds the send frame for a local message. Its
+  // idempotencyKey is created once with the message, so a resend after a
+  // lost ack is answered with the original ack instead of a duplicate.
+  const messageFrame = (m) => ({
+    username,
+    text: m.text,
+    timestamp: m.timestamp,
+    clientId: m.id,
+    idempotencyKey: m.idempotencyKey,
+    ...(m.fileUrl && { fileUrl: m.fileUrl, fileType: m.fileType, fileName: m.fileName }),
+    room: m.room,
+    replyTo: m.replyTo,
+    ...(m.isVoiceMessage && { isVoiceMessage: true }),
+  });
+
   const sendMessage = () => {
     if (!ws || ws.readyState !== WebSocket.OPEN) {
       setShowConnectionError(true);
@@ -554,7 +595,7 @@ export default function ChatBoxContent({ username, onLogout }) {
     if (!textTrimmed) return;
     
     // Stop typing indicator
-    ws.send(JSON.stringify({ type: "typing", username, isTyping: false }));
+    ws.send(JSON.stringify({ type: "typing", username, isTyping: false, room: currentRoom }));
 
     // Use timezone-aware timestamp
     const timestamp = new Date().toLocaleString("en-US", { timeZoneName: "short" });
@@ -572,6 +613,8 @@ export default function ChatBoxContent({ username, onLogout }) {
       fileName: null,
       status: "sending",
       replyTo: replyingTo,
+      room: currentRoom,
+      idempotencyKey: crypto.randomUUID(),
     };
     
     // Clear reply state
@@ -579,14 +622,14 @@ export default function ChatBoxContent({ username, onLogout }) {
     setMessages((prev) => [...prev, local]);
 
     // send to server
-    ws.send(JSON.stringify({ username, text: textTrimmed, timestamp, clientId: local.id, room: currentRoom, replyTo: replyingTo }));
+    ws.send(JSON.stringify(messageFrame(local)));
     setInput("");
   };
 
   const editMessage = async (id) => {
     if (!editInput.trim()) return;
     try {
-      const res = await fetch(`${backendHttp}/message`, {
+      const res = await apiFetch(`${backendHttp}/message`, {
         method: "PUT",
         headers: { "Content-Type": "application/json" },
         body: JSON.stringify({ id, text: editInput }),
@@ -599,7 +642,7 @@ export default function ChatBoxContent({ username, onLogout }) {
 
   const deleteMessage = async (id) => {
     try {
-      const res = await fetch(`${backendHttp}/message?id=${id}`, {
+      const res = await apiFetch(`${backendHttp}/message?id=${id}`, {
         method: "DELETE",
       });
       if (!res.ok) console.error("Delete failed");
@@ -617,7 +660,8 @@ export default function ChatBoxContent({ username, onLogout }) {
       type: "reaction", 
       messageId, 
       emoji, 
-      username 
+      username,
+      room: currentRoom
     }));
   };
 
@@ -690,7 +734,7 @@ export default function ChatBoxContent({ username, onLogout }) {
     formData.append('file', file);
     
     try {
-      const response = await fetch(`${backendHttp}/upload`, {
+      const response = await apiFetch(`${backendHttp}/upload`, {
         method: 'POST',
         body: formData,
       });
@@ -720,22 +764,14 @@ export default function ChatBoxContent({ username, onLogout }) {
         fileName: result.fileName,
         status: "sending",
         replyTo: replyingTo,
+        room: currentRoom,
+        idempotencyKey: crypto.randomUUID(),
       };
       
       setMessages((prev) => [...prev, fileMessage]);
       
       if (ws && ws.readyState === WebSocket.OPEN) {
-        ws.send(JSON.stringify({
-          username,
-          text: '',
-          timestamp,
-          clientId: fileMessage.id,
-          fileUrl: result.fileUrl,
-          fileType: result.fileType,
-          fileName: result.fileName,
-          room: currentRoom,
-          replyTo: replyingTo,
-        }));
+        ws.send(JSON.stringify(messageFrame(fileMessage)));
       }
     } catch (err) {
       console.error('File upload failed:', err);
@@ -817,7 +853,7 @@ export default function ChatBoxContent({ username, onLogout }) {
     formData.append('file', audioBlob, 'voice-message.webm');
     
     try {
-      const response = await fetch(`${backendHttp}/upload`, {
+      const response = await apiFetch(`${backendHttp}/upload`, {
         method: 'POST',
         body: formData,
       });
@@ -839,22 +875,14 @@ export default function ChatBoxContent({ username, onLogout }) {
         fileName: 'Voice Message',
         status: "sending",
         isVoiceMessage: true,
+        room: currentRoom,
+        idempotencyKey: crypto.randomUUID(),
       };
       
       setMessages((prev) => [...prev, voiceMessage]);
       
       if (ws && ws.readyState === WebSocket.OPEN) {
-        ws.send(JSON.stringify({
-          username,
-          text: '',
-          timestamp,
-          clientId: voiceMessage.id,
-          fileUrl: result.fileUrl,
-          fileType: 'audio/webm',
-          fileName: 'Voice Message',
-          room: currentRoom,
-          isVoiceMessage: true,
-        }));
+        ws.send(JSON.stringify(messageFrame(voiceMessage)));
       }
     } catch (err) {
       console.error('Voice message upload failed:', err);
@@ -1027,7 +1055,7 @@ export default function ChatBoxContent({ username, onLogout }) {
               const newMode = !darkMode;
               setDarkMode(newMode);
               try {
-                await fetch(`${backendHttp}/set_dark_mode`, {
+                await apiFetch(`${backendHttp}/set_dark_mode`, {
                   method: "POST",
                   headers: { "Content-Type": "application/json" },
                   body: JSON.stringify({ username, darkMode: newMode }),
@@ -2083,7 +2111,7 @@ export default function ChatBoxContent({ username, onLogout }) {
                     if (!password) return;
                     
                     try {
-                      const res = await fetch(`${backendHttp}/rooms/join`, {
+                      const res = await apiFetch(`${backendHttp}/rooms/join`, {
                         method: 'POST',
                         headers: { 'Content-Type': 'application/json' },
                         body: JSON.stringify({ roomName, password })